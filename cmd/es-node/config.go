@@ -245,6 +245,22 @@ func NewStorageConfig(ctx *cli.Context, client *ethclient.Client) (*storage.Stor
 		return nil, err
 	}
 	storageCfg.Filenames = ctx.GlobalStringSlice(flags.StorageFiles.Name)
+	storageCfg.VerifyOnStart = ctx.GlobalBool(flags.StorageVerifyOnStart.Name)
+	storageCfg.MetaConfirmations = ctx.GlobalUint64(flags.StorageMetaConfirmations.Name)
+	storageCfg.MetaBatchMin = ctx.GlobalUint64(flags.StorageMetaBatchMin.Name)
+	storageCfg.MetaBatchMax = ctx.GlobalUint64(flags.StorageMetaBatchMax.Name)
+	storageCfg.DownloadBatchMax = ctx.GlobalInt(flags.StorageDownloadBatchMax.Name)
+	storageCfg.MetaBandwidth = ctx.GlobalUint64(flags.StorageMetaBandwidth.Name)
+	storageCfg.MetaCheckpoint = ctx.GlobalBool(flags.StorageMetaCheckpoint.Name)
+	storageCfg.L1Checkpoint = ctx.GlobalBool(flags.StorageL1Checkpoint.Name)
+	storageCfg.MaskCacheSize = ctx.GlobalInt(flags.StorageMaskCacheSize.Name)
+	storageCfg.DiskTimeout = ctx.GlobalDuration(flags.StorageDiskTimeout.Name)
+	storageCfg.DiskFullRetry = ctx.GlobalDuration(flags.StorageDiskFullRetry.Name)
+	storageCfg.HashSize = ctx.GlobalInt(flags.StorageHashSize.Name)
+	storageCfg.LogLevels = ctx.GlobalString(flags.StorageLogLevels.Name)
+	storageCfg.Prewarm = ctx.GlobalBool(flags.StoragePrewarm.Name)
+	storageCfg.CommitThreadNum = ctx.GlobalInt(flags.StorageCommitThreadNum.Name)
+	storageCfg.MetaIndexOnDisk = ctx.GlobalBool(flags.StorageMetaIndexOnDisk.Name)
 	return storageCfg, nil
 }
 
@@ -271,5 +287,6 @@ func NewDownloaderConfig(ctx *cli.Context) *downloader.Config {
 		DownloadStart:     ctx.GlobalInt64(flags.DownloadStart.Name),
 		DownloadDump:      ctx.GlobalString(flags.DownloadDump.Name),
 		DownloadThreadNum: ctx.GlobalInt(flags.DownloadThreadNum.Name),
+		MaxInFlightBytes:  ctx.GlobalUint64(flags.DownloadMaxInFlightBytes.Name),
 	}
 }
@@ -23,7 +23,7 @@ import (
 )
 
 const (
-	fileName             = "shard-%d.dat"
+	fileName             = es.ShardFileName
 	shardLenFlagName     = "shard_len"
 	shardIndexFlagName   = "shard_index"
 	encodingTypeFlagName = "encoding_type"
@@ -174,6 +174,10 @@ func createDataFile(cfg *storage.StorageConfig, shardIdxList []uint64, datadir s
 			return nil, err
 		}
 		log.Info("Data file created", "shard", shardIdx, "file", dataFile, "kvIdxStart", df.KvIdxStart(), "kvIdxEnd", df.KvIdxEnd(), "miner", df.Miner())
+		// release the lock of the data file so that it can be opened by the node
+		if err = df.Close(); err != nil {
+			return nil, err
+		}
 		files = append(files, dataFile)
 	}
 	return files, nil
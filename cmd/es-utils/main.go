@@ -203,10 +203,13 @@ func runCreate(cmd *cobra.Command, args []string) {
 
 	log.Info("Creating data file", "chunkIdx", *chunkIdx, "chunksLen", *chunkLen, "chunkSize", *chunkSize, "miner", minerAddr, "encodeType", *encodeType)
 
-	_, err := es.Create((*filenames)[0], *chunkIdx, *chunkLen, 0, *kvSize, *encodeType, minerAddr, *chunkSize)
+	df, err := es.Create((*filenames)[0], *chunkIdx, *chunkLen, 0, *kvSize, *encodeType, minerAddr, *chunkSize)
 	if err != nil {
 		log.Crit("Create failed", "error", err)
 	}
+	if err = df.Close(); err != nil {
+		log.Crit("Close failed", "error", err)
+	}
 }
 
 func runChunkRead(cmd *cobra.Command, args []string) {
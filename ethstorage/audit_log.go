@@ -0,0 +1,65 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+// The sources of the blobs committed into the local storage.
+const (
+	CommitSourceDownload = "download" // downloaded from L1 by DownloadFinished
+	CommitSourceSync     = "sync"     // synced from peers by CommitBlobs or CommitBlob
+	CommitSourceEmpty    = "empty"    // filled as empty by CommitEmptyBlobs
+	CommitSourceEncoded  = "encoded"  // committed as encoded by CommitEncodedBlobPublic
+)
+
+// CommitAuditRecord is one line of the audit log, written for each blob committed into the local storage.
+type CommitAuditRecord struct {
+	KvIdx  uint64        `json:"kvIdx"`
+	Commit hexutil.Bytes `json:"commit"` // the commit prefix stored in the contract
+	Source string        `json:"source"`
+	Time   time.Time     `json:"time"`
+}
+
+// auditLog appends the records as JSON lines to the writer, which is shared by the concurrent writers of DownloadFinished.
+type auditLog struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// SetAuditWriter This function sets the writer of the audit log which records each blob committed into the local
+// storage, so that the sequence of the writes to a blob can be reconstructed, e.g. when its data unexpectedly
+// changes. The writer should be append-only, e.g. a file opened with O_APPEND. The audit log is disabled if w is nil,
+// which it is by default.
+func (s *StorageManager) SetAuditWriter(w io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if w == nil {
+		s.audit = nil
+		return
+	}
+	s.audit = &auditLog{enc: json.NewEncoder(w)}
+}
+
+// record writes the record of the committed blob. It is safe to call on a nil auditLog, which records nothing.
+func (a *auditLog) record(kvIdx uint64, commit common.Hash, source string, now time.Time) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	r := &CommitAuditRecord{KvIdx: kvIdx, Commit: commit[:HashSizeInContract], Source: source, Time: now}
+	if err := a.enc.Encode(r); err != nil {
+		commitLog.Warn("Failed to write audit log", "kvIdx", kvIdx, "err", err)
+	}
+}
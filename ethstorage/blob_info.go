@@ -0,0 +1,106 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+// BlobInfo is the status of a blob in the local storage, e.g. for an explorer of what the node holds.
+type BlobInfo struct {
+	KvIdx    uint64 `json:"kvIdx"`
+	ShardIdx uint64 `json:"shardIdx"`
+	Synced   bool   `json:"synced"` // whether the blob has been filled, with synced or empty data
+	Empty    bool   `json:"empty"`  // whether the commit of the blob is empty
+	// LocalCommit is the commit prefix in the local meta, and ContractCommit is the one in the contract meta,
+	// which is nil if the meta has not been downloaded.
+	LocalCommit    hexutil.Bytes `json:"localCommit"`
+	ContractCommit hexutil.Bytes `json:"contractCommit"`
+}
+
+// BlobInfo This function returns the status of the blob, which is read under a single lock acquisition so that the
+// local and contract commits are consistent. It returns ErrShardNotManaged or ErrNotOwned if the blob is not stored
+// locally.
+func (s *StorageManager) BlobInfo(kvIdx uint64) (*BlobInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	m, success, err := s.shardManager.TryReadMeta(kvIdx)
+	if err != nil {
+		return nil, err
+	}
+	if !success {
+		return nil, ErrShardNotManaged
+	}
+	localMeta := common.BytesToHash(m)
+	hashSize := s.hashSize()
+
+	info := &BlobInfo{
+		KvIdx:       kvIdx,
+		ShardIdx:    kvIdx / s.shardManager.kvEntries,
+		Synced:      s.isFilled(localMeta),
+		LocalCommit: common.CopyBytes(localMeta[0:hashSize]),
+	}
+	info.Empty = s.isEmptyFilled(localMeta)
+	if meta, ok := s.blobMetas.get(kvIdx); ok {
+		info.ContractCommit = common.CopyBytes(meta[32-hashSize:])
+	} else if kvIdx >= s.lastKvIdx {
+		// the meta beyond lastKvIdx is taken as empty
+		info.ContractCommit = make([]byte, hashSize)
+	}
+	return info, nil
+}
+
+// Blob is a blob read from the local storage with its status, so the data is never paired with the commit of
+// another read.
+type Blob struct {
+	Index      uint64      // kvIdx of the blob
+	Data       []byte      // decoded data of kvSize bytes, nil if the blob is not synced
+	Commit     common.Hash // commit in the local meta, of which only the hash size bytes are kept
+	EncodeType uint64      // encoding of the blob in its shard
+	Synced     bool        // whether the blob has been filled, with synced or empty data
+}
+
+// TryReadBlob This function reads the whole blob with the commit in its local meta, both under a single lock
+// acquisition, and returns them with the status of the blob. Unlike TryRead, a blob not synced yet is not an error
+// but returned with Synced false and no data. It returns ErrShardNotManaged if the blob is not stored locally, and
+// an error if the data does not match the commit. TryRead and TryReadEncoded save the allocation of the Blob and
+// are preferred on the hot paths.
+func (s *StorageManager) TryReadBlob(kvIdx uint64) (*Blob, error) {
+	s.rlock("TryReadBlob")
+	defer s.mu.RUnlock()
+
+	if err := s.checkAllowed(kvIdx); err != nil {
+		return nil, err
+	}
+	encodeType, ok := s.shardManager.GetShardEncodeType(kvIdx / s.shardManager.kvEntries)
+	if !ok {
+		return nil, ErrShardNotManaged
+	}
+	m, success, err := s.tryReadMeta(kvIdx)
+	if err != nil {
+		return nil, err
+	}
+	if !success {
+		return nil, ErrShardNotManaged
+	}
+	blob := &Blob{Index: kvIdx, EncodeType: encodeType}
+	localMeta := common.BytesToHash(m)
+	if !s.isFilled(localMeta) {
+		return blob, nil
+	}
+
+	data, m, success, err := s.tryReadWithMeta(kvIdx, int(s.shardManager.kvSize))
+	if err != nil {
+		return nil, err
+	}
+	if !success {
+		return nil, ErrShardNotManaged
+	}
+	blob.Data = data
+	copy(blob.Commit[:s.hashSize()], m)
+	blob.Synced = true
+	return blob, nil
+}
@@ -0,0 +1,68 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto/kzg4844"
+	"github.com/protolambda/go-kzg/eth"
+)
+
+var ErrNotBlobSized = errors.New("kv size is not the blob size")
+
+// BlobWrapper is a blob in the EIP-4844 network wrapper format, i.e. the blob with its KZG commitment and proof,
+// as expected by the tools that broadcast blob transactions or serve blob sidecars.
+type BlobWrapper struct {
+	Blob          kzg4844.Blob
+	Commitment    kzg4844.Commitment
+	Proof         kzg4844.Proof
+	VersionedHash common.Hash // EIP-4844 versioned hash of the commitment
+}
+
+// ExportBlobWrapper This function reads and decodes the blob, and returns it in the EIP-4844 network wrapper format
+// with the KZG commitment and proof computed from it. The proof is computed after the lock is released, as it takes
+// much longer than the read. Like TryReadEncoded, it returns err if the blob is empty or not synced, and it returns
+// ErrNotBlobSized if the kv size of the storage is not the blob size.
+func (s *StorageManager) ExportBlobWrapper(kvIdx uint64) (*BlobWrapper, error) {
+	w := &BlobWrapper{}
+	if s.shardManager.kvSize != uint64(len(w.Blob)) {
+		return nil, fmt.Errorf("%w: %d vs %d", ErrNotBlobSized, s.shardManager.kvSize, len(w.Blob))
+	}
+
+	blob, err := s.readSyncedBlob(kvIdx)
+	if err != nil {
+		return nil, err
+	}
+	copy(w.Blob[:], blob)
+
+	if w.Commitment, err = kzg4844.BlobToCommitment(w.Blob); err != nil {
+		return nil, fmt.Errorf("could not convert blob to commitment: %w", err)
+	}
+	if w.Proof, err = kzg4844.ComputeBlobProof(w.Blob, w.Commitment); err != nil {
+		return nil, fmt.Errorf("could not compute blob proof: %w", err)
+	}
+	w.VersionedHash = common.Hash(eth.KZGToVersionedHash(eth.KZGCommitment(w.Commitment)))
+	return w, nil
+}
+
+// readSyncedBlob returns the decoded blob of the kv, or err if the blob is empty or not synced.
+func (s *StorageManager) readSyncedBlob(kvIdx uint64) ([]byte, error) {
+	s.rlock("ExportBlobWrapper")
+	defer s.mu.RUnlock()
+
+	if err := s.syncCheck(kvIdx); err != nil {
+		return nil, err
+	}
+	blob, _, success, err := s.tryReadWithMeta(kvIdx, int(s.shardManager.kvSize))
+	if err != nil {
+		return nil, err
+	}
+	if !success {
+		return nil, fmt.Errorf("%w: kvIdx %d", ErrShardNotManaged, kvIdx)
+	}
+	return blob, nil
+}
@@ -0,0 +1,44 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"bytes"
+	"errors"
+)
+
+// GetBlobsByVersionedHashes This function returns the blobs stored locally of the versioned hashes, e.g. to serve
+// the getBlobs of the engine API as a blob archive, with nil for the hashes not stored. The commit of a blob kept in
+// its meta is its versioned hash truncated to the hash size, so a versioned hash is mapped to a local kvIdx by
+// HasCommit, which uses the reverse index of the commits if enabled by EnableCommitIndex, or scans all the
+// downloaded metas for each hash otherwise. As a blob may be overwritten after it is found, its commit read with
+// the data is checked against the versioned hash again. Return an error if a blob found cannot be read.
+func (s *StorageManager) GetBlobsByVersionedHashes(hashes [][32]byte) ([]*Blob, error) {
+	s.mu.RLock()
+	hashSize := s.hashSize()
+	s.mu.RUnlock()
+
+	blobs := make([]*Blob, len(hashes))
+	for i, h := range hashes {
+		// the zero hash is not a versioned hash, but the commit of the empty filled blobs
+		if h == [32]byte{} {
+			continue
+		}
+		kvIdx, ok := s.HasCommit(h)
+		if !ok {
+			continue
+		}
+		blob, err := s.TryReadBlob(kvIdx)
+		if errors.Is(err, ErrShardNotManaged) || errors.Is(err, ErrNotOwned) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if blob.Synced && bytes.Equal(blob.Commit[:hashSize], h[:hashSize]) {
+			blobs[i] = blob
+		}
+	}
+	return blobs, nil
+}
@@ -0,0 +1,50 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+var ErrChangesNotTracked = errors.New("changes before the block are not tracked")
+
+// BlobsChangedSince This function returns the kvs of the local shards whose metas are updated by DownloadFinished
+// in the blocks after fromL1 up to the local L1, in order, e.g. for a mirror to pull the delta instead of diffing
+// the shards. The changes are tracked since the last Reset or ResetAndInvalidateMetas, before which it returns
+// ErrChangesNotTracked, so a mirror behind that block must fall back to a full diff.
+// The block of the last update is kept for each kv updated since then, which costs about 40 bytes per kv in memory,
+// e.g. 40 MB after a million kvs are updated, bounded by the number of the kvs of the local shards.
+func (s *StorageManager) BlobsChangedSince(fromL1 int64) ([]uint64, error) {
+	s.rlock("BlobsChangedSince")
+	defer s.mu.RUnlock()
+
+	if fromL1 < s.metaUpdatesFrom {
+		return nil, fmt.Errorf("%w: from %d, tracked since %d", ErrChangesNotTracked, fromL1, s.metaUpdatesFrom)
+	}
+	changed := []uint64{}
+	for kvIdx, l1 := range s.metaUpdatedAt {
+		if l1 > fromL1 && s.shardManager.owns(kvIdx) {
+			changed = append(changed, kvIdx)
+		}
+	}
+	sort.Slice(changed, func(i, j int) bool { return changed[i] < changed[j] })
+	return changed, nil
+}
+
+// resetMetaUpdates restarts the tracking of the meta updates from newL1, as the updates tracked may not be
+// consistent with a local L1 moved by other than DownloadFinished. The caller must hold s.mu and s.metasMu.
+func (s *StorageManager) resetMetaUpdates(newL1 int64) {
+	s.metaUpdatesFrom = newL1
+	s.metaUpdatedAt = nil
+}
+
+// recordMetaUpdate records the kv as updated at the L1 block. The caller must hold s.mu and s.metasMu.
+func (s *StorageManager) recordMetaUpdate(kvIdx uint64, l1 int64) {
+	if s.metaUpdatedAt == nil {
+		s.metaUpdatedAt = make(map[uint64]int64)
+	}
+	s.metaUpdatedAt[kvIdx] = l1
+}
@@ -0,0 +1,50 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import "sync"
+
+// byteBudget is a semaphore weighted by bytes, which limits the total size of the data being processed at
+// the same time. A budget with a zero limit is unlimited.
+type byteBudget struct {
+	limit    uint64
+	mu       sync.Mutex
+	cond     *sync.Cond
+	inFlight uint64
+}
+
+func newByteBudget(limit uint64) *byteBudget {
+	b := &byteBudget{limit: limit}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// acquire blocks until n bytes are available in the budget. A request larger than the limit is capped to the
+// limit, so it waits for the whole budget instead of blocking forever.
+func (b *byteBudget) acquire(n uint64) uint64 {
+	if b.limit == 0 {
+		return n
+	}
+	if n > b.limit {
+		n = b.limit
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for b.inFlight+n > b.limit {
+		b.cond.Wait()
+	}
+	b.inFlight += n
+	return n
+}
+
+// release returns the n bytes returned by acquire to the budget.
+func (b *byteBudget) release(n uint64) {
+	if b.limit == 0 {
+		return
+	}
+	b.mu.Lock()
+	b.inFlight -= n
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
@@ -0,0 +1,53 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestByteBudget(t *testing.T) {
+	const blobSize = 1024
+	budget := newByteBudget(2 * blobSize)
+
+	var inFlight, maxInFlight int64
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			acquired := budget.acquire(blobSize)
+			cur := atomic.AddInt64(&inFlight, 1)
+			for {
+				old := atomic.LoadInt64(&maxInFlight)
+				if cur <= old || atomic.CompareAndSwapInt64(&maxInFlight, old, cur) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+			atomic.AddInt64(&inFlight, -1)
+			budget.release(acquired)
+		}()
+	}
+	wg.Wait()
+	if maxInFlight > 2 {
+		t.Fatal("too many blobs in flight", maxInFlight)
+	}
+
+	// a request larger than the limit takes the whole budget instead of blocking forever
+	acquired := budget.acquire(4 * blobSize)
+	if acquired != 2*blobSize {
+		t.Fatal("unexpected acquired bytes", acquired)
+	}
+	budget.release(acquired)
+
+	// zero limit is unlimited
+	unlimited := newByteBudget(0)
+	for i := 0; i < 16; i++ {
+		unlimited.acquire(blobSize)
+	}
+}
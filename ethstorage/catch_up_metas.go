@@ -0,0 +1,174 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethstorage/go-ethstorage/ethstorage/eth"
+)
+
+// Il1LogSource is implemented by the l1 sources which can filter the logs of the storage contract, e.g.
+// eth.PollingClient, so that the kvs updated in a block range can be found.
+type Il1LogSource interface {
+	FilterLogsByBlockRange(start *big.Int, end *big.Int, eventSig string) ([]types.Log, error)
+}
+
+// errNoLogSource is returned by catchUpMetas if the l1 source does not implement Il1LogSource.
+var errNoLogSource = errors.New("l1 source cannot filter logs")
+
+// CatchUpMetas This function is a fast path of DownloadAllMetas after a restart, where prevL1 and prevLastKvIdx are
+// the local L1 view and its lastKvIdx before the restart. The blobs filled locally at prevL1 still match the contract
+// unless they are updated after it, so their metas are restored from the local metas, and only the metas of the rest
+// kvs below prevLastKvIdx, the kvs updated in (prevL1, localL1] and the kvs in [prevLastKvIdx, lastKvIdx) are
+// downloaded. The restored metas do not carry the kv size, which is not used locally. If the kvs updated after prevL1
+// cannot be found as the l1 source does not implement Il1LogSource, it falls back to DownloadAllMetas. Like it,
+// CatchUpMetas is gated by Pause.
+func (s *StorageManager) CatchUpMetas(ctx context.Context, prevL1 int64, prevLastKvIdx uint64, batchSize uint64) error {
+	if err := s.enterSync(); err != nil {
+		return err
+	}
+	err := s.catchUpMetas(ctx, prevL1, prevLastKvIdx, batchSize)
+	// DownloadAllMetas is gated by itself
+	s.exitSync()
+	if errors.Is(err, errNoLogSource) {
+		metaLog.Info("Kvs updated since the previous L1 cannot be found, download all the metas", "prevL1", prevL1)
+		return s.DownloadAllMetas(ctx, batchSize)
+	}
+	return err
+}
+
+func (s *StorageManager) catchUpMetas(ctx context.Context, prevL1 int64, prevLastKvIdx uint64, batchSize uint64) error {
+	if err := s.acquire(); err != nil {
+		return err
+	}
+	defer s.release()
+	ctx, cancel := s.withCloseCtx(ctx)
+	defer cancel()
+
+	s.mu.Lock()
+	localL1 := s.localL1
+	lastKvIdx := s.lastKvIdx
+	s.mu.Unlock()
+	if prevL1 > localL1 {
+		return fmt.Errorf("previous L1 %d is newer than local L1 %d", prevL1, localL1)
+	}
+
+	updated := map[uint64]bool{}
+	if prevL1 < localL1 {
+		logSource, ok := s.getL1Source().(Il1LogSource)
+		if !ok {
+			return errNoLogSource
+		}
+		events, err := logSource.FilterLogsByBlockRange(big.NewInt(prevL1+1), big.NewInt(localL1), eth.PutBlobEvent)
+		if err != nil {
+			return err
+		}
+		for _, event := range events {
+			updated[new(big.Int).SetBytes(event.Topics[1][:]).Uint64()] = true
+		}
+	}
+
+	for _, shardIdx := range s.Shards() {
+		if err := s.catchUpShardMetas(ctx, shardIdx, prevLastKvIdx, lastKvIdx, updated, batchSize); err != nil {
+			return err
+		}
+	}
+
+	if s.closeCtx.Err() != nil {
+		return ErrStorageClosed
+	}
+	if ctx.Err() == nil {
+		s.mu.Lock()
+		s.metasDownloaded = true
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+func (s *StorageManager) catchUpShardMetas(ctx context.Context, shardIdx, prevLastKvIdx, lastKvIdx uint64, updated map[uint64]bool, batchSize uint64) error {
+	first, limit, ok := s.OwnedKvRange(shardIdx)
+	if !ok {
+		return ErrShardNotManaged
+	}
+	if limit > lastKvIdx {
+		limit = lastKvIdx
+	}
+
+	var (
+		toDownload []uint64
+		restored   int
+	)
+	for kvIdx := first; kvIdx < limit; kvIdx++ {
+		if kvIdx >= prevLastKvIdx || updated[kvIdx] {
+			toDownload = append(toDownload, kvIdx)
+			continue
+		}
+		restoredMeta, err := s.restoreMeta(kvIdx)
+		if err != nil {
+			return err
+		}
+		if !restoredMeta {
+			toDownload = append(toDownload, kvIdx)
+			continue
+		}
+		restored++
+	}
+	metaLog.Info("Begin to catch up metas", "shard", shardIdx, "restored", restored, "toDownload", len(toDownload))
+
+	if err := s.downloadMetaKvs(ctx, toDownload, batchSize); err != nil || ctx.Err() != nil {
+		return err
+	}
+	s.markShardMetasDownloaded(shardIdx)
+	return nil
+}
+
+// downloadMetaKvs downloads the metas of the kvs in batches of batchSize, and stops without an error if ctx is done.
+func (s *StorageManager) downloadMetaKvs(ctx context.Context, kvs []uint64, batchSize uint64) error {
+	for len(kvs) > 0 {
+		if ctx.Err() != nil {
+			return nil
+		}
+		n := batchSize
+		if n > uint64(len(kvs)) {
+			n = uint64(len(kvs))
+		}
+		if err := s.downloadMetaBatch(kvs[:n], true); err != nil {
+			return err
+		}
+		kvs = kvs[n:]
+	}
+	return nil
+}
+
+// restoreMeta sets the contract meta of the kv from its local meta if the blob has been filled, and returns whether
+// it is restored. The meta is not overwritten if it has been set, e.g. by DownloadFinished.
+func (s *StorageManager) restoreMeta(kvIdx uint64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.blobMetas.get(kvIdx); ok {
+		return true, nil
+	}
+	m, success, err := s.shardManager.TryReadMeta(kvIdx)
+	if !success || err != nil {
+		return false, err
+	}
+	localMeta := common.BytesToHash(m)
+	if !s.isFilled(localMeta) {
+		return false, nil
+	}
+	meta := [32]byte{}
+	if err = putMetaKvIdx(&meta, kvIdx); err != nil {
+		return false, err
+	}
+	copy(meta[32-s.hashSize():], localMeta[0:s.hashSize()])
+	s.blobMetas.set(kvIdx, meta)
+	return true, nil
+}
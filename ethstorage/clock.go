@@ -0,0 +1,19 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import "time"
+
+// Clock tells the current time, so that the time-based behaviors, e.g. the stall detection of HealthStatus,
+// can be tested with a fake clock.
+type Clock interface {
+	Now() time.Time
+}
+
+// SystemClock is the Clock of the real time.
+type SystemClock struct{}
+
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
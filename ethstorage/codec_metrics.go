@@ -0,0 +1,27 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import "github.com/ethereum/go-ethereum/common"
+
+const (
+	// CodecEncode and CodecDecode are the operations recorded by StorageMetrics.RecordCodec
+	CodecEncode = "encode"
+	CodecDecode = "decode"
+)
+
+// tryEncodeKV is shardManager.TryEncodeKV, which records the encoding time if the metrics are enabled. It is called
+// without s.mu, so the measurement does not include the lock wait.
+func (s *StorageManager) tryEncodeKV(kvIdx uint64, blob []byte, commit common.Hash) ([]byte, bool, error) {
+	m := s.getMetrics()
+	if m == nil {
+		return s.shardManager.TryEncodeKV(kvIdx, blob, commit)
+	}
+	start := s.Clock.Now()
+	encoded, success, err := s.shardManager.TryEncodeKV(kvIdx, blob, commit)
+	if success && err == nil {
+		m.RecordCodec(CodecEncode, s.Clock.Now().Sub(start))
+	}
+	return encoded, success, err
+}
@@ -0,0 +1,143 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// commitIndex is the reverse index of the commits to the kvs which may store them, used by HasCommit instead of
+// scanning blobMetas. The index is only a hint: an entry is added for each blob committed, and is dropped once it is
+// found stale, e.g. after the kv is overwritten, so the candidates must be checked against the local metas.
+// It has its own lock as the DownloadFinished workers add to it concurrently.
+type commitIndex struct {
+	mu  sync.Mutex
+	kvs map[common.Hash][]uint64 // kv indices by the commit truncated to the hash size
+}
+
+func newCommitIndex() *commitIndex {
+	return &commitIndex{kvs: make(map[common.Hash][]uint64)}
+}
+
+func commitKey(commit common.Hash, hashSize int) common.Hash {
+	key := common.Hash{}
+	copy(key[:hashSize], commit[:hashSize])
+	return key
+}
+
+// add records that kvIdx may store the commit. A nil commitIndex ignores it.
+func (ci *commitIndex) add(kvIdx uint64, commit common.Hash, hashSize int) {
+	if ci == nil {
+		return
+	}
+	key := commitKey(commit, hashSize)
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+	for _, idx := range ci.kvs[key] {
+		if idx == kvIdx {
+			return
+		}
+	}
+	ci.kvs[key] = append(ci.kvs[key], kvIdx)
+}
+
+// candidates returns the kv indices which may store the commit.
+func (ci *commitIndex) candidates(commit common.Hash, hashSize int) []uint64 {
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+	return append([]uint64(nil), ci.kvs[commitKey(commit, hashSize)]...)
+}
+
+// drop removes the stale candidates of the commit.
+func (ci *commitIndex) drop(commit common.Hash, hashSize int, stale []uint64) {
+	key := commitKey(commit, hashSize)
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+	kvs := ci.kvs[key][:0]
+	for _, idx := range ci.kvs[key] {
+		isStale := false
+		for _, s := range stale {
+			isStale = isStale || s == idx
+		}
+		if !isStale {
+			kvs = append(kvs, idx)
+		}
+	}
+	if len(kvs) == 0 {
+		delete(ci.kvs, key)
+		return
+	}
+	ci.kvs[key] = kvs
+}
+
+// EnableCommitIndex This function builds the reverse index of the commits used by HasCommit from the downloaded metas,
+// and keeps it updated with the blobs committed since. The index takes about 100 bytes per kv in memory, so enable it
+// only if HasCommit is called frequently, and after the metas are downloaded, e.g. by DownloadAllMetas, as the kvs
+// stored locally without a downloaded meta are not indexed.
+func (s *StorageManager) EnableCommitIndex() {
+	s.lock("EnableCommitIndex")
+	defer s.mu.Unlock()
+
+	if s.commitIndex != nil {
+		return
+	}
+	hashSize := s.hashSize()
+	index := newCommitIndex()
+	s.blobMetas.forEach(func(kvIdx uint64, meta [32]byte) {
+		commit := common.Hash{}
+		copy(commit[:hashSize], meta[32-hashSize:])
+		index.add(kvIdx, commit, hashSize)
+	})
+	s.commitIndex = index
+}
+
+// HasCommit This function returns whether a blob with the commit is stored in the local shards, and the lowest kvIdx
+// storing it, e.g. to deduplicate the data across the shards. The commit is matched by the hash size kept in the local
+// metas. Without the index enabled by EnableCommitIndex, it scans all the downloaded metas under the read lock, which
+// is O(n) in the number of the local kvs and blocks the writes meanwhile. With the index, only the kvs indexed with
+// the commit are checked. In both cases, the candidates are checked against the local metas on disk, and the stale
+// candidates are dropped from the index, which has a lock of its own.
+func (s *StorageManager) HasCommit(commit common.Hash) (uint64, bool) {
+	s.rlock("HasCommit")
+	defer s.mu.RUnlock()
+
+	hashSize := s.hashSize()
+	var kvs []uint64
+	if s.commitIndex != nil {
+		kvs = s.commitIndex.candidates(commit, hashSize)
+	} else {
+		s.blobMetas.forEach(func(kvIdx uint64, meta [32]byte) {
+			if bytes.Equal(meta[32-hashSize:], commit[:hashSize]) {
+				kvs = append(kvs, kvIdx)
+			}
+		})
+	}
+	sort.Slice(kvs, func(i, j int) bool { return kvs[i] < kvs[j] })
+
+	var stale []uint64
+	found := false
+	kvIdx := uint64(0)
+	for _, idx := range kvs {
+		m, success, err := s.tryReadMeta(idx)
+		if err != nil || !success {
+			// the kv is not stored, e.g. its shard is removed
+			stale = append(stale, idx)
+			continue
+		}
+		localMeta := common.BytesToHash(m)
+		if isFilledN(localMeta, hashSize) && bytes.Equal(localMeta[:hashSize], commit[:hashSize]) {
+			found, kvIdx = true, idx
+			break
+		}
+		stale = append(stale, idx)
+	}
+	if s.commitIndex != nil && len(stale) > 0 {
+		s.commitIndex.drop(commit, hashSize, stale)
+	}
+	return kvIdx, found
+}
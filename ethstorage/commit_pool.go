@@ -0,0 +1,52 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"sync"
+)
+
+// commitWorkerPool returns the worker pool of the commit path, which is created on first use like workerPool, so
+// the encoding of the blobs synced from the peers does not compete with the DownloadFinished writes for the workers.
+func (s *StorageManager) commitWorkerPool() *workerPool {
+	s.commitPoolOnce.Do(func() {
+		s.commitPool = newWorkerPool(s.CommitThreadNum)
+	})
+	return s.commitPool
+}
+
+// runCommitTasks runs fn for each of [0, n) with CommitThreadNum workers, or sequentially if it is not more than 1,
+// and waits for all of them. fn must be safe to run concurrently for different indices.
+func (s *StorageManager) runCommitTasks(n int, fn func(i int)) error {
+	taskNum := s.CommitThreadNum
+	if taskNum <= 1 || n <= 1 {
+		for i := 0; i < n; i++ {
+			fn(i)
+		}
+		return nil
+	}
+	if taskNum > n {
+		taskNum = n
+	}
+
+	pool := s.commitWorkerPool()
+	var wg sync.WaitGroup
+	for t := 0; t < taskNum; t++ {
+		first := t
+		wg.Add(1)
+		err := pool.submit(func() {
+			defer wg.Done()
+			for i := first; i < n; i += taskNum {
+				fn(i)
+			}
+		})
+		if err != nil {
+			wg.Done()
+			wg.Wait()
+			return err
+		}
+	}
+	wg.Wait()
+	return nil
+}
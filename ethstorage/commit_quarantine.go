@@ -0,0 +1,29 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+// quarantine records the kv index of a blob from the sync layer which failed the commit-mismatch check, dropping the
+// oldest one if QuarantineLimit is reached. It is a no-op if QuarantineLimit is 0. The caller must hold s.mu.
+func (s *StorageManager) quarantine(kvIdx uint64) {
+	if s.QuarantineLimit <= 0 {
+		return
+	}
+	if len(s.quarantined) >= s.QuarantineLimit {
+		s.quarantined = s.quarantined[len(s.quarantined)-s.QuarantineLimit+1:]
+	}
+	s.quarantined = append(s.quarantined, kvIdx)
+}
+
+// QuarantinedCommits This function returns the kv indices of the blobs committed by CommitBlobs or CommitBlob which
+// failed the commit-mismatch check since the last call, in the order they are rejected, so that the sync layer can
+// correlate the bad data with the peers, e.g. for a rate-based peer scoring. An index appears once per rejection.
+// The indices are only recorded if QuarantineLimit is set, and the oldest ones are dropped beyond it.
+func (s *StorageManager) QuarantinedCommits() []uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	quarantined := s.quarantined
+	s.quarantined = nil
+	return quarantined
+}
@@ -0,0 +1,91 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"context"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// maxStreamBatch is the max number of blobs committed together by CommitBlobStream.
+const maxStreamBatch = 16
+
+// BlobItem is a blob to commit by CommitBlobStream.
+type BlobItem struct {
+	KvIndex uint64
+	Blob    []byte
+	Commit  common.Hash
+}
+
+// CommitStreamStats is the aggregate result of CommitBlobStream.
+type CommitStreamStats struct {
+	Received  int // blobs received from the channel
+	Committed int // blobs committed, or already in the local storage
+	Skipped   int // blobs not committed, e.g. not matching the local L1 view
+}
+
+// CommitBlobStream This function commits the blobs received from ch as they arrive, until ch is closed or ctx is
+// cancelled, and returns the aggregate stats. The blobs ready in ch are committed together by CommitBlobs in batches
+// of up to maxStreamBatch, so the batches grow with the rate of the producer, which is backpressured by the commits
+// as ch is not read in the meantime. It returns ctx.Err() if ctx is cancelled, or the error of CommitBlobs, e.g. if
+// the metas are not downloaded.
+func (s *StorageManager) CommitBlobStream(ctx context.Context, ch <-chan BlobItem) (CommitStreamStats, error) {
+	stats := CommitStreamStats{}
+	for {
+		var item BlobItem
+		var ok bool
+		select {
+		case item, ok = <-ch:
+			if !ok {
+				return stats, nil
+			}
+		case <-ctx.Done():
+			return stats, ctx.Err()
+		}
+
+		batch := []BlobItem{item}
+		closed := false
+	drain:
+		for len(batch) < maxStreamBatch {
+			select {
+			case item, ok = <-ch:
+				if !ok {
+					closed = true
+					break drain
+				}
+				batch = append(batch, item)
+			default:
+				break drain
+			}
+		}
+
+		if err := s.commitBlobItems(batch, &stats); err != nil {
+			return stats, err
+		}
+		if closed {
+			return stats, nil
+		}
+	}
+}
+
+func (s *StorageManager) commitBlobItems(batch []BlobItem, stats *CommitStreamStats) error {
+	var (
+		kvIndices = make([]uint64, len(batch))
+		blobs     = make([][]byte, len(batch))
+		commits   = make([]common.Hash, len(batch))
+	)
+	for i, item := range batch {
+		kvIndices[i], blobs[i], commits[i] = item.KvIndex, item.Blob, item.Commit
+	}
+	stats.Received += len(batch)
+	inserted, err := s.CommitBlobs(kvIndices, blobs, commits)
+	if err != nil {
+		stats.Skipped += len(batch)
+		return err
+	}
+	stats.Committed += len(inserted)
+	stats.Skipped += len(batch) - len(inserted)
+	return nil
+}
@@ -0,0 +1,31 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+var ErrVersionedHashMismatch = errors.New("versioned hash of the blob is not matched")
+
+// CommitBlobByVersionedHash This function commits a blob identified by its EIP-4844 versioned hash, e.g. from a
+// standard 4844 pipeline, instead of the commit in the contract. The versioned hash is verified to derive from the
+// KZG commitment of the blob, and then used as the commit, as the contract keeps the prefix of the versioned hash.
+// Return ErrVersionedHashMismatch if the versioned hash does not match the blob, or the errors of CommitBlob.
+func (s *StorageManager) CommitBlobByVersionedHash(kvIndex uint64, blob []byte, versionedHash common.Hash) error {
+	if len(blob) > int(s.shardManager.kvSize) {
+		return fmt.Errorf("blob size %d is larger than kvSize %d", len(blob), s.shardManager.kvSize)
+	}
+	hash, err := blobVersionedHash(blob)
+	if err != nil {
+		return err
+	}
+	if hash != versionedHash {
+		return fmt.Errorf("%w: kvIdx %d, expected %s, got %s", ErrVersionedHashMismatch, kvIndex, hash, versionedHash)
+	}
+	return s.CommitBlob(kvIndex, blob, versionedHash)
+}
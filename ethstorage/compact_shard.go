@@ -0,0 +1,304 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/ethereum/go-ethereum/log"
+)
+
+const (
+	// compactFileSuffix is the suffix of the file a data file is compacted to, which replaces the data file once done
+	compactFileSuffix = ".compact"
+	// compactProgressSuffix is the suffix of the file of the number of kvs compacted, to resume from after a crash
+	compactProgressSuffix = ".next"
+	// compactBackupSuffix is the suffix of the hard link to the data file kept while it is replaced, to restore it if
+	// the compacted file fails to open
+	compactBackupSuffix = ".orig"
+	// compactSyncInterval is the number of kvs copied between two syncs of the compacted file and its progress
+	compactSyncInterval = 1024
+)
+
+var ErrShardCompacting = errors.New("shard is being compacted")
+
+// CompactShard This function rewrites the data files of the shard to reclaim the disk space of the blobs never
+// filled, which are left as holes of sparse files instead of the space allocated when the files were created. The
+// layout of the data files is fixed, so no offsets are changed. Each data file is copied to a file with the
+// compactFileSuffix without the lock, and the kvs committed meanwhile are copied again under the lock, during which
+// the shard is read-only, before the copy atomically replaces the data file by a rename, so the data file is intact
+// if the node crashes. The number of kvs copied is synced every compactSyncInterval kvs, so an interrupted compaction
+// resumes from there, with the kvs changed since copied again.
+// As the kvs are copied again only if their metas changed, the compaction must not overlap a re-encoding by
+// ReEncodeShard, which rewrites the data without changing the metas. So ErrShardCompacting is returned if the shard is
+// being compacted, and an error if its re-encoding is unfinished, while ReEncodeShard rejects a shard being compacted.
+// Note that the blobs filled after the compaction allocate the disk space then, which may fail if the disk is full,
+// and the samples read without the lock by mining may fail while a data file is being replaced.
+func (s *StorageManager) CompactShard(ctx context.Context, shardIdx uint64) error {
+	if err := s.enterSync(); err != nil {
+		return err
+	}
+	defer s.exitSync()
+	if err := s.acquire(); err != nil {
+		return err
+	}
+	defer s.release()
+
+	s.mu.Lock()
+	ds, ok := s.shardManager.getDataShard(shardIdx)
+	if !ok {
+		s.mu.Unlock()
+		return ErrShardNotManaged
+	}
+	if s.compacting[shardIdx] {
+		s.mu.Unlock()
+		return ErrShardCompacting
+	}
+	files := append([]*DataFile{}, ds.dataFiles...)
+	if len(files) > 0 {
+		if _, err := os.Stat(files[0].file.Name() + reEncodeFileSuffix); !errors.Is(err, os.ErrNotExist) {
+			s.mu.Unlock()
+			return fmt.Errorf("unfinished re-encoding of shard %d: %v", shardIdx, err)
+		}
+	}
+	s.compacting[shardIdx] = true
+	hashSize := s.hashSize()
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.compacting, shardIdx)
+		s.mu.Unlock()
+	}()
+
+	for _, df := range files {
+		if err := s.compactDataFile(ctx, ds, df, hashSize); err != nil {
+			return err
+		}
+	}
+	log.Info("Shard compacted", "shard", shardIdx, "files", len(files))
+	return nil
+}
+
+func (s *StorageManager) compactDataFile(ctx context.Context, ds *DataShard, df *DataFile, hashSize int) error {
+	name := df.file.Name()
+	tmpName := name + compactFileSuffix
+	progressName := tmpName + compactProgressSuffix
+	// a backup left by a crash during the replacement is a link to the data file or to the one replaced
+	os.Remove(name + compactBackupSuffix)
+
+	next := readCompactProgress(progressName)
+	tmp, err := os.OpenFile(tmpName, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	defer tmp.Close()
+	if next > 0 && !sameSize(df.file, tmp) {
+		// the compacted file is not the one of the progress
+		next = 0
+	}
+	if next == 0 {
+		if err = initCompactFile(df, tmp); err != nil {
+			return err
+		}
+	}
+	c := &kvCopier{src: df, dst: tmp, hashSize: hashSize}
+
+	start, end := df.KvIdxStart(), df.KvIdxEnd()
+	if next > end-start {
+		next = 0
+	}
+	// the kvs copied before an interruption may have been committed again since
+	for kvIdx := start; kvIdx < start+next; kvIdx++ {
+		if err = c.copyKV(kvIdx, true); err != nil {
+			return err
+		}
+	}
+	for kvIdx := start + next; kvIdx < end; kvIdx++ {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		if err = c.copyKV(kvIdx, false); err != nil {
+			return err
+		}
+		if (kvIdx+1-start)%compactSyncInterval == 0 {
+			if err = syncCompactProgress(tmp, progressName, kvIdx+1-start); err != nil {
+				return err
+			}
+		}
+	}
+	if err = syncCompactProgress(tmp, progressName, end-start); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// copy the kvs committed during the copy, while no more can be committed
+	for kvIdx := start; kvIdx < end; kvIdx++ {
+		if err = c.copyKV(kvIdx, true); err != nil {
+			return err
+		}
+	}
+	if err = tmp.Sync(); err != nil {
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = replaceDataFile(ds, df, tmpName); err != nil {
+		return err
+	}
+	os.Remove(progressName)
+	return nil
+}
+
+// replaceDataFile atomically replaces the data file df of the shard with the file tmpName by a rename, and swaps the
+// reopened file into the shard. The caller must hold s.mu. The data file is linked to a backup before the rename, so
+// if the replaced file fails to open, the data file is restored by renaming the backup back, and the shard keeps
+// writing to it instead of an unlinked file. The swap is made under ds.filesMu, so the old file is closed only after
+// the readers without s.mu, e.g. ReadSampleUnlocked, have finished reading it.
+func replaceDataFile(ds *DataShard, df *DataFile, tmpName string) error {
+	name := df.file.Name()
+	backup := name + compactBackupSuffix
+	if err := os.Link(name, backup); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpName, name); err != nil {
+		os.Remove(backup)
+		return err
+	}
+	newDf, err := OpenDataFile(name)
+	if err != nil {
+		if newDf != nil {
+			// opened with a bad header
+			newDf.Close()
+		}
+		if restoreErr := os.Rename(backup, name); restoreErr != nil {
+			log.Error("Failed to restore data file, the shard must not be written until restored", "file", name,
+				"backup", backup, "err", restoreErr)
+			return fmt.Errorf("open compacted file failed: %w, restore data file failed: %v", err, restoreErr)
+		}
+		syncDir(filepath.Dir(name))
+		return fmt.Errorf("open compacted file failed: %w", err)
+	}
+	os.Remove(backup)
+	syncDir(filepath.Dir(name))
+
+	ds.filesMu.Lock()
+	for i := range ds.dataFiles {
+		if ds.dataFiles[i] == df {
+			ds.dataFiles[i] = newDf
+		}
+	}
+	ds.filesMu.Unlock()
+	return df.Close()
+}
+
+// initCompactFile truncates the compacted file to the size of the data file with the header copied, so the kvs
+// not copied are holes.
+func initCompactFile(df *DataFile, tmp *os.File) error {
+	info, err := df.file.Stat()
+	if err != nil {
+		return err
+	}
+	header := make([]byte, HEADER_SIZE)
+	if _, err = df.file.ReadAt(header, 0); err != nil {
+		return err
+	}
+	if err = tmp.Truncate(0); err != nil {
+		return err
+	}
+	if _, err = tmp.WriteAt(header, 0); err != nil {
+		return err
+	}
+	return tmp.Truncate(info.Size())
+}
+
+func sameSize(f1, f2 *os.File) bool {
+	info1, err1 := f1.Stat()
+	info2, err2 := f2.Stat()
+	return err1 == nil && err2 == nil && info1.Size() == info2.Size()
+}
+
+// kvCopier copies the kvs of a data file to its compacted file.
+type kvCopier struct {
+	src      *DataFile
+	dst      *os.File
+	hashSize int
+}
+
+func (c *kvCopier) metaOffset(kvIdx uint64) int64 {
+	df := c.src
+	return int64(HEADER_SIZE + df.chunkIdxLen*df.chunkSize + (kvIdx-df.KvIdxStart())*df.metaSize)
+}
+
+func (c *kvCopier) dataOffset(kvIdx uint64) int64 {
+	df := c.src
+	return int64(HEADER_SIZE + (kvIdx-df.KvIdxStart())*df.maxKvSize)
+}
+
+// copyKV copies the meta of the kv, and the data of it if it is filled. The meta is read before the data, so the
+// data written by a commit after the meta is read is copied again by the next copyKV with onlyChanged, which skips
+// the kv if its meta has not changed since copied.
+func (c *kvCopier) copyKV(kvIdx uint64, onlyChanged bool) error {
+	meta, err := c.src.ReadMeta(kvIdx)
+	if err != nil {
+		return err
+	}
+	if onlyChanged {
+		copied := make([]byte, len(meta))
+		if _, err = c.dst.ReadAt(copied, c.metaOffset(kvIdx)); err != nil {
+			return err
+		}
+		if bytes.Equal(meta, copied) {
+			return nil
+		}
+	}
+	if isFilledN([32]byte(meta), c.hashSize) {
+		data := make([]byte, c.src.maxKvSize)
+		if _, err = c.src.file.ReadAt(data, c.dataOffset(kvIdx)); err != nil {
+			return err
+		}
+		if _, err = c.dst.WriteAt(data, c.dataOffset(kvIdx)); err != nil {
+			return err
+		}
+	}
+	_, err = c.dst.WriteAt(meta, c.metaOffset(kvIdx))
+	return err
+}
+
+// readCompactProgress returns the number of kvs compacted, or 0 if the progress is not found.
+func readCompactProgress(name string) uint64 {
+	b, err := os.ReadFile(name)
+	if err != nil || len(b) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+// syncCompactProgress syncs the compacted file before the number of kvs compacted is written, so the progress
+// never covers the kvs not persisted.
+func syncCompactProgress(tmp *os.File, name string, next uint64) error {
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, next)
+	return os.WriteFile(name, b, 0644)
+}
+
+// syncDir syncs the directory so that a rename in it is persisted, which is best-effort as it is not supported on
+// all the platforms.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
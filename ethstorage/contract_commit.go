@@ -0,0 +1,43 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// ContractCommit is the commit of a blob as kept by the contract, i.e. the first HashSizeInContract bytes of the
+// commit, without the padding of common.Hash.
+type ContractCommit [HashSizeInContract]byte
+
+// ToContractCommit returns the contract commit of the commit, i.e. its first HashSizeInContract bytes.
+func ToContractCommit(commit common.Hash) ContractCommit {
+	c := ContractCommit{}
+	copy(c[:], commit[:HashSizeInContract])
+	return c
+}
+
+// Hash returns the commit padded with zeros to 32 bytes, as taken by DownloadFinished.
+func (c ContractCommit) Hash() common.Hash {
+	h := common.Hash{}
+	copy(h[:], c[:])
+	return h
+}
+
+// DownloadFinishedWithContractCommits This function is like DownloadFinished but takes the commits as kept by the
+// contract, so the callers sourcing them from the contract do not pad them to 32 bytes, which DownloadFinished
+// truncates silently. It returns ErrInvalidHashSize if the hash size set by SetHashSize is larger than
+// HashSizeInContract, as the metas would then keep more bytes than the contract commits carry.
+func (s *StorageManager) DownloadFinishedWithContractCommits(newL1 int64, kvIndices []uint64, blobs [][]byte, commits []ContractCommit) error {
+	if hashSize := s.HashSize(); hashSize > HashSizeInContract {
+		return fmt.Errorf("%w: %d bytes of the metas vs %d bytes of the contract commits", ErrInvalidHashSize, hashSize, HashSizeInContract)
+	}
+	hashes := make([]common.Hash, len(commits))
+	for i, c := range commits {
+		hashes[i] = c.Hash()
+	}
+	return s.DownloadFinished(newL1, kvIndices, blobs, hashes)
+}
@@ -6,6 +6,7 @@ package ethstorage
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"os"
 
@@ -27,6 +28,10 @@ const (
 	HEADER_SIZE = 4096
 )
 
+// ErrDataFileLocked is returned when a data file is opened while it is already open, e.g. by another es-node process
+// against the same data directory, whose writes would corrupt each other.
+var ErrDataFileLocked = errors.New("data file is locked by another open")
+
 // A DataFile represents a local file for a consecutive chunks
 type DataFile struct {
 	file          *os.File
@@ -74,6 +79,9 @@ func UnmaskDataInPlace(userData []byte, maskData []byte) []byte {
 	return maskData[:len(userData)]
 }
 
+// Create creates the data file, or truncates it if it exists. The file is locked with flock until it is closed, and
+// ErrDataFileLocked is returned if it is already open, which is best-effort and not checked on the platforms
+// without flock.
 func Create(filename string, chunkIdxStart, chunkIdxLen, epoch, maxKvSize, encodeType uint64, miner common.Address, chunkSize uint64) (*DataFile, error) {
 	if chunkSize > maxKvSize {
 		return nil, fmt.Errorf("chunkSize must be smaller than maxKvSize")
@@ -88,10 +96,19 @@ func Create(filename string, chunkIdxStart, chunkIdxLen, epoch, maxKvSize, encod
 		return nil, fmt.Errorf("chunkSize and maxKvSize must be 2^n")
 	}
 
-	file, err := os.Create(filename)
+	// lock the file before truncating it, so a file open elsewhere is never truncated
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0666)
 	if err != nil {
 		return nil, err
 	}
+	if err = lockFile(file); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if err = file.Truncate(0); err != nil {
+		file.Close()
+		return nil, err
+	}
 	// actual initialization is done when synchronize
 	err = fallocate.Fallocate(file, int64((chunkSize+32)*chunkIdxLen), int64(HEADER_SIZE))
 	if err != nil {
@@ -111,11 +128,16 @@ func Create(filename string, chunkIdxStart, chunkIdxLen, epoch, maxKvSize, encod
 	return dataFile, nil
 }
 
+// OpenDataFile opens the data file, which is locked like Create until it is closed.
 func OpenDataFile(filename string) (*DataFile, error) {
 	file, err := os.OpenFile(filename, os.O_RDWR, 0755)
 	if err != nil {
 		return nil, err
 	}
+	if err = lockFile(file); err != nil {
+		file.Close()
+		return nil, err
+	}
 	dataFile := &DataFile{
 		file: file,
 	}
@@ -150,6 +172,15 @@ func (df *DataFile) Miner() common.Address {
 	return df.miner
 }
 
+// SetMiner updates the storage provider address in the header of the data file.
+func (df *DataFile) SetMiner(miner common.Address) error {
+	df.miner = miner
+	if err := df.writeHeader(); err != nil {
+		return err
+	}
+	return df.file.Sync()
+}
+
 // Read raw chunk data from the storage file.
 func (df *DataFile) Read(chunkIdx uint64, len int) ([]byte, error) {
 	if !df.Contains(chunkIdx) {
@@ -352,7 +383,7 @@ func (df *DataFile) readHeader() error {
 
 func (df *DataFile) Close() error {
 	if df.file != nil {
-		if err := df.file.Close(); err != nil {
+		if err := df.file.Close(); err != nil && !errors.Is(err, os.ErrClosed) {
 			return fmt.Errorf("close data file %s error: %w", df.file.Name(), err)
 		}
 	}
@@ -0,0 +1,13 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+//go:build !unix
+
+package ethstorage
+
+import "os"
+
+// lockFile is a no-op on the platforms without flock, so the double-open of a data file is not detected there.
+func lockFile(file *os.File) error {
+	return nil
+}
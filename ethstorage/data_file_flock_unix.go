@@ -0,0 +1,23 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+//go:build unix
+
+package ethstorage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// lockFile takes an exclusive advisory lock (flock) of the file without blocking, which is released when the file
+// is closed. Return ErrDataFileLocked if the lock is held by another open of the file, e.g. by another process.
+func lockFile(file *os.File) error {
+	err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return fmt.Errorf("%w: %s", ErrDataFileLocked, file.Name())
+	}
+	return err
+}
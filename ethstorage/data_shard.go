@@ -5,8 +5,11 @@ package ethstorage
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"math/big"
+	"sync"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/crypto"
@@ -16,6 +19,9 @@ import (
 	"github.com/protolambda/go-kzg/eth"
 )
 
+// ErrNotOwned is returned when the kv is in a managed shard but out of the sub-range covered by its data files.
+var ErrNotOwned = errors.New("kv is not owned")
+
 // A DataShard is a logical shard that manages multiple DataFiles.
 // It also manages the encoding/decoding, translation from KV read/write to chunk read/write,
 // and sanity check of the data files.
@@ -26,6 +32,12 @@ type DataShard struct {
 	kvEntries   uint64
 	dataFiles   []*DataFile
 	chunkSize   uint64
+	// filesMu protects dataFiles against the readers without s.mu of StorageManager, e.g. ReadSampleUnlocked and
+	// PrewarmShard, while a data file is replaced by CompactShard or PromoteStaging
+	filesMu sync.RWMutex
+
+	sampleHasher SampleHasher // RawSampleHasher if nil
+	masks        *maskCache   // cache of the encoding masks for the decoding, disabled if nil
 }
 
 func NewDataShard(shardIdx uint64, kvSize uint64, kvEntries uint64, chunkSize uint64) *DataShard {
@@ -50,7 +62,9 @@ func (ds *DataShard) AddDataFile(df *DataFile) error {
 		}
 		// TODO: May check if not overlapped?
 	}
+	ds.filesMu.Lock()
 	ds.dataFiles = append(ds.dataFiles, df)
+	ds.filesMu.Unlock()
 	return nil
 }
 
@@ -94,6 +108,34 @@ func (ds *DataShard) Contains(kvIdx uint64) bool {
 	return kvIdx >= ds.shardIdx*ds.kvEntries && kvIdx < (ds.shardIdx+1)*ds.kvEntries
 }
 
+// Owns returns whether the kv is covered by the data files of the shard, which may cover only a sub-range of it.
+func (ds *DataShard) Owns(kvIdx uint64) bool {
+	for _, df := range ds.dataFiles {
+		if df.ContainsKv(kvIdx) {
+			return true
+		}
+	}
+	return false
+}
+
+// KvRange returns the range [start, end) of the kvs covered by the data files of the shard, which are expected to
+// be contiguous.
+func (ds *DataShard) KvRange() (uint64, uint64) {
+	if len(ds.dataFiles) == 0 {
+		return ds.shardIdx * ds.kvEntries, ds.shardIdx * ds.kvEntries
+	}
+	start, end := ds.dataFiles[0].KvIdxStart(), ds.dataFiles[0].KvIdxEnd()
+	for _, df := range ds.dataFiles[1:] {
+		if df.KvIdxStart() < start {
+			start = df.KvIdxStart()
+		}
+		if df.KvIdxEnd() > end {
+			end = df.KvIdxEnd()
+		}
+	}
+	return start, end
+}
+
 func (ds *DataShard) ContainsSample(sampleIdx uint64) bool {
 	return ds.Contains(sampleIdx * 32 / ds.kvSize)
 }
@@ -122,7 +164,7 @@ func (ds *DataShard) ReadChunkEncoded(kvIdx uint64, chunkIdx uint64) ([]byte, er
 func (ds *DataShard) ReadChunk(kvIdx uint64, chunkIdx uint64, commit common.Hash) ([]byte, error) {
 	return ds.readChunkWith(kvIdx, chunkIdx, func(cdata []byte, chunkIdx uint64) []byte {
 		encodeKey := calcEncodeKey(commit, chunkIdx, ds.dataFiles[0].miner)
-		return decodeChunk(ds.chunkSize, cdata, ds.dataFiles[0].encodeType, encodeKey)
+		return ds.masks.decode(ds.chunkSize, cdata, ds.dataFiles[0].encodeType, encodeKey)
 	})
 }
 
@@ -131,6 +173,9 @@ func (ds *DataShard) readChunkWith(kvIdx uint64, chunkIdx uint64, decoder func([
 	if !ds.Contains(kvIdx) {
 		return nil, fmt.Errorf("kv not found")
 	}
+	if !ds.Owns(kvIdx) {
+		return nil, fmt.Errorf("%w: kvIdx %d", ErrNotOwned, kvIdx)
+	}
 	if chunkIdx >= ds.chunksPerKv {
 		return nil, fmt.Errorf("chunkIdx out of range, chunkIdx： %d vs chunksPerKv %d", chunkIdx, ds.chunksPerKv)
 	}
@@ -154,7 +199,7 @@ func (ds *DataShard) ReadEncoded(kvIdx uint64, readLen int) ([]byte, error) {
 func (ds *DataShard) Read(kvIdx uint64, readLen int, commit common.Hash) ([]byte, error) {
 	bs, err := ds.readWith(kvIdx, int(ds.kvSize), func(cdata []byte, chunkIdx uint64) []byte {
 		encodeKey := calcEncodeKey(commit, chunkIdx, ds.dataFiles[0].miner)
-		return decodeChunk(ds.chunkSize, cdata, ds.dataFiles[0].encodeType, encodeKey)
+		return ds.masks.decode(ds.chunkSize, cdata, ds.dataFiles[0].encodeType, encodeKey)
 	})
 	if err != nil {
 		return nil, err
@@ -174,7 +219,7 @@ func (ds *DataShard) ReadWithMeta(kvIdx uint64, readLen int) ([]byte, []byte, er
 	}
 	bs, err := ds.readWith(kvIdx, int(ds.kvSize), func(cdata []byte, chunkIdx uint64) []byte {
 		encodeKey := calcEncodeKey(common.BytesToHash(commit), chunkIdx, ds.dataFiles[0].miner)
-		return decodeChunk(ds.chunkSize, cdata, ds.dataFiles[0].encodeType, encodeKey)
+		return ds.masks.decode(ds.chunkSize, cdata, ds.dataFiles[0].encodeType, encodeKey)
 	})
 	if err != nil {
 		return nil, nil, err
@@ -186,11 +231,55 @@ func (ds *DataShard) ReadWithMeta(kvIdx uint64, readLen int) ([]byte, []byte, er
 	return bs[0:readLen], commit, nil
 }
 
+// ReadTo read the encoded data in [offset, offset+length) of the kv from storage, decode it and write it to w chunk
+// by chunk, so that the whole blob is never buffered. Unlike Read, the data is not verified against the commit, as
+// the verification needs the whole blob.
+func (ds *DataShard) ReadTo(kvIdx uint64, w io.Writer, offset, length int, commit common.Hash) error {
+	if !ds.Contains(kvIdx) {
+		return fmt.Errorf("kv not found")
+	}
+	if !ds.Owns(kvIdx) {
+		return fmt.Errorf("%w: kvIdx %d", ErrNotOwned, kvIdx)
+	}
+	if offset < 0 || length < 0 || offset+length > int(ds.kvSize) {
+		return fmt.Errorf("read range out of kv size, offset %d length %d vs kvSize %d", offset, length, ds.kvSize)
+	}
+	end := offset + length
+	for i := uint64(offset) / ds.chunkSize; i < ds.chunksPerKv && int(i*ds.chunkSize) < end; i++ {
+		chunkStart := int(i * ds.chunkSize)
+		// the chunk is decoded from its start, as the mask of the decoding begins there
+		chunkReadLen := end - chunkStart
+		if chunkReadLen > int(ds.chunkSize) {
+			chunkReadLen = int(ds.chunkSize)
+		}
+
+		chunkIdx := kvIdx*ds.chunksPerKv + i
+		cdata, err := ds.readChunk(chunkIdx, chunkReadLen)
+		if err != nil {
+			return err
+		}
+		encodeKey := calcEncodeKey(commit, chunkIdx, ds.dataFiles[0].miner)
+		cdata = ds.masks.decode(ds.chunkSize, cdata, ds.dataFiles[0].encodeType, encodeKey)
+
+		skip := 0
+		if offset > chunkStart {
+			skip = offset - chunkStart
+		}
+		if _, err = w.Write(cdata[skip:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // readWith read the encoded data from storage with a decoder.
 func (ds *DataShard) readWith(kvIdx uint64, readLen int, decoder func([]byte, uint64) []byte) ([]byte, error) {
 	if !ds.Contains(kvIdx) {
 		return nil, fmt.Errorf("kv not found")
 	}
+	if !ds.Owns(kvIdx) {
+		return nil, fmt.Errorf("%w: kvIdx %d", ErrNotOwned, kvIdx)
+	}
 	if readLen > int(ds.kvSize) {
 		return nil, fmt.Errorf("read len too large")
 	}
@@ -219,7 +308,17 @@ func (ds *DataShard) readWith(kvIdx uint64, readLen int, decoder func([]byte, ui
 }
 
 func (ds *DataShard) ReadSample(sampleIdx uint64) (common.Hash, error) {
+	sample, err := ds.readRawSample(sampleIdx)
+	if err != nil || ds.sampleHasher == nil {
+		return sample, err
+	}
+	return ds.sampleHasher.HashSample(sampleIdx, sample.Bytes()), nil
+}
 
+// readRawSample reads the encoded data at the sample index without the SampleHasher applied.
+func (ds *DataShard) readRawSample(sampleIdx uint64) (common.Hash, error) {
+	ds.filesMu.RLock()
+	defer ds.filesMu.RUnlock()
 	for _, df := range ds.dataFiles {
 		if df.ContainsSample(sampleIdx) {
 			return df.ReadSample(sampleIdx)
@@ -334,6 +433,19 @@ func decodeChunk(chunkSize uint64, bs []byte, encodeType uint64, encodeKey commo
 
 var EmptyBlobCommit = make([]byte, HashSizeInContract)
 
+// blobVersionedHash computes the EIP-4844 versioned hash of the blob, i.e. 0x01 || sha256(kzg_commitment)[1:].
+func blobVersionedHash(blobData []byte) (common.Hash, error) {
+	// kzg blob
+	blob := kzg4844.Blob{}
+	copy(blob[:], blobData)
+	// Generate VersionedHash
+	commitment, err := kzg4844.BlobToCommitment(blob)
+	if err != nil {
+		return common.Hash{}, fmt.Errorf("could not convert blob to commitment: %v", err)
+	}
+	return common.Hash(eth.KZGToVersionedHash(eth.KZGCommitment(commitment))), nil
+}
+
 func checkCommit(commit common.Hash, blobData []byte) error {
 	// commit is empty 0x00..00
 	if bytes.Equal(commit[0:HashSizeInContract], EmptyBlobCommit) {
@@ -346,15 +458,10 @@ func checkCommit(commit common.Hash, blobData []byte) error {
 		return nil
 	}
 
-	// kzg blob
-	blob := kzg4844.Blob{}
-	copy(blob[:], blobData)
-	// Generate VersionedHash
-	commitment, err := kzg4844.BlobToCommitment(blob)
+	versionedHash, err := blobVersionedHash(blobData)
 	if err != nil {
-		return fmt.Errorf("could not convert blob to commitment: %v", err)
+		return err
 	}
-	versionedHash := eth.KZGToVersionedHash(eth.KZGCommitment(commitment))
 	// Get the hash and only take 24 bits
 	if !bytes.Equal(versionedHash[0:HashSizeInContract], commit[0:HashSizeInContract]) {
 		return fmt.Errorf("commit does not match")
@@ -367,6 +474,9 @@ func (ds *DataShard) WriteWith(kvIdx uint64, b []byte, commit common.Hash, encod
 	if !ds.Contains(kvIdx) {
 		return fmt.Errorf("kv not found")
 	}
+	if !ds.Owns(kvIdx) {
+		return fmt.Errorf("%w: kvIdx %d", ErrNotOwned, kvIdx)
+	}
 
 	if uint64(len(b)) > ds.kvSize {
 		return fmt.Errorf("write data too large")
@@ -419,7 +529,7 @@ func (ds *DataShard) WriteMeta(kvIdx uint64, b []byte) error {
 			return df.WriteMeta(kvIdx, b)
 		}
 	}
-	return fmt.Errorf("kv not found: the shard is not completed?")
+	return fmt.Errorf("%w: kvIdx %d", ErrNotOwned, kvIdx)
 }
 
 func (ds *DataShard) ReadMeta(kvIdx uint64) ([]byte, error) {
@@ -428,14 +538,47 @@ func (ds *DataShard) ReadMeta(kvIdx uint64) ([]byte, error) {
 			return df.ReadMeta(kvIdx)
 		}
 	}
-	return nil, fmt.Errorf("kv not found: the shard is not completed?")
+	return nil, fmt.Errorf("%w: kvIdx %d", ErrNotOwned, kvIdx)
 }
 
-func (ds *DataShard) Close() error {
+// SetMiner updates the storage provider address of the shard in all of its data files.
+// Note that the stored data is not re-encoded.
+func (ds *DataShard) SetMiner(miner common.Address) error {
 	for _, df := range ds.dataFiles {
-		if err := df.Close(); err != nil {
+		if err := df.SetMiner(miner); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sync commits the data files of the shard to stable storage.
+func (ds *DataShard) Sync() error {
+	for _, df := range ds.dataFiles {
+		if err := df.file.Sync(); err != nil {
 			return err
 		}
 	}
 	return nil
 }
+
+// Filenames returns the names of the data files of the shard.
+func (ds *DataShard) Filenames() []string {
+	names := make([]string, 0, len(ds.dataFiles))
+	for _, df := range ds.dataFiles {
+		names = append(names, df.file.Name())
+	}
+	return names
+}
+
+// Close closes all the data files of the shard, even if some of them fail to close, and returns the errors of those
+// failed. The files closed already are skipped, so a failed Close can be retried.
+func (ds *DataShard) Close() error {
+	var errs []error
+	for _, df := range ds.dataFiles {
+		if err := df.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,67 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// DefaultDiskFullRetry is how long the commits fail fast after the disk is found full, before one is let through to
+// check whether the space is freed.
+const DefaultDiskFullRetry = time.Minute
+
+var ErrDiskFull = errors.New("disk is full")
+
+// checkDiskWrite returns ErrDiskFull wrapping err if the write of the kv failed as the disk is full, and records the
+// disk as full, or records the disk as not full if the write succeeded. It is called by the write wrappers, which may
+// run in the workers of DownloadFinished, so the state is kept atomically instead of under s.mu.
+func (s *StorageManager) checkDiskWrite(kvIdx uint64, err error) error {
+	if err == nil {
+		if s.diskFullAt.Swap(0) != 0 {
+			log.Info("Disk space freed, the commits are resumed", "kvIdx", kvIdx)
+		}
+		return nil
+	}
+	if !errors.Is(err, syscall.ENOSPC) {
+		return err
+	}
+	if s.diskFullAt.Swap(s.Clock.Now().UnixNano()) == 0 {
+		log.Error("Disk is full, the commits fail fast until the space is freed", "kvIdx", kvIdx, "err", err)
+	}
+	return fmt.Errorf("%w: kvIdx %d: %w", ErrDiskFull, kvIdx, err)
+}
+
+// checkDiskFull returns ErrDiskFull if the disk was found full within DiskFullRetry, so that the commits fail fast
+// instead of encoding the blobs and failing the writes one by one. Once DiskFullRetry passes, the commits go on to
+// write again, and the disk is recorded as not full by the first write which succeeds, or full again by one failing.
+func (s *StorageManager) checkDiskFull() error {
+	fullAt := s.diskFullAt.Load()
+	if fullAt == 0 {
+		return nil
+	}
+	retry := s.DiskFullRetry
+	if retry == 0 {
+		retry = DefaultDiskFullRetry
+	}
+	since := time.Unix(0, fullAt)
+	if s.Clock.Now().Sub(since) >= retry {
+		return nil
+	}
+	return fmt.Errorf("%w: since %v", ErrDiskFull, since)
+}
+
+// DiskFull This function reports whether the last write to the shard files failed as the disk is full, and the time
+// it is last found full, e.g. for alerting. It is reported until a write succeeds after the space is freed.
+func (s *StorageManager) DiskFull() (bool, time.Time) {
+	fullAt := s.diskFullAt.Load()
+	if fullAt == 0 {
+		return false, time.Time{}
+	}
+	return true, time.Unix(0, fullAt)
+}
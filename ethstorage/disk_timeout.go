@@ -0,0 +1,212 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+var ErrStorageTimeout = errors.New("storage operation timed out")
+
+// diskIO runs the shard IO of fn, which must assign its results to the variables of the caller, with DiskTimeout.
+// If DiskTimeout is 0, fn is run directly. Otherwise fn runs in a goroutine, and ErrStorageTimeout is returned if it
+// does not finish in time, e.g. on a hung network mount, so that s.mu is released instead of freezing the node.
+// As the IO cannot be cancelled, it is left to finish in the background, and the caller must not read the results
+// of fn in that case. The goroutines of the hung IO accumulate until the disk recovers. The writes go through
+// diskWrite instead.
+func (s *StorageManager) diskIO(op string, kvIdx uint64, fn func()) error {
+	timeout := s.DiskTimeout
+	if timeout == 0 {
+		fn()
+		return nil
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fn()
+	}()
+	return waitIO(op, kvIdx, timeout, done)
+}
+
+// diskWrite runs the shard write of fn for the kv with DiskTimeout like diskIO. A write timed out may still land
+// later, so the kv is hung until it finishes in the background: the other writes of the kv are refused with
+// ErrStorageTimeout so that they never interleave with it, and its shard is reported as faulted by HealthStatus.
+// The background write is counted as an in-flight operation, so Close waits for it before closing the shard files
+// or returns ErrCloseTimeout. The caller must hold an in-flight operation registered by acquire.
+func (s *StorageManager) diskWrite(op string, kvIdx uint64, fn func()) error {
+	s.hungMu.Lock()
+	hung := s.hungWrites[kvIdx]
+	s.hungMu.Unlock()
+	if hung {
+		return fmt.Errorf("%w: %s kv %d while its timed out write is running", ErrStorageTimeout, op, kvIdx)
+	}
+	timeout := s.DiskTimeout
+	if timeout == 0 {
+		fn()
+		return nil
+	}
+
+	done := make(chan struct{})
+	// the counter of the in-flight operations is positive while the caller holds one, so it can be added to
+	s.ops.Add(1)
+	go func() {
+		defer s.ops.Done()
+		fn()
+		// done is closed under hungMu so that the kv is never marked hung after the write finishes
+		s.hungMu.Lock()
+		delete(s.hungWrites, kvIdx)
+		close(done)
+		s.hungMu.Unlock()
+	}()
+	err := waitIO(op, kvIdx, timeout, done)
+	if err != nil {
+		s.hungMu.Lock()
+		select {
+		case <-done:
+			err = nil
+		default:
+			s.hungWrites[kvIdx] = true
+		}
+		s.hungMu.Unlock()
+	}
+	return err
+}
+
+// hungShards returns the shards with the writes timed out by diskWrite still running in the background.
+func (s *StorageManager) hungShards() map[uint64]bool {
+	s.hungMu.Lock()
+	defer s.hungMu.Unlock()
+
+	shards := make(map[uint64]bool)
+	for kvIdx := range s.hungWrites {
+		shards[kvIdx/s.shardManager.kvEntries] = true
+	}
+	return shards
+}
+
+func waitIO(op string, kvIdx uint64, timeout time.Duration, done <-chan struct{}) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return nil
+	case <-timer.C:
+		log.Error("Storage operation timed out", "op", op, "kvIdx", kvIdx, "timeout", timeout)
+		return fmt.Errorf("%w: %s kv %d after %v", ErrStorageTimeout, op, kvIdx, timeout)
+	}
+}
+
+// The wrappers below run the shard IO with DiskTimeout. On timeout they return ErrStorageTimeout with success as
+// true, as the kv is managed by the shards.
+
+func (s *StorageManager) tryReadMeta(kvIdx uint64) ([]byte, bool, error) {
+	var (
+		meta    []byte
+		success bool
+		err     error
+	)
+	if ioErr := s.diskIO("read meta", kvIdx, func() {
+		meta, success, err = s.shardManager.TryReadMeta(kvIdx)
+	}); ioErr != nil {
+		return nil, true, ioErr
+	}
+	return meta, success, err
+}
+
+func (s *StorageManager) tryRead(kvIdx uint64, readLen int, commit common.Hash) ([]byte, bool, error) {
+	var (
+		data    []byte
+		success bool
+		err     error
+	)
+	if ioErr := s.diskIO("read", kvIdx, func() {
+		data, success, err = s.shardManager.TryRead(kvIdx, readLen, commit)
+	}); ioErr != nil {
+		return nil, true, ioErr
+	}
+	return data, success, err
+}
+
+func (s *StorageManager) tryReadEncoded(kvIdx uint64, readLen int) ([]byte, bool, error) {
+	var (
+		data    []byte
+		success bool
+		err     error
+	)
+	if ioErr := s.diskIO("read encoded", kvIdx, func() {
+		data, success, err = s.shardManager.TryReadEncoded(kvIdx, readLen)
+	}); ioErr != nil {
+		return nil, true, ioErr
+	}
+	return data, success, err
+}
+
+func (s *StorageManager) tryReadWithMeta(kvIdx uint64, readLen int) ([]byte, []byte, bool, error) {
+	var (
+		data    []byte
+		meta    []byte
+		success bool
+		err     error
+	)
+	if ioErr := s.diskIO("read", kvIdx, func() {
+		data, meta, success, err = s.shardManager.TryReadWithMeta(kvIdx, readLen)
+	}); ioErr != nil {
+		return nil, nil, true, ioErr
+	}
+	return data, meta, success, err
+}
+
+func (s *StorageManager) tryWrite(kvIdx uint64, blob []byte, commit common.Hash) (bool, error) {
+	var (
+		managed bool
+		err     error
+	)
+	// the staging shard is looked up under s.mu, as fn may run after it is released on timeout
+	staged := s.stagedShard(kvIdx)
+	if ioErr := s.diskWrite("write", kvIdx, func() {
+		defer recoverWritePanic(kvIdx, &err)
+		if staged != nil {
+			if managed = staged.Owns(kvIdx); managed {
+				err = staged.Write(kvIdx, blob, commit)
+			}
+			return
+		}
+		managed, err = s.shardManager.TryWrite(kvIdx, blob, commit)
+	}); ioErr != nil {
+		return true, ioErr
+	}
+	if managed {
+		err = s.checkDiskWrite(kvIdx, err)
+	}
+	return managed, err
+}
+
+func (s *StorageManager) tryWriteEncoded(kvIdx uint64, encodedBlob []byte, commit common.Hash) (bool, error) {
+	var (
+		success bool
+		err     error
+	)
+	staged := s.stagedShard(kvIdx)
+	if ioErr := s.diskWrite("write encoded", kvIdx, func() {
+		if staged != nil {
+			success, err = true, staged.WriteWith(kvIdx, encodedBlob, commit, func(cdata []byte, chunkIdx uint64) []byte {
+				return cdata
+			})
+			return
+		}
+		success, err = s.shardManager.TryWriteEncoded(kvIdx, encodedBlob, commit)
+	}); ioErr != nil {
+		return true, ioErr
+	}
+	if success {
+		err = s.checkDiskWrite(kvIdx, err)
+	}
+	return success, err
+}
@@ -7,4 +7,5 @@ type Config struct {
 	DownloadStart     int64  // which block should we download the blobs from
 	DownloadDump      string // where to dump the download blobs
 	DownloadThreadNum int    // how many threads that will be used to download the blobs into storage file
+	MaxInFlightBytes  uint64 // max total size of the blobs being written into storage file at the same time, 0 for unlimited
 }
@@ -110,8 +110,16 @@ func NewDownloader(
 func (s *Downloader) Start() error {
 	// user does NOT specify a download start in the flag
 	if s.lastDownloadBlock == 0 {
+		// the L1 checkpoint is only written once the blobs are synced to the disk, so it is preferred to the database
+		ckpt, ok, ckptErr := s.sm.ReadL1Checkpoint()
+		if ckptErr != nil {
+			s.log.Warn("Read L1 checkpoint failed", "err", ckptErr)
+		}
 		bs, err := s.db.Get(append(downloaderPrefix, lastDownloadKey...))
-		if err != nil {
+		if ok {
+			s.lastDownloadBlock = ckpt.L1
+			s.log.Info("Downloader will use the L1 checkpoint to start", "block", s.lastDownloadBlock)
+		} else if err != nil {
 			// first-time start
 			header, err := s.l1Source.HeaderByNumber(context.Background(), big.NewInt(rpc.FinalizedBlockNumber.Int64()))
 			if err != nil {
@@ -0,0 +1,142 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// DefaultL1SourceTimeout is how long FailoverL1Source waits for a backend before trying the next one.
+const DefaultL1SourceTimeout = 10 * time.Second
+
+var errL1SourceTimeout = errors.New("l1 source request timeout")
+
+// FailoverL1Source is an Il1Source which sends the requests to multiple L1 backends, e.g. RPC endpoints of
+// different providers, and fails over to the next backend if one fails or times out. The backend which succeeded
+// last is taken as healthy and tried first by the following requests.
+type FailoverL1Source struct {
+	backends []Il1Source
+	timeout  time.Duration
+
+	mu        sync.Mutex
+	preferred int // index of the backend succeeded last
+}
+
+var _ Il1Source = (*FailoverL1Source)(nil)
+
+// NewFailoverL1Source creates a FailoverL1Source trying the backends in order with the timeout for each of them.
+// DefaultL1SourceTimeout is used if timeout is 0.
+func NewFailoverL1Source(timeout time.Duration, backends ...Il1Source) (*FailoverL1Source, error) {
+	if len(backends) == 0 {
+		return nil, errors.New("no l1 source backend")
+	}
+	if timeout == 0 {
+		timeout = DefaultL1SourceTimeout
+	}
+	return &FailoverL1Source{backends: backends, timeout: timeout}, nil
+}
+
+// Preferred returns the index of the backend which will be tried first.
+func (f *FailoverL1Source) Preferred() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.preferred
+}
+
+// try calls the request with each backend, starting from the preferred one, until one of them succeeds.
+// The request should return once ctx is done; requests unable to be cancelled are run by callWithTimeout.
+func (f *FailoverL1Source) try(ctx context.Context, method string, request func(ctx context.Context, backend Il1Source) error) error {
+	start := f.Preferred()
+	var errs []error
+	for i := 0; i < len(f.backends); i++ {
+		idx := (start + i) % len(f.backends)
+		tctx, cancel := context.WithTimeout(ctx, f.timeout)
+		err := request(tctx, f.backends[idx])
+		cancel()
+		if err == nil {
+			if idx != start {
+				f.mu.Lock()
+				f.preferred = idx
+				f.mu.Unlock()
+				log.Info("L1 source failed over", "method", method, "from", start, "to", idx)
+			}
+			return nil
+		}
+		log.Warn("L1 source request failed", "method", method, "backend", idx, "err", err)
+		errs = append(errs, fmt.Errorf("backend %d: %w", idx, err))
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return fmt.Errorf("all l1 source backends failed: %w", errors.Join(errs...))
+}
+
+// callWithTimeout runs the request which cannot be cancelled in a goroutine, and returns errL1SourceTimeout if it
+// does not finish before ctx is done. The request is left to finish in the background in that case.
+func callWithTimeout[T any](ctx context.Context, request func() (T, error)) (T, error) {
+	type result struct {
+		val T
+		err error
+	}
+	res := make(chan result, 1)
+	go func() {
+		val, err := request()
+		res <- result{val, err}
+	}()
+	select {
+	case r := <-res:
+		return r.val, r.err
+	case <-ctx.Done():
+		var zero T
+		return zero, fmt.Errorf("%w: %v", errL1SourceTimeout, ctx.Err())
+	}
+}
+
+func (f *FailoverL1Source) GetKvMetas(kvIndices []uint64, blockNumber int64) ([][32]byte, error) {
+	var metas [][32]byte
+	err := f.try(context.Background(), "GetKvMetas", func(ctx context.Context, backend Il1Source) error {
+		m, err := callWithTimeout(ctx, func() ([][32]byte, error) {
+			return backend.GetKvMetas(kvIndices, blockNumber)
+		})
+		if err == nil {
+			metas = m
+		}
+		return err
+	})
+	return metas, err
+}
+
+func (f *FailoverL1Source) GetStorageLastBlobIdx(blockNumber int64) (uint64, error) {
+	var lastBlobIdx uint64
+	err := f.try(context.Background(), "GetStorageLastBlobIdx", func(ctx context.Context, backend Il1Source) error {
+		idx, err := callWithTimeout(ctx, func() (uint64, error) {
+			return backend.GetStorageLastBlobIdx(blockNumber)
+		})
+		if err == nil {
+			lastBlobIdx = idx
+		}
+		return err
+	})
+	return lastBlobIdx, err
+}
+
+func (f *FailoverL1Source) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	var header *types.Header
+	err := f.try(ctx, "HeaderByNumber", func(ctx context.Context, backend Il1Source) error {
+		h, err := backend.HeaderByNumber(ctx, number)
+		if err == nil {
+			header = h
+		}
+		return err
+	})
+	return header, err
+}
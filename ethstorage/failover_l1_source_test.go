@@ -0,0 +1,101 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// flakyL1Source fails or hangs when down, and counts the requests it receives.
+type flakyL1Source struct {
+	lastBlobIdx uint64
+	down        atomic.Bool
+	hang        bool
+	calls       atomic.Int64
+}
+
+func (l1 *flakyL1Source) check() error {
+	l1.calls.Add(1)
+	if !l1.down.Load() {
+		return nil
+	}
+	if l1.hang {
+		time.Sleep(time.Second)
+	}
+	return errors.New("backend down")
+}
+
+func (l1 *flakyL1Source) GetKvMetas(kvIndices []uint64, blockNumber int64) ([][32]byte, error) {
+	if err := l1.check(); err != nil {
+		return nil, err
+	}
+	return make([][32]byte, len(kvIndices)), nil
+}
+
+func (l1 *flakyL1Source) GetStorageLastBlobIdx(blockNumber int64) (uint64, error) {
+	if err := l1.check(); err != nil {
+		return 0, err
+	}
+	return l1.lastBlobIdx, nil
+}
+
+func (l1 *flakyL1Source) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	if err := l1.check(); err != nil {
+		return nil, err
+	}
+	return &types.Header{Number: new(big.Int).Set(number)}, nil
+}
+
+func TestFailoverL1Source(t *testing.T) {
+	first, second := &flakyL1Source{lastBlobIdx: 1, hang: true}, &flakyL1Source{lastBlobIdx: 2}
+	f, err := NewFailoverL1Source(100*time.Millisecond, first, second)
+	if err != nil {
+		t.Fatal("failed to create failover l1 source", err)
+	}
+
+	if idx, err := f.GetStorageLastBlobIdx(1); err != nil || idx != 1 {
+		t.Fatal("unexpected last blob index", idx, err)
+	}
+
+	// the hanging backend times out and the second one is preferred from then on
+	first.down.Store(true)
+	if idx, err := f.GetStorageLastBlobIdx(1); err != nil || idx != 2 {
+		t.Fatal("unexpected last blob index after failover", idx, err)
+	}
+	if f.Preferred() != 1 {
+		t.Fatal("the healthy backend should be preferred", f.Preferred())
+	}
+	calls := first.calls.Load()
+	if metas, err := f.GetKvMetas([]uint64{1, 2}, 1); err != nil || len(metas) != 2 {
+		t.Fatal("unexpected metas", metas, err)
+	}
+	if header, err := f.HeaderByNumber(context.Background(), big.NewInt(3)); err != nil || header.Number.Int64() != 3 {
+		t.Fatal("unexpected header", header, err)
+	}
+	if first.calls.Load() != calls {
+		t.Fatal("the failed backend should not be tried while the preferred one is healthy")
+	}
+
+	// fail back to the first backend
+	first.down.Store(false)
+	second.down.Store(true)
+	if idx, err := f.GetStorageLastBlobIdx(1); err != nil || idx != 1 || f.Preferred() != 0 {
+		t.Fatal("unexpected last blob index after failing back", idx, err)
+	}
+
+	first.down.Store(true)
+	if _, err := f.GetStorageLastBlobIdx(1); err == nil {
+		t.Fatal("request should fail when all the backends are down")
+	}
+	if _, err := NewFailoverL1Source(0); err == nil {
+		t.Fatal("creating failover l1 source without backends should fail")
+	}
+}
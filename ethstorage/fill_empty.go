@@ -0,0 +1,172 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// FillStopReason tells why FillEmptyRange stopped.
+type FillStopReason string
+
+const (
+	// FillReachedLimit means the blobs up to the limit are all processed, i.e. filled or skipped.
+	FillReachedLimit FillStopReason = "reached limit"
+	// FillEncodeFailed means the empty blob at NextIndex failed to encode.
+	FillEncodeFailed FillStopReason = "encode failed"
+	// FillWriteFailed means the empty blob at NextIndex failed to write, e.g. as the disk is full.
+	FillWriteFailed FillStopReason = "write failed"
+)
+
+// FillResult is the result of FillEmptyRange.
+type FillResult struct {
+	Inserted uint64 // number of the empty blobs written
+	// number of the blobs skipped as they are not empty, i.e. the contract has a blob other than the empty one, or
+	// they are not owned, which do not stop the fill
+	Skipped       uint64
+	NextIndex     uint64         // the first kvIdx not processed, from which the fill goes on
+	StoppedReason FillStopReason // empty if the fill did not start, e.g. as the metas cannot be got
+	Err           error          // the error of the blob at NextIndex if it failed to encode or write
+}
+
+const (
+	// emptyFillBatchSize is the number of blobs filled by one CommitEmptyBlobs call of FillEmptyBlobs, which bounds
+	// the memory of the encoded blobs held by each worker
+	emptyFillBatchSize = 64
+	// emptyFillProgressInterval is the number of blobs processed between two progress reports of FillEmptyBlobs
+	emptyFillProgressInterval = 4096
+)
+
+// FillEmptyBlobs This function fills the empty blobs between start and limit (include limit) by CommitEmptyBlobs,
+// with the range split into batches that are filled by up to workers goroutines in parallel. If progress is not nil,
+// it is called with the number of blobs processed so far every emptyFillProgressInterval blobs and once the range
+// is done, where the blobs that are not empty or not owned count as processed as CommitEmptyBlobs skips them. The
+// calls are serialized, and the reported number never decreases nor exceeds total, i.e. limit - start + 1.
+// Return the number of blobs inserted, and the first error of the workers or ctx.Err() if ctx is cancelled.
+func (s *StorageManager) FillEmptyBlobs(ctx context.Context, start, limit uint64, workers int,
+	progress func(filled, total uint64)) (uint64, error) {
+	if limit < start {
+		return 0, nil
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	var (
+		total     = limit - start + 1
+		inserted  atomic.Uint64
+		processed atomic.Uint64
+		batches   = make(chan uint64)
+		wg        sync.WaitGroup
+		errOnce   sync.Once
+		fillErr   error
+	)
+	ctx2, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	report := newFillProgress(total, progress)
+	fail := func(err error) {
+		errOnce.Do(func() {
+			fillErr = err
+			cancel()
+		})
+	}
+
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for from := range batches {
+				to := from + emptyFillBatchSize - 1
+				if to > limit || to < from {
+					to = limit
+				}
+				// FillEmptyRange stops at the first blob failed to encode or commit, so retry from there
+				for next := from; next <= to; {
+					r, err := s.FillEmptyRange(next, to)
+					inserted.Add(r.Inserted)
+					if err != nil {
+						fail(err)
+						return
+					}
+					if r.NextIndex <= next {
+						fail(fmt.Errorf("fill empty blobs stalled at kvIdx %d, %s: %v", next, r.StoppedReason, r.Err))
+						return
+					}
+					report.add(processed.Add(r.NextIndex - next))
+					next = r.NextIndex
+				}
+			}
+		}()
+	}
+
+feed:
+	for from := start; ; from += emptyFillBatchSize {
+		select {
+		case batches <- from:
+		case <-ctx2.Done():
+			break feed
+		}
+		if limit-from < emptyFillBatchSize {
+			break
+		}
+	}
+	close(batches)
+	wg.Wait()
+
+	if fillErr != nil {
+		return inserted.Load(), fillErr
+	}
+	if err := ctx.Err(); err != nil {
+		return inserted.Load(), err
+	}
+	report.done()
+	return inserted.Load(), nil
+}
+
+// fillProgress reports the progress aggregated from the workers of FillEmptyBlobs.
+type fillProgress struct {
+	total    uint64
+	callback func(filled, total uint64)
+
+	mu       sync.Mutex
+	reported uint64 // the last reported number
+}
+
+func newFillProgress(total uint64, callback func(filled, total uint64)) *fillProgress {
+	return &fillProgress{total: total, callback: callback}
+}
+
+// add reports the aggregated processed number if it crossed an emptyFillProgressInterval boundary since the last
+// report. As the workers add concurrently, an older number may arrive later, so it is only reported if it increased.
+func (p *fillProgress) add(processed uint64) {
+	if p.callback == nil {
+		return
+	}
+	if processed > p.total {
+		processed = p.total
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if processed/emptyFillProgressInterval > p.reported/emptyFillProgressInterval {
+		p.reported = processed
+		p.callback(processed, p.total)
+	}
+}
+
+// done reports the total once the whole range is processed.
+func (p *fillProgress) done() {
+	if p.callback == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.reported < p.total {
+		p.reported = p.total
+		p.callback(p.total, p.total)
+	}
+}
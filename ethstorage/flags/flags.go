@@ -129,6 +129,12 @@ var (
 		Value:  1,
 		EnvVar: prefixEnvVar("DOWNLOAD_THREAD"),
 	}
+	DownloadMaxInFlightBytes = cli.Uint64Flag{
+		Name:   "download.max-inflight-bytes",
+		Usage:  "Max total size in bytes of the blobs being written into storage files at the same time, 0 for unlimited",
+		Value:  0,
+		EnvVar: prefixEnvVar("DOWNLOAD_MAX_INFLIGHT_BYTES"),
+	}
 	DownloadDump = cli.StringFlag{
 		Name:   "download.dump",
 		Usage:  "Where to dump the downloaded blobs",
@@ -172,6 +178,97 @@ var (
 		Value:  0,
 		EnvVar: prefixEnvVar("STORAGE_KV_ENTRIES"),
 	}
+	StorageVerifyOnStart = cli.BoolFlag{
+		Name:   "storage.verify-on-start",
+		Usage:  "Verify the blobs of the shards on start to find the torn ones and resync them, which reads the whole shards",
+		EnvVar: prefixEnvVar("STORAGE_VERIFY_ON_START"),
+	}
+	StorageMetaConfirmations = cli.Uint64Flag{
+		Name:   "storage.meta-confirmations",
+		Usage:  "Number of blocks behind the finalized L1 view at which the blob metadata is downloaded, to reduce the exposure to reorgs",
+		Value:  0,
+		EnvVar: prefixEnvVar("STORAGE_META_CONFIRMATIONS"),
+	}
+	StorageMetaBatchMin = cli.Uint64Flag{
+		Name:   "storage.meta-batch-min",
+		Usage:  "Min batch size of the blob metadata download, from which the batch size starts to adapt to the L1 RPC if storage.meta-batch-max is set",
+		Value:  100,
+		EnvVar: prefixEnvVar("STORAGE_META_BATCH_MIN"),
+	}
+	StorageMetaBatchMax = cli.Uint64Flag{
+		Name:   "storage.meta-batch-max",
+		Usage:  "Max batch size of the blob metadata download, up to which the batch size grows while the L1 RPC responds fast, and shrinks on its failures. The batch size is fixed to p2p.meta.download.batch if 0.",
+		Value:  0,
+		EnvVar: prefixEnvVar("STORAGE_META_BATCH_MAX"),
+	}
+	StorageDownloadBatchMax = cli.IntFlag{
+		Name:   "storage.download-batch-max",
+		Usage:  "Max number of the downloaded blobs written under one hold of the storage lock, with the lock released between the sub-batches of a larger batch so the reads are not blocked for long, e.g. after a long downtime. Unlimited if 0.",
+		Value:  0,
+		EnvVar: prefixEnvVar("STORAGE_DOWNLOAD_BATCH_MAX"),
+	}
+	StorageMetaBandwidth = cli.Uint64Flag{
+		Name:   "storage.meta-bandwidth",
+		Usage:  "Max bytes per second of the blob metadata download shared by all the download threads, estimated as 32 bytes per blob, to keep it from saturating a shared L1 RPC. Unlimited if 0.",
+		Value:  0,
+		EnvVar: prefixEnvVar("STORAGE_META_BANDWIDTH"),
+	}
+	StorageMetaCheckpoint = cli.BoolFlag{
+		Name:   "storage.meta-checkpoint",
+		Usage:  "Checkpoint the blob metadata download in the data directory, so that it resumes from the checkpoint after a restart",
+		EnvVar: prefixEnvVar("STORAGE_META_CHECKPOINT"),
+	}
+	StorageL1Checkpoint = cli.BoolFlag{
+		Name:   "storage.l1-checkpoint",
+		Usage:  "Checkpoint the L1 block of the blobs downloaded in the data directory after the blobs are synced to the disk, so that a restart resumes the download from the checkpoint",
+		EnvVar: prefixEnvVar("STORAGE_L1_CHECKPOINT"),
+	}
+	StorageMaskCacheSize = cli.IntFlag{
+		Name:   "storage.mask-cache",
+		Usage:  "Max number of the encoding masks of the chunks cached to speed up the repeated reads of the same blobs, each taking the chunk size of memory. Disabled if 0.",
+		Value:  0,
+		EnvVar: prefixEnvVar("STORAGE_MASK_CACHE"),
+	}
+	StorageDiskTimeout = cli.DurationFlag{
+		Name:   "storage.disk-timeout",
+		Usage:  "Timeout of each read or write of the storage files, e.g. on a network mount, after which it fails instead of blocking the node. Disabled if 0.",
+		Value:  0,
+		EnvVar: prefixEnvVar("STORAGE_DISK_TIMEOUT"),
+	}
+	StorageDiskFullRetry = cli.DurationFlag{
+		Name:   "storage.disk-full-retry",
+		Usage:  "How long the commits fail fast after a write to the storage files fails as the disk is full, before the writes are tried again. The default 1m if 0.",
+		Value:  0,
+		EnvVar: prefixEnvVar("STORAGE_DISK_FULL_RETRY"),
+	}
+	StorageHashSize = cli.IntFlag{
+		Name:   "storage.hash-size",
+		Usage:  "Number of bytes of the blob commit stored by the storage contract of the deployment, between 24 and 27. The default 24 if 0.",
+		Value:  0,
+		EnvVar: prefixEnvVar("STORAGE_HASH_SIZE"),
+		Hidden: true,
+	}
+	StorageLogLevels = cli.StringFlag{
+		Name:   "storage.log-levels",
+		Usage:  "Comma separated log levels of the storage subsystems (meta, commit) as subsystem=level, e.g. meta=warn to quiet the per batch logs of the metadata download. Errors are always output.",
+		EnvVar: prefixEnvVar("STORAGE_LOG_LEVELS"),
+	}
+	StoragePrewarm = cli.BoolFlag{
+		Name:   "storage.prewarm",
+		Usage:  "Read the storage files in the background on start to populate the OS page cache, for nodes serving frequent reads",
+		EnvVar: prefixEnvVar("STORAGE_PREWARM"),
+	}
+	StorageMetaIndexOnDisk = cli.BoolFlag{
+		Name:   "storage.meta-index-on-disk",
+		Usage:  "Keep the metas downloaded from the contract in the database instead of in memory, for nodes with many shards",
+		EnvVar: prefixEnvVar("STORAGE_META_INDEX_ON_DISK"),
+	}
+	StorageCommitThreadNum = cli.IntFlag{
+		Name:   "storage.commit-thread",
+		Usage:  "Threads number that will be used to encode the blobs synced from the peers, independent of download.thread",
+		Value:  1,
+		EnvVar: prefixEnvVar("STORAGE_COMMIT_THREAD"),
+	}
 	L1EpochPollIntervalFlag = cli.DurationFlag{
 		Name:   "l1.epoch-poll-interval",
 		Usage:  "Poll interval for retrieving new L1 epoch updates such as safe and finalized block changes. Disabled if 0 or negative.",
@@ -226,11 +323,28 @@ var optionalFlags = []cli.Flag{
 	PprofPortFlag,
 	DownloadStart,
 	DownloadThreadNum,
+	DownloadMaxInFlightBytes,
 	DownloadDump,
 	L1EpochPollIntervalFlag,
 	StorageKvSize,
 	StorageChunkSize,
 	StorageKvEntries,
+	StorageVerifyOnStart,
+	StorageMetaConfirmations,
+	StorageMetaBatchMin,
+	StorageMetaBatchMax,
+	StorageDownloadBatchMax,
+	StorageMetaBandwidth,
+	StorageMetaCheckpoint,
+	StorageL1Checkpoint,
+	StorageMaskCacheSize,
+	StorageDiskTimeout,
+	StorageDiskFullRetry,
+	StorageHashSize,
+	StorageLogLevels,
+	StoragePrewarm,
+	StorageCommitThreadNum,
+	StorageMetaIndexOnDisk,
 	RPCListenAddr,
 	RPCListenPort,
 	RPCESCallURL,
@@ -0,0 +1,87 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// maxHashSizeInContract is the max size of the commit kept in a meta, as the kvIdx takes the first 5 bytes of the
+// contract meta and the filling bit takes one byte of the local meta.
+const maxHashSizeInContract = 27
+
+var ErrInvalidHashSize = errors.New("invalid hash size")
+
+// SetHashSize This function sets the number of bytes of the commit stored by the contract of the deployment, which is
+// compared with the local metas and followed by the filling bit in them. As the encoding key and the commit check of
+// the data shards only take the first HashSizeInContract bytes, the size must be in [HashSizeInContract, 27].
+// It should be called before the storage files are written, as the metas written with another size are not readable.
+func (s *StorageManager) SetHashSize(size int) error {
+	if size < HashSizeInContract || size > maxHashSizeInContract {
+		return fmt.Errorf("%w: %d not in [%d, %d]", ErrInvalidHashSize, size, HashSizeInContract, maxHashSizeInContract)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hashSizeInContract = size
+	return nil
+}
+
+// HashSize returns the number of bytes of the commit stored by the contract, HashSizeInContract by default.
+func (s *StorageManager) HashSize() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.hashSize()
+}
+
+// hashSize returns the configured hash size, or HashSizeInContract if it is not set. The caller must hold s.mu.
+func (s *StorageManager) hashSize() int {
+	if s.hashSizeInContract == 0 {
+		return HashSizeInContract
+	}
+	return s.hashSizeInContract
+}
+
+// prepareCommit returns the local meta of the commit with the configured hash size.
+func (s *StorageManager) prepareCommit(commit common.Hash) common.Hash {
+	return prepareCommitN(commit, s.hashSize())
+}
+
+// isFilled returns whether the filling bit of the local meta with the configured hash size is set.
+func (s *StorageManager) isFilled(meta common.Hash) bool {
+	return isFilledN(meta, s.hashSize())
+}
+
+// isEmptyFilled returns whether the local meta with the configured hash size is of a blob filled with empty data.
+func (s *StorageManager) isEmptyFilled(meta common.Hash) bool {
+	return isEmptyFilledN(meta, s.hashSize())
+}
+
+// isUnsynced returns whether the local meta with the configured hash size is of a blob not filled yet.
+func (s *StorageManager) isUnsynced(meta common.Hash) bool {
+	return !isFilledN(meta, s.hashSize())
+}
+
+func prepareCommitN(commit common.Hash, size int) common.Hash {
+	c := common.Hash{}
+	copy(c[0:size], commit[0:size])
+
+	// The first bit after data hash in the meta indicate whether this blob has been filled. 0 stands for NOT filled yet.
+	// We want to make sure this bit to be 1 when filling data
+	c[size] = c[size] | blobFillingMask
+
+	return c
+}
+
+func isFilledN(meta common.Hash, size int) bool {
+	return meta[size]&blobFillingMask != 0
+}
+
+// isEmptyFilledN returns whether the meta is exactly the local meta of the empty commit with the hash size, so a
+// meta with any other bit set, e.g. of a non-empty commit, is not taken as empty.
+func isEmptyFilledN(meta common.Hash, size int) bool {
+	return meta == prepareCommitN(common.Hash{}, size)
+}
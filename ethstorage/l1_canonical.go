@@ -0,0 +1,49 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"context"
+	"errors"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+var ErrL1HashUnknown = errors.New("hash of local L1 is unknown")
+
+// fetchL1Hash returns the hash of the L1 block to record with localL1, or the zero hash if the header fails to be
+// fetched, which is only logged so that the L1 view can still advance.
+func (s *StorageManager) fetchL1Hash(number int64) common.Hash {
+	header, err := s.getL1Source().HeaderByNumber(context.Background(), big.NewInt(number))
+	if err != nil {
+		log.Warn("Fetch header of local L1 failed", "number", number, "err", err)
+		return common.Hash{}
+	}
+	return header.Hash()
+}
+
+// VerifyL1Canonical This function fetches the header of localL1 and compares its hash against the one recorded when
+// localL1 was set by Reset or DownloadFinished, to detect a reorg of the local L1 view. It returns false if they
+// differ, so that the caller can recover, e.g. by Reset to a canonical block and downloading the metas again.
+// Return ErrL1HashUnknown if the hash could not be recorded when localL1 was set.
+func (s *StorageManager) VerifyL1Canonical(ctx context.Context) (bool, error) {
+	s.mu.Lock()
+	localL1, hash := s.localL1, s.localL1Hash
+	s.mu.Unlock()
+
+	if hash == (common.Hash{}) {
+		return false, ErrL1HashUnknown
+	}
+	header, err := s.getL1Source().HeaderByNumber(ctx, big.NewInt(localL1))
+	if err != nil {
+		return false, err
+	}
+	if header.Hash() != hash {
+		log.Warn("Local L1 is not canonical", "number", localL1, "local", hash, "canonical", header.Hash())
+		return false, nil
+	}
+	return true, nil
+}
@@ -0,0 +1,143 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// L1Checkpoint records the local L1 view reached by DownloadFinished, from which a restart resumes.
+type L1Checkpoint struct {
+	L1         int64       `json:"l1"`         // localL1 after the batch, whose blobs are all written and synced
+	L1Hash     common.Hash `json:"l1Hash"`     // hash of the L1 block, zero if it could not be fetched
+	LastKvIdx  uint64      `json:"lastKvIdx"`  // the lastKvIdx of the contract at L1
+	FilledNext uint64      `json:"filledNext"` // the highest kvIdx written by DownloadFinished + 1, 0 if none
+}
+
+// checkpointL1 writes the L1Checkpoint of the local L1 view to L1CheckpointFile after DownloadFinished wrote the
+// blobs of the written kvs, which is disabled if L1CheckpointFile is empty. The data files of the shards written are synced
+// first, so the checkpoint never claims the progress of the blobs not on the disk, then the checkpoint is written to
+// a temp file, synced, renamed over the last one and the directory synced, so a crash at any point leaves either the
+// last checkpoint or the new one. The checkpoint is best-effort, as the batch is already committed, so the failure
+// is only logged and a restart resumes from the last one. The caller must hold s.mu.
+func (s *StorageManager) checkpointL1(written []uint64) {
+	if s.L1CheckpointFile == "" {
+		return
+	}
+	shards := make(map[uint64]struct{})
+	for _, kvIdx := range written {
+		shards[kvIdx/s.shardManager.kvEntries] = struct{}{}
+		if kvIdx+1 > s.filledNext {
+			s.filledNext = kvIdx + 1
+		}
+	}
+	for shardIdx := range shards {
+		if err := s.syncShard(shardIdx); err != nil {
+			metaLog.Warn("Sync shard for L1 checkpoint failed", "shard", shardIdx, "err", err)
+			return
+		}
+	}
+	ckpt := L1Checkpoint{L1: s.localL1, L1Hash: s.localL1Hash, LastKvIdx: s.lastKvIdx, FilledNext: s.filledNext}
+	if err := writeJSONSynced(s.L1CheckpointFile, &ckpt); err != nil {
+		metaLog.Warn("Write L1 checkpoint failed", "file", s.L1CheckpointFile, "err", err)
+		return
+	}
+	metaLog.Debug("L1 checkpoint written", "l1", ckpt.L1, "lastKvIdx", ckpt.LastKvIdx, "filledNext", ckpt.FilledNext)
+}
+
+// syncShard syncs the data files of the shard, and its staging copy if any. The caller must hold s.mu.
+func (s *StorageManager) syncShard(shardIdx uint64) error {
+	if staged := s.staging[shardIdx]; staged != nil {
+		if err := staged.Sync(); err != nil {
+			return err
+		}
+	}
+	ds, ok := s.shardManager.getDataShard(shardIdx)
+	if !ok {
+		return nil
+	}
+	return ds.Sync()
+}
+
+// ReadL1Checkpoint This function returns the L1Checkpoint last written to L1CheckpointFile, from which the caller
+// resumes by Reset to its L1, e.g. after a crash. Return false if the checkpoints are disabled or none is written.
+// The checkpoint whose L1Hash no longer matches the block is not trusted, and false is returned as well.
+func (s *StorageManager) ReadL1Checkpoint() (*L1Checkpoint, bool, error) {
+	if s.L1CheckpointFile == "" {
+		return nil, false, nil
+	}
+	bs, err := os.ReadFile(s.L1CheckpointFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	ckpt := &L1Checkpoint{}
+	if err = json.Unmarshal(bs, ckpt); err != nil {
+		return nil, false, err
+	}
+	if ckpt.L1Hash != (common.Hash{}) {
+		if hash := s.fetchL1Hash(ckpt.L1); hash != (common.Hash{}) && hash != ckpt.L1Hash {
+			metaLog.Warn("L1 checkpoint block does not match", "l1", ckpt.L1, "hash", ckpt.L1Hash, "canonical", hash)
+			return nil, false, nil
+		}
+	}
+	s.mu.Lock()
+	if ckpt.FilledNext > s.filledNext {
+		s.filledNext = ckpt.FilledNext
+	}
+	s.mu.Unlock()
+	return ckpt, true, nil
+}
+
+// writeJSONSynced writes v to filename by writeFileSynced.
+func writeJSONSynced(filename string, v interface{}) error {
+	bs, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return writeFileSynced(filename, bs)
+}
+
+// writeFileSynced writes bs to a temp file, syncs it, renames it over filename and syncs the directory, so the file is
+// never torn and is durable once it returns.
+func writeFileSynced(filename string, bs []byte) error {
+	dir := filepath.Dir(filename)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp := filename + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(bs)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, filename); err != nil {
+		return err
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if closeErr := d.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,35 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import "errors"
+
+var ErrNoSyncedKv = errors.New("no synced kv in local storage")
+
+// LocalHighestFilledIndex This function returns the highest kvIdx of the managed shards whose local meta is filled
+// with a synced blob, i.e. not empty filled, which shows how far the local data is behind LastKvIndex. It is found
+// from the fill state of each shard, see shardFill, under the read lock. Return ErrNoSyncedKv if no blob is synced.
+func (s *StorageManager) LocalHighestFilledIndex() (uint64, error) {
+	s.rlock("LocalHighestFilledIndex")
+	defer s.mu.RUnlock()
+
+	var (
+		highest uint64
+		found   bool
+	)
+	for _, shardIdx := range s.shardManager.ShardIds() {
+		f, err := s.shardFillOf(shardIdx)
+		if err != nil {
+			return 0, err
+		}
+		// next is the highest synced kvIdx + 1, or 0 if none
+		if next := f.highestSynced(); next > 0 && (!found || next-1 > highest) {
+			highest, found = next-1, true
+		}
+	}
+	if !found {
+		return 0, ErrNoSyncedKv
+	}
+	return highest, nil
+}
@@ -0,0 +1,74 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/hashicorp/golang-lru/v2/simplelru"
+)
+
+// maskCache caches the encoding masks of the chunks in LRU order for the decoding. A mask is keyed by its encoding
+// key, which covers the chunk, the commit of the blob and the miner, along with the encode type, so a cached mask is
+// never used to decode another blob, e.g. after the kv is updated. Only the masks of ENCODE_BLOB_POSEIDON and
+// ENCODE_ETHASH are cached, as the others are cheaper to compute than to look up.
+type maskCache struct {
+	mu    sync.Mutex
+	masks *simplelru.LRU[maskKey, []byte]
+}
+
+type maskKey struct {
+	encodeKey  common.Hash
+	encodeType uint64
+}
+
+func newMaskCache(size int) *maskCache {
+	masks, _ := simplelru.NewLRU[maskKey, []byte](size, nil)
+	return &maskCache{masks: masks}
+}
+
+// decode decodes the chunk like decodeChunk, with the mask from the cache, or computed and cached if not cached.
+func (c *maskCache) decode(chunkSize uint64, bs []byte, encodeType uint64, encodeKey common.Hash) []byte {
+	if c == nil || (encodeType != ENCODE_BLOB_POSEIDON && encodeType != ENCODE_ETHASH) {
+		return decodeChunk(chunkSize, bs, encodeType, encodeKey)
+	}
+	if len(bs) > int(chunkSize) {
+		panic("cannot encode chunk with size > CHUNK_SIZE")
+	}
+	key := maskKey{encodeKey: encodeKey, encodeType: encodeType}
+	c.mu.Lock()
+	mask, ok := c.masks.Get(key)
+	c.mu.Unlock()
+	if !ok {
+		// the mask is the encoded chunk of zeros
+		mask = encodeChunk(chunkSize, nil, encodeType, encodeKey)
+		c.mu.Lock()
+		c.masks.Add(key, mask)
+		c.mu.Unlock()
+	}
+	// the cached mask is shared, so it is not unmasked in place
+	output := make([]byte, len(bs))
+	for i := range bs {
+		output[i] = bs[i] ^ mask[i]
+	}
+	return output
+}
+
+// SetMaskCache This function enables the cache of the encoding masks of up to size chunks for the decoding of the
+// blobs read from all the shards, including those added later, which speeds up the repeated reads of the same blobs,
+// e.g. by the peers syncing from the node, at the cost of chunkSize bytes of memory per mask cached. The cache is
+// disabled if size is 0. It must be called before the blobs are read, as the shards are read without the lock.
+func (sm *ShardManager) SetMaskCache(size int) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	sm.masks = nil
+	if size > 0 {
+		sm.masks = newMaskCache(size)
+	}
+	for _, ds := range sm.shardMap {
+		ds.masks = sm.masks
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// metaAgeHeadTTL is how long the head of L1 queried by MetaAge is cached, which is about one slot
+const metaAgeHeadTTL = 12 * time.Second
+
+// cachedHead is the number of the L1 head queried at a time.
+type cachedHead struct {
+	mu     sync.Mutex
+	number int64
+	at     time.Time
+}
+
+// MetaAge This function returns the number of blocks the local L1 view, at which the metas are kept by
+// DownloadFinished, is behind the head of L1, so that a status endpoint can tell the operators how stale the cached
+// view of the contract is. The head is cached for metaAgeHeadTTL to avoid a request to the L1 source for each call.
+func (s *StorageManager) MetaAge(ctx context.Context) (int64, error) {
+	head, err := s.l1Head(ctx)
+	if err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	localL1 := s.localL1
+	s.mu.Unlock()
+	if head < localL1 {
+		return 0, nil
+	}
+	return head - localL1, nil
+}
+
+// l1Head returns the number of the head of L1, which is queried again once the cached one is older than
+// metaAgeHeadTTL.
+func (s *StorageManager) l1Head(ctx context.Context) (int64, error) {
+	c := &s.headCache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := s.Clock.Now()
+	if !c.at.IsZero() && now.Sub(c.at) < metaAgeHeadTTL {
+		return c.number, nil
+	}
+	header, err := s.getL1Source().HeaderByNumber(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	c.number, c.at = header.Number.Int64(), now
+	return c.number, nil
+}
@@ -0,0 +1,51 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"context"
+
+	"golang.org/x/time/rate"
+)
+
+// metaResponseSize is the estimated bytes of the response per meta requested from the contract
+const metaResponseSize = 32
+
+// metaBandwidthLimiter returns the limiter of the meta downloads shared by all the download workers of all the
+// shards, created on the first use with MetaBandwidth, or nil if it is unlimited. The burst is the bytes of
+// one second, so the first second of a download is not throttled.
+func (s *StorageManager) metaBandwidthLimiter() *rate.Limiter {
+	s.metaLimiterOnce.Do(func() {
+		if s.MetaBandwidth == 0 {
+			return
+		}
+		burst := s.MetaBandwidth
+		if burst < metaResponseSize {
+			burst = metaResponseSize
+		}
+		s.metaLimiter = rate.NewLimiter(rate.Limit(s.MetaBandwidth), int(burst))
+	})
+	return s.metaLimiter
+}
+
+// waitMetaBandwidth waits until the request of n metas fits in MetaBandwidth, with the response estimated as
+// metaResponseSize bytes per meta. Return ctx.Err() if ctx is done before.
+func (s *StorageManager) waitMetaBandwidth(ctx context.Context, n int) error {
+	limiter := s.metaBandwidthLimiter()
+	if limiter == nil {
+		return nil
+	}
+	// a request larger than the burst waits for it in parts
+	for size := n * metaResponseSize; size > 0; {
+		part := size
+		if part > limiter.Burst() {
+			part = limiter.Burst()
+		}
+		if err := limiter.WaitN(ctx, part); err != nil {
+			return err
+		}
+		size -= part
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"sync"
+	"time"
+)
+
+// metaBatchFastLatency is the latency within which a batch of metas is taken as fast, after which the batch size grows
+const metaBatchFastLatency = 2 * time.Second
+
+// metaBatcher adapts the batch size of the meta download shared by the download tasks of a shard. The size starts
+// from the min, doubles after each full batch downloaded within metaBatchFastLatency up to the max, and is halved
+// after a batch fails, e.g. by a timeout or a response size limit of the provider, down to the min. The halved size
+// also becomes the ceiling of the growth, so a size rejected by the provider is not tried again. The size is fixed
+// if the min equals the max.
+type metaBatcher struct {
+	mu       sync.Mutex
+	size     uint64
+	min, max uint64
+}
+
+// newMetaBatcher returns a metaBatcher adapting between min and max, or one fixed at size if max is 0.
+func newMetaBatcher(size, min, max uint64) *metaBatcher {
+	if max == 0 {
+		min, max = size, size
+	}
+	if min == 0 {
+		min = 1
+	}
+	if min > max {
+		min = max
+	}
+	return &metaBatcher{size: min, min: min, max: max}
+}
+
+// batchSize returns the size of the next batch, and whether it is the min, at which the failures are retried instead
+// of shrinking the batch.
+func (b *metaBatcher) batchSize() (uint64, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.size, b.size == b.min
+}
+
+// succeeded records a batch of n metas downloaded in latency.
+func (b *metaBatcher) succeeded(n uint64, latency time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if n >= b.size && latency < metaBatchFastLatency && b.size < b.max {
+		b.size *= 2
+		if b.size > b.max {
+			b.size = b.max
+		}
+	}
+}
+
+// failed records a batch of n metas failed to download.
+func (b *metaBatcher) failed(n uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	size := n / 2
+	if size < b.min {
+		size = b.min
+	}
+	if size < b.size {
+		b.size = size
+	}
+	if size < b.max {
+		b.max = size
+	}
+}
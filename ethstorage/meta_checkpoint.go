@@ -0,0 +1,260 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+const (
+	// metaCheckpointFileName is the file name pattern of the meta download checkpoint of a shard
+	metaCheckpointFileName = "metas-%d.ckpt"
+	// metaCheckpointDataFileName is the file name pattern of the metas stored by the checkpoint of a shard, which are
+	// 32 bytes each in the order of kvIdx from the first owned kv of the shard
+	metaCheckpointDataFileName = "metas-%d.dat"
+	// metaCheckpointInterval is the min interval between two checkpoints of a shard during the download
+	metaCheckpointInterval = 30 * time.Second
+)
+
+// metaCheckpoint records the progress of the meta download of a shard.
+type metaCheckpoint struct {
+	L1     int64       `json:"l1"`     // localL1 when the checkpoint is written, the stored metas are consistent with it
+	L1Hash common.Hash `json:"l1Hash"` // hash of the L1 block, so that a reorged checkpoint is not trusted
+	First  uint64      `json:"first"`  // the first owned kvIdx of the shard
+	Next   uint64      `json:"next"`   // the metas of [First, Next) are all downloaded and stored
+}
+
+func readMetaCheckpoint(filename string) (*metaCheckpoint, error) {
+	bs, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	ckpt := &metaCheckpoint{}
+	if err = json.Unmarshal(bs, ckpt); err != nil {
+		return nil, err
+	}
+	return ckpt, nil
+}
+
+// metaCheckpointer checkpoints the metas downloaded for a shard by the parallel workers. As the workers complete
+// their batches out of order, the checkpoint only advances over the contiguous completed range from the first kv.
+type metaCheckpointer struct {
+	s        *StorageManager
+	ckptFile string
+	dataFile string
+
+	mu        sync.Mutex
+	ckpt      metaCheckpoint    // the last written checkpoint
+	next      uint64            // the metas of [First, next) are all downloaded
+	completed map[uint64]uint64 // the completed batches beyond next, from -> to
+	lastWrite time.Time
+}
+
+// newMetaCheckpointer returns nil if the checkpoints are disabled, whose methods are no-ops.
+func (s *StorageManager) newMetaCheckpointer(shardIdx, first uint64) *metaCheckpointer {
+	if s.MetaCheckpointDir == "" {
+		return nil
+	}
+	return &metaCheckpointer{
+		s:         s,
+		ckptFile:  filepath.Join(s.MetaCheckpointDir, fmt.Sprintf(metaCheckpointFileName, shardIdx)),
+		dataFile:  filepath.Join(s.MetaCheckpointDir, fmt.Sprintf(metaCheckpointDataFileName, shardIdx)),
+		ckpt:      metaCheckpoint{First: first, Next: first},
+		next:      first,
+		completed: map[uint64]uint64{},
+		lastWrite: s.Clock.Now(),
+	}
+}
+
+// resume loads the metas stored by the checkpoint, and returns the kvIdx from which the metas need to be downloaded,
+// with the kvs before it whose stored metas are stale. The checkpoint may be written at an earlier localL1 as long
+// as its block is still canonical, in which case the metas of the kvs updated by the PutBlob logs since then are
+// not loaded but returned as stale. Any invalid checkpoint is ignored and the download starts from the first kv.
+func (c *metaCheckpointer) resume() (uint64, []uint64) {
+	if c == nil {
+		return 0, nil
+	}
+	first := c.ckpt.First
+	ckpt, err := readMetaCheckpoint(c.ckptFile)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			metaLog.Warn("Read meta checkpoint failed", "file", c.ckptFile, "err", err)
+		}
+		return first, nil
+	}
+
+	s := c.s
+	s.mu.Lock()
+	localL1 := s.localL1
+	s.mu.Unlock()
+	if ckpt.First != first || ckpt.Next < first || ckpt.L1 > localL1 {
+		metaLog.Info("Meta checkpoint does not match", "first", ckpt.First, "next", ckpt.Next, "l1", ckpt.L1, "localL1", localL1)
+		return first, nil
+	}
+	header, err := s.getL1Source().HeaderByNumber(context.Background(), big.NewInt(ckpt.L1))
+	if err != nil || header.Hash() != ckpt.L1Hash {
+		metaLog.Info("Meta checkpoint block does not match", "l1", ckpt.L1, "err", err)
+		return first, nil
+	}
+	updated, all, err := s.updatedKvsBetween(ckpt.L1, localL1)
+	if err != nil || all {
+		metaLog.Info("Updated kvs since meta checkpoint unknown", "l1", ckpt.L1, "localL1", localL1, "err", err)
+		return first, nil
+	}
+	bs, err := os.ReadFile(c.dataFile)
+	if err != nil || uint64(len(bs)) < (ckpt.Next-first)*32 {
+		metaLog.Warn("Read metas of checkpoint failed", "file", c.dataFile, "err", err)
+		return first, nil
+	}
+	isUpdated := make(map[uint64]bool, len(updated))
+	for _, kvIdx := range updated {
+		isUpdated[kvIdx] = true
+	}
+
+	var stale []uint64
+	s.mu.Lock()
+	if s.localL1 != localL1 {
+		s.mu.Unlock()
+		return first, nil
+	}
+	for kvIdx := first; kvIdx < ckpt.Next; kvIdx++ {
+		// keep the metas set in the meantime, e.g. by DownloadFinished
+		if _, ok := s.blobMetas.get(kvIdx); ok {
+			continue
+		}
+		if isUpdated[kvIdx] {
+			stale = append(stale, kvIdx)
+			continue
+		}
+		meta := [32]byte{}
+		copy(meta[:], bs[(kvIdx-first)*32:])
+		s.blobMetas.set(kvIdx, meta)
+	}
+	s.mu.Unlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ckpt = *ckpt
+	c.next = ckpt.Next
+	metaLog.Info("Resume downloading metas from checkpoint", "first", first, "next", ckpt.Next, "l1", ckpt.L1,
+		"localL1", localL1, "stale", len(stale))
+	return ckpt.Next, stale
+}
+
+// complete records that the metas of [from, to) are downloaded, and writes a checkpoint if the contiguous
+// downloaded range advanced and metaCheckpointInterval passed since the last one.
+func (c *metaCheckpointer) complete(from, to uint64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.completed[from] = to
+	for {
+		to, ok := c.completed[c.next]
+		if !ok {
+			break
+		}
+		delete(c.completed, c.next)
+		c.next = to
+	}
+	if c.s.Clock.Now().Sub(c.lastWrite) >= metaCheckpointInterval {
+		c.write()
+	}
+}
+
+// flush writes a checkpoint of the contiguous downloaded range, e.g. when the download completes.
+func (c *metaCheckpointer) flush() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.write()
+}
+
+// write stores the metas and the checkpoint, which is best-effort so the failure is only logged. If localL1 changed
+// since the last checkpoint, the stored metas may have been updated by DownloadFinished or downloaded again after
+// resume, so they are all rewritten even if the range did not advance. The caller must hold c.mu.
+func (c *metaCheckpointer) write() {
+	c.lastWrite = c.s.Clock.Now()
+	c.s.mu.Lock()
+	localL1 := c.s.localL1
+	c.s.mu.Unlock()
+	if c.next == c.ckpt.Next && localL1 == c.ckpt.L1 {
+		return
+	}
+	if err := c.store(); err != nil {
+		metaLog.Warn("Write meta checkpoint failed", "file", c.ckptFile, "err", err)
+	}
+}
+
+func (c *metaCheckpointer) store() error {
+	s := c.s
+	first, next := c.ckpt.First, c.next
+
+	s.mu.Lock()
+	localL1 := s.localL1
+	start := c.ckpt.Next
+	if localL1 != c.ckpt.L1 {
+		start = first
+	}
+	bs := make([]byte, 0, (next-start)*32)
+	for kvIdx := start; kvIdx < next; kvIdx++ {
+		meta, _ := s.blobMetas.get(kvIdx)
+		bs = append(bs, meta[:]...)
+	}
+	s.mu.Unlock()
+
+	header, err := s.getL1Source().HeaderByNumber(context.Background(), big.NewInt(localL1))
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(s.MetaCheckpointDir, 0755); err != nil {
+		return err
+	}
+
+	if start == first {
+		// drop the checkpoint before its metas are rewritten, so it never refers to the metas of another L1
+		if err = os.Remove(c.ckptFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if err = writeFileSynced(c.dataFile, bs); err != nil {
+			return err
+		}
+	} else {
+		f, err := os.OpenFile(c.dataFile, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		_, err = f.WriteAt(bs, int64((start-first)*32))
+		if err == nil {
+			err = f.Sync()
+		}
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	ckpt := metaCheckpoint{L1: localL1, L1Hash: header.Hash(), First: first, Next: next}
+	if err = writeJSONSynced(c.ckptFile, &ckpt); err != nil {
+		return err
+	}
+	c.ckpt = ckpt
+	return nil
+}
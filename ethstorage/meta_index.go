@@ -0,0 +1,418 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"encoding/binary"
+	"sort"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb"
+)
+
+var (
+	// metaIndexPrefix is the prefix of the keys of the metas in the database of dbMetaStore, followed by the kvIdx in
+	// big endian, so the keys are ordered by kvIdx.
+	metaIndexPrefix = []byte("es-meta-")
+	// metaIndexL1Key is the key of the L1 block number and hash the metas in the database are valid at, which is out
+	// of metaIndexPrefix so it is never taken as a meta.
+	metaIndexL1Key = []byte("es-metaindex-l1")
+)
+
+// metaIndex keeps the contract metas of the local shards. metaStore keeps them in memory, which is the default,
+// and dbMetaStore keeps them in a key-value database, e.g. the leveldb of the node, for the nodes of many shards
+// whose metas do not fit in memory. Like metaStore, each operation is thread-safe, while a sequence of operations
+// must be protected by the caller.
+type metaIndex interface {
+	get(kvIdx uint64) ([32]byte, bool)
+	set(kvIdx uint64, meta [32]byte)
+	delete(kvIdx uint64)
+	deleteFrom(kvIdx uint64)
+	deleteShard(shardIdx uint64)
+	len() int
+	clear()
+	forEach(fn func(kvIdx uint64, meta [32]byte))
+	// iterate calls fn with the metas of [from, to) in the order of kvIdx until fn returns false. Unlike forEach,
+	// fn may call back into the index.
+	iterate(from, to uint64, fn func(kvIdx uint64, meta [32]byte) bool)
+}
+
+var (
+	_ metaIndex = (*metaStore)(nil)
+	_ metaIndex = (*dbMetaStore)(nil)
+)
+
+// metaIterateBatch is the max number of the metas copied under the lock at a time by metaStore.iterate
+const metaIterateBatch = 256
+
+type indexedMeta struct {
+	kvIdx uint64
+	meta  [32]byte
+}
+
+// iterate calls fn with the metas of [from, to) in the order of kvIdx until fn returns false. The metas are read
+// from the slices of the shards by offset, and copied in batches so fn is called without the lock.
+func (ms *metaStore) iterate(from, to uint64, fn func(kvIdx uint64, meta [32]byte) bool) {
+	ms.mu.RLock()
+	var irregular []uint64
+	for kvIdx := range ms.irregular {
+		if kvIdx >= from && kvIdx < to {
+			irregular = append(irregular, kvIdx)
+		}
+	}
+	ms.mu.RUnlock()
+	sort.Slice(irregular, func(i, j int) bool { return irregular[i] < irregular[j] })
+
+	batch := make([]indexedMeta, 0, metaIterateBatch)
+	for next := from; next < to; {
+		batch, next = ms.copyRange(next, to, &irregular, batch[:0])
+		for _, e := range batch {
+			if !fn(e.kvIdx, e.meta) {
+				return
+			}
+		}
+	}
+}
+
+// copyRange appends the metas from next on to buf in the order of kvIdx until it is full or to is reached, with the
+// irregular metas of the sorted indices merged and removed from them, and returns it with the kvIdx to go on from.
+func (ms *metaStore) copyRange(next, to uint64, irregular *[]uint64, buf []indexedMeta) ([]indexedMeta, uint64) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	for next < to && len(buf) < cap(buf) {
+		shardIdx := next / ms.kvEntries
+		first := shardIdx * ms.kvEntries
+		end := first + ms.kvEntries
+		if end > to || end < first {
+			end = to
+		}
+		// the next regular meta in [next, end), or end if none
+		found := end
+		if shard, ok := ms.shards[shardIdx]; ok {
+			for offset := next - first; offset < uint64(len(shard.metas)) && first+offset < end; offset++ {
+				if shard.present[offset/64] == 0 {
+					offset |= 63
+					continue
+				}
+				if shard.has(offset) {
+					found = first + offset
+					break
+				}
+			}
+		} else {
+			found = ms.nextShardFirst(shardIdx, to)
+		}
+
+		for len(*irregular) > 0 && (*irregular)[0] < found && len(buf) < cap(buf) {
+			kvIdx := (*irregular)[0]
+			*irregular = (*irregular)[1:]
+			if meta, ok := ms.irregular[kvIdx]; ok {
+				buf = append(buf, indexedMeta{kvIdx, meta})
+			}
+			next = kvIdx + 1
+		}
+		if len(buf) == cap(buf) {
+			break
+		}
+		if found >= end {
+			next = found
+			continue
+		}
+		meta := [32]byte{}
+		putMetaKvIdx(&meta, found)
+		copy(meta[kvIdxSizeInMeta:], ms.shards[shardIdx].metas[found-first][:])
+		buf = append(buf, indexedMeta{found, meta})
+		next = found + 1
+	}
+	return buf, next
+}
+
+// nextShardFirst returns the first kvIdx of the first shard with metas after shardIdx, or to if it is not before to.
+// The caller must hold ms.mu.
+func (ms *metaStore) nextShardFirst(shardIdx, to uint64) uint64 {
+	next := to
+	for idx := range ms.shards {
+		if idx > shardIdx && idx*ms.kvEntries < next {
+			next = idx * ms.kvEntries
+		}
+	}
+	return next
+}
+
+// dbMetaStore keeps the contract metas in a key-value database with 32 bytes per kvIdx, so the memory used does not
+// grow with the number of the metas, at the cost of a database read per get. The errors of the database are logged,
+// and a meta failed to read is taken as not downloaded, so the commit of its kv fails until it is downloaded again.
+type dbMetaStore struct {
+	db        ethdb.KeyValueStore
+	kvEntries uint64
+
+	mu    sync.Mutex // serialize the writes, so the count is consistent with the keys
+	count int
+}
+
+// newDBMetaStore returns a dbMetaStore in db with the metas left in it, e.g. by the last run, which are counted. Whether
+// they are still valid is up to the caller, see SetMetaIndexDB.
+func newDBMetaStore(db ethdb.KeyValueStore, kvEntries uint64) (*dbMetaStore, error) {
+	ms := &dbMetaStore{db: db, kvEntries: kvEntries}
+	it := db.NewIterator(metaIndexPrefix, nil)
+	defer it.Release()
+	for it.Next() {
+		ms.count++
+	}
+	if err := it.Error(); err != nil {
+		return nil, err
+	}
+	return ms, nil
+}
+
+// readL1 returns the L1 block number and hash written by writeL1, or false if none is written.
+func (ms *dbMetaStore) readL1() (int64, common.Hash, bool) {
+	v, err := ms.db.Get(metaIndexL1Key)
+	if err != nil || len(v) != 8+common.HashLength {
+		return 0, common.Hash{}, false
+	}
+	return int64(binary.BigEndian.Uint64(v[:8])), common.BytesToHash(v[8:]), true
+}
+
+// writeL1 records that the metas are valid at the L1 block, so they are reused by the next run if the block is still
+// canonical. The failure is logged, and the next run drops the metas if the record is stale.
+func (ms *dbMetaStore) writeL1(l1 int64, hash common.Hash) {
+	v := make([]byte, 8+common.HashLength)
+	binary.BigEndian.PutUint64(v[:8], uint64(l1))
+	copy(v[8:], hash[:])
+	if err := ms.db.Put(metaIndexL1Key, v); err != nil {
+		metaLog.Error("Failed to write the block of metas", "l1", l1, "err", err)
+	}
+}
+
+func metaIndexKey(kvIdx uint64) []byte {
+	key := make([]byte, len(metaIndexPrefix)+8)
+	copy(key, metaIndexPrefix)
+	binary.BigEndian.PutUint64(key[len(metaIndexPrefix):], kvIdx)
+	return key
+}
+
+func (ms *dbMetaStore) get(kvIdx uint64) ([32]byte, bool) {
+	meta := [32]byte{}
+	v, err := ms.db.Get(metaIndexKey(kvIdx))
+	if err != nil {
+		if ok, _ := ms.db.Has(metaIndexKey(kvIdx)); ok {
+			metaLog.Error("Failed to read meta", "kvIdx", kvIdx, "err", err)
+		}
+		return meta, false
+	}
+	copy(meta[:], v)
+	return meta, true
+}
+
+func (ms *dbMetaStore) set(kvIdx uint64, meta [32]byte) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	key := metaIndexKey(kvIdx)
+	exists, err := ms.db.Has(key)
+	if err == nil {
+		err = ms.db.Put(key, meta[:])
+	}
+	if err != nil {
+		metaLog.Error("Failed to write meta", "kvIdx", kvIdx, "err", err)
+		return
+	}
+	if !exists {
+		ms.count++
+	}
+}
+
+func (ms *dbMetaStore) delete(kvIdx uint64) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	key := metaIndexKey(kvIdx)
+	exists, err := ms.db.Has(key)
+	if err != nil || !exists {
+		return
+	}
+	if err = ms.db.Delete(key); err != nil {
+		metaLog.Error("Failed to delete meta", "kvIdx", kvIdx, "err", err)
+		return
+	}
+	ms.count--
+}
+
+// deleteRange removes the metas of [from, to) in a batch.
+func (ms *dbMetaStore) deleteRange(from, to uint64) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	it := ms.db.NewIterator(metaIndexPrefix, metaIndexKey(from)[len(metaIndexPrefix):])
+	defer it.Release()
+	batch := ms.db.NewBatch()
+	deleted := 0
+	for it.Next() {
+		if binary.BigEndian.Uint64(it.Key()[len(metaIndexPrefix):]) >= to {
+			break
+		}
+		if err := batch.Delete(common.CopyBytes(it.Key())); err != nil {
+			return err
+		}
+		deleted++
+	}
+	if err := it.Error(); err != nil {
+		return err
+	}
+	if err := batch.Write(); err != nil {
+		return err
+	}
+	ms.count -= deleted
+	return nil
+}
+
+func (ms *dbMetaStore) deleteFrom(kvIdx uint64) {
+	if err := ms.deleteRange(kvIdx, ^uint64(0)); err != nil {
+		metaLog.Error("Failed to delete metas", "from", kvIdx, "err", err)
+	}
+}
+
+func (ms *dbMetaStore) deleteShard(shardIdx uint64) {
+	if err := ms.deleteRange(shardIdx*ms.kvEntries, (shardIdx+1)*ms.kvEntries); err != nil {
+		metaLog.Error("Failed to delete metas", "shard", shardIdx, "err", err)
+	}
+}
+
+func (ms *dbMetaStore) len() int {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.count
+}
+
+func (ms *dbMetaStore) clear() {
+	ms.deleteFrom(0)
+}
+
+func (ms *dbMetaStore) forEach(fn func(kvIdx uint64, meta [32]byte)) {
+	ms.iterate(0, ^uint64(0), func(kvIdx uint64, meta [32]byte) bool {
+		fn(kvIdx, meta)
+		return true
+	})
+}
+
+func (ms *dbMetaStore) iterate(from, to uint64, fn func(kvIdx uint64, meta [32]byte) bool) {
+	it := ms.db.NewIterator(metaIndexPrefix, metaIndexKey(from)[len(metaIndexPrefix):])
+	defer it.Release()
+	for it.Next() {
+		kvIdx := binary.BigEndian.Uint64(it.Key()[len(metaIndexPrefix):])
+		if kvIdx >= to {
+			return
+		}
+		meta := [32]byte{}
+		copy(meta[:], it.Value())
+		if !fn(kvIdx, meta) {
+			return
+		}
+	}
+	if err := it.Error(); err != nil {
+		metaLog.Error("Failed to iterate metas", "from", from, "to", to, "err", err)
+	}
+}
+
+// SetMetaIndexDB This function moves the downloaded metas into db, e.g. the leveldb of the node, and keeps the metas
+// downloaded since in it instead of in memory, which saves the memory of the nodes with many shards at the cost of a
+// database read for each meta read by the commits. It should be called on start, before the metas are downloaded, as
+// the in-memory metas are copied one by one under the lock.
+// The metas left in db by the last run are reused if the L1 block they are recorded valid at is still canonical, in
+// which case the metas of the kvs updated since that block are dropped by the first Reset, or right away if localL1
+// is already set, see reconcileRestoredMetas. They are all dropped otherwise, e.g. after a reorg of the block.
+func (s *StorageManager) SetMetaIndexDB(db ethdb.KeyValueStore) error {
+	index, err := newDBMetaStore(db, s.shardManager.kvEntries)
+	if err != nil {
+		return err
+	}
+	l1, hash, ok := index.readL1()
+	restored := ok && index.len() > 0 && hash != (common.Hash{}) && s.fetchL1Hash(l1) == hash
+	if !restored && index.len() > 0 {
+		metaLog.Info("Metas left in the database dropped", "metas", index.len(), "l1", l1, "hash", hash)
+		if err = index.deleteRange(0, ^uint64(0)); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	s.metasMu.Lock()
+	s.blobMetas.forEach(func(kvIdx uint64, meta [32]byte) {
+		index.set(kvIdx, meta)
+	})
+	s.blobMetas = index
+	if restored {
+		s.restoredMetasL1 = l1
+		metaLog.Info("Metas in the database restored", "metas", index.len(), "l1", l1)
+	}
+	localL1 := s.localL1
+	s.metasMu.Unlock()
+	s.mu.Unlock()
+	metaLog.Info("Metas moved to the database", "metas", index.len())
+
+	if localL1 == 0 {
+		return nil
+	}
+	s.reconcileRestoredMetas(localL1)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.restoredMetasL1 == 0 {
+		index.writeL1(s.localL1, s.localL1Hash)
+	}
+	return nil
+}
+
+// markMetaIndexL1 records the block of localL1 in the database of the metas, if they are kept in one, once the metas
+// restored from it are reconciled. The caller must hold s.mu and s.metasMu.
+func (s *StorageManager) markMetaIndexL1() {
+	if index, ok := s.blobMetas.(*dbMetaStore); ok && s.restoredMetasL1 == 0 {
+		index.writeL1(s.localL1, s.localL1Hash)
+	}
+}
+
+// reconcileRestoredMetas drops the metas restored by SetMetaIndexDB which may be stale at l1, i.e. those of the kvs
+// updated between the block they are valid at and l1 as found by the PutBlob logs, and those beyond the lastKvIdx at
+// l1. If the updated kvs cannot be found, all of them are dropped. It is a no-op unless the restored metas are not
+// reconciled yet, which is done once, before localL1 is first set.
+func (s *StorageManager) reconcileRestoredMetas(l1 int64) {
+	s.mu.Lock()
+	from := s.restoredMetasL1
+	s.mu.Unlock()
+	if from == 0 {
+		return
+	}
+
+	updated, all, err := s.updatedKvsBetween(from, l1)
+	if err != nil {
+		metaLog.Warn("Find kvs updated since restored metas failed", "from", from, "to", l1, "err", err)
+		all = true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.restoredMetasL1 != from {
+		return
+	}
+	lastKvIdx, err := s.getStorageLastBlobIdx(l1)
+	if err != nil {
+		metaLog.Warn("Get lastKvIdx for restored metas failed", "l1", l1, "err", err)
+		all = true
+	}
+	s.metasMu.Lock()
+	defer s.metasMu.Unlock()
+	before := s.blobMetas.len()
+	if all {
+		s.blobMetas.clear()
+	} else {
+		for _, kvIdx := range updated {
+			s.blobMetas.delete(kvIdx)
+		}
+		s.blobMetas.deleteFrom(lastKvIdx)
+	}
+	s.restoredMetasL1 = 0
+	metaLog.Info("Restored metas reconciled", "from", from, "to", l1, "dropped", before-s.blobMetas.len(), "metas", s.blobMetas.len())
+}
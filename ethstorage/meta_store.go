@@ -0,0 +1,240 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+)
+
+const (
+	// kvIdxSizeInMeta is the size of the kvIdx stored at the beginning of a contract meta.
+	kvIdxSizeInMeta = 5
+	// MaxKvIdxInMeta is the largest kvIdx that can be encoded in a meta, as the contract does with uint40.
+	MaxKvIdxInMeta = uint64(1)<<(kvIdxSizeInMeta*8) - 1
+)
+
+var ErrKvIdxOutOfRange = errors.New("kvIdx out of the range of meta")
+
+// compactMeta is the in-memory form of a contract meta. The kvIdx in meta[0:5] equals the index of the meta,
+// so only the rest (the kv size and the hash) is kept.
+type compactMeta [32 - kvIdxSizeInMeta]byte
+
+// shardMetas keeps the compact metas of one shard in a slice indexed by the offset of kvIdx in the shard.
+// As blobs are appended to a shard in order, the slice only grows up to the highest downloaded offset.
+type shardMetas struct {
+	metas   []compactMeta
+	present []uint64 // bitmap of the offsets whose meta is set
+	count   int
+}
+
+func (sm *shardMetas) has(offset uint64) bool {
+	return offset < uint64(len(sm.metas)) && sm.present[offset/64]&(1<<(offset%64)) != 0
+}
+
+// metaStore keeps the contract metas of the local shards with about 27 bytes per kvIdx, instead of a map
+// of full 32 bytes metas which costs several times more per entry.
+// Each operation of metaStore is thread-safe with its own lock, so the metas can be written by the meta download
+// without s.mu, while a sequence of operations must be protected by the caller.
+type metaStore struct {
+	mu        sync.RWMutex
+	kvEntries uint64
+	shards    map[uint64]*shardMetas
+	// irregular keeps the full metas whose embedded kvIdx does not match their index, e.g. a wrong meta
+	// from the contract, so that the kvIdx check in the commit path still works on them.
+	irregular map[uint64][32]byte
+}
+
+func newMetaStore(kvEntries uint64) *metaStore {
+	return &metaStore{
+		kvEntries: kvEntries,
+		shards:    make(map[uint64]*shardMetas),
+		irregular: make(map[uint64][32]byte),
+	}
+}
+
+func metaKvIdx(meta [32]byte) uint64 {
+	return new(big.Int).SetBytes(meta[0:kvIdxSizeInMeta]).Uint64()
+}
+
+// putMetaKvIdx writes kvIdx into meta[0:5], and returns ErrKvIdxOutOfRange if kvIdx does not fit in it
+// instead of letting big.Int.FillBytes panic.
+func putMetaKvIdx(meta *[32]byte, kvIdx uint64) error {
+	if kvIdx > MaxKvIdxInMeta {
+		return fmt.Errorf("%w: %d > %d", ErrKvIdxOutOfRange, kvIdx, MaxKvIdxInMeta)
+	}
+	new(big.Int).SetUint64(kvIdx).FillBytes(meta[0:kvIdxSizeInMeta])
+	return nil
+}
+
+func (ms *metaStore) get(kvIdx uint64) ([32]byte, bool) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	if meta, ok := ms.irregular[kvIdx]; ok {
+		return meta, true
+	}
+
+	meta := [32]byte{}
+	shard, ok := ms.shards[kvIdx/ms.kvEntries]
+	if !ok {
+		return meta, false
+	}
+	offset := kvIdx % ms.kvEntries
+	if !shard.has(offset) {
+		return meta, false
+	}
+	// kvIdx of a regular meta always fits as it equals the one embedded in the meta
+	putMetaKvIdx(&meta, kvIdx)
+	copy(meta[kvIdxSizeInMeta:], shard.metas[offset][:])
+	return meta, true
+}
+
+func (ms *metaStore) set(kvIdx uint64, meta [32]byte) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if metaKvIdx(meta) != kvIdx {
+		ms.remove(kvIdx)
+		ms.irregular[kvIdx] = meta
+		return
+	}
+	delete(ms.irregular, kvIdx)
+
+	shard, ok := ms.shards[kvIdx/ms.kvEntries]
+	if !ok {
+		shard = &shardMetas{}
+		ms.shards[kvIdx/ms.kvEntries] = shard
+	}
+	offset := kvIdx % ms.kvEntries
+	if offset >= uint64(len(shard.metas)) {
+		shard.metas = append(shard.metas, make([]compactMeta, offset+1-uint64(len(shard.metas)))...)
+		for uint64(len(shard.present))*64 < uint64(len(shard.metas)) {
+			shard.present = append(shard.present, 0)
+		}
+	}
+	if !shard.has(offset) {
+		shard.present[offset/64] |= 1 << (offset % 64)
+		shard.count++
+	}
+	copy(shard.metas[offset][:], meta[kvIdxSizeInMeta:])
+}
+
+func (ms *metaStore) delete(kvIdx uint64) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.remove(kvIdx)
+}
+
+// remove removes the meta of kvIdx. The caller must hold ms.mu.
+func (ms *metaStore) remove(kvIdx uint64) {
+	delete(ms.irregular, kvIdx)
+
+	shard, ok := ms.shards[kvIdx/ms.kvEntries]
+	if !ok {
+		return
+	}
+	offset := kvIdx % ms.kvEntries
+	if !shard.has(offset) {
+		return
+	}
+	shard.present[offset/64] &^= 1 << (offset % 64)
+	shard.metas[offset] = compactMeta{}
+	shard.count--
+	if shard.count == 0 {
+		delete(ms.shards, kvIdx/ms.kvEntries)
+	}
+}
+
+// deleteFrom removes the metas of all the indices >= kvIdx, e.g. when lastKvIdx is decreased by removal.
+func (ms *metaStore) deleteFrom(kvIdx uint64) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	for idx := range ms.irregular {
+		if idx >= kvIdx {
+			delete(ms.irregular, idx)
+		}
+	}
+	for shardIdx, shard := range ms.shards {
+		first := shardIdx * ms.kvEntries
+		if first+uint64(len(shard.metas)) <= kvIdx {
+			continue
+		}
+		keep := uint64(0)
+		if kvIdx > first {
+			keep = kvIdx - first
+		}
+		for offset := keep; offset < uint64(len(shard.metas)); offset++ {
+			if shard.has(offset) {
+				shard.present[offset/64] &^= 1 << (offset % 64)
+				shard.count--
+			}
+		}
+		shard.metas = shard.metas[:keep]
+		if shard.count == 0 {
+			delete(ms.shards, shardIdx)
+		}
+	}
+}
+
+// deleteShard removes all the metas of the shard.
+func (ms *metaStore) deleteShard(shardIdx uint64) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	first, limit := shardIdx*ms.kvEntries, (shardIdx+1)*ms.kvEntries
+	for idx := range ms.irregular {
+		if idx >= first && idx < limit {
+			delete(ms.irregular, idx)
+		}
+	}
+	delete(ms.shards, shardIdx)
+}
+
+// forEach calls fn with each meta in the store in no particular order, holding the read lock, so fn must not
+// call back into the store.
+func (ms *metaStore) forEach(fn func(kvIdx uint64, meta [32]byte)) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	for kvIdx, meta := range ms.irregular {
+		fn(kvIdx, meta)
+	}
+	for shardIdx, shard := range ms.shards {
+		for offset := uint64(0); offset < uint64(len(shard.metas)); offset++ {
+			if !shard.has(offset) {
+				continue
+			}
+			kvIdx := shardIdx*ms.kvEntries + offset
+			meta := [32]byte{}
+			putMetaKvIdx(&meta, kvIdx)
+			copy(meta[kvIdxSizeInMeta:], shard.metas[offset][:])
+			fn(kvIdx, meta)
+		}
+	}
+}
+
+// len returns the number of metas in the store.
+func (ms *metaStore) len() int {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	l := len(ms.irregular)
+	for _, shard := range ms.shards {
+		l += shard.count
+	}
+	return l
+}
+
+// clear removes all the metas in the store.
+func (ms *metaStore) clear() {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.shards = make(map[uint64]*shardMetas)
+	ms.irregular = make(map[uint64][32]byte)
+}
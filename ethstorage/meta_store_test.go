@@ -0,0 +1,236 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"math/big"
+	"runtime"
+	"sort"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+)
+
+func newTestMeta(kvIdx uint64, hash byte) [32]byte {
+	meta := [32]byte{}
+	new(big.Int).SetUint64(kvIdx).FillBytes(meta[0:kvIdxSizeInMeta])
+	meta[7] = 1
+	for i := 32 - HashSizeInContract; i < 32; i++ {
+		meta[i] = hash
+	}
+	return meta
+}
+
+func TestMetaStore(t *testing.T) {
+	ms := newMetaStore(kvEntries)
+	for i := uint64(0); i < 2*kvEntries; i++ {
+		ms.set(i, newTestMeta(i, byte(i)))
+	}
+	if ms.len() != int(2*kvEntries) {
+		t.Fatal("unexpected meta count", ms.len())
+	}
+	for i := uint64(0); i < 2*kvEntries; i++ {
+		if meta, ok := ms.get(i); !ok || meta != newTestMeta(i, byte(i)) {
+			t.Fatal("unexpected meta", i, meta)
+		}
+	}
+	if _, ok := ms.get(2 * kvEntries); ok {
+		t.Fatal("meta should not be found")
+	}
+
+	// the meta with a mismatched embedded kvIdx is kept as it is
+	irregular := newTestMeta(100, 1)
+	ms.set(1, irregular)
+	if meta, ok := ms.get(1); !ok || meta != irregular {
+		t.Fatal("unexpected irregular meta", meta)
+	}
+
+	ms.delete(2)
+	if _, ok := ms.get(2); ok {
+		t.Fatal("meta should be deleted")
+	}
+	ms.deleteFrom(kvEntries - 1)
+	if ms.len() != int(kvEntries-2) {
+		t.Fatal("unexpected meta count after deleteFrom", ms.len())
+	}
+	if _, ok := ms.get(kvEntries - 2); !ok {
+		t.Fatal("meta before deleteFrom should be kept")
+	}
+	ms.deleteShard(0)
+	if ms.len() != 0 {
+		t.Fatal("unexpected meta count after deleteShard", ms.len())
+	}
+}
+
+func TestDBMetaStore(t *testing.T) {
+	db := memorydb.New()
+	// the metas left by the last run are kept and counted
+	if err := db.Put(metaIndexKey(3), make([]byte, 32)); err != nil {
+		t.Fatal("failed to put", err)
+	}
+	ms, err := newDBMetaStore(db, kvEntries)
+	if err != nil {
+		t.Fatal("failed to create dbMetaStore", err)
+	}
+	if _, ok := ms.get(3); !ok || ms.len() != 1 {
+		t.Fatal("the metas of the last run should be kept", ms.len())
+	}
+	if _, _, ok := ms.readL1(); ok {
+		t.Fatal("no block of the metas should be written")
+	}
+	ms.writeL1(5, common.Hash{1})
+	if l1, hash, ok := ms.readL1(); !ok || l1 != 5 || hash != (common.Hash{1}) || ms.len() != 1 {
+		t.Fatal("unexpected block of the metas", l1, hash, ms.len())
+	}
+	if err = db.Delete(metaIndexL1Key); err != nil {
+		t.Fatal("failed to delete", err)
+	}
+
+	for i := uint64(0); i < 2*kvEntries; i++ {
+		ms.set(i, newTestMeta(i, byte(i)))
+	}
+	ms.set(1, newTestMeta(100, 1))
+	if ms.len() != int(2*kvEntries) {
+		t.Fatal("unexpected meta count", ms.len())
+	}
+	if meta, ok := ms.get(1); !ok || meta != newTestMeta(100, 1) {
+		t.Fatal("unexpected meta", meta)
+	}
+
+	// the range query in the order of kvIdx, stopped by fn
+	var kvs []uint64
+	ms.iterate(kvEntries-2, kvEntries+10, func(kvIdx uint64, meta [32]byte) bool {
+		if meta != newTestMeta(kvIdx, byte(kvIdx)) {
+			t.Fatal("unexpected meta", kvIdx, meta)
+		}
+		kvs = append(kvs, kvIdx)
+		return len(kvs) < 3
+	})
+	if len(kvs) != 3 || kvs[0] != kvEntries-2 || kvs[1] != kvEntries-1 || kvs[2] != kvEntries {
+		t.Fatal("unexpected range", kvs)
+	}
+
+	ms.delete(2)
+	ms.delete(2)
+	if _, ok := ms.get(2); ok || ms.len() != int(2*kvEntries-1) {
+		t.Fatal("meta should be deleted", ms.len())
+	}
+	ms.deleteShard(1)
+	if ms.len() != int(kvEntries-1) {
+		t.Fatal("unexpected meta count after deleteShard", ms.len())
+	}
+	ms.deleteFrom(kvEntries - 1)
+	if ms.len() != int(kvEntries-2) {
+		t.Fatal("unexpected meta count after deleteFrom", ms.len())
+	}
+	count := 0
+	ms.forEach(func(kvIdx uint64, meta [32]byte) { count++ })
+	if count != ms.len() {
+		t.Fatal("forEach should visit all the metas", count)
+	}
+	ms.clear()
+	if ms.len() != 0 || db.Len() != 0 {
+		t.Fatal("all the metas should be cleared", ms.len(), db.Len())
+	}
+}
+
+func TestMetaStoreIterate(t *testing.T) {
+	ms := newMetaStore(kvEntries)
+	for i := uint64(2 * kvEntries); i > 0; i-- {
+		ms.set(i-1, newTestMeta(i-1, byte(i-1)))
+	}
+	ms.set(kvEntries, newTestMeta(100, 1))
+	var kvs []uint64
+	ms.iterate(kvEntries-1, kvEntries+2, func(kvIdx uint64, meta [32]byte) bool {
+		kvs = append(kvs, kvIdx)
+		return true
+	})
+	if len(kvs) != 3 || kvs[0] != kvEntries-1 || kvs[1] != kvEntries || kvs[2] != kvEntries+1 {
+		t.Fatal("unexpected range", kvs)
+	}
+}
+
+func TestMetaStoreIterateSparse(t *testing.T) {
+	// sparse metas of the shards 0 and 5 over several batches, with irregular ones in and between them
+	const entries = 1024
+	ms := newMetaStore(entries)
+	var expected []uint64
+	for _, shardIdx := range []uint64{0, 5} {
+		for offset := uint64(0); offset < entries; offset += 3 {
+			kvIdx := shardIdx*entries + offset
+			ms.set(kvIdx, newTestMeta(kvIdx, 1))
+			expected = append(expected, kvIdx)
+		}
+	}
+	for _, kvIdx := range []uint64{1, 2*entries + 7, 5*entries + 1, 9 * entries} {
+		ms.set(kvIdx, newTestMeta(kvIdx+1, 1))
+	}
+	expected = append(expected, 1, 2*entries+7, 5*entries+1, 9*entries)
+	sort.Slice(expected, func(i, j int) bool { return expected[i] < expected[j] })
+
+	var kvs []uint64
+	ms.iterate(0, ^uint64(0), func(kvIdx uint64, meta [32]byte) bool {
+		if got, _ := ms.get(kvIdx); got != meta {
+			t.Fatal("unexpected meta", kvIdx)
+		}
+		kvs = append(kvs, kvIdx)
+		return true
+	})
+	if len(kvs) != len(expected) {
+		t.Fatal("unexpected number of metas", len(kvs), len(expected))
+	}
+	for i := range kvs {
+		if kvs[i] != expected[i] {
+			t.Fatal("unexpected order", i, kvs[i], expected[i])
+		}
+	}
+
+	kvs = kvs[:0]
+	ms.iterate(entries-2, 5*entries+4, func(kvIdx uint64, meta [32]byte) bool {
+		kvs = append(kvs, kvIdx)
+		return true
+	})
+	if len(kvs) != 5 || kvs[0] != entries-1 || kvs[1] != 2*entries+7 || kvs[2] != 5*entries || kvs[3] != 5*entries+1 ||
+		kvs[4] != 5*entries+3 {
+		t.Fatal("unexpected range", kvs)
+	}
+}
+
+func TestMetaStoreMemory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping memory measurement in short mode")
+	}
+	// kv entries of a full shard with 128KB blobs
+	const entries = 256 * 1024
+
+	heapInUse := func() uint64 {
+		runtime.GC()
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		return m.HeapAlloc
+	}
+
+	before := heapInUse()
+	metaMap := make(map[uint64][32]byte)
+	for i := uint64(0); i < entries; i++ {
+		metaMap[i] = newTestMeta(i, byte(i))
+	}
+	mapSize := heapInUse() - before
+	runtime.KeepAlive(metaMap)
+	metaMap = nil
+
+	before = heapInUse()
+	ms := newMetaStore(entries)
+	for i := uint64(0); i < entries; i++ {
+		ms.set(i, newTestMeta(i, byte(i)))
+	}
+	storeSize := heapInUse() - before
+	runtime.KeepAlive(ms)
+
+	t.Logf("memory of %d metas: map %d bytes, metaStore %d bytes", entries, mapSize, storeSize)
+	if storeSize >= mapSize {
+		t.Fatal("metaStore should use less memory than map")
+	}
+}
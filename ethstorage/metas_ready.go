@@ -0,0 +1,28 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"errors"
+)
+
+var ErrMetasNotLoaded = errors.New("metas are not loaded yet")
+
+// MetasReady This function returns whether DownloadAllMetas, or CatchUpMetas, has completed at least once, i.e. the
+// blobs not synced after it are missing rather than waiting for their metas to be downloaded.
+func (s *StorageManager) MetasReady() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.metasDownloaded
+}
+
+// checkMetasLoaded returns ErrMetasNotLoaded for a blob not synced if MetasRequired is set and the metas have not
+// been downloaded, so the caller can tell the startup state from a blob missing in the steady state. The caller
+// must hold s.mu.
+func (s *StorageManager) checkMetasLoaded() error {
+	if s.MetasRequired && !s.metasDownloaded {
+		return ErrMetasNotLoaded
+	}
+	return nil
+}
@@ -25,6 +25,7 @@ const (
 
 	SyncServerSubsystem = "sync_server"
 	SyncClientSubsystem = "sync_client"
+	StorageSubsystem    = "storage"
 	ContractMetrics     = "contract_data"
 )
 
@@ -45,6 +46,8 @@ type Metricer interface {
 	ServerGetBlobsByListEvent(peerID string, resultCode byte, duration time.Duration)
 	ServerReadBlobs(peerID string, read, sucRead uint64, timeUse time.Duration)
 	ServerRecordTimeUsed(method string) func()
+	RecordLockWait(method string, wait time.Duration)
+	RecordCodec(op string, duration time.Duration)
 	Document() []metrics.DocumentedMetric
 	RecordGossipEvent(evType int32)
 	SetPeerScores(map[string]float64)
@@ -98,6 +101,10 @@ type Metrics struct {
 	SyncServerPerfCallTotal                   *prometheus.CounterVec
 	SyncServerPerfCallDurationSeconds         *prometheus.HistogramVec
 
+	StorageLockWaitTotal   *prometheus.CounterVec
+	StorageLockWaitSeconds *prometheus.HistogramVec
+	StorageCodecSeconds    *prometheus.HistogramVec
+
 	Info *prometheus.GaugeVec
 	Up   prometheus.Gauge
 
@@ -390,6 +397,35 @@ func NewMetrics(procName string) *Metrics {
 			"method",
 		}),
 
+		StorageLockWaitTotal: factory.NewCounterVec(prometheus.CounterOpts{
+			Namespace: ns,
+			Subsystem: StorageSubsystem,
+			Name:      "lock_wait_total",
+			Help:      "Number of storage lock acquisitions",
+		}, []string{
+			"method",
+		}),
+
+		StorageLockWaitSeconds: factory.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: ns,
+			Subsystem: StorageSubsystem,
+			Name:      "lock_wait_seconds",
+			Buckets:   []float64{},
+			Help:      "Duration of waiting for the storage lock",
+		}, []string{
+			"method",
+		}),
+
+		StorageCodecSeconds: factory.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: ns,
+			Subsystem: StorageSubsystem,
+			Name:      "codec_seconds",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 2, 12),
+			Help:      "CPU time of encoding or decoding a blob",
+		}, []string{
+			"op",
+		}),
+
 		PeerScores: factory.NewGaugeVec(prometheus.GaugeOpts{
 			Namespace: ns,
 			Subsystem: "p2p",
@@ -596,6 +632,15 @@ func (m *Metrics) ServerRecordTimeUsed(method string) func() {
 	}
 }
 
+func (m *Metrics) RecordLockWait(method string, wait time.Duration) {
+	m.StorageLockWaitTotal.WithLabelValues(method).Inc()
+	m.StorageLockWaitSeconds.WithLabelValues(method).Observe(wait.Seconds())
+}
+
+func (m *Metrics) RecordCodec(op string, duration time.Duration) {
+	m.StorageCodecSeconds.WithLabelValues(op).Observe(duration.Seconds())
+}
+
 func (m *Metrics) RecordBandwidth(ctx context.Context, bwc *libp2pmetrics.BandwidthCounter) {
 	tick := time.NewTicker(10 * time.Second)
 	defer tick.Stop()
@@ -684,6 +729,12 @@ func (n *noopMetricer) ServerRecordTimeUsed(method string) func() {
 	return func() {}
 }
 
+func (n *noopMetricer) RecordLockWait(method string, wait time.Duration) {
+}
+
+func (n *noopMetricer) RecordCodec(op string, duration time.Duration) {
+}
+
 func (m *noopMetricer) RecordGossipEvent(evType int32) {
 }
 
@@ -127,6 +127,7 @@ func (n *EsNode) init(ctx context.Context, cfg *Config) error {
 }
 
 func (n *EsNode) initL2(ctx context.Context, cfg *Config) error {
+	n.storageManager.MaxInFlightBytes = cfg.Downloader.MaxInFlightBytes
 	n.downloader = downloader.NewDownloader(
 		n.l1Source,
 		n.l1Beacon,
@@ -209,6 +210,7 @@ func (n *EsNode) initStorageManager(ctx context.Context, cfg *Config) error {
 	if shardManager.IsComplete() != nil {
 		return fmt.Errorf("shard is not completed")
 	}
+	shardManager.SetMaskCache(cfg.Storage.MaskCacheSize)
 
 	log.Info("Initialized storage",
 		"miner", cfg.Storage.Miner,
@@ -217,7 +219,61 @@ func (n *EsNode) initStorageManager(ctx context.Context, cfg *Config) error {
 		"chunkSize", shardManager.ChunkSize(),
 		"kvsPerShard", shardManager.KvEntries())
 
+	levels, err := ethstorage.ParseLogLevels(cfg.Storage.LogLevels)
+	if err != nil {
+		return err
+	}
+	for subsystem, lvl := range levels {
+		if err = ethstorage.SetLogLevel(subsystem, lvl); err != nil {
+			return err
+		}
+	}
+
 	n.storageManager = ethstorage.NewStorageManager(shardManager, n.l1Source)
+	n.storageManager.MetaConfirmations = cfg.Storage.MetaConfirmations
+	n.storageManager.MetaBatchMin = cfg.Storage.MetaBatchMin
+	n.storageManager.MetaBatchMax = cfg.Storage.MetaBatchMax
+	n.storageManager.MetaBandwidth = cfg.Storage.MetaBandwidth
+	n.storageManager.DownloadBatchMax = cfg.Storage.DownloadBatchMax
+	n.storageManager.CommitThreadNum = cfg.Storage.CommitThreadNum
+	if cfg.Storage.MetaIndexOnDisk {
+		if err := n.storageManager.SetMetaIndexDB(n.db); err != nil {
+			return err
+		}
+	}
+	n.storageManager.DiskTimeout = cfg.Storage.DiskTimeout
+	n.storageManager.DiskFullRetry = cfg.Storage.DiskFullRetry
+	if cfg.Storage.HashSize != 0 {
+		if err := n.storageManager.SetHashSize(cfg.Storage.HashSize); err != nil {
+			return err
+		}
+	}
+	if cfg.Storage.MetaCheckpoint {
+		n.storageManager.MetaCheckpointDir = cfg.ResolvePath("metacheckpoint")
+	}
+	if cfg.Storage.L1Checkpoint {
+		n.storageManager.L1CheckpointFile = cfg.ResolvePath("l1checkpoint.json")
+	}
+	if cfg.Metrics.Enabled {
+		n.storageManager.SetMetrics(n.metrics)
+	}
+	if cfg.Storage.VerifyOnStart {
+		for _, shardIdx := range n.storageManager.Shards() {
+			if _, err := n.storageManager.VerifyShard(shardIdx); err != nil {
+				return fmt.Errorf("verify shard %d failed: %w", shardIdx, err)
+			}
+		}
+	}
+	if cfg.Storage.Prewarm {
+		go func() {
+			for _, shardIdx := range n.storageManager.Shards() {
+				if _, err := n.storageManager.PrewarmShard(n.resourcesCtx, shardIdx); err != nil {
+					log.Warn("Prewarm shard failed", "shard", shardIdx, "err", err)
+					return
+				}
+			}
+		}()
+	}
 	return nil
 }
 
@@ -23,11 +23,12 @@ func createSstorage(shardIdxList []uint64, cfg storage.StorageConfig) {
 		files = append(files, fileName)
 		chunkPerfile := cfg.KvSize / cfg.ChunkSize
 		startChunkId := shardIdx * cfg.KvEntriesPerShard * chunkPerfile
-		_, err := ethstorage.Create(fileName, startChunkId, chunkPerfile*cfg.KvEntriesPerShard, 0, cfg.KvSize,
+		df, err := ethstorage.Create(fileName, startChunkId, chunkPerfile*cfg.KvEntriesPerShard, 0, cfg.KvSize,
 			ethstorage.ENCODE_ETHASH, cfg.Miner, cfg.ChunkSize)
 		if err != nil {
 			log.Crit("Open failed", "error", err)
 		}
+		df.Close()
 	}
 	cfg.Filenames = files
 }
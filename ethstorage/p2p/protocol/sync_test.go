@@ -19,6 +19,7 @@ import (
 	"github.com/ethereum/go-ethereum"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/event"
 	"github.com/ethereum/go-ethereum/log"
@@ -78,6 +79,7 @@ func GenerateMetadata(idx, size uint64, hash []byte) common.Hash {
 
 type mockL1Source struct {
 	lastBlobIndex uint64
+	finalized     int64
 	metaFile      *os.File
 }
 
@@ -122,6 +124,13 @@ func (l1 *mockL1Source) GetStorageLastBlobIdx(blockNumber int64) (uint64, error)
 	return l1.lastBlobIndex, nil
 }
 
+func (l1 *mockL1Source) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	if number.Sign() < 0 {
+		return &types.Header{Number: new(big.Int).SetInt64(l1.finalized)}, nil
+	}
+	return &types.Header{Number: new(big.Int).Set(number)}, nil
+}
+
 type mockStorageManagerReader struct {
 	kvEntries       uint64
 	maxKvSize       uint64
@@ -197,12 +206,12 @@ func createEthStorage(contract common.Address, shardIdxList []uint64, chunkSize,
 		fileName := fmt.Sprintf(".\\ss%d.dat", shardIdx)
 		files = append(files, fileName)
 		startChunkId := shardIdx * chunkPerKv * kvEntries
-		_, err := ethstorage.Create(fileName, startChunkId, kvEntries*chunkPerKv, 0, kvSize, encodeType, miner, sm.ChunkSize())
+		df, err := ethstorage.Create(fileName, startChunkId, kvEntries*chunkPerKv, 0, kvSize, encodeType, miner, sm.ChunkSize())
 		if err != nil {
 			log.Crit("open failed", "error", err)
 		}
+		df.Close()
 
-		var df *ethstorage.DataFile
 		df, err = ethstorage.OpenDataFile(fileName)
 		if err != nil {
 			log.Crit("open failed", "error", err)
@@ -135,6 +135,10 @@ type StorageManager interface {
 	DecodeKV(kvIdx uint64, b []byte, hash common.Hash, providerAddr common.Address, encodeType uint64) ([]byte, bool, error)
 
 	DownloadAllMetas(ctx context.Context, batchSize uint64) error
+
+	ShouldThrottle() bool
+
+	PendingWriteDepth() int64
 }
 
 type SyncClient struct {
@@ -580,11 +584,16 @@ func (s *SyncClient) mainLoop() {
 			s.saveSyncStatus(true)
 			return
 		}
-		s.assignBlobRangeTasks()
-		// Assign all the Data retrieval tasks to any free peers
-		s.assignBlobHealTasks()
+		// Stop requesting more blobs while the local storage cannot keep up with the commits
+		if s.storageManager.ShouldThrottle() {
+			s.log.Debug("Sync throttled by storage", "pendingWrites", s.storageManager.PendingWriteDepth())
+		} else {
+			s.assignBlobRangeTasks()
+			// Assign all the Data retrieval tasks to any free peers
+			s.assignBlobHealTasks()
 
-		s.assignFillEmptyBlobTasks()
+			s.assignFillEmptyBlobTasks()
+		}
 
 		select {
 		case <-time.After(requestTimeoutInMillisecond):
@@ -0,0 +1,44 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"context"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// L1FinalizedStep is the number of the blocks finalized at a time, i.e. an epoch of 32 slots, by which DownloadFinished
+// advances localL1 in most cases.
+const L1FinalizedStep = 32
+
+// PendingL1Range This function returns the blocks (from, to] still to be processed by DownloadFinished, where from
+// is localL1 and to is the finalized head of L1, so the sync driver schedules the DownloadFinished calls without
+// looking up the head itself, e.g. by NextL1Step. Return from == to when localL1 is caught up with the finalized head.
+func (s *StorageManager) PendingL1Range(ctx context.Context) (int64, int64, error) {
+	header, err := s.getL1Source().HeaderByNumber(ctx, big.NewInt(rpc.FinalizedBlockNumber.Int64()))
+	if err != nil {
+		return 0, 0, err
+	}
+	s.rlock("PendingL1Range")
+	from := s.localL1
+	s.mu.RUnlock()
+
+	to := header.Number.Int64()
+	// localL1 may be ahead of the head of a lagging l1 source, which has nothing to process either
+	if to < from {
+		to = from
+	}
+	return from, to, nil
+}
+
+// NextL1Step returns the block to pass to the next DownloadFinished for the pending range (from, to], which is one
+// L1FinalizedStep after from, or to if it is closer, e.g. after the node was down for a while.
+func NextL1Step(from, to int64) int64 {
+	if to-from > L1FinalizedStep {
+		return from + L1FinalizedStep
+	}
+	return to
+}
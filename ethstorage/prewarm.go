@@ -0,0 +1,72 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// prewarmReadSize is the size of each sequential read of PrewarmShard
+const prewarmReadSize = 4 * 1024 * 1024
+
+// PrewarmShard This function reads the data files of the shard sequentially to populate the OS page cache, e.g. at
+// the start of a node serving frequent reads, so the first reads of the blobs do not wait for the disk. The files are
+// read without the lock, so the commits are not blocked, and the reads are stopped once ctx is cancelled. Return the
+// number of bytes read.
+func (s *StorageManager) PrewarmShard(ctx context.Context, shardIdx uint64) (uint64, error) {
+	if err := s.acquire(); err != nil {
+		return 0, err
+	}
+	defer s.release()
+
+	s.mu.Lock()
+	ds, ok := s.shardManager.getDataShard(shardIdx)
+	files := 0
+	if ok {
+		files = len(ds.dataFiles)
+	}
+	s.mu.Unlock()
+	if !ok {
+		return 0, ErrShardNotManaged
+	}
+
+	ts := s.Clock.Now()
+	total := uint64(0)
+	for i := 0; i < files; i++ {
+		n, err := prewarmFile(ctx, ds, i)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	log.Info("Shard prewarmed", "shard", shardIdx, "bytes", total, "time", s.Clock.Now().Sub(ts).Seconds())
+	return total, nil
+}
+
+// prewarmFile reads the i-th data file of the shard sequentially until the end or ctx is cancelled, and returns the
+// number of bytes read. Each read is made under ds.filesMu, so if the file is replaced meanwhile, e.g. by
+// CompactShard, the reads go on from the new file instead of the closed one.
+func prewarmFile(ctx context.Context, ds *DataShard, i int) (uint64, error) {
+	buf := make([]byte, prewarmReadSize)
+	total := uint64(0)
+	for {
+		if err := ctx.Err(); err != nil {
+			return total, err
+		}
+		ds.filesMu.RLock()
+		n, err := ds.dataFiles[i].file.ReadAt(buf, int64(total))
+		ds.filesMu.RUnlock()
+		total += uint64(n)
+		if errors.Is(err, io.EOF) {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// ProofInputs is the witness of the storage proof of a sample, as taken by the GetStorageProof of the provers.
+type ProofInputs struct {
+	KvIdx         uint64
+	SampleIdxInKv uint64
+	Commit        common.Hash // commit in the local meta, of which only the hash size bytes are kept
+	EncodingKey   common.Hash // key the blob is encoded with, derived from the commit, the miner and the chunk
+	EncodedSample common.Hash // sample as stored, i.e. the value read by ReadSample
+	Data          []byte      // decoded blob of kvSize bytes, from which the proof of the sample in the blob is built
+}
+
+// GetProofInputs This function returns the witness of the storage proof of a sample, i.e. the encoded sample along
+// with the decoded blob and the encoding key it is proven with, which are read under a single lock acquisition, so
+// the sample and the blob are never of different commits as they may be if read by ReadSampleUnlocked and TryRead.
+// The sample index is global as in ReadSampleUnlocked. It returns ErrSampleOutOfRange if the sample is not in the
+// owned range of the shard, ErrSampleNotSynced if its blob is not synced, or an error if the blob does not match the
+// commit in its local meta.
+func (s *StorageManager) GetProofInputs(shardIdx, sampleIdx uint64) (*ProofInputs, error) {
+	s.rlock("GetProofInputs")
+	defer s.mu.RUnlock()
+
+	ds, ok := s.shardManager.getDataShard(shardIdx)
+	if !ok {
+		return nil, ErrShardNotManaged
+	}
+	samplesPerKv := s.shardManager.kvSize / 32
+	kvIdx := sampleIdx / samplesPerKv
+	if !ds.Owns(kvIdx) {
+		return nil, fmt.Errorf("%w: sample %d, shard %d", ErrSampleOutOfRange, sampleIdx, shardIdx)
+	}
+	m, _, err := s.tryReadMeta(kvIdx)
+	if err != nil {
+		return nil, err
+	}
+	hashSize := s.hashSize()
+	if !isFilledN(common.BytesToHash(m), hashSize) {
+		return nil, fmt.Errorf("%w: sample %d, kvIdx %d", ErrSampleNotSynced, sampleIdx, kvIdx)
+	}
+
+	// the blob is decoded with and checked against the commit in its local meta
+	data, m, _, err := s.tryReadWithMeta(kvIdx, int(s.shardManager.kvSize))
+	if err != nil {
+		return nil, err
+	}
+	sample, err := ds.ReadSample(sampleIdx)
+	if err != nil {
+		return nil, err
+	}
+	inputs := &ProofInputs{
+		KvIdx:         kvIdx,
+		SampleIdxInKv: sampleIdx % samplesPerKv,
+		EncodedSample: sample,
+		Data:          data,
+	}
+	copy(inputs.Commit[:hashSize], m)
+	chunkIdx := sampleIdx * 32 / s.shardManager.chunkSize
+	inputs.EncodingKey = calcEncodeKey(inputs.Commit, chunkIdx, ds.Miner())
+	return inputs, nil
+}
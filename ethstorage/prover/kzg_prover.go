@@ -113,3 +113,45 @@ func reverseBits(x uint64) uint64 {
 	// Find index irev, such that i and irev get swapped
 	return bits.Reverse64(x) >> shiftCorrection
 }
+
+// PointEvaluation is the point evaluation input generated by GenerateKZGProof, which proves that the blob committed
+// by Commitment evaluates to ClaimedValue at Point.
+type PointEvaluation struct {
+	VersionedHash common.Hash
+	Point         [32]byte
+	ClaimedValue  common.Hash
+	Commitment    [48]byte
+	Proof         [48]byte
+}
+
+// ParsePointEvaluation parses the point evaluation input generated by GenerateKZGProof.
+func ParsePointEvaluation(peInput []byte) (*PointEvaluation, error) {
+	var pe PointEvaluation
+	if len(peInput) != len(pe.VersionedHash)+len(pe.Point)+len(pe.ClaimedValue)+len(pe.Commitment)+len(pe.Proof) {
+		return nil, fmt.Errorf("invalid point evaluation input size: %v", len(peInput))
+	}
+	b := peInput
+	b = b[copy(pe.VersionedHash[:], b):]
+	b = b[copy(pe.Point[:], b):]
+	b = b[copy(pe.ClaimedValue[:], b):]
+	b = b[copy(pe.Commitment[:], b):]
+	copy(pe.Proof[:], b)
+	return &pe, nil
+}
+
+// VerifyKZGProof returns whether pe is a valid proof of the sample at sampleIdx of the blob, i.e. the versioned hash
+// is of the commitment, the point is the one of sampleIdx, and the KZG proof is valid.
+func (p *KZGProver) VerifyKZGProof(pe *PointEvaluation, sampleIdx uint64) bool {
+	if sampleIdx >= gokzg4844.ScalarsPerBlob {
+		return false
+	}
+	if eth.KZGToVersionedHash(eth.KZGCommitment(pe.Commitment)) != eth.VersionedHash(pe.VersionedHash) {
+		return false
+	}
+	var xe fr.Element
+	if gokzg4844.SerializeScalar(*xe.Exp(p.ru, new(big.Int).SetUint64(reverseBits(sampleIdx)))) != pe.Point {
+		return false
+	}
+	err := p.ctx.VerifyKZGProof(pe.Commitment, pe.Point, gokzg4844.Scalar(pe.ClaimedValue), pe.Proof)
+	return err == nil
+}
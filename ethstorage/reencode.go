@@ -0,0 +1,202 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+const (
+	// reEncodeFileSuffix is appended to the name of the first data file of a shard to store the progress of re-encoding
+	reEncodeFileSuffix = ".reencode"
+	// reEncodeCheckpointInterval is the number of blobs re-encoded between two progress checkpoints
+	reEncodeCheckpointInterval = 64
+)
+
+type reEncodeProgress struct {
+	OldMiner common.Address `json:"oldMiner"`
+	NewMiner common.Address `json:"newMiner"`
+	Next     uint64         `json:"next"` // the next kvIdx to re-encode
+}
+
+func readReEncodeProgress(filename string) (*reEncodeProgress, error) {
+	bs, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	progress := &reEncodeProgress{}
+	if err = json.Unmarshal(bs, progress); err != nil {
+		return nil, err
+	}
+	return progress, nil
+}
+
+// writeReEncodeProgress writes the progress by writeJSONSynced, so the progress file is never torn.
+func writeReEncodeProgress(filename string, progress *reEncodeProgress) error {
+	return writeJSONSynced(filename, progress)
+}
+
+// ReEncodeShard This function re-encodes all the blobs of a shard for a new miner (storage provider) address, e.g.
+// when the shard is transferred to another miner, and updates the miner in the headers of the data files. The data
+// files are rewritten in place, and the progress is checkpointed next to them so that calling ReEncodeShard again
+// with the same newMiner resumes an interrupted re-encoding. Until it completes, the shard holds blobs encoded with
+// both miners, so it must not be served by a restarted node before the re-encoding is resumed.
+// The lock is held for the whole re-encoding, so reads and commits are blocked until it finishes. ErrShardCompacting
+// is returned if the shard is being compacted by CompactShard, or its compaction is unfinished, as the compaction
+// would keep the data copied before the re-encoding.
+func (s *StorageManager) ReEncodeShard(shardIdx uint64, newMiner common.Address) error {
+	if err := s.enterSync(); err != nil {
+		return err
+	}
+	defer s.exitSync()
+	if err := s.acquire(); err != nil {
+		return err
+	}
+	defer s.release()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ds, ok := s.shardManager.getDataShard(shardIdx)
+	if !ok {
+		return ErrShardNotManaged
+	}
+	filenames := ds.Filenames()
+	if len(filenames) == 0 {
+		return fmt.Errorf("shard %d has no data file", shardIdx)
+	}
+	if s.compacting[shardIdx] {
+		return ErrShardCompacting
+	}
+	for _, filename := range filenames {
+		if _, err := os.Stat(filename + compactFileSuffix); err == nil {
+			return fmt.Errorf("%w: unfinished compaction of %s", ErrShardCompacting, filename)
+		}
+	}
+	progressFile := filenames[0] + reEncodeFileSuffix
+
+	first, limit := ds.KvRange()
+	progress, err := readReEncodeProgress(progressFile)
+	if errors.Is(err, os.ErrNotExist) {
+		if ds.Miner() == newMiner {
+			return nil
+		}
+		progress = &reEncodeProgress{OldMiner: ds.Miner(), NewMiner: newMiner, Next: first}
+	} else if err != nil {
+		return fmt.Errorf("read re-encode progress failed: %w", err)
+	} else if progress.NewMiner != newMiner {
+		return fmt.Errorf("unfinished re-encoding of shard %d to miner %s", shardIdx, progress.NewMiner.Hex())
+	}
+	log.Info("Begin to re-encode shard", "shard", shardIdx, "oldMiner", progress.OldMiner, "newMiner", newMiner, "next", progress.Next)
+
+	// the miner in the headers is updated at the end, so it still is the old miner when resuming
+	if ds.Miner() != newMiner {
+		for kvIdx := progress.Next; kvIdx < limit; kvIdx++ {
+			if err = s.reEncodeKV(ds, kvIdx, progress.OldMiner, newMiner); err != nil {
+				return fmt.Errorf("re-encode kv %d failed: %w", kvIdx, err)
+			}
+			if (kvIdx+1-first)%reEncodeCheckpointInterval == 0 || kvIdx+1 == limit {
+				if err = ds.Sync(); err != nil {
+					return err
+				}
+				progress.Next = kvIdx + 1
+				if err = writeReEncodeProgress(progressFile, progress); err != nil {
+					return err
+				}
+			}
+		}
+		if err = ds.SetMiner(newMiner); err != nil {
+			return err
+		}
+	}
+
+	if err = os.Remove(progressFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	log.Info("Shard re-encoded", "shard", shardIdx, "newMiner", newMiner)
+	return nil
+}
+
+// reEncodeKV decodes the blob with the old miner and encodes it with the new miner. Blobs that have never been
+// filled are skipped, as their data is not initialized. The decoded blob is checked against its commit before it is
+// written, so re-encoding a kv is idempotent: a blob already encoded with the new miner, e.g. re-encoded after the
+// last progress checkpoint before a crash, is skipped, and a blob matching neither, i.e. torn, is flagged for resync
+// like VerifyShard does, instead of being garbled by the masks of both miners.
+func (s *StorageManager) reEncodeKV(ds *DataShard, kvIdx uint64, oldMiner, newMiner common.Address) error {
+	meta, err := ds.ReadMeta(kvIdx)
+	if err != nil {
+		return err
+	}
+	commit := common.BytesToHash(meta)
+	if !s.isFilled(commit) {
+		return nil
+	}
+
+	encodeType := ds.EncodeType()
+	decodeWith := func(miner common.Address) ([]byte, error) {
+		return ds.readWith(kvIdx, int(ds.kvSize), func(cdata []byte, chunkIdx uint64) []byte {
+			return decodeChunk(ds.chunkSize, cdata, encodeType, calcEncodeKey(commit, chunkIdx, miner))
+		})
+	}
+	data, err := decodeWith(oldMiner)
+	if err != nil {
+		return err
+	}
+	if checkCommit(commit, data) != nil {
+		reEncoded, err := decodeWith(newMiner)
+		if err != nil {
+			return err
+		}
+		if checkCommit(commit, reEncoded) == nil {
+			return nil
+		}
+		log.Warn("Torn blob found by re-encoding and flagged for resync", "kvIdx", kvIdx)
+		if err = ds.WriteMeta(kvIdx, common.Hash{}.Bytes()); err != nil {
+			return err
+		}
+		s.updateFill(kvIdx, common.Hash{})
+		return nil
+	}
+	return ds.WriteWith(kvIdx, data, commit, func(cdata []byte, chunkIdx uint64) []byte {
+		return encodeChunk(ds.chunkSize, cdata, encodeType, calcEncodeKey(commit, chunkIdx, newMiner))
+	})
+}
+
+// StoredProvider This function returns the miner (storage provider) address with which the stored blob is encoded,
+// to decode it by DecodeKV. It always equals the miner of the shard returned by GetShardMiner, except while the shard
+// is being re-encoded by ReEncodeShard after an interruption, when the blobs already re-encoded by the progress
+// checkpoint are encoded with the new miner. As ReEncodeShard holds the lock until it completes, the exception is
+// only visible before an interrupted re-encoding is resumed.
+func (s *StorageManager) StoredProvider(kvIdx uint64) (common.Address, error) {
+	s.rlock("StoredProvider")
+	defer s.mu.RUnlock()
+
+	ds, ok := s.shardManager.getDataShard(kvIdx / s.shardManager.kvEntries)
+	if !ok {
+		return common.Address{}, ErrShardNotManaged
+	}
+	if !ds.Owns(kvIdx) {
+		return common.Address{}, fmt.Errorf("%w: kvIdx %d", ErrNotOwned, kvIdx)
+	}
+	filenames := ds.Filenames()
+	if len(filenames) == 0 {
+		return ds.Miner(), nil
+	}
+	progress, err := readReEncodeProgress(filenames[0] + reEncodeFileSuffix)
+	if errors.Is(err, os.ErrNotExist) {
+		return ds.Miner(), nil
+	} else if err != nil {
+		return common.Address{}, fmt.Errorf("read re-encode progress failed: %w", err)
+	}
+	// the miner in the headers is updated once all the blobs are re-encoded
+	if ds.Miner() != progress.NewMiner && kvIdx < progress.Next {
+		return progress.NewMiner, nil
+	}
+	return ds.Miner(), nil
+}
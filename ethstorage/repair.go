@@ -0,0 +1,127 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// repairBatchSize is the number of local metas compared under one lock acquisition by RepairDivergentBlobs
+const repairBatchSize = 256
+
+// BlobFetcher fetches the blob of the kv with the commit from a remote source, e.g. an archive service or the peers.
+type BlobFetcher func(ctx context.Context, kvIdx uint64, commit common.Hash) ([]byte, error)
+
+// RepairResult is the result of RepairDivergentBlobs.
+type RepairResult struct {
+	Divergent uint64   // number of the blobs whose local meta disagrees with the contract meta
+	Repaired  uint64   // number of the divergent blobs recommitted
+	Failed    []uint64 // kv indices of the divergent blobs failed to fetch or commit, to be retried
+}
+
+// RepairDivergentBlobs This function finds the filled blobs of the managed shards whose local meta disagrees with
+// the downloaded contract meta, and recommits them with the blobs fetched by fetch, or with empty data if the
+// contract commit is empty. The blobs not downloaded yet are left to the sync. The shards are scanned in batches of
+// repairBatchSize and the divergent blobs of a batch are repaired before the next one is scanned, so the repairs
+// made before ctx is cancelled are kept and returned with ctx.Err(). The blobs failed to fetch or commit are listed
+// in the result instead of failing the repair.
+func (s *StorageManager) RepairDivergentBlobs(ctx context.Context, fetch BlobFetcher) (*RepairResult, error) {
+	res := &RepairResult{}
+	for _, shardIdx := range s.Shards() {
+		start, end, ok := s.OwnedKvRange(shardIdx)
+		if !ok {
+			continue
+		}
+		for from := start; from < end; from += repairBatchSize {
+			if err := ctx.Err(); err != nil {
+				return res, err
+			}
+			to := from + repairBatchSize
+			if to > end {
+				to = end
+			}
+			kvIndices, commits, err := s.findDivergent(from, to)
+			if err != nil {
+				return res, err
+			}
+			res.Divergent += uint64(len(kvIndices))
+			for i, kvIdx := range kvIndices {
+				if err = ctx.Err(); err != nil {
+					return res, err
+				}
+				if err = s.repairBlob(ctx, kvIdx, commits[i], fetch); err != nil {
+					commitLog.Warn("Repair blob failed", "kvIdx", kvIdx, "commit", commits[i], "err", err)
+					res.Failed = append(res.Failed, kvIdx)
+					continue
+				}
+				res.Repaired++
+			}
+		}
+	}
+	if res.Divergent > 0 {
+		commitLog.Info("Divergent blobs repaired", "divergent", res.Divergent, "repaired", res.Repaired, "failed", len(res.Failed))
+	}
+	return res, nil
+}
+
+// findDivergent returns the kv indices in [from, to) whose local meta is filled but disagrees with the downloaded
+// contract meta, and the contract commits of them.
+func (s *StorageManager) findDivergent(from, to uint64) ([]uint64, []common.Hash, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	hashSize := s.hashSize()
+	var (
+		kvIndices []uint64
+		commits   []common.Hash
+	)
+	for kvIdx := from; kvIdx < to; kvIdx++ {
+		if !s.syncAllowlist.contains(kvIdx) {
+			continue
+		}
+		m, success, err := s.tryReadMeta(kvIdx)
+		if err != nil {
+			return nil, nil, err
+		}
+		localMeta := common.BytesToHash(m)
+		if !success || !s.isFilled(localMeta) {
+			continue
+		}
+		var contractMeta [32]byte
+		if meta, ok := s.blobMetas.get(kvIdx); ok {
+			contractMeta = meta
+		} else if kvIdx < s.lastKvIdx {
+			continue
+		}
+		// the meta beyond lastKvIdx is taken as empty
+		if bytes.Equal(contractMeta[32-hashSize:], localMeta[0:hashSize]) {
+			continue
+		}
+		commit := common.Hash{}
+		copy(commit[0:hashSize], contractMeta[32-hashSize:])
+		kvIndices = append(kvIndices, kvIdx)
+		commits = append(commits, commit)
+	}
+	return kvIndices, commits, nil
+}
+
+// repairBlob recommits the blob of the kv with the commit, with empty data if the commit is empty.
+func (s *StorageManager) repairBlob(ctx context.Context, kvIdx uint64, commit common.Hash, fetch BlobFetcher) error {
+	if commit == (common.Hash{}) {
+		inserted, _, err := s.CommitEmptyBlobs(kvIdx, kvIdx)
+		if err == nil && inserted == 0 {
+			err = errors.New("empty blob not committed")
+		}
+		return err
+	}
+	blob, err := fetch(ctx, kvIdx, commit)
+	if err != nil {
+		return err
+	}
+	return s.CommitBlob(kvIdx, blob, commit)
+}
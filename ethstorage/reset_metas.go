@@ -0,0 +1,105 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"math/big"
+
+	"github.com/ethstorage/go-ethstorage/ethstorage/eth"
+)
+
+// ResetAndInvalidateMetas This function is like Reset, but also drops the downloaded metas which may be stale at
+// newL1, i.e. those of the kvs updated between the local L1 view and newL1, and those beyond the lastKvIdx at newL1.
+// If the updated kvs cannot be found as the l1 source does not implement Il1LogSource, all the metas are dropped.
+// Use it instead of Reset to move a running node to another block, e.g. after a reorg, unless the caller refreshes
+// the metas right after by DownloadAllMetas. The commits of the kvs whose metas are dropped fail until the metas are
+// downloaded again, and MetasReady reports false until then. Return the number of the metas dropped.
+func (s *StorageManager) ResetAndInvalidateMetas(newL1 int64) (int, error) {
+	if err := s.enterSync(); err != nil {
+		return 0, err
+	}
+	defer s.exitSync()
+	s.reconcileRestoredMetas(newL1)
+	hash := s.fetchL1Hash(newL1)
+
+	s.mu.Lock()
+	localL1 := s.localL1
+	s.mu.Unlock()
+
+	updated, all, err := s.updatedKvsBetween(localL1, newL1)
+	if err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	lastKvIdx, err := s.getStorageLastBlobIdx(newL1)
+	if err != nil {
+		return 0, err
+	}
+	// the updated kvs are unknown if localL1 changed meanwhile, e.g. by DownloadFinished
+	all = all || s.localL1 != localL1
+
+	s.metasMu.Lock()
+	defer s.metasMu.Unlock()
+	dropped := 0
+	if all {
+		dropped = s.blobMetas.len()
+		s.blobMetas.clear()
+		s.shardMetasL1 = nil
+	} else {
+		for _, kvIdx := range updated {
+			if _, ok := s.blobMetas.get(kvIdx); ok {
+				s.blobMetas.delete(kvIdx)
+				s.dropShardMetasL1(kvIdx / s.shardManager.kvEntries)
+				dropped++
+			}
+		}
+		before := s.blobMetas.len()
+		s.blobMetas.deleteFrom(lastKvIdx)
+		if s.blobMetas.len() < before {
+			dropped += before - s.blobMetas.len()
+			for shardIdx := range s.shardMetasL1 {
+				if (shardIdx+1)*s.shardManager.kvEntries > lastKvIdx {
+					s.dropShardMetasL1(shardIdx)
+				}
+			}
+		}
+	}
+	if dropped > 0 {
+		s.metasDownloaded = false
+	}
+
+	s.lastKvIdx = lastKvIdx
+	s.setLocalL1(newL1, hash)
+	s.resetMetaUpdates(newL1)
+	s.lastDownloadTime = s.Clock.Now()
+	metaLog.Info("Reset with the stale metas dropped", "from", localL1, "to", newL1, "lastKvIdx", lastKvIdx, "dropped", dropped)
+	return dropped, nil
+}
+
+// updatedKvsBetween returns the kvs updated in the blocks between l1a and l1b, or all as true if they cannot be
+// found as the l1 source does not implement Il1LogSource.
+func (s *StorageManager) updatedKvsBetween(l1a, l1b int64) ([]uint64, bool, error) {
+	if l1a == l1b {
+		return nil, false, nil
+	}
+	if l1a > l1b {
+		l1a, l1b = l1b, l1a
+	}
+	logSource, ok := s.getL1Source().(Il1LogSource)
+	if !ok {
+		return nil, true, nil
+	}
+	events, err := logSource.FilterLogsByBlockRange(big.NewInt(l1a+1), big.NewInt(l1b), eth.PutBlobEvent)
+	if err != nil {
+		return nil, false, err
+	}
+	updated := make([]uint64, 0, len(events))
+	for _, event := range events {
+		updated = append(updated, new(big.Int).SetBytes(event.Topics[1][:]).Uint64())
+	}
+	return updated, false, nil
+}
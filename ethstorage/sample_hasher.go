@@ -0,0 +1,35 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// SampleHasher computes the sample returned by ReadSample from the raw 32 bytes of the encoded data at the sample
+// index, so that a proof scheme with a different sampling hash can be adopted without changing the storage files.
+type SampleHasher interface {
+	HashSample(sampleIdx uint64, raw []byte) common.Hash
+}
+
+// RawSampleHasher is the default SampleHasher, which returns the raw encoded data as the sample as required by the
+// current proof scheme.
+type RawSampleHasher struct{}
+
+func (RawSampleHasher) HashSample(sampleIdx uint64, raw []byte) common.Hash {
+	return common.BytesToHash(raw)
+}
+
+// SetSampleHasher This function sets the SampleHasher of the samples read from all the shards, including those added
+// later. It must be called before the samples are read, e.g. before mining is started, as the samples are read
+// without the lock. A nil hasher restores RawSampleHasher.
+func (sm *ShardManager) SetSampleHasher(h SampleHasher) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	sm.sampleHasher = h
+	for _, ds := range sm.shardMap {
+		ds.sampleHasher = h
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+	prv "github.com/ethstorage/go-ethstorage/ethstorage/prover"
+)
+
+var ErrSampleNotSynced = errors.New("blob of the sample is not synced yet")
+
+var (
+	// kzgVerifier is created on the first use, as loading the trusted setup takes a while
+	kzgVerifier     *prv.KZGProver
+	kzgVerifierOnce sync.Once
+)
+
+func getKZGVerifier() *prv.KZGProver {
+	kzgVerifierOnce.Do(func() {
+		kzgVerifier = prv.NewKZGProver(log.Root())
+	})
+	return kzgVerifier
+}
+
+// VerifySampleProof This function checks the proof of a sample against the local storage before it is submitted, so
+// an invalid proof does not waste the gas of a mining transaction. The proof is the point evaluation input generated
+// by KZGProver.GenerateKZGProof for the blob of the sample, which is valid if the KZG proof is of the sample index in
+// the blob, its versioned hash matches the commit in the local meta of the kv, and its claimed value is the local
+// sample, i.e. the encoded data read by ReadSample without the SampleHasher, decoded with the encoding key of the shard.
+// Return false with no error if the proof is invalid, or an error if the proof is malformed or the sample cannot
+// be read, e.g. ErrSampleOutOfRange or ErrSampleNotSynced.
+func (s *StorageManager) VerifySampleProof(shardIdx, sampleIdx uint64, proof []byte) (bool, error) {
+	pe, err := prv.ParsePointEvaluation(proof)
+	if err != nil {
+		return false, err
+	}
+
+	s.rlock("VerifySampleProof")
+	ds, ok := s.shardManager.getDataShard(shardIdx)
+	if !ok {
+		s.mu.RUnlock()
+		return false, ErrShardNotManaged
+	}
+	samplesPerKv := s.shardManager.kvSize / 32
+	kvIdx := sampleIdx / samplesPerKv
+	if !ds.Owns(kvIdx) {
+		s.mu.RUnlock()
+		return false, fmt.Errorf("%w: sample %d, shard %d", ErrSampleOutOfRange, sampleIdx, shardIdx)
+	}
+	m, _, err := s.tryReadMeta(kvIdx)
+	var sample common.Hash
+	if err == nil {
+		sample, err = ds.readRawSample(sampleIdx)
+	}
+	hashSize, miner, encodeType := s.hashSize(), ds.Miner(), ds.EncodeType()
+	s.mu.RUnlock()
+	if err != nil {
+		return false, err
+	}
+	localMeta := common.BytesToHash(m)
+	if !isFilledN(localMeta, hashSize) {
+		return false, fmt.Errorf("%w: sample %d, kvIdx %d", ErrSampleNotSynced, sampleIdx, kvIdx)
+	}
+
+	if !bytes.Equal(pe.VersionedHash[:hashSize], localMeta[:hashSize]) {
+		return false, nil
+	}
+	// the mask is the encoded chunk of zeros
+	chunkIdx := sampleIdx * 32 / s.shardManager.chunkSize
+	offset := sampleIdx * 32 % s.shardManager.chunkSize
+	encodeKey := calcEncodeKey(localMeta, chunkIdx, miner)
+	mask := encodeChunk(s.shardManager.chunkSize, nil, encodeType, encodeKey)
+	decoded := UnmaskDataInPlace(sample.Bytes(), mask[offset:offset+32])
+	if !bytes.Equal(decoded, pe.ClaimedValue[:]) {
+		return false, nil
+	}
+	return getKZGVerifier().VerifyKZGProof(pe, sampleIdx%samplesPerKv), nil
+}
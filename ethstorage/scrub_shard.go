@@ -0,0 +1,136 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// DefaultScrubRate is the max number of the blobs checked per second by ScrubShard if ScrubRate is 0
+	DefaultScrubRate = 16
+	// scrubLogInterval is the number of the kvs scrubbed between two logs of the progress
+	scrubLogInterval = 4096
+)
+
+// ScrubResult is the result of ScrubShard.
+type ScrubResult struct {
+	Scrubbed uint64   // number of the synced blobs checked
+	Corrupt  []uint64 // kv indices of the blobs not matching their commits, flagged for resync in order
+	Next     uint64   // kvIdx to scrub next, the end of the shard if completed
+}
+
+// ScrubShard This function checks the synced blobs of the shard for the bit rot of the stored data, by decoding each
+// blob and checking it against the commit in its local meta with the KZG commitment of the data, like VerifyShard.
+// Unlike VerifyShard, it runs in the background of a serving node: each blob is checked under the read lock taken
+// for it alone, and at most ScrubRate blobs (DefaultScrubRate if 0) are checked per second. A corrupt blob is
+// checked again under the lock, in case it was rewritten meanwhile, before its filling bit is cleared like a torn
+// blob, so it is no longer served and is written again by the next commit of it. The progress is logged, and the
+// result is returned with ctx.Err() if ctx is cancelled, with Next to tell where it stopped.
+func (s *StorageManager) ScrubShard(ctx context.Context, shardIdx uint64) (*ScrubResult, error) {
+	if err := s.acquire(); err != nil {
+		return nil, err
+	}
+	defer s.release()
+
+	s.rlock("ScrubShard")
+	start, end, ok := s.OwnedKvRange(shardIdx)
+	s.mu.RUnlock()
+	if !ok {
+		return nil, ErrShardNotManaged
+	}
+	r := s.ScrubRate
+	if r <= 0 {
+		r = DefaultScrubRate
+	}
+	limiter := rate.NewLimiter(rate.Limit(r), 1)
+	logger := log.New("shard", shardIdx)
+	logger.Info("Begin to scrub shard", "start", start, "end", end, "rate", r)
+
+	res := &ScrubResult{Next: start}
+	for ; res.Next < end; res.Next++ {
+		if err := ctx.Err(); err != nil {
+			return res, err
+		}
+		kvIdx := res.Next
+		synced, corrupt, err := s.scrubKV(shardIdx, kvIdx)
+		if err != nil {
+			return res, err
+		}
+		if corrupt {
+			if corrupt, err = s.flagCorrupt(shardIdx, kvIdx); err != nil {
+				return res, err
+			}
+		}
+		if corrupt {
+			res.Corrupt = append(res.Corrupt, kvIdx)
+			logger.Warn("Corrupt blob found and flagged for resync", "kvIdx", kvIdx)
+		}
+		if (kvIdx-start+1)%scrubLogInterval == 0 {
+			logger.Info("Scrubbing shard", "kvIdx", kvIdx, "scrubbed", res.Scrubbed, "corrupt", len(res.Corrupt),
+				"progress", fmt.Sprintf("%.1f%%", float64((kvIdx-start+1)*100)/float64(end-start)))
+		}
+		if !synced {
+			continue
+		}
+		res.Scrubbed++
+		if err := limiter.Wait(ctx); err != nil {
+			res.Next++
+			return res, err
+		}
+	}
+	logger.Info("Shard scrubbed", "scrubbed", res.Scrubbed, "corrupt", len(res.Corrupt), "kvIndices", res.Corrupt)
+	return res, nil
+}
+
+// scrubKV returns whether the blob is synced, and whether it is corrupt as checked by verifyKV, under the read lock.
+func (s *StorageManager) scrubKV(shardIdx, kvIdx uint64) (bool, bool, error) {
+	s.rlock("ScrubShard")
+	defer s.mu.RUnlock()
+
+	ds, ok := s.shardManager.getDataShard(shardIdx)
+	if !ok {
+		return false, false, ErrShardNotManaged
+	}
+	hashSize := s.hashSize()
+	m, err := ds.ReadMeta(kvIdx)
+	if err != nil {
+		return false, false, err
+	}
+	if !isFilledN(common.BytesToHash(m), hashSize) {
+		return false, false, nil
+	}
+	corrupt, err := verifyKV(ds, kvIdx, hashSize)
+	return true, corrupt, err
+}
+
+// flagCorrupt checks the blob again under the lock, and clears the filling bit of its local meta if it is still
+// corrupt. Return whether it is flagged.
+func (s *StorageManager) flagCorrupt(shardIdx, kvIdx uint64) (bool, error) {
+	if err := s.enterSync(); err != nil {
+		return false, err
+	}
+	defer s.exitSync()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ds, ok := s.shardManager.getDataShard(shardIdx)
+	if !ok {
+		return false, ErrShardNotManaged
+	}
+	corrupt, err := verifyKV(ds, kvIdx, s.hashSize())
+	if err != nil || !corrupt {
+		return false, err
+	}
+	if err := ds.WriteMeta(kvIdx, common.Hash{}.Bytes()); err != nil {
+		return false, err
+	}
+	s.updateFill(kvIdx, common.Hash{})
+	return true, nil
+}
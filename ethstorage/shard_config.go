@@ -110,11 +110,11 @@ func IsComplete() error {
 func Shards() map[common.Address][]uint64 {
 	shardList := make(map[common.Address][]uint64, 0)
 	for addr, sm := range ContractToShardManager {
-		if sm != nil && len(sm.shardMap) > 0 {
-			shardList[addr] = make([]uint64, 0, len(sm.shardMap))
-			for idx := range sm.shardMap {
-				shardList[addr] = append(shardList[addr], idx)
-			}
+		if sm == nil {
+			continue
+		}
+		if ids := sm.ShardIds(); len(ids) > 0 {
+			shardList[addr] = ids
 		}
 	}
 
@@ -0,0 +1,137 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"bytes"
+	"math/bits"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// shardFill is the fill state of the kvs of a shard, for ShardCapacities, ShardProgress and LocalHighestFilledIndex.
+// It is loaded by scanning the local metas of the shard once, and then kept up to date by the writes of the local
+// metas, so the queries never scan the metas again.
+type shardFill struct {
+	start  uint64   // first kvIdx of the shard
+	filled []uint64 // bitmap of the offsets whose local meta has the filling bit set
+	synced []uint64 // bitmap of the filled offsets with a synced blob, i.e. not empty filled
+	count  uint64   // number of the bits set in filled
+}
+
+func newShardFill(start, kvEntries uint64) *shardFill {
+	words := (kvEntries + 63) / 64
+	return &shardFill{start: start, filled: make([]uint64, words), synced: make([]uint64, words)}
+}
+
+// set updates the bits of the kv by whether it is filled and synced.
+func (f *shardFill) set(kvIdx uint64, filled, synced bool) {
+	offset := kvIdx - f.start
+	word, bit := offset/64, uint64(1)<<(offset%64)
+	if was := f.filled[word]&bit != 0; was != filled {
+		if filled {
+			f.count++
+		} else {
+			f.count--
+		}
+	}
+	f.filled[word] = setBit(f.filled[word], bit, filled)
+	f.synced[word] = setBit(f.synced[word], bit, synced)
+}
+
+func setBit(word, bit uint64, on bool) uint64 {
+	if on {
+		return word | bit
+	}
+	return word &^ bit
+}
+
+// filledBelow returns the number of the filled kvs before kvIdx.
+func (f *shardFill) filledBelow(kvIdx uint64) uint64 {
+	if kvIdx <= f.start {
+		return 0
+	}
+	offset := kvIdx - f.start
+	if offset >= uint64(len(f.filled))*64 {
+		return f.count
+	}
+	n := 0
+	for _, w := range f.filled[:offset/64] {
+		n += bits.OnesCount64(w)
+	}
+	n += bits.OnesCount64(f.filled[offset/64] & (uint64(1)<<(offset%64) - 1))
+	return uint64(n)
+}
+
+// highestSynced returns the highest synced kvIdx + 1, or 0 if none.
+func (f *shardFill) highestSynced() uint64 {
+	for word := len(f.synced) - 1; word >= 0; word-- {
+		if w := f.synced[word]; w != 0 {
+			return f.start + uint64(word)*64 + uint64(63-bits.LeadingZeros64(w)) + 1
+		}
+	}
+	return 0
+}
+
+// fillBits returns whether the local meta is filled, and whether it is filled with a synced blob.
+func fillBits(meta common.Hash, hashSize int) (bool, bool) {
+	filled := isFilledN(meta, hashSize)
+	return filled, filled && !bytes.Equal(meta[0:hashSize], make([]byte, hashSize))
+}
+
+// shardFillOf returns the fill state of the shard, which is loaded by scanning its local metas the first time. The
+// caller must hold s.mu, for which the read lock is enough, and must not write the returned state.
+func (s *StorageManager) shardFillOf(shardIdx uint64) (*shardFill, error) {
+	s.fillMu.Lock()
+	f, ok := s.fills[shardIdx]
+	s.fillMu.Unlock()
+	if ok {
+		return f, nil
+	}
+
+	ds, ok := s.shardManager.getDataShard(shardIdx)
+	if !ok {
+		return nil, ErrShardNotManaged
+	}
+	// the local metas are not written while s.mu is held, so the scans of the parallel readers agree
+	hashSize := s.hashSize()
+	start, end := ds.KvRange()
+	f = newShardFill(shardIdx*s.shardManager.kvEntries, s.shardManager.kvEntries)
+	for kvIdx := start; kvIdx < end; kvIdx++ {
+		meta, err := ds.ReadMeta(kvIdx)
+		if err != nil {
+			return nil, err
+		}
+		filled, synced := fillBits(common.BytesToHash(meta), hashSize)
+		f.set(kvIdx, filled, synced)
+	}
+
+	s.fillMu.Lock()
+	defer s.fillMu.Unlock()
+	if loaded, ok := s.fills[shardIdx]; ok {
+		return loaded, nil
+	}
+	s.fills[shardIdx] = f
+	return f, nil
+}
+
+// updateFill updates the fill state of the shard of the kv, if loaded, with the local meta written to the shard. The
+// writes to a staging copy must not be counted, as the state is of the shard, which is reloaded once the copy is
+// promoted. The caller must hold s.mu.
+func (s *StorageManager) updateFill(kvIdx uint64, meta common.Hash) {
+	s.fillMu.Lock()
+	defer s.fillMu.Unlock()
+	if f, ok := s.fills[kvIdx/s.shardManager.kvEntries]; ok {
+		filled, synced := fillBits(meta, s.hashSize())
+		f.set(kvIdx, filled, synced)
+	}
+}
+
+// dropFill drops the fill state of the shard, e.g. when its data is replaced, so it is loaded again by the next
+// query. The caller must hold s.mu.
+func (s *StorageManager) dropFill(shardIdx uint64) {
+	s.fillMu.Lock()
+	defer s.fillMu.Unlock()
+	delete(s.fills, shardIdx)
+}
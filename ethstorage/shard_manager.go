@@ -4,13 +4,18 @@
 package ethstorage
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"math/bits"
+	"sort"
+	"sync"
 
 	"github.com/ethereum/go-ethereum/common"
 )
 
 type ShardManager struct {
+	mu              sync.RWMutex // protect shardMap, which can be changed while the node is running
 	shardMap        map[uint64]*DataShard
 	contractAddress common.Address
 	kvSizeBits      uint64
@@ -21,6 +26,8 @@ type ShardManager struct {
 	kvEntries       uint64
 	chunkSize       uint64
 	chunkSizeBits   uint64
+	sampleHasher    SampleHasher // set to the shards by SetSampleHasher, RawSampleHasher if nil
+	masks           *maskCache   // set to the shards by SetMaskCache, disabled if nil
 }
 
 // if v is not 2^n, panic; otherwise return n
@@ -68,18 +75,45 @@ func (sm *ShardManager) ContractAddress() common.Address {
 	return sm.contractAddress
 }
 
+// ShardMap Return a copy of the managed data shards.
 func (sm *ShardManager) ShardMap() map[uint64]*DataShard {
-	return sm.shardMap
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	shardMap := make(map[uint64]*DataShard, len(sm.shardMap))
+	for id, ds := range sm.shardMap {
+		shardMap[id] = ds
+	}
+	return shardMap
 }
 
+// ShardIds returns the indices of the managed shards in ascending order.
 func (sm *ShardManager) ShardIds() []uint64 {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
 	shardIds := make([]uint64, 0)
 	for id := range sm.shardMap {
 		shardIds = append(shardIds, id)
 	}
+	sort.Slice(shardIds, func(i, j int) bool { return shardIds[i] < shardIds[j] })
 	return shardIds
 }
 
+func (sm *ShardManager) getDataShard(shardIdx uint64) (*DataShard, bool) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	ds, ok := sm.shardMap[shardIdx]
+	return ds, ok
+}
+
+// owns returns whether the kv is owned by a managed shard.
+func (sm *ShardManager) owns(kvIdx uint64) bool {
+	ds, ok := sm.getDataShard(kvIdx / sm.kvEntries)
+	return ok && ds.Owns(kvIdx)
+}
+
 func (sm *ShardManager) ChunkSize() uint64 {
 	return sm.chunkSize
 }
@@ -109,8 +143,13 @@ func (sm *ShardManager) MaxKvSizeBits() uint64 {
 }
 
 func (sm *ShardManager) AddDataShard(shardIdx uint64) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
 	if _, ok := sm.shardMap[shardIdx]; !ok {
 		ds := NewDataShard(shardIdx, sm.kvSize, sm.kvEntries, sm.chunkSize)
+		ds.sampleHasher = sm.sampleHasher
+		ds.masks = sm.masks
 		sm.shardMap[shardIdx] = ds
 		return nil
 	} else {
@@ -118,11 +157,38 @@ func (sm *ShardManager) AddDataShard(shardIdx uint64) error {
 	}
 }
 
+// addDataShard registers a data shard whose data files are already attached, so that the shard never
+// becomes visible to readers before it is usable.
+func (sm *ShardManager) addDataShard(ds *DataShard) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	if _, ok := sm.shardMap[ds.shardIdx]; ok {
+		return fmt.Errorf("data shard already exists")
+	}
+	ds.sampleHasher = sm.sampleHasher
+	ds.masks = sm.masks
+	sm.shardMap[ds.shardIdx] = ds
+	return nil
+}
+
+// RemoveDataShard stops managing the data shard and returns it, so the caller can close its data files.
+func (sm *ShardManager) RemoveDataShard(shardIdx uint64) (*DataShard, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	ds, ok := sm.shardMap[shardIdx]
+	if !ok {
+		return nil, fmt.Errorf("data shard not found")
+	}
+	delete(sm.shardMap, shardIdx)
+	return ds, nil
+}
+
 func (sm *ShardManager) AddDataFile(df *DataFile) error {
 	shardIdx := df.chunkIdxStart / sm.chunksPerKv / sm.kvEntries
-	var ds *DataShard
-	var ok bool
-	if ds, ok = sm.shardMap[shardIdx]; !ok {
+	ds, ok := sm.getDataShard(shardIdx)
+	if !ok {
 		return fmt.Errorf("data shard not found")
 	}
 
@@ -131,22 +197,25 @@ func (sm *ShardManager) AddDataFile(df *DataFile) error {
 
 func (sm *ShardManager) AddDataFileAndShard(df *DataFile) error {
 	shardIdx := df.chunkIdxStart / sm.chunksPerKv / sm.kvEntries
-	var ds *DataShard
-	var ok bool
-	if ds, ok = sm.shardMap[shardIdx]; !ok {
+	sm.mu.Lock()
+	ds, ok := sm.shardMap[shardIdx]
+	if !ok {
 		ds = NewDataShard(shardIdx, sm.kvSize, sm.kvEntries, sm.chunkSize)
+		ds.sampleHasher = sm.sampleHasher
+		ds.masks = sm.masks
 		sm.shardMap[shardIdx] = ds
 	}
+	sm.mu.Unlock()
 
 	return ds.AddDataFile(df)
 }
 
 // TryWrite Encode a raw KV data, and write it to the underly storage file.
 // Return error if the write IO fails.
-// Return false if the data is not managed by the ShardManager.
+// Return false if the data is not managed by the ShardManager, including the data of a managed shard but not owned by it.
 func (sm *ShardManager) TryWrite(kvIdx uint64, b []byte, commit common.Hash) (bool, error) {
 	shardIdx := kvIdx / sm.kvEntries
-	if ds, ok := sm.shardMap[shardIdx]; ok {
+	if ds, ok := sm.getDataShard(shardIdx); ok && ds.Owns(kvIdx) {
 		return true, ds.Write(kvIdx, b, commit)
 	} else {
 		return false, nil
@@ -158,7 +227,7 @@ func (sm *ShardManager) TryWrite(kvIdx uint64, b []byte, commit common.Hash) (bo
 // Return false if the data is not managed by the ShardManager.
 func (sm *ShardManager) TryWriteEncoded(kvIdx uint64, b []byte, commit common.Hash) (bool, error) {
 	shardIdx := kvIdx / sm.kvEntries
-	if ds, ok := sm.shardMap[shardIdx]; ok {
+	if ds, ok := sm.getDataShard(shardIdx); ok {
 		err := ds.WriteWith(kvIdx, b, commit, func(cdata []byte, chunkIdx uint64) []byte {
 			return cdata
 		})
@@ -173,7 +242,7 @@ func (sm *ShardManager) TryWriteEncoded(kvIdx uint64, b []byte, commit common.Ha
 // Return false if the data is not managed by the ShardManager.
 func (sm *ShardManager) TryRead(kvIdx uint64, readLen int, commit common.Hash) ([]byte, bool, error) {
 	shardIdx := kvIdx / sm.kvEntries
-	if ds, ok := sm.shardMap[shardIdx]; ok {
+	if ds, ok := sm.getDataShard(shardIdx); ok {
 		b, err := ds.Read(kvIdx, readLen, commit)
 		return b, true, err
 	} else {
@@ -181,11 +250,21 @@ func (sm *ShardManager) TryRead(kvIdx uint64, readLen int, commit common.Hash) (
 	}
 }
 
+// TryReadTo decodes the data in [offset, offset+length) of the KV and writes it to w, without verifying the commit.
+// Return false if the data is not managed by the ShardManager.
+func (sm *ShardManager) TryReadTo(kvIdx uint64, w io.Writer, offset, length int, commit common.Hash) (bool, error) {
+	shardIdx := kvIdx / sm.kvEntries
+	if ds, ok := sm.getDataShard(shardIdx); ok {
+		return true, ds.ReadTo(kvIdx, w, offset, length, commit)
+	}
+	return false, nil
+}
+
 // TryEncodeKV encode the KV data using the miner and encodeType specified by the data shard.
 // Return false if the data is not managed by the ShardManager.
 func (sm *ShardManager) TryEncodeKV(kvIdx uint64, b []byte, hash common.Hash) ([]byte, bool, error) {
 	shardIdx := kvIdx / sm.kvEntries
-	if ds, ok := sm.shardMap[shardIdx]; ok {
+	if ds, ok := sm.getDataShard(shardIdx); ok {
 		cb := make([]byte, ds.kvSize)
 		copy(cb, b)
 		return sm.EncodeKV(kvIdx, cb, hash, ds.Miner(), ds.EncodeType())
@@ -199,7 +278,7 @@ func (sm *ShardManager) TryEncodeKV(kvIdx uint64, b []byte, hash common.Hash) ([
 // Return false if the data is not managed by the ShardManager.
 func (sm *ShardManager) TryReadWithMeta(kvIdx uint64, readLen int) ([]byte, []byte, bool, error) {
 	shardIdx := kvIdx / sm.kvEntries
-	if ds, ok := sm.shardMap[shardIdx]; ok {
+	if ds, ok := sm.getDataShard(shardIdx); ok {
 		b, commit, err := ds.ReadWithMeta(kvIdx, readLen)
 		return b, commit, true, err
 	} else {
@@ -208,22 +287,42 @@ func (sm *ShardManager) TryReadWithMeta(kvIdx uint64, readLen int) ([]byte, []by
 }
 
 func (sm *ShardManager) GetShardMiner(shardIdx uint64) (common.Address, bool) {
-	if ds, ok := sm.shardMap[shardIdx]; ok {
+	if ds, ok := sm.getDataShard(shardIdx); ok {
 		return ds.Miner(), true
 	}
 	return common.Address{}, false
 }
 
 func (sm *ShardManager) GetShardEncodeType(shardIdx uint64) (uint64, bool) {
-	if ds, ok := sm.shardMap[shardIdx]; ok {
+	if ds, ok := sm.getDataShard(shardIdx); ok {
 		return ds.EncodeType(), true
 	}
 	return NO_ENCODE, false
 }
 
 // DecodeKV Decode the encoded KV data.
+// Return false with no error if the data is not managed by the ShardManager, like DecodeOrEncodeKV. The failures are
+// wrapped with the kvIdx, encodeType, providerAddr and blob length to tell why it cannot be decoded, including an
+// encodeType not supported and a blob larger than the kv size, which are rejected before decoding.
 func (sm *ShardManager) DecodeKV(kvIdx uint64, b []byte, hash common.Hash, providerAddr common.Address, encodeType uint64) ([]byte, bool, error) {
-	return sm.DecodeOrEncodeKV(kvIdx, b, hash, providerAddr, false, encodeType)
+	if _, ok := sm.getDataShard(kvIdx / sm.kvEntries); !ok {
+		return nil, false, nil
+	}
+	var (
+		data  []byte
+		found bool
+		err   error
+	)
+	if encodeType > ENCODE_END {
+		err = errors.New("unsupported encode type")
+	} else if uint64(len(b)) > sm.kvSize {
+		err = fmt.Errorf("blob larger than kv size %d", sm.kvSize)
+	} else if data, found, err = sm.DecodeOrEncodeKV(kvIdx, b, hash, providerAddr, false, encodeType); err == nil {
+		// not found if the shard is removed in the meantime
+		return data, found, nil
+	}
+	return nil, true, fmt.Errorf("decode kv %d with encodeType %d, providerAddr %s, blob length %d failed: %w",
+		kvIdx, encodeType, providerAddr.Hex(), len(b), err)
 }
 
 // EncodeKV Encode the raw KV data.
@@ -234,7 +333,7 @@ func (sm *ShardManager) EncodeKV(kvIdx uint64, b []byte, hash common.Hash, provi
 func (sm *ShardManager) DecodeOrEncodeKV(kvIdx uint64, b []byte, hash common.Hash, providerAddr common.Address, encode bool, encodeType uint64) ([]byte, bool, error) {
 	shardIdx := kvIdx / sm.kvEntries
 	var data []byte
-	if ds, ok := sm.shardMap[shardIdx]; ok {
+	if ds, ok := sm.getDataShard(shardIdx); ok {
 		datalen := len(b)
 		for i := uint64(0); i < ds.chunksPerKv; i++ {
 			if datalen == 0 {
@@ -267,9 +366,12 @@ func (sm *ShardManager) DecodeOrEncodeKV(kvIdx uint64, b []byte, hash common.Has
 // Return false if the data is not managed by the ShardManager.
 func (sm *ShardManager) TryReadEncoded(kvIdx uint64, readLen int) ([]byte, bool, error) {
 	shardIdx := kvIdx / sm.kvEntries
-	if ds, ok := sm.shardMap[shardIdx]; ok {
+	if ds, ok := sm.getDataShard(shardIdx); ok {
 		b, err := ds.ReadEncoded(kvIdx, readLen) // read all the data
-		return b[:readLen], true, err
+		if err != nil {
+			return nil, true, err
+		}
+		return b[:readLen], true, nil
 	} else {
 		return nil, false, nil
 	}
@@ -280,7 +382,7 @@ func (sm *ShardManager) TryReadEncoded(kvIdx uint64, readLen int) ([]byte, bool,
 // Return false if the data is not managed by the ShardManager.
 func (sm *ShardManager) TryReadMeta(kvIdx uint64) ([]byte, bool, error) {
 	shardIdx := kvIdx / sm.kvEntries
-	if ds, ok := sm.shardMap[shardIdx]; ok {
+	if ds, ok := sm.getDataShard(shardIdx); ok {
 		b, err := ds.ReadMeta(kvIdx) // read all the data
 		return b, true, err
 	} else {
@@ -295,7 +397,7 @@ func (sm *ShardManager) TryReadChunk(chunkIdx uint64, commit common.Hash) ([]byt
 	kvIdx := chunkIdx / sm.chunksPerKv
 	cIdx := chunkIdx % sm.chunksPerKv
 	shardIdx := kvIdx / sm.kvEntries
-	if ds, ok := sm.shardMap[shardIdx]; ok {
+	if ds, ok := sm.getDataShard(shardIdx); ok {
 		b, err := ds.ReadChunk(kvIdx, cIdx, commit) // read all the data
 		return b, true, err
 	} else {
@@ -310,7 +412,7 @@ func (sm *ShardManager) TryReadChunkEncoded(chunkIdx uint64) ([]byte, bool, erro
 	kvIdx := chunkIdx / sm.chunksPerKv
 	cIdx := chunkIdx % sm.chunksPerKv
 	shardIdx := kvIdx / sm.kvEntries
-	if ds, ok := sm.shardMap[shardIdx]; ok {
+	if ds, ok := sm.getDataShard(shardIdx); ok {
 		b, err := ds.ReadChunkEncoded(kvIdx, cIdx) // read all the data
 		return b, true, err
 	} else {
@@ -319,7 +421,7 @@ func (sm *ShardManager) TryReadChunkEncoded(chunkIdx uint64) ([]byte, bool, erro
 }
 
 func (sm *ShardManager) IsComplete() error {
-	for _, ds := range sm.shardMap {
+	for _, ds := range sm.ShardMap() {
 		if !ds.IsComplete() {
 			return fmt.Errorf("shard %d is not complete", ds.shardIdx)
 		}
@@ -328,7 +430,7 @@ func (sm *ShardManager) IsComplete() error {
 }
 
 func (sm *ShardManager) Close() error {
-	for _, ds := range sm.shardMap {
+	for _, ds := range sm.ShardMap() {
 		if err := ds.Close(); err != nil {
 			return err
 		}
@@ -0,0 +1,33 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+// ShardMetasL1 This function returns the block at which the metas of the shard were last downloaded in full, by
+// DownloadShardMetas, DownloadAllMetas or CatchUpMetas, and false if they have not been since the shard was added or
+// its metas were dropped, e.g. by ResetAndInvalidateMetas. The metas are kept updated by DownloadFinished afterwards,
+// so the distance to the local L1 tells how long the metas of the shard have relied on those updates, which differs
+// by shard once the shards are downloaded independently.
+func (s *StorageManager) ShardMetasL1(shardIdx uint64) (int64, bool) {
+	s.metasMu.Lock()
+	defer s.metasMu.Unlock()
+	l1, ok := s.shardMetasL1[shardIdx]
+	return l1, ok
+}
+
+// markShardMetasDownloaded records the localL1 as the block at which the metas of the shard were last downloaded.
+func (s *StorageManager) markShardMetasDownloaded(shardIdx uint64) {
+	s.metasMu.Lock()
+	defer s.metasMu.Unlock()
+	if s.shardMetasL1 == nil {
+		s.shardMetasL1 = make(map[uint64]int64)
+	}
+	s.shardMetasL1[shardIdx] = s.localL1
+}
+
+// dropShardMetasL1 drops the records of the shards whose metas are dropped. The caller must hold s.metasMu.
+func (s *StorageManager) dropShardMetasL1(shards ...uint64) {
+	for _, shardIdx := range shards {
+		delete(s.shardMetasL1, shardIdx)
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+// streamMetasBatch is the number of the metas read under the lock at a time by StreamShardMetas
+const streamMetasBatch = 1024
+
+// StreamShardMetas This function calls fn with the downloaded contract meta of each kv of the shard in the order of
+// kvIdx, skipping the kvs whose metas are not downloaded, e.g. beyond lastKvIdx. The metas are read under the lock
+// a batch at a time, and fn is called without the lock, so it may call back into the StorageManager, and the metas
+// of the later batches may be newer than those of the earlier. The walk stops at the first error returned by fn,
+// which is returned. Return ErrShardNotManaged if the shard is not managed, or is removed during the walk.
+func (s *StorageManager) StreamShardMetas(shardIdx uint64, fn func(kvIdx uint64, meta [32]byte) error) error {
+	return s.streamShardMetas(shardIdx, false, fn)
+}
+
+// StreamShardFileMetas This function is like StreamShardMetas, but reads the local metas from the data files of the
+// shard instead of the downloaded metas, so fn is called for every kv of the shard, including those not synced.
+func (s *StorageManager) StreamShardFileMetas(shardIdx uint64, fn func(kvIdx uint64, meta [32]byte) error) error {
+	return s.streamShardMetas(shardIdx, true, fn)
+}
+
+// shardMeta is a meta read by streamShardMetas
+type shardMeta struct {
+	kvIdx uint64
+	meta  [32]byte
+}
+
+func (s *StorageManager) streamShardMetas(shardIdx uint64, local bool, fn func(kvIdx uint64, meta [32]byte) error) error {
+	start := shardIdx * s.shardManager.kvEntries
+	end := start + s.shardManager.kvEntries
+	batch := make([]shardMeta, 0, streamMetasBatch)
+	for from := start; from < end; {
+		var err error
+		batch, from, err = s.readShardMetas(shardIdx, from, end, local, batch[:0])
+		if err != nil {
+			return err
+		}
+		for _, m := range batch {
+			if err := fn(m.kvIdx, m.meta); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readShardMetas appends up to cap(batch) metas of [from, end) of the shard to batch, read from the data files if
+// local or the downloaded metas otherwise, and returns it with the kvIdx to read from next. The downloaded metas are
+// read by the range of the index, so the kvs without metas are skipped at no cost.
+func (s *StorageManager) readShardMetas(shardIdx, from, end uint64, local bool, batch []shardMeta) ([]shardMeta, uint64, error) {
+	s.rlock("StreamShardMetas")
+	defer s.mu.RUnlock()
+
+	if _, ok := s.shardManager.getDataShard(shardIdx); !ok {
+		return nil, end, ErrShardNotManaged
+	}
+	if !local {
+		next := end
+		s.blobMetas.iterate(from, end, func(kvIdx uint64, meta [32]byte) bool {
+			batch = append(batch, shardMeta{kvIdx, meta})
+			if len(batch) < cap(batch) {
+				return true
+			}
+			next = kvIdx + 1
+			return false
+		})
+		return batch, next, nil
+	}
+	to := from + uint64(cap(batch))
+	if to > end {
+		to = end
+	}
+	for kvIdx := from; kvIdx < to; kvIdx++ {
+		m, _, err := s.tryReadMeta(kvIdx)
+		if err != nil {
+			return nil, end, err
+		}
+		var meta [32]byte
+		copy(meta[:], m)
+		batch = append(batch, shardMeta{kvIdx, meta})
+	}
+	return batch, to, nil
+}
@@ -0,0 +1,32 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+// ShardProgress This function returns the fraction between 0 and 1 of the owned kvs of the shard which are synced or
+// empty filled, e.g. for a progress bar. The kvs from the lastKvIdx of the local L1 view are counted as complete,
+// as they are legitimately empty. The filled kvs are counted from the fill state of the shard, see shardFill, under
+// the read lock. See ShardCapacities for the bytes used.
+func (s *StorageManager) ShardProgress(shardIdx uint64) (float64, error) {
+	s.rlock("ShardProgress")
+	defer s.mu.RUnlock()
+
+	ds, ok := s.shardManager.getDataShard(shardIdx)
+	if !ok {
+		return 0, ErrShardNotManaged
+	}
+	start, end := ds.KvRange()
+	if end <= start {
+		return 1, nil
+	}
+	f, err := s.shardFillOf(shardIdx)
+	if err != nil {
+		return 0, err
+	}
+	lastKvIdx := s.lastKvIdx
+	complete := f.filledBelow(min(end, lastKvIdx)) - f.filledBelow(start)
+	if lastKvIdx < end {
+		complete += end - max(start, lastKvIdx)
+	}
+	return float64(complete) / float64(end-start), nil
+}
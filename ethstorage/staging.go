@@ -0,0 +1,225 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// stagingFileSuffix is the suffix of the staging copy of a data file, which replaces the data file once promoted
+const stagingFileSuffix = ".staging"
+
+var (
+	ErrShardStaging    = errors.New("shard is staging")
+	ErrShardNotStaging = errors.New("shard is not staging")
+)
+
+// BeginStaging This function starts a bulk resync of the shard, after which the blobs written to the shard by
+// DownloadFinished and the commit functions go to a staging copy of its data files, while the reads are still served
+// from the live data files, so the readers never see the shard partially resynced. The staging copy is made like
+// CompactShard, i.e. sparsely without the lock and then with the kvs committed meanwhile copied again under the lock.
+// Call PromoteStaging once the resync completes, or AbortStaging to drop the writes since.
+// Note that the checks of the commits against the local metas still read the live data files, and the staging copy
+// is dropped by RemoveShard and not kept over a restart.
+func (s *StorageManager) BeginStaging(ctx context.Context, shardIdx uint64) (err error) {
+	if err = s.enterSync(); err != nil {
+		return err
+	}
+	defer s.exitSync()
+	if err = s.acquire(); err != nil {
+		return err
+	}
+	defer s.release()
+
+	s.mu.Lock()
+	ds, ok := s.shardManager.getDataShard(shardIdx)
+	_, staging := s.staging[shardIdx]
+	var files []*DataFile
+	if ok && !staging {
+		files = append(files, ds.dataFiles...)
+		// the nil staging shard keeps the writes going to the data files until the copy completes
+		if s.staging == nil {
+			s.staging = make(map[uint64]*DataShard)
+		}
+		s.staging[shardIdx] = nil
+	}
+	hashSize := s.hashSize()
+	s.mu.Unlock()
+	if !ok {
+		return ErrShardNotManaged
+	}
+	if staging {
+		return ErrShardStaging
+	}
+
+	copiers := make([]*kvCopier, 0, len(files))
+	defer func() {
+		for _, c := range copiers {
+			c.dst.Close()
+			if err != nil {
+				os.Remove(c.dst.Name())
+			}
+		}
+		if err != nil {
+			s.mu.Lock()
+			delete(s.staging, shardIdx)
+			s.mu.Unlock()
+		}
+	}()
+	for _, df := range files {
+		var tmp *os.File
+		tmp, err = os.OpenFile(df.file.Name()+stagingFileSuffix, os.O_RDWR|os.O_CREATE, 0666)
+		if err != nil {
+			return err
+		}
+		c := &kvCopier{src: df, dst: tmp, hashSize: hashSize}
+		copiers = append(copiers, c)
+		if err = initCompactFile(df, tmp); err != nil {
+			return err
+		}
+		for kvIdx := df.KvIdxStart(); kvIdx < df.KvIdxEnd(); kvIdx++ {
+			if err = ctx.Err(); err != nil {
+				return err
+			}
+			if err = c.copyKV(kvIdx, false); err != nil {
+				return err
+			}
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// the shard may be removed or its data files replaced, e.g. by CompactShard, during the copy
+	if cur, ok := s.shardManager.getDataShard(shardIdx); !ok || cur != ds {
+		return ErrShardNotManaged
+	}
+	for i, df := range ds.dataFiles {
+		if i >= len(files) || files[i] != df {
+			return fmt.Errorf("data files of shard %d changed during the staging copy", shardIdx)
+		}
+	}
+
+	staged := NewDataShard(shardIdx, ds.kvSize, ds.kvEntries, ds.chunkSize)
+	for _, c := range copiers {
+		// copy the kvs committed during the copy, while no more can be committed
+		for kvIdx := c.src.KvIdxStart(); kvIdx < c.src.KvIdxEnd(); kvIdx++ {
+			if err = c.copyKV(kvIdx, true); err != nil {
+				break
+			}
+		}
+		var sdf *DataFile
+		if err == nil {
+			sdf, err = OpenDataFile(c.dst.Name())
+		}
+		if err == nil {
+			err = staged.AddDataFile(sdf)
+		}
+		if err != nil {
+			staged.Close()
+			return err
+		}
+	}
+	s.staging[shardIdx] = staged
+	log.Info("Shard staging begun", "shard", shardIdx, "files", len(files))
+	return nil
+}
+
+// PromoteStaging This function replaces the data files of the shard with the staging copy made by BeginStaging,
+// so the blobs written since are served at once. Each data file is replaced atomically by a rename under the lock,
+// so the readers see either all the old data or all the new, including ReadSampleUnlocked, as the old file is closed
+// only after its reads in flight, see replaceDataFile. The writes to the shard go to the data files again.
+func (s *StorageManager) PromoteStaging(shardIdx uint64) error {
+	if err := s.enterSync(); err != nil {
+		return err
+	}
+	defer s.exitSync()
+	if err := s.acquire(); err != nil {
+		return err
+	}
+	defer s.release()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	staged := s.staging[shardIdx]
+	if staged == nil {
+		return ErrShardNotStaging
+	}
+	ds, ok := s.shardManager.getDataShard(shardIdx)
+	if !ok {
+		return ErrShardNotManaged
+	}
+	delete(s.staging, shardIdx)
+	// the fill state is of the old data
+	s.dropFill(shardIdx)
+
+	for _, sdf := range staged.dataFiles {
+		stagingName := sdf.file.Name()
+		if err := sdf.file.Sync(); err != nil {
+			return err
+		}
+		if err := sdf.Close(); err != nil {
+			return err
+		}
+		name := strings.TrimSuffix(stagingName, stagingFileSuffix)
+		var live *DataFile
+		for _, df := range ds.dataFiles {
+			if df.file.Name() == name {
+				live = df
+			}
+		}
+		if live == nil {
+			return fmt.Errorf("data file %s of the staging copy not found", name)
+		}
+		if err := replaceDataFile(ds, live, stagingName); err != nil {
+			return err
+		}
+	}
+	log.Info("Shard staging promoted", "shard", shardIdx, "files", len(staged.dataFiles))
+	return nil
+}
+
+// AbortStaging This function drops the staging copy made by BeginStaging along with the blobs written to it, and
+// the writes to the shard go to the data files again.
+func (s *StorageManager) AbortStaging(shardIdx uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.staging[shardIdx] == nil {
+		return ErrShardNotStaging
+	}
+	return s.dropStaging(shardIdx)
+}
+
+// dropStaging closes and removes the staging copy of the shard if any. The caller must hold s.mu.
+func (s *StorageManager) dropStaging(shardIdx uint64) error {
+	staged := s.staging[shardIdx]
+	if staged == nil {
+		return nil
+	}
+	// the staging copy is only forgotten once its files are closed, so a failed drop can be retried
+	filenames := staged.Filenames()
+	if err := staged.Close(); err != nil {
+		return err
+	}
+	delete(s.staging, shardIdx)
+	for _, filename := range filenames {
+		os.Remove(filename)
+	}
+	log.Info("Shard staging dropped", "shard", shardIdx, "files", filenames)
+	return nil
+}
+
+// stagedShard returns the staging shard of the kv to write to if its shard is staging, or nil if it is not or the
+// staging copy is still being made. The caller must hold s.mu.
+func (s *StorageManager) stagedShard(kvIdx uint64) *DataShard {
+	return s.staging[kvIdx/s.shardManager.kvEntries]
+}
@@ -3,7 +3,11 @@
 
 package storage
 
-import "github.com/ethereum/go-ethereum/common"
+import (
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
 
 type StorageConfig struct {
 	Filenames         []string
@@ -12,4 +16,20 @@ type StorageConfig struct {
 	KvEntriesPerShard uint64
 	L1Contract        common.Address
 	Miner             common.Address
+	VerifyOnStart     bool          // whether to verify the shards for torn blobs on start
+	MetaConfirmations uint64        // blocks behind the local L1 view at which the metas are downloaded
+	MetaBatchMin      uint64        // min batch size of the adaptive meta download
+	MetaBatchMax      uint64        // max batch size of the adaptive meta download, disabled if 0
+	DownloadBatchMax  int           // max blobs written by each hold of the lock when downloading, unlimited if 0
+	MetaBandwidth     uint64        // max bytes per second of the meta download, unlimited if 0
+	MetaCheckpoint    bool          // whether to checkpoint the meta download to resume from after a restart
+	L1Checkpoint      bool          // whether to checkpoint the L1 block of the blobs downloaded to resume from after a restart
+	MaskCacheSize     int           // max number of the encoding masks cached for the decoding, disabled if 0
+	DiskTimeout       time.Duration // timeout of each read or write of the storage files, disabled if 0
+	DiskFullRetry     time.Duration // how long the commits fail fast after the disk is full, the default if 0
+	HashSize          int           // bytes of the commit stored by the contract, the default HashSizeInContract if 0
+	LogLevels         string        // log levels of the storage subsystems, e.g. "meta=warn"
+	Prewarm           bool          // whether to read the shard files into the page cache on start
+	CommitThreadNum   int           // workers encoding the blobs synced from the peers in parallel
+	MetaIndexOnDisk   bool          // whether to keep the downloaded metas in the database instead of in memory
 }
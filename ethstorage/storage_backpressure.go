@@ -0,0 +1,64 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"time"
+)
+
+const (
+	// DefaultThrottleDepth is the number of the pending commits from which ShouldThrottle reports true.
+	DefaultThrottleDepth = 16
+	// DefaultThrottleLatency is the average commit latency from which ShouldThrottle reports true.
+	DefaultThrottleLatency = 5 * time.Second
+	// commitLatencyWeight is the reciprocal of the weight of the latest commit in the average commit latency.
+	commitLatencyWeight = 8
+)
+
+// beginWrite counts a commit as pending until endWrite is called with the returned start time.
+func (s *StorageManager) beginWrite() time.Time {
+	s.pendingWrites.Add(1)
+	return s.Clock.Now()
+}
+
+// endWrite ends a pending commit, and updates the moving average of the commit latency with it.
+func (s *StorageManager) endWrite(start time.Time) {
+	latency := int64(s.Clock.Now().Sub(start))
+	for {
+		old := s.commitLatency.Load()
+		avg := latency
+		if old != 0 {
+			avg = old + (latency-old)/commitLatencyWeight
+		}
+		if s.commitLatency.CompareAndSwap(old, avg) {
+			break
+		}
+	}
+	s.pendingWrites.Add(-1)
+}
+
+// PendingWriteDepth This function returns the number of the commits from the sync layer which are waiting for the
+// lock or being written.
+func (s *StorageManager) PendingWriteDepth() int64 {
+	return s.pendingWrites.Load()
+}
+
+// CommitLatency This function returns the moving average of the time taken by the commits from the sync layer,
+// including the time waiting for the lock.
+func (s *StorageManager) CommitLatency() time.Duration {
+	return time.Duration(s.commitLatency.Load())
+}
+
+// ShouldThrottle This function tells the sync layer to stop requesting more blobs temporarily, as the disk cannot
+// keep up with the commits, i.e. too many commits are pending or the commits are taking too long.
+func (s *StorageManager) ShouldThrottle() bool {
+	depth, latency := s.ThrottleDepth, s.ThrottleLatency
+	if depth == 0 {
+		depth = DefaultThrottleDepth
+	}
+	if latency == 0 {
+		latency = DefaultThrottleLatency
+	}
+	return s.PendingWriteDepth() >= depth || s.CommitLatency() >= latency
+}
@@ -0,0 +1,59 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+// ShardCapacity is the capacity of the owned kvs of a shard in bytes, in which Used counts the kvs filled with synced or empty blobs.
+type ShardCapacity struct {
+	ShardIdx uint64 `json:"shardIdx"`
+	Total    uint64 `json:"total"`
+	Used     uint64 `json:"used"`
+}
+
+// TotalCapacity This function returns the total capacity in bytes of the owned kvs of all the managed shards.
+func (s *StorageManager) TotalCapacity() uint64 {
+	total := uint64(0)
+	for _, shardIdx := range s.Shards() {
+		if start, end, ok := s.OwnedKvRange(shardIdx); ok {
+			total += (end - start) * s.shardManager.kvSize
+		}
+	}
+	return total
+}
+
+// UsedCapacity This function returns the capacity in bytes of the kvs filled with synced or empty blobs in all the
+// managed shards.
+func (s *StorageManager) UsedCapacity() (uint64, error) {
+	capacities, err := s.ShardCapacities()
+	if err != nil {
+		return 0, err
+	}
+	used := uint64(0)
+	for _, c := range capacities {
+		used += c.Used
+	}
+	return used, nil
+}
+
+// ShardCapacities This function returns the capacity of each managed shard sorted by shard index. The filled kvs of
+// a shard are counted by its fill state, see shardFill, under the read lock.
+func (s *StorageManager) ShardCapacities() ([]ShardCapacity, error) {
+	s.rlock("ShardCapacities")
+	defer s.mu.RUnlock()
+
+	shards := s.shardManager.ShardIds()
+	capacities := make([]ShardCapacity, 0, len(shards))
+	for _, shardIdx := range shards {
+		f, err := s.shardFillOf(shardIdx)
+		if err != nil {
+			return nil, err
+		}
+		start, end, _ := s.OwnedKvRange(shardIdx)
+		capacities = append(capacities, ShardCapacity{
+			ShardIdx: shardIdx,
+			Total:    (end - start) * s.shardManager.kvSize,
+			Used:     f.count * s.shardManager.kvSize,
+		})
+	}
+	return capacities, nil
+}
@@ -0,0 +1,87 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// DefaultCloseTimeout is how long Close waits for the in-flight operations if CloseTimeout is not set.
+const DefaultCloseTimeout = 30 * time.Second
+
+var (
+	ErrStorageClosed = errors.New("storage manager is closed")
+	ErrCloseTimeout  = errors.New("timeout waiting for in-flight operations to close")
+)
+
+// acquire registers an in-flight operation writing to the shard files, which Close waits for before closing them.
+// Return ErrStorageClosed if Close has been called, otherwise release must be called once the operation completes.
+func (s *StorageManager) acquire() error {
+	s.opsMu.RLock()
+	defer s.opsMu.RUnlock()
+
+	if s.closed {
+		return ErrStorageClosed
+	}
+	s.ops.Add(1)
+	return nil
+}
+
+func (s *StorageManager) release() {
+	s.ops.Done()
+}
+
+// withCloseCtx returns a context derived from ctx which is also cancelled by Close, for the long-running operations
+// like DownloadShardMetas to stop early.
+func (s *StorageManager) withCloseCtx(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(s.closeCtx, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// Close This function rejects new operations with ErrStorageClosed, including those waiting for Resume, cancels the
+// meta downloads, and waits for the in-flight commits and downloads, including their writes timed out by DiskTimeout
+// and still running, to complete for up to CloseTimeout (DefaultCloseTimeout if 0) before it drains the worker pool
+// and closes the shard files. If they don't complete in time, ErrCloseTimeout is returned and the shard files are left open, as closing them under the writes may corrupt
+// the data on some platforms.
+func (s *StorageManager) Close() error {
+	s.opsMu.Lock()
+	s.closed = true
+	s.opsMu.Unlock()
+	s.closeCancel()
+	s.closeSync()
+
+	timeout := s.CloseTimeout
+	if timeout == 0 {
+		timeout = DefaultCloseTimeout
+	}
+	done := make(chan struct{})
+	go func() {
+		s.ops.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.Warn("Timeout waiting for in-flight operations to close", "timeout", timeout)
+		return ErrCloseTimeout
+	}
+
+	s.workerPool().close()
+	s.commitWorkerPool().close()
+	// the staging copies are not resumed after a restart
+	s.mu.Lock()
+	for shardIdx := range s.staging {
+		s.dropStaging(shardIdx)
+	}
+	s.mu.Unlock()
+	return s.shardManager.Close()
+}
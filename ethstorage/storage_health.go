@@ -0,0 +1,83 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"context"
+	"math/big"
+	"sort"
+	"time"
+
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+const (
+	HealthSyncing = "syncing"
+	HealthSynced  = "synced"
+	HealthStalled = "stalled"
+
+	// DefaultStallTimeout is how long localL1 may stay behind the finalized head before the node is
+	// regarded as stalled; blocks are finalized every 32 slots (~6.4 minutes).
+	DefaultStallTimeout = 20 * time.Minute
+	// maxSyncedL1Lag is the number of blocks localL1 may lag behind the finalized head and still be synced,
+	// which covers the time DownloadFinished takes to process a newly finalized epoch.
+	maxSyncedL1Lag = 64
+)
+
+// HealthStatus reports whether the node is syncing, synced or stalled, for liveness/readiness probes.
+type HealthStatus struct {
+	State            string    `json:"state"`
+	LocalL1          int64     `json:"localL1"`
+	FinalizedL1      int64     `json:"finalizedL1"`
+	LastDownloadTime time.Time `json:"lastDownloadTime"`
+	MetasDownloaded  bool      `json:"metasDownloaded"`
+	FaultedShards    []uint64  `json:"faultedShards"`
+	DiskFull         bool      `json:"diskFull"`
+}
+
+// HealthStatus This function compares the local L1 view against the finalized head of L1. The node is stalled if
+// localL1 is behind the finalized head and DownloadFinished has not advanced it for StallTimeout; it is synced if
+// all the metas are downloaded, localL1 follows the finalized head and no shard is faulted, either by a failed write
+// or by a timed out write still pending; otherwise it is syncing.
+func (s *StorageManager) HealthStatus(ctx context.Context) (*HealthStatus, error) {
+	header, err := s.getL1Source().HeaderByNumber(ctx, big.NewInt(rpc.FinalizedBlockNumber.Int64()))
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	status := &HealthStatus{
+		LocalL1:          s.localL1,
+		FinalizedL1:      header.Number.Int64(),
+		LastDownloadTime: s.lastDownloadTime,
+		MetasDownloaded:  s.metasDownloaded,
+		FaultedShards:    make([]uint64, 0, len(s.shardFaults)),
+	}
+	for shardIdx := range s.shardFaults {
+		status.FaultedShards = append(status.FaultedShards, shardIdx)
+	}
+	for shardIdx := range s.hungShards() {
+		if _, ok := s.shardFaults[shardIdx]; !ok {
+			status.FaultedShards = append(status.FaultedShards, shardIdx)
+		}
+	}
+	s.mu.Unlock()
+	status.DiskFull, _ = s.DiskFull()
+	sort.Slice(status.FaultedShards, func(i, j int) bool { return status.FaultedShards[i] < status.FaultedShards[j] })
+
+	stallTimeout := s.StallTimeout
+	if stallTimeout == 0 {
+		stallTimeout = DefaultStallTimeout
+	}
+	lag := status.FinalizedL1 - status.LocalL1
+	switch {
+	case lag > 0 && !status.LastDownloadTime.IsZero() && s.Clock.Now().Sub(status.LastDownloadTime) > stallTimeout:
+		status.State = HealthStalled
+	case status.MetasDownloaded && lag <= maxSyncedL1Lag && len(status.FaultedShards) == 0:
+		status.State = HealthSynced
+	default:
+		status.State = HealthSyncing
+	}
+	return status, nil
+}
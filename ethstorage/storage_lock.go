@@ -0,0 +1,61 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import "time"
+
+// StorageMetrics records the metrics of StorageManager, which is implemented by metrics.Metricer.
+type StorageMetrics interface {
+	RecordLockWait(method string, wait time.Duration)
+	RecordCodec(op string, duration time.Duration)
+}
+
+// SetMetrics This function sets the metrics to record the time waiting for the lock in the hot methods, which
+// quantifies the lock contention, and the CPU time of encoding the blobs committed by the sync layer and decoding
+// them by DecodeKV, which tells whether the node is CPU-bound. The metrics are disabled if m is nil, which they are
+// by default, and the lock metrics are compiled out with the build tag nolockmetrics.
+func (s *StorageManager) SetMetrics(m StorageMetrics) {
+	if m == nil {
+		s.metrics.Store(nil)
+		return
+	}
+	s.metrics.Store(&m)
+}
+
+// getMetrics returns the metrics set by SetMetrics, or nil if disabled. It can be called without s.mu.
+func (s *StorageManager) getMetrics() StorageMetrics {
+	if m := s.metrics.Load(); m != nil {
+		return *m
+	}
+	return nil
+}
+
+// lock acquires s.mu, and records the time waiting for it by the method if the metrics are enabled.
+func (s *StorageManager) lock(method string) {
+	if !lockMetricsEnabled {
+		s.mu.Lock()
+		return
+	}
+	start := s.Clock.Now()
+	s.mu.Lock()
+	if m := s.getMetrics(); m != nil {
+		m.RecordLockWait(method, s.Clock.Now().Sub(start))
+	}
+}
+
+// rlock acquires the read lock of s.mu for the pure reads, which run in parallel with each other but not with the
+// writes, and records the time waiting for it like lock. The shard files are read with ReadAt, which is safe for
+// parallel readers. A method taking the read lock must not write any state guarded by s.mu, including the caches
+// filled on read, e.g. lastBlobIdxCache, unless they have a lock of their own like fills.
+func (s *StorageManager) rlock(method string) {
+	if !lockMetricsEnabled {
+		s.mu.RLock()
+		return
+	}
+	start := s.Clock.Now()
+	s.mu.RLock()
+	if m := s.getMetrics(); m != nil {
+		m.RecordLockWait(method, s.Clock.Now().Sub(start))
+	}
+}
@@ -0,0 +1,8 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+//go:build nolockmetrics
+
+package ethstorage
+
+const lockMetricsEnabled = false
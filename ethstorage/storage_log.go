@@ -0,0 +1,99 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/ethereum/go-ethereum/log"
+)
+
+const (
+	// LogSubsystemMeta is the subsystem of the logs of the meta download
+	LogSubsystemMeta = "meta"
+	// LogSubsystemCommit is the subsystem of the logs of the blob commits
+	LogSubsystemCommit = "commit"
+)
+
+var ErrUnknownLogSubsystem = errors.New("unknown log subsystem")
+
+var (
+	metaLog   = newSubsystemLog(LogSubsystemMeta)
+	commitLog = newSubsystemLog(LogSubsystemCommit)
+
+	subsystemLogs = map[string]*subsystemLog{
+		LogSubsystemMeta:   metaLog,
+		LogSubsystemCommit: commitLog,
+	}
+)
+
+// subsystemLog is the logger of a subsystem, which tags the records with the subsystem and drops those above its
+// level before they reach the root handler, so its level can only quiet the subsystem further than the root level.
+type subsystemLog struct {
+	log.Logger
+	lvl atomic.Int64
+}
+
+func newSubsystemLog(name string) *subsystemLog {
+	l := &subsystemLog{Logger: log.New("subsystem", name)}
+	l.lvl.Store(int64(log.LvlTrace))
+	l.SetHandler(log.FuncHandler(func(r *log.Record) error {
+		// errors are never dropped by the subsystem level
+		if r.Lvl > log.LvlError && r.Lvl > log.Lvl(l.lvl.Load()) {
+			return nil
+		}
+		return log.Root().GetHandler().Log(r)
+	}))
+	return l
+}
+
+// SetLogLevel This function sets the lowest level of the logs of the subsystem that will be output, e.g. LvlWarn to
+// quiet the per batch logs of the meta download. The errors of the subsystem are output regardless of the level.
+func SetLogLevel(subsystem string, lvl log.Lvl) error {
+	l, ok := subsystemLogs[subsystem]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownLogSubsystem, subsystem)
+	}
+	l.lvl.Store(int64(lvl))
+	return nil
+}
+
+// LogSubsystems returns the sorted names of the subsystems whose level can be set by SetLogLevel.
+func LogSubsystems() []string {
+	names := make([]string, 0, len(subsystemLogs))
+	for name := range subsystemLogs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ParseLogLevels parses the levels of the subsystems in the format of "subsystem=level,...", e.g. "meta=warn".
+func ParseLogLevels(s string) (map[string]log.Lvl, error) {
+	levels := make(map[string]log.Lvl)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, level, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid log level %q, expected subsystem=level", item)
+		}
+		name = strings.TrimSpace(name)
+		if _, ok := subsystemLogs[name]; !ok {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownLogSubsystem, name)
+		}
+		lvl, err := log.LvlFromString(strings.ToLower(strings.TrimSpace(level)))
+		if err != nil {
+			return nil, fmt.Errorf("invalid log level of %s: %w", name, err)
+		}
+		levels[name] = lvl
+	}
+	return levels, nil
+}
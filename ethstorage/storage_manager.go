@@ -8,71 +8,333 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/log"
+	"golang.org/x/time/rate"
 )
 
 const (
 	blobFillingMask    = byte(0b10000000)
 	HashSizeInContract = 24
 	MetaDownloadThread = 32
+	// maxStaleMetaBatches is the number of times a batch of metas is downloaded again as localL1 changed,
+	// before it is downloaded with the lock held.
+	maxStaleMetaBatches = 3
+	// fetchMetaBatchSize is the max number of metas requested in one call by FetchContractMetas, which is within the
+	// limit of the L1 nodes as the default of the meta download batch.
+	fetchMetaBatchSize = 8000
+
+	// ShardFileName is the file name pattern of a shard data file, formatted with the shard index.
+	ShardFileName = "shard-%d.dat"
 )
 
 var (
-	errCommitMismatch = errors.New("commit from contract and input is not matched")
+	ErrCommitMismatch    = errors.New("commit from contract and input is not matched")
+	ErrShardNotManaged   = errors.New("shard is not managed")
+	ErrMismatchedLengths = errors.New("invalid params lens")
+	ErrSampleOutOfRange  = errors.New("sample out of the range of shard")
+	ErrKvIdxMismatch     = errors.New("kvIdx from contract and input is not matched")
+	ErrNilL1Source       = errors.New("l1Source is nil")
+	ErrReadLenTooLarge   = errors.New("read len too large")
+	ErrInvalidBlobLen    = errors.New("invalid blob length")
+
+	errL1Older = errors.New("new L1 is older than local L1")
 )
 
 type Il1Source interface {
 	GetKvMetas(kvIndices []uint64, blockNumber int64) ([][32]byte, error)
 
 	GetStorageLastBlobIdx(blockNumber int64) (uint64, error)
+
+	HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error)
 }
 
 // StorageManager is a higher-level abstract of ShardManager which provides multi-thread safety to storage file read/write
 // and a consistent view of most-recent-finalized L1 block.
 type StorageManager struct {
 	DownloadThreadNum int
+	CommitThreadNum   int           // workers encoding the blobs of CommitBlobs in parallel, sequential if not more than 1
+	DataDir           string        // directory of the shard data files created by AddShard
+	StallTimeout      time.Duration // how long localL1 may not advance before HealthStatus reports stalled
+	MaxInFlightBytes  uint64        // max total size of the blobs written by DownloadFinished at the same time, 0 for unlimited
+	DownloadBatchMax  int           // max blobs written by DownloadFinished under one hold of the lock, unlimited if 0
+	ScrubRate         int           // max blobs checked per second by ScrubShard, DefaultScrubRate if 0
+	Clock             Clock         // time source of the timestamps and durations, SystemClock by default
+	ThrottleDepth     int64         // pending commits from which ShouldThrottle reports true, DefaultThrottleDepth if 0
+	ThrottleLatency   time.Duration // average commit latency from which ShouldThrottle reports true, DefaultThrottleLatency if 0
+	MetaConfirmations uint64        // blocks behind localL1 at which the metas are downloaded, to reduce the exposure to reorgs
+	MetaCheckpointDir string        // directory of the checkpoints of the meta download to resume from, disabled if empty
+	L1CheckpointFile  string        // file of the L1Checkpoint written after each DownloadFinished, disabled if empty
+	DiskTimeout       time.Duration // max duration of each read or write of the shard files, disabled if 0
+	DiskFullRetry     time.Duration // how long the commits fail fast after the disk is full, DefaultDiskFullRetry if 0
+	PauseBlocks       bool          // whether the commits and downloads wait for Resume while paused instead of ErrPaused
+	QuarantineLimit   int           // max number of the mismatched commits kept for QuarantinedCommits, disabled if 0
+	CloseTimeout      time.Duration // how long Close waits for the in-flight operations, DefaultCloseTimeout if 0
+	MetasRequired     bool          // whether the reads of the blobs not synced return ErrMetasNotLoaded until MetasReady
+	MetaBatchMin      uint64        // min batch size of the adaptive meta download, which starts from it
+	MetaBatchMax      uint64        // max batch size of the adaptive meta download, fixed to the size of DownloadAllMetas if 0
+	MetaBandwidth     uint64        // max bytes per second of the meta download by all the workers, unlimited if 0
 	shardManager      *ShardManager
-	localL1           int64      // local view of most-recent-finalized L1 block
-	mu                sync.Mutex // protect lastKvIdx, shardManager and blobMeta read/write state
-	lastKvIdx         uint64     // lastKvIndex in the most-recent-finalized L1 block
+	localL1           int64        // local view of most-recent-finalized L1 block
+	localL1Hash       common.Hash  // hash of the localL1 block, zero if it could not be fetched
+	mu                sync.RWMutex // protect lastKvIdx, shardManager and blobMeta state, read locked by the pure reads
+	lastKvIdx         uint64       // lastKvIndex in the most-recent-finalized L1 block
+	filledNext        uint64       // the highest kvIdx written by DownloadFinished + 1 for the L1Checkpoint
 	l1Source          Il1Source
-	blobMetas         map[uint64][32]byte
+	l1Mu              sync.RWMutex // protect l1Source, which may be read without s.mu
+	blobMetas         metaIndex
+	lastDownloadTime  time.Time        // time localL1 was last set by Reset or DownloadFinished
+	metasDownloaded   bool             // whether DownloadAllMetas has completed at least once
+	shardFaults       map[uint64]error // the last write error of the shards failed to write
+	lastBlobIdxCache  map[int64]uint64 // lastKvIdx queried from l1Source by block number
+	audit             *auditLog        // audit log of the committed blobs, nil if disabled
+	committed         []uint64         // kv indices written under s.mu, to be notified once it is released
+	l1Advances        []l1Advance      // advances of localL1 under s.mu, to be notified once it is released
+	quarantined       []uint64         // kv indices of the mismatched commits from the sync layer
+	syncAllowlist     kvSet            // kvs to sync set by SetSyncAllowlist, nil for all the owned kvs
+	commitRate        commitRate       // rolling count of the committed blobs for EstimateSyncETA
+	warns             *warnLimiter     // aggregator of the repeated warnings of the commits
+	headCache         cachedHead       // head of L1 cached by MetaAge
+	commitIndex       *commitIndex     // reverse index of the commits for HasCommit, nil unless enabled
+
+	pool     *workerPool // workers of the DownloadFinished writes, sized by DownloadThreadNum
+	poolOnce sync.Once
+
+	commitPool     *workerPool // workers of the CommitBlobs encoding, sized by CommitThreadNum
+	commitPoolOnce sync.Once
+
+	metaLimiter     *rate.Limiter // limiter of the meta download by MetaBandwidth, nil if unlimited
+	metaLimiterOnce sync.Once
+
+	hashSizeInContract int // bytes of the commit kept in the metas set by SetHashSize, HashSizeInContract if 0
+
+	// fill states of the shards by shardFillOf, which may load them under the read lock of s.mu, so they are
+	// protected by fillMu as well
+	fills  map[uint64]*shardFill
+	fillMu sync.Mutex
+
+	// staging copies of the shards by BeginStaging, to which the writes of the shards go until promoted, with nil for
+	// the shards whose staging copies are being made
+	staging map[uint64]*DataShard
+
+	// shards being compacted by CompactShard, which must not overlap a re-encoding of the shard
+	compacting map[uint64]bool
+
+	// kvs whose writes timed out by DiskTimeout still run in the background, to which diskWrite refuses the writes
+	hungWrites map[uint64]bool
+	hungMu     sync.Mutex
+
+	// metasMu serializes the writes of the downloaded metas with the changes of localL1, so the meta download can
+	// write blobMetas without s.mu, which would block the reads, while a batch downloaded at an older localL1 is never
+	// written over the metas updated by DownloadFinished. localL1 is written holding both s.mu and metasMu, so it can
+	// be read holding either. The lock order is s.mu before metasMu.
+	metasMu sync.Mutex
+	// shardMetasL1 is the localL1 at which the metas of each shard were last downloaded, protected by metasMu
+	shardMetasL1 map[uint64]int64
+	// metaUpdatedAt is the local L1 at which each kv is last updated by DownloadFinished since metaUpdatesFrom, the
+	// local L1 of the last Reset, for BlobsChangedSince. They are written holding both s.mu and metasMu.
+	metaUpdatedAt   map[uint64]int64
+	metaUpdatesFrom int64
+	// restoredMetasL1 is the L1 block the metas restored by SetMetaIndexDB are valid at until they are reconciled
+	// with localL1 by reconcileRestoredMetas, 0 if none
+	restoredMetasL1 int64
+
+	opsMu       sync.RWMutex   // protect closed and the registering to ops
+	ops         sync.WaitGroup // in-flight operations writing to the shard files, waited by Close
+	closed      bool
+	closeCtx    context.Context // cancelled by Close to stop the meta downloads
+	closeCancel context.CancelFunc
+
+	pendingWrites atomic.Int64                   // commits from the sync layer waiting for the lock or being written
+	commitLatency atomic.Int64                   // moving average of the commit latency in nanoseconds
+	diskFullAt    atomic.Int64                   // time in nanoseconds the disk is last found full, 0 if not full
+	metrics       atomic.Pointer[StorageMetrics] // metrics of the lock wait and codec time, nil if disabled
+	tracer        atomic.Pointer[StorageTracer]  // tracer of the spans of the operations, nil if disabled
+
+	gate syncGate // gate of the commits and downloads by Pause and Resume
+
+	subMu             sync.Mutex // protect the subscriber callbacks
+	blobCommittedSubs []func(kvIdx uint64)
+	l1AdvanceSubs     []func(oldL1, newL1 int64)
+}
+
+// l1Advance is an advance of localL1 by DownloadFinished to be notified to the OnL1Advance subscribers.
+type l1Advance struct {
+	oldL1, newL1 int64
 }
 
 func NewStorageManager(sm *ShardManager, l1Source Il1Source) *StorageManager {
+	closeCtx, closeCancel := context.WithCancel(context.Background())
 	return &StorageManager{
-		shardManager: sm,
-		l1Source:     l1Source,
-		blobMetas:    map[uint64][32]byte{},
+		Clock:            SystemClock{},
+		shardManager:     sm,
+		l1Source:         l1Source,
+		blobMetas:        newMetaStore(sm.kvEntries),
+		shardFaults:      map[uint64]error{},
+		lastBlobIdxCache: map[int64]uint64{},
+		fills:            map[uint64]*shardFill{},
+		compacting:       map[uint64]bool{},
+		hungWrites:       map[uint64]bool{},
+		warns:            newWarnLimiter(commitLog, warnAggregateInterval),
+		closeCtx:         closeCtx,
+		closeCancel:      closeCancel,
 	}
 }
 
 // DownloadFinished This function will be called when the node found new block are finalized, and it will update the
-// local L1 view and commit new blobs into local storage file.
+// local L1 view and commit new blobs into local storage file. Only the first hash size bytes of the commits are kept,
+// see DownloadFinishedWithContractCommits for the commits as kept by the contract.
+// If DownloadBatchMax is set, the blobs are written in sub-batches of up to that many, with the lock released between
+// them so the reads are not blocked by a huge batch, e.g. after a long downtime, while localL1 and lastKvIdx are still
+// updated at once after the last sub-batch. The metas of each sub-batch are updated with its blobs under its lock,
+// so the commits of the sync layer checked against the metas before newL1 cannot overwrite the blobs written. So the
+// readers may see the blobs and the metas of the earlier sub-batches before localL1 advances, and if a sub-batch
+// fails, the blobs and the metas of those before it are kept while localL1 is not advanced, like a batch failed in the
+// middle of the parallel writes, and the retry of the whole batch rewrites them with the same data.
 func (s *StorageManager) DownloadFinished(newL1 int64, kvIndices []uint64, blobs [][]byte, commits []common.Hash) error {
-	if len(kvIndices) != len(blobs) || len(blobs) != len(commits) {
-		return errors.New("invalid params lens")
+	return s.DownloadFinishedContext(context.Background(), newL1, kvIndices, blobs, commits)
+}
+
+// DownloadFinishedContext This function is like DownloadFinished, but with ctx carrying the parent of its spans
+// traced by the tracer set by SetTracer.
+func (s *StorageManager) DownloadFinishedContext(ctx context.Context, newL1 int64, kvIndices []uint64, blobs [][]byte,
+	commits []common.Hash) (err error) {
+	ctx, end := s.startSpan(ctx, "DownloadFinished")
+	defer func() { end(err) }()
+
+	if err := checkParamsLens(kvIndices, blobs, commits); err != nil {
+		return err
+	}
+	if err := s.enterSync(); err != nil {
+		return err
+	}
+	defer s.exitSync()
+	if err := s.acquire(); err != nil {
+		return err
+	}
+	defer s.release()
+	if err := s.checkDiskFull(); err != nil {
+		return err
+	}
+	// check the indices before writing anything, so that the metas can always be updated after the write
+	for _, kvIdx := range kvIndices {
+		if kvIdx > MaxKvIdxInMeta {
+			return fmt.Errorf("%w: %d > %d", ErrKvIdxOutOfRange, kvIdx, MaxKvIdxInMeta)
+		}
 	}
+	hash := s.fetchL1Hash(newL1)
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	// the blobs beyond DownloadBatchMax are written in sub-batches, releasing the lock between them for the reads
+	size := s.DownloadBatchMax
+	if size <= 0 {
+		size = len(kvIndices)
+	}
+	var writtenKvs []uint64
+	from := 0
+	for ; len(kvIndices)-from > size; from += size {
+		written, err := s.downloadSubBatch(ctx, newL1, kvIndices[from:from+size], blobs[from:from+size], commits[from:from+size])
+		writtenKvs = append(writtenKvs, written...)
+		if err != nil {
+			return err
+		}
+	}
 
-	// in most case, newL1 should be equal to s.localL1 + 32
+	_, endLock := s.startSpan(ctx, "lock")
+	s.lock("DownloadFinished")
+	endLock(nil)
+	defer s.unlockAndNotify()
+
+	// in most case, newL1 should be equal to s.localL1 + L1FinalizedStep
 	// but it is possible that the node was shutdown for some time, and when it restart and DownloadFinished for the first time
 	// the new finalized L1 will be larger than that, so we just do the simple compare check here.
 	if newL1 <= s.localL1 {
-		return errors.New("new L1 is older than local L1")
+		return errL1Older
+	}
+	written, err := s.writeDownloaded(ctx, kvIndices[from:], blobs[from:], commits[from:])
+	writtenKvs = append(writtenKvs, written...)
+	if err != nil {
+		return err
+	}
+	// the shards with the timed out writes still pending stay faulted
+	pending := s.hungShards()
+	for _, kvIdx := range kvIndices {
+		if shardIdx := kvIdx / s.KvEntries(); !pending[shardIdx] {
+			delete(s.shardFaults, shardIdx)
+		}
+	}
+
+	lastKvIdx, err := s.getStorageLastBlobIdx(newL1)
+	if err != nil {
+		return err
+	}
+	s.metasMu.Lock()
+	defer s.metasMu.Unlock()
+	s.l1Advances = append(s.l1Advances, l1Advance{oldL1: s.localL1, newL1: newL1})
+	s.lastKvIdx = lastKvIdx
+	s.setLocalL1(newL1, hash)
+	s.lastDownloadTime = s.Clock.Now()
+
+	_, endMetas := s.startSpan(ctx, "metas")
+	err = s.updateLocalMetas(kvIndices, commits)
+	endMetas(err)
+	if err != nil {
+		return err
+	}
+	s.checkpointL1(writtenKvs)
+	return nil
+}
+
+// downloadSubBatch writes a sub-batch of the blobs of DownloadFinished other than the last under the lock, which is
+// released after it, without advancing localL1. The metas of the sub-batch are updated before the lock is released,
+// so a commit of the sync layer with the commit before newL1 cannot overwrite the blobs written.
+func (s *StorageManager) downloadSubBatch(ctx context.Context, newL1 int64, kvIndices []uint64, blobs [][]byte,
+	commits []common.Hash) ([]uint64, error) {
+	_, endLock := s.startSpan(ctx, "lock")
+	s.lock("DownloadFinished")
+	endLock(nil)
+	defer s.unlockAndNotify()
+
+	if newL1 <= s.localL1 {
+		return nil, errL1Older
+	}
+	written, err := s.writeDownloaded(ctx, kvIndices, blobs, commits)
+	if err != nil {
+		return written, err
 	}
+	s.metasMu.Lock()
+	defer s.metasMu.Unlock()
+	return written, s.setLocalMetas(kvIndices, commits, newL1)
+}
 
+// writeDownloaded writes the blobs of DownloadFinished with DownloadThreadNum tasks, and returns the kv indices
+// written. The write error of a task is recorded as the fault of the shard of the kv failed to write, and the first
+// one is returned. The caller must hold s.mu.
+func (s *StorageManager) writeDownloaded(ctx context.Context, kvIndices []uint64, blobs [][]byte,
+	commits []common.Hash) ([]uint64, error) {
 	taskNum := s.DownloadThreadNum
+	pool := s.workerPool()
+	budget := newByteBudget(s.MaxInFlightBytes)
+	audit := s.audit
+	index := s.commitIndex
+	allowlist := s.syncAllowlist
+	hashSize := s.hashSize()
 	var wg sync.WaitGroup
-	chanRes := make(chan error, taskNum)
-	defer close(chanRes)
+	// taskErrs records the write error of each task, and failedKvIdx records the kv index failed to write
+	// by each task, so the fault can be tracked by shard
+	taskErrs := make([]error, taskNum)
+	failedKvIdx := make([]int, taskNum)
+	// written records the positions in kvIndices of the kvs written by each task
+	written := make([][]int, taskNum)
 
 	taskIdx := 0
 	for taskIdx < taskNum {
@@ -80,117 +342,326 @@ func (s *StorageManager) DownloadFinished(newL1 int64, kvIndices []uint64, blobs
 			break
 		}
 
-		wg.Add(1)
-
 		insertIdxInTask := make([]int, 0)
 		for i := taskIdx; i < len(kvIndices); i += taskNum {
 			insertIdxInTask = append(insertIdxInTask, i)
 		}
 
-		go func(insertIdx []int, out chan<- error) {
+		failedKvIdx[taskIdx] = -1
+		tIdx := taskIdx
+		wg.Add(1)
+		err := pool.submit(func() {
 			defer wg.Done()
 
-			var err error = nil
-			for _, idx := range insertIdx {
-				c := prepareCommit(commits[idx])
+			for _, idx := range insertIdxInTask {
+				if !allowlist.contains(kvIndices[idx]) {
+					continue
+				}
+				// the other tasks stop writing once the disk is found full
+				if err := s.checkDiskFull(); err != nil {
+					taskErrs[tIdx] = err
+					break
+				}
+				c := prepareCommitN(commits[idx], hashSize)
+				// the encoding of a blob allocates a copy of it, so wait for the budget before writing
+				acquired := budget.acquire(uint64(len(blobs[idx])))
 				// if return false, just ignore because we are not intersted in it
-				_, err = s.shardManager.TryWrite(kvIndices[idx], blobs[idx], c)
+				_, endWrite := s.startSpan(ctx, "write")
+				managed, err := s.tryWrite(kvIndices[idx], blobs[idx], c)
+				endWrite(err)
+				budget.release(acquired)
 				if err != nil {
+					taskErrs[tIdx] = err
+					failedKvIdx[tIdx] = idx
 					break
 				}
+				if managed {
+					written[tIdx] = append(written[tIdx], idx)
+					audit.record(kvIndices[idx], commits[idx], CommitSourceDownload, s.Clock.Now())
+					index.add(kvIndices[idx], commits[idx], hashSize)
+				}
 			}
-
-			chanRes <- err
-		}(insertIdxInTask, chanRes)
+		})
+		if err != nil {
+			wg.Done()
+			taskErrs[taskIdx] = err
+			break
+		}
 
 		taskIdx++
 	}
 
 	wg.Wait()
 
-	for i := 0; i < taskIdx; i++ {
-		res := <-chanRes
-		if res != nil {
-			return res
+	var writeErr error
+	for i := 0; i < taskNum; i++ {
+		if taskErrs[i] != nil && writeErr == nil {
+			writeErr = taskErrs[i]
+		}
+		// the tasks not started have no kv index recorded
+		if taskErrs[i] != nil && failedKvIdx[i] >= 0 {
+			s.shardFaults[kvIndices[failedKvIdx[i]]/s.KvEntries()] = taskErrs[i]
+		}
+	}
+	var writtenKvs []uint64
+	for _, w := range written {
+		for _, idx := range w {
+			s.committed = append(s.committed, kvIndices[idx])
+			// the blobs of a staged shard are written to its staging copy
+			if s.stagedShard(kvIndices[idx]) == nil {
+				s.updateFill(kvIndices[idx], prepareCommitN(commits[idx], hashSize))
+			}
+			writtenKvs = append(writtenKvs, kvIndices[idx])
 		}
 	}
+	return writtenKvs, writeErr
+}
+
+// SetL1Source This function replaces the l1Source at runtime, e.g. when the operator rotates the RPC providers.
+// The operations holding the lock complete against the old source, and the later ones use the new source.
+func (s *StorageManager) SetL1Source(src Il1Source) error {
+	if src == nil {
+		return ErrNilL1Source
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.l1Mu.Lock()
+	defer s.l1Mu.Unlock()
+	s.l1Source = src
+	return nil
+}
+
+func (s *StorageManager) getL1Source() Il1Source {
+	s.l1Mu.RLock()
+	defer s.l1Mu.RUnlock()
+	return s.l1Source
+}
 
-	lastKvIdx, err := s.l1Source.GetStorageLastBlobIdx(newL1)
+// getStorageLastBlobIdx returns the lastKvIdx of the block from the cache if it has been queried, otherwise it
+// queries l1Source and caches the result. The caller must hold s.mu.
+func (s *StorageManager) getStorageLastBlobIdx(blockNumber int64) (uint64, error) {
+	if lastKvIdx, ok := s.lastBlobIdxCache[blockNumber]; ok {
+		return lastKvIdx, nil
+	}
+	lastKvIdx, err := s.getL1Source().GetStorageLastBlobIdx(blockNumber)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	s.lastKvIdx = lastKvIdx
-	s.localL1 = newL1
+	s.lastBlobIdxCache[blockNumber] = lastKvIdx
+	return lastKvIdx, nil
+}
 
-	s.updateLocalMetas(kvIndices, commits)
+// setLocalL1 updates localL1 with the hash of its block and drops the cached lastKvIdx of the blocks before it, which
+// are not expected to be queried again. The block is recorded with the metas kept in a database, see SetMetaIndexDB.
+// The caller must hold s.mu and s.metasMu.
+func (s *StorageManager) setLocalL1(newL1 int64, hash common.Hash) {
+	s.localL1 = newL1
+	s.localL1Hash = hash
+	s.markMetaIndexL1()
+	for blockNumber := range s.lastBlobIdxCache {
+		if blockNumber < newL1 {
+			delete(s.lastBlobIdxCache, blockNumber)
+		}
+	}
+}
 
+// checkParamsLens returns ErrMismatchedLengths with all the lengths if the params are not of the same length.
+func checkParamsLens(kvIndices []uint64, blobs [][]byte, commits []common.Hash) error {
+	if len(kvIndices) != len(blobs) || len(blobs) != len(commits) {
+		return fmt.Errorf("%w: kvIndices %d, blobs %d, commits %d", ErrMismatchedLengths, len(kvIndices), len(blobs), len(commits))
+	}
 	return nil
 }
 
-func prepareCommit(commit common.Hash) common.Hash {
-	c := common.Hash{}
-	copy(c[0:HashSizeInContract], commit[0:HashSizeInContract])
+// checkBlobLen returns ErrInvalidBlobLen unless the blob is of kvSize bytes, or is empty with the empty commit.
+// The encoding pads a short blob with zeros and truncates a long one, which would store data not matching the commit.
+func (s *StorageManager) checkBlobLen(kvIdx uint64, blob []byte, commit common.Hash) error {
+	if uint64(len(blob)) == s.shardManager.kvSize || (len(blob) == 0 && commit == common.Hash{}) {
+		return nil
+	}
+	return fmt.Errorf("%w: kvIdx %d, length %d, expected %d", ErrInvalidBlobLen, kvIdx, len(blob), s.shardManager.kvSize)
+}
+
+// PrepareCommit returns the local meta of a blob with the commit, i.e. the commit truncated to HashSizeInContract
+// bytes followed by the filling bit, so that external tools writing to the storage files produce compatible metas.
+func PrepareCommit(commit common.Hash) common.Hash {
+	return prepareCommit(commit)
+}
+
+// IsFilled returns whether the local meta has the filling bit set, i.e. the blob has been filled with synced or
+// empty data.
+func IsFilled(meta common.Hash) bool {
+	return isFilledN(meta, HashSizeInContract)
+}
 
-	// The first bit after data hash in the meta indicate whether this blob has been filled. 0 stands for NOT filled yet.
-	// We want to make sure this bit to be 1 when filling data
-	c[HashSizeInContract] = c[HashSizeInContract] | blobFillingMask
+// IsEmptyFilled returns whether the local meta is of a blob filled with empty data, i.e. the empty commit followed by
+// the filling bit.
+func IsEmptyFilled(meta common.Hash) bool {
+	return isEmptyFilledN(meta, HashSizeInContract)
+}
 
-	return c
+// IsUnsynced returns whether the local meta is of a blob not filled yet, i.e. it has the filling bit cleared.
+func IsUnsynced(meta common.Hash) bool {
+	return !isFilledN(meta, HashSizeInContract)
+}
+
+func prepareCommit(commit common.Hash) common.Hash {
+	return prepareCommitN(commit, HashSizeInContract)
 }
 
 // Reset This function must be called before calling any other funcs, it will setup a local L1 view for the node.
+// The downloaded metas are kept as they are, so it assumes the metas are downloaded or refreshed by the caller after
+// it, e.g. by DownloadAllMetas. Use ResetAndInvalidateMetas to move a running node to another block otherwise.
+// The metas restored from the database by SetMetaIndexDB are reconciled with newL1 first, see reconcileRestoredMetas.
 func (s *StorageManager) Reset(newL1 int64) error {
+	s.reconcileRestoredMetas(newL1)
+	hash := s.fetchL1Hash(newL1)
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	lastKvIdx, err := s.l1Source.GetStorageLastBlobIdx(newL1)
+	lastKvIdx, err := s.getStorageLastBlobIdx(newL1)
 	if err != nil {
 		return err
 	}
+	s.metasMu.Lock()
+	defer s.metasMu.Unlock()
 	s.lastKvIdx = lastKvIdx
-	s.localL1 = newL1
+	s.setLocalL1(newL1, hash)
+	s.resetMetaUpdates(newL1)
+	s.lastDownloadTime = s.Clock.Now()
 
 	return nil
 }
 
 // CommitBlobs This function will be called when p2p sync received blobs. It will commit the blobs
-// that match local L1 view and return the unmatched ones.
+// that match local L1 view and return the kv indices of the inserted ones, including those already stored.
+// The inserted indices are a subsequence of kvIndices in the same relative order, with an index appearing once per
+// occurrence in kvIndices, so the caller can correlate them with the input positionally.
 // Note that the caller must make sure the blobs data and the corresponding commit are matched.
+// The blobs are read while CommitBlobs runs and are not retained after it returns, as each blob is encoded into a new
+// buffer before it is written, so the caller may reuse the buffers, e.g. from a pool, once it returns, but must not
+// mutate them during the call, or the corrupted data is stored with the commit.
+// Each blob must be of kvSize bytes, or empty with the empty commit like those of CommitEmptyBlobs; the other blobs,
+// e.g. truncated by a buggy peer, are skipped with ErrInvalidBlobLen instead of being padded or truncated to kvSize.
+// If the disk is full, the batch is aborted with ErrDiskFull and the blobs inserted before it, and the commits fail
+// fast with ErrDiskFull for DiskFullRetry, see DiskFull.
 func (s *StorageManager) CommitBlobs(kvIndices []uint64, blobs [][]byte, commits []common.Hash) ([]uint64, error) {
-	if len(kvIndices) != len(blobs) || len(blobs) != len(commits) {
-		return nil, errors.New("invalid params lens")
+	return s.commitBlobs(context.Background(), kvIndices, blobs, commits, false)
+}
+
+// CommitBlobsContext This function is like CommitBlobs, but with ctx carrying the parent of its spans traced by the
+// tracer set by SetTracer.
+func (s *StorageManager) CommitBlobsContext(ctx context.Context, kvIndices []uint64, blobs [][]byte, commits []common.Hash) ([]uint64, error) {
+	return s.commitBlobs(ctx, kvIndices, blobs, commits, false)
+}
+
+// CommitBlobsStrict This function is like CommitBlobs, but aborts the batch on the first blob failed to write for
+// other reasons than the benign ones like a commit mismatch (see isBenignCommitErr), e.g. the disk is full, and
+// returns the blobs inserted before it with the error, so that the caller can tell a systemic failure from a batch
+// with fewer blobs inserted. The blobs failed to encode are still skipped.
+func (s *StorageManager) CommitBlobsStrict(kvIndices []uint64, blobs [][]byte, commits []common.Hash) ([]uint64, error) {
+	return s.commitBlobs(context.Background(), kvIndices, blobs, commits, true)
+}
+
+// isBenignCommitErr returns whether the blob is not committed because it does not match the local view of the
+// contract or is not stored by the node, rather than because of a failure of the storage.
+func isBenignCommitErr(err error) bool {
+	return errors.Is(err, ErrCommitMismatch) || errors.Is(err, ErrKvIdxMismatch) ||
+		errors.Is(err, ErrNotOwned) || errors.Is(err, ErrShardNotManaged)
+}
+
+func (s *StorageManager) commitBlobs(ctx context.Context, kvIndices []uint64, blobs [][]byte, commits []common.Hash,
+	strict bool) (inserted []uint64, err error) {
+	ctx, end := s.startSpan(ctx, "CommitBlobs")
+	defer func() { end(err) }()
+
+	if err := checkParamsLens(kvIndices, blobs, commits); err != nil {
+		return nil, err
+	}
+	if err := s.enterSync(); err != nil {
+		return nil, err
+	}
+	defer s.exitSync()
+	if err := s.acquire(); err != nil {
+		return nil, err
+	}
+	defer s.release()
+	defer s.endWrite(s.beginWrite())
+	if err := s.checkDiskFull(); err != nil {
+		return nil, err
+	}
+
+	kvIdxErrs, err := s.checkContractKvIdxs(kvIndices)
+	if err != nil {
+		return nil, err
+	}
+	for i := range kvIdxErrs {
+		if kvIdxErrs[i] == nil {
+			kvIdxErrs[i] = s.checkBlobLen(kvIndices[i], blobs[i], commits[i])
+		}
 	}
 	var (
 		l            = len(kvIndices)
 		encodedBlobs = make([][]byte, l)
 		encoded      = make([]bool, l)
 	)
-	for i := 0; i < len(kvIndices); i++ {
-		encodedBlob, success, err := s.shardManager.TryEncodeKV(kvIndices[i], blobs[i], commits[i])
-		if !success || err != nil {
-			log.Warn("Blob encode failed", "index", kvIndices[i], "err", err.Error())
-			continue
+	// the blobs are encoded in parallel by CommitThreadNum workers, each of which sets the results of its own indices
+	err = s.runCommitTasks(l, func(i int) {
+		if kvIdxErrs[i] != nil {
+			s.warns.warn(s.Clock.Now(), "Blob skipped", kvIndices[i]/s.shardManager.kvEntries, "index", kvIndices[i], "err", kvIdxErrs[i].Error())
+			return
+		}
+		// the encoded blob never aliases blobs[i], so the input is not referenced after the encoding
+		_, endEncode := s.startSpan(ctx, "encode")
+		encodedBlob, success, err := s.tryEncodeKV(kvIndices[i], blobs[i], commits[i])
+		if err == nil && !success {
+			err = fmt.Errorf("%w: kvIdx %d", ErrShardNotManaged, kvIndices[i])
+		}
+		endEncode(err)
+		if err != nil {
+			s.warns.warn(s.Clock.Now(), "Blob encode failed", kvIndices[i]/s.shardManager.kvEntries, "index", kvIndices[i], "err", err.Error())
+			return
 		}
 		encodedBlobs[i] = encodedBlob
 		encoded[i] = true
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	_, endLock := s.startSpan(ctx, "lock")
+	s.lock("CommitBlobs")
+	endLock(nil)
+	defer s.unlockAndNotify()
 
+	_, endMetas := s.startSpan(ctx, "metas")
 	metas, err := s.getKvMetas(kvIndices)
+	endMetas(err)
 	if err != nil {
 		return nil, err
 	}
 
-	inserted := []uint64{}
+	// metas[i] is the meta of kvIndices[i], so inserted keeps the order of kvIndices as documented by CommitBlobs
+	inserted = []uint64{}
 	for i, contractMeta := range metas {
 		if !encoded[i] {
 			continue
 		}
-		err := s.commitEncodedBlob(kvIndices[i], encodedBlobs[i], commits[i], contractMeta)
+		// the write includes the read of the local meta, which tells whether the blob is already stored
+		_, endWrite := s.startSpan(ctx, "write")
+		err := s.commitEncodedBlob(kvIndices[i], encodedBlobs[i], commits[i], contractMeta, CommitSourceSync)
+		endWrite(err)
 		if err != nil {
-			log.Warn("Commit blobs fail", "kvIndex", kvIndices[i], "err", err.Error())
+			if errors.Is(err, ErrCommitMismatch) {
+				s.quarantine(kvIndices[i])
+			}
+			// the rest of the batch would fail to write as well
+			if errors.Is(err, ErrDiskFull) || strict && !isBenignCommitErr(err) {
+				return inserted, fmt.Errorf("commit kv %d failed: %w", kvIndices[i], err)
+			}
+			s.warns.warn(s.Clock.Now(), "Commit blobs fail", kvIndices[i]/s.shardManager.kvEntries, "kvIndex", kvIndices[i], "err", err.Error())
 			continue
 		}
 		inserted = append(inserted, kvIndices[i])
@@ -200,58 +671,121 @@ func (s *StorageManager) CommitBlobs(kvIndices []uint64, blobs [][]byte, commits
 
 // CommitEmptyBlobs use to commit batch empty blobs, return inserted blobs count, next index to fill
 // and error GetKvMetas got. Any error (like encode or commit) happen to a blob, cancel to rest.
+// If a blob fails to encode, the error is returned along with the blobs inserted before it, so the fill is never
+// taken as complete. See FillEmptyRange for why the fill stopped.
 func (s *StorageManager) CommitEmptyBlobs(start, limit uint64) (uint64, uint64, error) {
+	r, err := s.FillEmptyRange(start, limit)
+	if err == nil && r.StoppedReason == FillEncodeFailed {
+		err = r.Err
+	}
+	return r.Inserted, r.NextIndex, err
+}
+
+// FillEmptyRange This function is like CommitEmptyBlobs, but returns a FillResult telling why the fill stopped, so
+// the caller filling the ranges in a loop knows whether to go on from NextIndex, retry the blob at NextIndex, or give
+// up. The error is returned as by CommitEmptyBlobs, i.e. if the fill cannot start or the metas cannot be got, while
+// the error of the blob stopping the fill is kept in the result.
+func (s *StorageManager) FillEmptyRange(start, limit uint64) (FillResult, error) {
+	r := FillResult{NextIndex: start}
+	if err := s.enterSync(); err != nil {
+		return r, err
+	}
+	defer s.exitSync()
+	if err := s.acquire(); err != nil {
+		return r, err
+	}
+	defer s.release()
+	defer s.endWrite(s.beginWrite())
+	if err := s.checkDiskFull(); err != nil {
+		return r, err
+	}
+
 	var (
 		encodedBlobs = make([][]byte, 0)
 		kvIndices    = make([]uint64, 0)
-		inserted     = uint64(0)
 		emptyBs      = make([]byte, 0)
 		hash         = common.Hash{}
-		next         = start
+		encodeErr    error
 	)
+	// the blobs before the one failed to encode are still committed, with NextIndex stopping at it
 	for i := start; i <= limit; i++ {
-		encodedBlob, success, err := s.shardManager.TryEncodeKV(i, emptyBs, hash)
-		if !success || err != nil {
-			log.Warn("Blob encode failed", "index", i, "err", err.Error())
+		encodedBlob, success, err := s.tryEncodeKV(i, emptyBs, hash)
+		if err == nil && !success {
+			err = fmt.Errorf("%w: kvIdx %d", ErrShardNotManaged, i)
+		}
+		if err != nil {
+			s.warns.warn(s.Clock.Now(), "Blob encode failed", i/s.shardManager.kvEntries, "index", i, "err", err.Error())
+			encodeErr = fmt.Errorf("encode empty blob %d: %w", i, err)
 			break
 		}
 		encodedBlobs = append(encodedBlobs, encodedBlob)
 		kvIndices = append(kvIndices, i)
 	}
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	s.lock("CommitEmptyBlobs")
+	defer s.unlockAndNotify()
 
 	metas, err := s.getKvMetas(kvIndices)
 	if err != nil {
-		return inserted, next, err
+		return r, err
 	}
 
 	for i, index := range kvIndices {
-		err := s.commitEncodedBlob(index, encodedBlobs[i], hash, metas[i])
+		err := s.commitEncodedBlob(index, encodedBlobs[i], hash, metas[i], CommitSourceEmpty)
 		if err == nil {
-			inserted++
-		} else if err != errCommitMismatch {
-			log.Info("Commit blobs fail", "kvIndex", kvIndices[i], "err", err.Error())
-			break
+			r.Inserted++
+		} else if !errors.Is(err, ErrCommitMismatch) && !errors.Is(err, ErrNotOwned) {
+			commitLog.Info("Commit blobs fail", "kvIndex", kvIndices[i], "err", err.Error())
+			r.StoppedReason, r.Err = FillWriteFailed, err
+			return r, nil
+		} else {
+			// if meta is not equal to empty hash, that mean the blob is not empty, or the blob is not owned,
+			// so cancel the fill empty for that index and continue the rest.
+			r.Skipped++
 		}
-		// if meta is not equal to empty hash, that mean the blob is not empty,
-		// so cancel the fill empty for that index and continue the rest.
-		next++
+		r.NextIndex++
+	}
+	r.StoppedReason = FillReachedLimit
+	if r.NextIndex <= limit {
+		r.StoppedReason, r.Err = FillEncodeFailed, encodeErr
 	}
-	return inserted, next, nil
+	return r, nil
 }
 
 // CommitBlob This function will be called when p2p sync received a blob.
-// Return err if the passed commit and the one queried from contract are not matched.
+// Return err if the passed commit and the one queried from contract are not matched, or ErrInvalidBlobLen if the
+// length of the blob is not valid as checked by CommitBlobs.
 func (s *StorageManager) CommitBlob(kvIndex uint64, blob []byte, commit common.Hash) error {
-	encodedBlob, success, err := s.shardManager.TryEncodeKV(kvIndex, blob, commit)
+	if err := s.enterSync(); err != nil {
+		return err
+	}
+	defer s.exitSync()
+	if err := s.acquire(); err != nil {
+		return err
+	}
+	defer s.release()
+	defer s.endWrite(s.beginWrite())
+	if err := s.checkDiskFull(); err != nil {
+		return err
+	}
+
+	kvIdxErrs, err := s.checkContractKvIdxs([]uint64{kvIndex})
+	if err != nil {
+		return err
+	}
+	if kvIdxErrs[0] != nil {
+		return kvIdxErrs[0]
+	}
+	if err := s.checkBlobLen(kvIndex, blob, commit); err != nil {
+		return err
+	}
+	encodedBlob, success, err := s.tryEncodeKV(kvIndex, blob, commit)
 	if !success || err != nil {
 		return errors.New("blob encode failed")
 	}
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	s.lock("CommitBlob")
+	defer s.unlockAndNotify()
 
 	metas, err := s.getKvMetas([]uint64{kvIndex})
 	if err != nil {
@@ -259,62 +793,213 @@ func (s *StorageManager) CommitBlob(kvIndex uint64, blob []byte, commit common.H
 	}
 
 	if len(metas) != 1 {
-		return errors.New("invalid params lens")
+		return fmt.Errorf("%w: kvIndices 1, metas %d", ErrMismatchedLengths, len(metas))
 	}
 
 	contractMeta := metas[0]
-	return s.commitEncodedBlob(kvIndex, encodedBlob, commit, contractMeta)
+	err = s.commitEncodedBlob(kvIndex, encodedBlob, commit, contractMeta, CommitSourceSync)
+	if errors.Is(err, ErrCommitMismatch) {
+		s.quarantine(kvIndex)
+	}
+	return err
+}
+
+// CommitEncodedBlobPublic This function is like CommitBlob but commits a blob which is already encoded, e.g. read by
+// TryReadEncoded from another replica of the shard, so it skips the encoding and goes to the meta checks directly.
+// The caller must make sure the blob is encoded with the miner and encode type of the shard.
+// Return err if the length of the encoded blob is not kvSize, or the passed commit and the one queried from contract
+// are not matched.
+func (s *StorageManager) CommitEncodedBlobPublic(kvIndex uint64, encodedBlob []byte, commit common.Hash) error {
+	if uint64(len(encodedBlob)) != s.shardManager.kvSize {
+		return fmt.Errorf("invalid encoded blob length %d, expected %d", len(encodedBlob), s.shardManager.kvSize)
+	}
+	if err := s.enterSync(); err != nil {
+		return err
+	}
+	defer s.exitSync()
+	if err := s.acquire(); err != nil {
+		return err
+	}
+	defer s.release()
+	defer s.endWrite(s.beginWrite())
+	if err := s.checkDiskFull(); err != nil {
+		return err
+	}
+
+	s.lock("CommitEncodedBlobPublic")
+	defer s.unlockAndNotify()
+
+	metas, err := s.getKvMetas([]uint64{kvIndex})
+	if err != nil {
+		return err
+	}
+	if len(metas) != 1 {
+		return fmt.Errorf("%w: kvIndices 1, metas %d", ErrMismatchedLengths, len(metas))
+	}
+	return s.commitEncodedBlob(kvIndex, encodedBlob, commit, metas[0], CommitSourceEncoded)
+}
+
+// checkContractKvIdxs checks the kvIdx embedded in the contract metas of kvIndices before the blobs are encoded, so
+// that no encoding is done for the kvs with a stale or wrong meta. It returns the error of each kv, which is
+// ErrKvIdxMismatch if the check fails. commitEncodedBlob checks them again as the metas may change in the meantime.
+func (s *StorageManager) checkContractKvIdxs(kvIndices []uint64) ([]error, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	metas, err := s.getKvMetas(kvIndices)
+	if err != nil {
+		return nil, err
+	}
+	errs := make([]error, len(kvIndices))
+	for i, meta := range metas {
+		errs[i] = checkContractKvIdx(kvIndices[i], meta)
+	}
+	return errs, nil
+}
+
+func checkContractKvIdx(kvIndex uint64, contractMeta [32]byte) error {
+	if contractKvIdx := metaKvIdx(contractMeta); contractKvIdx != kvIndex {
+		return fmt.Errorf("%w: contract %d, input %d", ErrKvIdxMismatch, contractKvIdx, kvIndex)
+	}
+	return nil
 }
 
-func (s *StorageManager) commitEncodedBlob(kvIndex uint64, encodedBlob []byte, commit common.Hash, contractMeta [32]byte) error {
+func (s *StorageManager) commitEncodedBlob(kvIndex uint64, encodedBlob []byte, commit common.Hash, contractMeta [32]byte, source string) error {
+	// a stale or wrong contract meta must never overwrite the blob
+	if err := checkContractKvIdx(kvIndex, contractMeta); err != nil {
+		return err
+	}
+	// the shard may be removed while the blob was encoded outside the lock
+	ds, ok := s.shardManager.getDataShard(kvIndex / s.shardManager.kvEntries)
+	if !ok {
+		return ErrShardNotManaged
+	}
+	if !ds.Owns(kvIndex) {
+		return fmt.Errorf("%w: kvIdx %d", ErrNotOwned, kvIndex)
+	}
+	if err := s.checkAllowed(kvIndex); err != nil {
+		return err
+	}
+
 	// the commit is different with what we got from the contract, so should not commit
-	if !bytes.Equal(contractMeta[32-HashSizeInContract:32], commit[0:HashSizeInContract]) {
-		return errCommitMismatch
+	hashSize := s.hashSize()
+	if !bytes.Equal(contractMeta[32-hashSize:32], commit[0:hashSize]) {
+		return ErrCommitMismatch
 	}
 
-	m, success, err := s.shardManager.TryReadMeta(kvIndex)
+	m, success, err := s.tryReadMeta(kvIndex)
+	if errors.Is(err, ErrStorageTimeout) {
+		return err
+	}
 	if !success || err != nil {
 		return errors.New("metadata read failed")
 	}
 
-	contractKvIdx := new(big.Int).SetBytes(contractMeta[0:5]).Uint64()
-	if contractKvIdx != kvIndex {
-		return errors.New("kvIdx from contract and input is not matched")
-	}
-
 	localMeta := common.Hash{}
 	copy(localMeta[:], m)
 
 	// the local already have the data and we do not need to commit
 	// empty filled case: if both of the hash is 0, but local meta shows this encodedBlob hasn't been filled yet, we should also commit
-	if bytes.Equal(localMeta[0:HashSizeInContract], commit[0:HashSizeInContract]) && (localMeta[HashSizeInContract]&blobFillingMask) != 0 {
+	if bytes.Equal(localMeta[0:hashSize], commit[0:hashSize]) && isFilledN(localMeta, hashSize) {
 		return nil
 	}
 
-	c := prepareCommit(commit)
+	c := prepareCommitN(commit, hashSize)
 
-	success, err = s.shardManager.TryWriteEncoded(kvIndex, encodedBlob, c)
-	if !success || err != nil {
+	success, err = s.tryWriteEncoded(kvIndex, encodedBlob, c)
+	if errors.Is(err, ErrStorageTimeout) {
+		// the write may still land later, so the kv is indeterminate until it finishes
+		s.shardFaults[kvIndex/s.shardManager.kvEntries] = err
+		return err
+	}
+	if errors.Is(err, ErrDiskFull) {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("encodedBlob write failed: %w", err)
+	}
+	if !success {
 		return errors.New("encodedBlob write failed")
 	}
+	s.committed = append(s.committed, kvIndex)
+	if s.stagedShard(kvIndex) == nil {
+		s.updateFill(kvIndex, c)
+	}
+	s.audit.record(kvIndex, commit, source, s.Clock.Now())
+	s.commitIndex.add(kvIndex, commit, hashSize)
 	return nil
 }
 
+// OnBlobCommitted registers a callback which is invoked with the kvIdx of each blob newly written into the local
+// storage by DownloadFinished and the commit functions. Callbacks are invoked outside the lock by the committing
+// goroutine, so they should return quickly.
+func (s *StorageManager) OnBlobCommitted(fn func(kvIdx uint64)) {
+	s.subMu.Lock()
+	defer s.subMu.Unlock()
+	s.blobCommittedSubs = append(s.blobCommittedSubs, fn)
+}
+
+// OnL1Advance registers a callback which is invoked with the old and new localL1 each time DownloadFinished advances
+// localL1, after the subscribers of OnBlobCommitted are notified of the blobs written with it. Callbacks are invoked
+// outside the lock by the goroutine calling DownloadFinished, so they may call back into the StorageManager, but they
+// should return quickly as they delay the next DownloadFinished.
+func (s *StorageManager) OnL1Advance(fn func(oldL1, newL1 int64)) {
+	s.subMu.Lock()
+	defer s.subMu.Unlock()
+	s.l1AdvanceSubs = append(s.l1AdvanceSubs, fn)
+}
+
+// unlockAndNotify releases s.mu and then notifies the subscribers of the blobs committed and the advances of localL1
+// while it was held.
+func (s *StorageManager) unlockAndNotify() {
+	committed := s.committed
+	s.committed = nil
+	advances := s.l1Advances
+	s.l1Advances = nil
+	if len(committed) > 0 {
+		s.commitRate.add(s.Clock.Now(), len(committed))
+	}
+	s.mu.Unlock()
+
+	if len(committed) == 0 && len(advances) == 0 {
+		return
+	}
+	s.subMu.Lock()
+	subs := s.blobCommittedSubs
+	l1Subs := s.l1AdvanceSubs
+	s.subMu.Unlock()
+	for _, kvIdx := range committed {
+		for _, fn := range subs {
+			fn(kvIdx)
+		}
+	}
+	for _, a := range advances {
+		for _, fn := range l1Subs {
+			fn(a.oldL1, a.newL1)
+		}
+	}
+}
+
 func (s *StorageManager) syncCheck(kvIdx uint64) error {
-	meta, success, err := s.shardManager.TryReadMeta(kvIdx)
-	if !success || err != nil {
+	if err := s.checkAllowed(kvIdx); err != nil {
+		return err
+	}
+	meta, success, err := s.tryReadMeta(kvIdx)
+	if err != nil {
+		return fmt.Errorf("meta reading failed: %w", err)
+	}
+	if !success {
 		return errors.New("meta reading failed")
 	}
 
 	// There are two cases that we do NOT want to return data: not synced and empty filled
-	h0 := common.Hash{} // means not filled, e.g. haven't been synced yet
-
-	h1 := common.Hash{}
-	h1[HashSizeInContract] = h1[HashSizeInContract] | blobFillingMask // means empty filled
-
-	hash := common.Hash{}
-	copy(hash[:], meta)
-	if hash == h0 || hash == h1 {
+	hash := common.BytesToHash(meta)
+	if s.isUnsynced(hash) {
+		if err := s.checkMetasLoaded(); err != nil {
+			return err
+		}
+	}
+	if s.isUnsynced(hash) || s.isEmptyFilled(hash) {
 		return errors.New("syncing or just empty blob")
 	}
 
@@ -322,40 +1007,121 @@ func (s *StorageManager) syncCheck(kvIdx uint64) error {
 }
 
 // DownloadAllMetas This function download the blob hashes of all the local storage shards from the smart contract
-func (s *StorageManager) DownloadAllMetas(ctx context.Context, batchSize uint64) error {
-	s.mu.Lock()
-	lastKvIdx := s.lastKvIdx
-	s.mu.Unlock()
+func (s *StorageManager) DownloadAllMetas(ctx context.Context, batchSize uint64) (err error) {
+	ctx, end := s.startSpan(ctx, "DownloadAllMetas")
+	defer func() { end(err) }()
 
 	for _, sid := range s.Shards() {
-		first, limit := s.KvEntries()*sid, s.KvEntries()*(sid+1)
-
-		// batch request metas until the lastKvIdx
-		end := limit
-		if end > lastKvIdx {
-			end = lastKvIdx
+		if err := s.DownloadShardMetas(ctx, sid, batchSize); err != nil {
+			return err
 		}
-		log.Info("Begin to download metas", "shard", sid, "first", first, "end", end, "limit", limit, "lastKvIdx", lastKvIdx)
-		ts := time.Now()
+	}
 
-		err := s.downloadMetaInParallel(ctx, first, end, batchSize)
-		if err != nil {
+	// downloadMetaInRange returns without error when ctx is cancelled, so the metas may not be complete
+	if ctx.Err() == nil {
+		s.mu.Lock()
+		s.metasDownloaded = true
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+// DownloadShardMetas This function download the blob hashes of the owned kvs of one local storage shard from the
+// smart contract, e.g. after the shard is added by AddShard.
+func (s *StorageManager) DownloadShardMetas(ctx context.Context, shardIdx uint64, batchSize uint64) error {
+	if err := s.enterSync(); err != nil {
+		return err
+	}
+	defer s.exitSync()
+	if err := s.acquire(); err != nil {
+		return err
+	}
+	defer s.release()
+	ctx, cancel := s.withCloseCtx(ctx)
+	defer cancel()
+
+	s.mu.RLock()
+	lastKvIdx := s.lastKvIdx
+	localL1 := s.localL1
+	s.mu.RUnlock()
+	logger := metaLog.New("shard", shardIdx, "block", localL1)
+
+	// only the metas of the owned kvs are downloaded
+	first, limit, ok := s.OwnedKvRange(shardIdx)
+	if !ok {
+		return ErrShardNotManaged
+	}
+
+	// batch request metas until the lastKvIdx
+	end := limit
+	if end > lastKvIdx {
+		end = lastKvIdx
+	}
+	// resume from the checkpoint of an interrupted download if it is enabled
+	ckpt := s.newMetaCheckpointer(shardIdx, first)
+	from := first
+	if ckpt != nil {
+		var stale []uint64
+		from, stale = ckpt.resume()
+		if from > end {
+			from = end
+		}
+		// the stale metas must be downloaded before the next checkpoint, which stores them again
+		if err := s.downloadMetaKvs(ctx, stale, batchSize); err != nil {
 			return err
 		}
+	}
+	logger.Info("Begin to download metas", "first", first, "from", from, "end", end, "limit", limit, "lastKvIdx", lastKvIdx)
+	ts := s.Clock.Now()
 
-		log.Info("All the metas has been downloaded", "first", first, "end", end, "time", time.Since(ts).Seconds())
+	batcher := newMetaBatcher(batchSize, s.MetaBatchMin, s.MetaBatchMax)
+	err := s.downloadMetaInParallel(ctx, from, end, batcher, ckpt, logger)
+	if err != nil {
+		return err
+	}
+
+	// The metas beyond lastKvIdx are taken as empty, so if lastKvIdx advanced during the download, e.g. by Reset,
+	// the metas of the newly covered indices must be downloaded, or they would be served as empty.
+	for ctx.Err() == nil && end < limit {
+		s.mu.RLock()
+		lastKvIdx = s.lastKvIdx
+		s.mu.RUnlock()
+		if lastKvIdx <= end {
+			break
+		}
+
+		newEnd := limit
+		if newEnd > lastKvIdx {
+			newEnd = lastKvIdx
+		}
+		logger.Info("LastKvIdx advanced during downloading metas", "from", end, "to", newEnd)
+		if err = s.downloadMetaInParallel(ctx, end, newEnd, batcher, ckpt, logger); err != nil {
+			return err
+		}
+		end = newEnd
+	}
+	ckpt.flush()
+	// the metas are not complete if the download is cancelled by Close
+	if s.closeCtx.Err() != nil {
+		return ErrStorageClosed
 	}
 
+	if ctx.Err() == nil {
+		s.markShardMetasDownloaded(shardIdx)
+	}
+	logger.Info("All the metas has been downloaded", "first", first, "end", end, "time", s.Clock.Now().Sub(ts).Seconds())
 	return nil
 }
 
-func (s *StorageManager) downloadMetaInParallel(ctx context.Context, from, to, batchSize uint64) error {
+func (s *StorageManager) downloadMetaInParallel(ctx context.Context, from, to uint64, batcher *metaBatcher,
+	ckpt *metaCheckpointer, logger log.Logger) error {
 	var wg sync.WaitGroup
 	taskNum := uint64(MetaDownloadThread)
 
 	// We don't need to download in parallel if the meta amount is small
+	batchSize, _ := batcher.batchSize()
 	if to-from < uint64(taskNum)*batchSize {
-		return s.downloadMetaInRange(ctx, from, to, batchSize, 0)
+		return s.downloadMetaInRange(ctx, from, to, batcher, 0, ckpt, logger)
 	}
 
 	chanRes := make(chan error, taskNum)
@@ -363,8 +1129,8 @@ func (s *StorageManager) downloadMetaInParallel(ctx context.Context, from, to, b
 
 	rangeSize := (to - from) / uint64(taskNum)
 	for taskIdx := uint64(0); taskIdx < taskNum; taskIdx++ {
-		rangeStart := taskIdx * rangeSize
-		rangeEnd := (taskIdx + 1) * rangeSize
+		rangeStart := from + taskIdx*rangeSize
+		rangeEnd := from + (taskIdx+1)*rangeSize
 		if taskIdx == taskNum-1 {
 			rangeEnd = to
 		}
@@ -372,7 +1138,7 @@ func (s *StorageManager) downloadMetaInParallel(ctx context.Context, from, to, b
 
 		go func(start, end, taskId uint64, out chan<- error) {
 			defer wg.Done()
-			err := s.downloadMetaInRange(ctx, start, end, batchSize, taskId)
+			err := s.downloadMetaInRange(ctx, start, end, batcher, taskId, ckpt, logger)
 
 			chanRes <- err
 		}(rangeStart, rangeEnd, taskIdx, chanRes)
@@ -390,14 +1156,23 @@ func (s *StorageManager) downloadMetaInParallel(ctx context.Context, from, to, b
 	return nil
 }
 
-func (s *StorageManager) downloadMetaInRange(ctx context.Context, from, to, batchSize, taskId uint64) error {
+// downloadMetaInRange downloads the metas of [from, to) in batches sized by batcher, and logs the progress with the
+// taskId added to the fields of logger, i.e. the shard and block of the download. A failed batch is downloaded again
+// with the batch size shrunk, unless it is the min size, with which the requests are retried before it fails.
+func (s *StorageManager) downloadMetaInRange(ctx context.Context, from, to uint64, batcher *metaBatcher, taskId uint64,
+	ckpt *metaCheckpointer, logger log.Logger) (err error) {
+	ctx, end := s.startSpan(ctx, "metaWorker")
+	defer func() { end(err) }()
+
+	logger = logger.New("taskId", taskId)
 	rangeStart := from
 	for from < to {
-		s.mu.Lock()
-		localL1 := s.localL1
+		s.mu.RLock()
 		lastKvIdx := s.lastKvIdx
-		s.mu.Unlock()
+		allowlist := s.syncAllowlist
+		s.mu.RUnlock()
 
+		batchSize, retry := batcher.batchSize()
 		batchLimit := from + batchSize
 		if batchLimit > to {
 			batchLimit = to
@@ -409,40 +1184,40 @@ func (s *StorageManager) downloadMetaInRange(ctx context.Context, from, to, batc
 
 		kvIndices := []uint64{}
 		for i := from; i < batchLimit; i++ {
-			kvIndices = append(kvIndices, i)
+			if allowlist.contains(i) {
+				kvIndices = append(kvIndices, i)
+			}
 		}
 
-		metas, err := s.l1Source.GetKvMetas(kvIndices, localL1)
-		for retryTimes := 0; (retryTimes < 10) && (err != nil); retryTimes++ {
-			// Retry the request for 10 times in case it could fail occasionally in poor network connection
-			time.Sleep(2 * time.Second)
-			metas, err = s.l1Source.GetKvMetas(kvIndices, localL1)
+		if err := s.waitMetaBandwidth(ctx, len(kvIndices)); err != nil {
+			logger.Info("Meta download cancelled while throttled", "first", from, "err", err)
+			return nil
 		}
-
+		ts := s.Clock.Now()
+		_, endBatch := s.startSpan(ctx, "metaBatch")
+		err := s.downloadMetaBatch(kvIndices, retry)
+		endBatch(err)
 		if err != nil {
-			return err
-		}
-
-		s.mu.Lock()
-		if localL1 != s.localL1 {
-			s.mu.Unlock()
+			if retry {
+				return err
+			}
+			logger.Warn("Failed to download one batch metas, shrink the batch size", "first", from,
+				"batchLimit", batchLimit, "error", err)
+			batcher.failed(batchLimit - from)
 			continue
 		}
-		for i, meta := range metas {
-			s.blobMetas[kvIndices[i]] = meta
-		}
-		s.mu.Unlock()
+		batcher.succeeded(batchLimit-from, s.Clock.Now().Sub(ts))
+		ckpt.complete(from, batchLimit)
 
-		log.Info(
+		logger.Info(
 			"One batch metas has been downloaded", "first", from,
 			"batchLimit", batchLimit,
 			"to", to,
-			"progress", fmt.Sprintf("%.1f%%", float64((from-rangeStart)*100)/float64(to-rangeStart)),
-			"taskId", taskId)
+			"progress", fmt.Sprintf("%.1f%%", float64((from-rangeStart)*100)/float64(to-rangeStart)))
 
 		select {
 		case <-ctx.Done():
-			log.Info("StorageManager res done, return")
+			logger.Info("StorageManager res done, return")
 			return nil
 		default:
 		}
@@ -451,34 +1226,183 @@ func (s *StorageManager) downloadMetaInRange(ctx context.Context, from, to, batc
 	return nil
 }
 
-// This function is only called by DownloadFinished which already uses s.mu to protect the s.blobMetas, so
-// we don't need to lock in this function
-func (s *StorageManager) updateLocalMetas(kvIndices []uint64, commits []common.Hash) {
-	for i, idx := range kvIndices {
-		meta := [32]byte{}
-		new(big.Int).SetInt64(int64(idx)).FillBytes(meta[0:5])
-		copy(meta[32-HashSizeInContract:32], commits[i][0:HashSizeInContract])
+func (s *StorageManager) getKvMetasWithRetry(kvIndices []uint64, blockNumber int64) ([][32]byte, error) {
+	metas, err := s.getL1Source().GetKvMetas(kvIndices, blockNumber)
+	for retryTimes := 0; (retryTimes < 10) && (err != nil); retryTimes++ {
+		// Retry the request for 10 times in case it could fail occasionally in poor network connection
+		time.Sleep(2 * time.Second)
+		metas, err = s.getL1Source().GetKvMetas(kvIndices, blockNumber)
+	}
+	return metas, err
+}
+
+// fetchKvMetas gets the metas of kvIndices at blockNumber, with the retries of getKvMetasWithRetry if retry is set.
+func (s *StorageManager) fetchKvMetas(kvIndices []uint64, blockNumber int64, retry bool) ([][32]byte, error) {
+	if retry {
+		return s.getKvMetasWithRetry(kvIndices, blockNumber)
+	}
+	return s.getL1Source().GetKvMetas(kvIndices, blockNumber)
+}
+
+// FetchContractMetas This function fetches the live metas of kvIndices from the contract at blockNumber, in batches
+// of up to fetchMetaBatchSize with retries, for the callers that need the authoritative metas, e.g. to verify a read,
+// rather than the downloaded ones used by the commits. The fetched metas are not cached.
+func (s *StorageManager) FetchContractMetas(kvIndices []uint64, blockNumber int64) ([][32]byte, error) {
+	metas := make([][32]byte, 0, len(kvIndices))
+	for from := 0; from < len(kvIndices); from += fetchMetaBatchSize {
+		to := from + fetchMetaBatchSize
+		if to > len(kvIndices) {
+			to = len(kvIndices)
+		}
+		batch, err := s.getKvMetasWithRetry(kvIndices[from:to], blockNumber)
+		if err != nil {
+			return nil, err
+		}
+		if len(batch) != to-from {
+			return nil, fmt.Errorf("%w: kvIndices %d, metas %d", ErrMismatchedLengths, to-from, len(batch))
+		}
+		metas = append(metas, batch...)
+	}
+	return metas, nil
+}
+
+// downloadMetaBatch downloads the metas of kvIndices and sets them if localL1 has not changed in the meantime. The
+// requests are retried if retry is set.
+// Otherwise the metas may have been updated by DownloadFinished after localL1, so they are downloaded again.
+func (s *StorageManager) downloadMetaBatch(kvIndices []uint64, retry bool) error {
+	if len(kvIndices) == 0 {
+		return nil
+	}
+	for staleTimes := 0; staleTimes < maxStaleMetaBatches; staleTimes++ {
+		s.metasMu.Lock()
+		localL1 := s.localL1
+		s.metasMu.Unlock()
+
+		metas, confirmed, err := s.confirmedKvMetas(kvIndices, localL1, retry)
+		if err != nil {
+			return err
+		}
+
+		// the metas are written without s.mu, so the reads are not blocked by the download
+		s.metasMu.Lock()
+		if localL1 == s.localL1 {
+			s.setDownloadedMetas(kvIndices, metas, confirmed)
+			s.metasMu.Unlock()
+			return nil
+		}
+		s.metasMu.Unlock()
+	}
+	// localL1 keeps advancing faster than a batch can be downloaded, so download the batch with the lock held to
+	// make sure it is consistent with localL1, which blocks the commits for one request.
+	metaLog.Warn("LocalL1 keeps changing, download metas with the lock held", "first", kvIndices[0], "count", len(kvIndices))
+	return s.downloadMetaBatchLocked(kvIndices, retry)
+}
+
+// downloadMetaBatchLocked downloads the metas of kvIndices at localL1 with s.mu held, so localL1 cannot change
+// before the metas are set.
+func (s *StorageManager) downloadMetaBatchLocked(kvIndices []uint64, retry bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.metasMu.Lock()
+	defer s.metasMu.Unlock()
+
+	metas, confirmed, err := s.confirmedKvMetas(kvIndices, s.localL1, retry)
+	if err != nil {
+		return err
+	}
+	s.setDownloadedMetas(kvIndices, metas, confirmed)
+	return nil
+}
+
+// confirmedKvMetas gets the metas of kvIndices, which are sorted, at MetaConfirmations blocks behind localL1 to reduce
+// the exposure to reorgs, except the ones of the kvs appended after that block, which are got at localL1. It returns
+// the number of the leading kvIndices whose metas are got at the confirmed block.
+func (s *StorageManager) confirmedKvMetas(kvIndices []uint64, localL1 int64, retry bool) ([][32]byte, int, error) {
+	confirmations := int64(s.MetaConfirmations)
+	if confirmations == 0 || localL1 <= confirmations {
+		metas, err := s.fetchKvMetas(kvIndices, localL1, retry)
+		return metas, 0, err
+	}
+
+	confirmedL1 := localL1 - confirmations
+	confirmedKvIdx, err := s.getL1Source().GetStorageLastBlobIdx(confirmedL1)
+	if err != nil {
+		return nil, 0, err
+	}
+	confirmed := sort.Search(len(kvIndices), func(i int) bool { return kvIndices[i] >= confirmedKvIdx })
+	metas := make([][32]byte, 0, len(kvIndices))
+	if confirmed > 0 {
+		if metas, err = s.fetchKvMetas(kvIndices[:confirmed], confirmedL1, retry); err != nil {
+			return nil, 0, err
+		}
+	}
+	if confirmed < len(kvIndices) {
+		latest, err := s.fetchKvMetas(kvIndices[confirmed:], localL1, retry)
+		if err != nil {
+			return nil, 0, err
+		}
+		metas = append(metas, latest...)
+	}
+	return metas, confirmed, nil
+}
 
-		s.blobMetas[idx] = meta
+// setDownloadedMetas sets the downloaded metas, except the ones got at the confirmed block which are already set, as
+// they may have been updated by DownloadFinished with the blobs after that block. The caller must hold s.metasMu.
+func (s *StorageManager) setDownloadedMetas(kvIndices []uint64, metas [][32]byte, confirmed int) {
+	for i, meta := range metas {
+		if i < confirmed {
+			if _, ok := s.blobMetas.get(kvIndices[i]); ok {
+				continue
+			}
+		}
+		s.blobMetas.set(kvIndices[i], meta)
 	}
+}
 
+// This function is only called by DownloadFinished which already holds s.mu and s.metasMu, so
+// we don't need to lock in this function
+func (s *StorageManager) updateLocalMetas(kvIndices []uint64, commits []common.Hash) error {
+	if err := s.setLocalMetas(kvIndices, commits, s.localL1); err != nil {
+		return err
+	}
 	// In case the lastKvIdx is smaller than oldLastKvIdx because of removal, we need to remove those metas
-	LocalMetaLen := len(s.blobMetas)
-	for i := int(s.lastKvIdx); i < LocalMetaLen; i++ {
-		delete(s.blobMetas, uint64(i))
+	s.blobMetas.deleteFrom(s.lastKvIdx)
+	return nil
+}
+
+// setLocalMetas sets the metas of the kvs with the commits, recorded as updated at the L1 block. The caller must
+// hold s.mu and s.metasMu.
+func (s *StorageManager) setLocalMetas(kvIndices []uint64, commits []common.Hash, l1 int64) error {
+	hashSize := s.hashSize()
+	for i, idx := range kvIndices {
+		if !s.syncAllowlist.contains(idx) {
+			continue
+		}
+		meta := [32]byte{}
+		if err := putMetaKvIdx(&meta, idx); err != nil {
+			return err
+		}
+		copy(meta[32-hashSize:32], commits[i][0:hashSize])
+
+		s.blobMetas.set(idx, meta)
+		s.recordMetaUpdate(idx, l1)
 	}
+	return nil
 }
 
 // Please note that the caller function must uses s.mu to protect the s.blobMetas reading in this function
 func (s *StorageManager) getKvMetas(kvIndices []uint64) ([][32]byte, error) {
 	metas := [][32]byte{}
 	for _, i := range kvIndices {
-		meta, ok := s.blobMetas[i]
+		meta, ok := s.blobMetas.get(i)
 		if ok {
 			metas = append(metas, meta)
-		} else if i >= s.lastKvIdx {
+		} else if i >= s.lastKvIdx || !s.shardManager.owns(i) || !s.syncAllowlist.contains(i) {
+			// the metas of the kvs not owned or not allowed are not downloaded, and the kvs will not be committed
 			meta := [32]byte{}
-			new(big.Int).SetInt64(int64(i)).FillBytes(meta[0:5])
+			if err := putMetaKvIdx(&meta, i); err != nil {
+				return nil, err
+			}
 			metas = append(metas, meta)
 		} else {
 			return nil, errors.New("meta not found in blobMetas")
@@ -489,39 +1413,161 @@ func (s *StorageManager) getKvMetas(kvIndices []uint64) ([][32]byte, error) {
 
 // TryReadEncoded This function will read the encoded data from the local storage file. It also check whether the blob is empty or not synced,
 // if they are these two cases, it will return err.
+// It returns ErrReadLenTooLarge if readLen is negative or larger than kvSize, and empty data if readLen is 0.
 func (s *StorageManager) TryReadEncoded(kvIdx uint64, readLen int) ([]byte, bool, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	if readLen < 0 || uint64(readLen) > s.shardManager.kvSize {
+		return nil, false, fmt.Errorf("%w: %d vs kvSize %d", ErrReadLenTooLarge, readLen, s.shardManager.kvSize)
+	}
+	s.rlock("TryReadEncoded")
+	defer s.mu.RUnlock()
 
 	err := s.syncCheck(kvIdx)
 	if err != nil {
 		return nil, false, err
 	}
 
-	return s.shardManager.TryReadEncoded(kvIdx, readLen)
+	return s.tryReadEncoded(kvIdx, readLen)
 }
 
 func (s *StorageManager) TryRead(kvIdx uint64, readLen int, commit common.Hash) ([]byte, bool, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	s.rlock("TryRead")
+	defer s.mu.RUnlock()
 
-	return s.shardManager.TryRead(kvIdx, readLen, commit)
+	if err := s.checkAllowed(kvIdx); err != nil {
+		return nil, true, err
+	}
+	return s.tryRead(kvIdx, readLen, commit)
+}
+
+// TryReadTo This function decodes the data in [offset, offset+length) of the blob and writes it to w chunk by chunk,
+// which saves the allocation of the whole blob by TryRead when streaming it, e.g. to a network socket. As the data is
+// streamed, it is not verified against the commit like TryRead does. Note that the lock is held until the writing
+// completes, so a slow writer blocks the commits.
+func (s *StorageManager) TryReadTo(kvIdx uint64, w io.Writer, offset, length int, commit common.Hash) (bool, error) {
+	s.rlock("TryReadTo")
+	defer s.mu.RUnlock()
+
+	if err := s.checkAllowed(kvIdx); err != nil {
+		return true, err
+	}
+	return s.shardManager.TryReadTo(kvIdx, w, offset, length, commit)
+}
+
+// TryReadVerified This function reads the blob like TryRead but with the commit in its local meta, which is
+// confirmed against the meta of the contract, from the downloaded metas or queried at the local L1 view, before
+// decoding. It returns ErrCommitMismatch if they are not matched, which means the local data is stale.
+// The contract meta is queried without the lock, and the local meta is read and confirmed again under the lock
+// before decoding, with the meta queried again if the local L1 view changed meanwhile.
+func (s *StorageManager) TryReadVerified(kvIdx uint64, readLen int) ([]byte, bool, error) {
+	var (
+		queried   [32]byte
+		queriedAt = int64(-1)
+	)
+	for {
+		data, success, queryAt, err := s.tryReadVerified(kvIdx, readLen, queried, queriedAt)
+		if queryAt < 0 {
+			return data, success, err
+		}
+		metas, err := s.getL1Source().GetKvMetas([]uint64{kvIdx}, queryAt)
+		if err != nil {
+			return nil, true, err
+		}
+		if len(metas) != 1 {
+			return nil, true, fmt.Errorf("%w: kvIndices 1, metas %d", ErrMismatchedLengths, len(metas))
+		}
+		queried, queriedAt = metas[0], queryAt
+	}
+}
+
+// tryReadVerified reads the blob for TryReadVerified under the read lock, with the contract meta queried at the L1
+// block queriedAt if it is not downloaded. It returns the L1 block at which the contract meta needs to be queried
+// instead, if it is neither downloaded nor queried at the local L1 view, or -1.
+func (s *StorageManager) tryReadVerified(kvIdx uint64, readLen int, queried [32]byte, queriedAt int64) ([]byte, bool, int64, error) {
+	s.rlock("TryReadVerified")
+	defer s.mu.RUnlock()
+
+	if err := s.checkAllowed(kvIdx); err != nil {
+		return nil, true, -1, err
+	}
+	m, success, err := s.tryReadMeta(kvIdx)
+	if !success || err != nil {
+		return nil, success, -1, err
+	}
+	localMeta := common.BytesToHash(m)
+	if !s.isFilled(localMeta) {
+		if err := s.checkMetasLoaded(); err != nil {
+			return nil, true, -1, err
+		}
+		return nil, true, -1, errors.New("blob is not synced yet")
+	}
+
+	var contractMeta [32]byte
+	if meta, ok := s.blobMetas.get(kvIdx); ok {
+		contractMeta = meta
+	} else if kvIdx < s.lastKvIdx {
+		if queriedAt != s.localL1 {
+			return nil, true, s.localL1, nil
+		}
+		contractMeta = queried
+	}
+	// the meta beyond lastKvIdx is taken as empty
+	hashSize := s.hashSize()
+	if !bytes.Equal(contractMeta[32-hashSize:32], localMeta[0:hashSize]) {
+		return nil, true, -1, fmt.Errorf("%w: kvIdx %d", ErrCommitMismatch, kvIdx)
+	}
+
+	data, success, err := s.tryRead(kvIdx, readLen, localMeta)
+	return data, success, -1, err
+}
+
+// TryReadWithVersionedHash This function reads and decodes the blob with the commit in its local meta, and returns
+// it with its EIP-4844 versioned hash, as expected by execution clients, instead of the commit in the contract.
+// Like TryReadEncoded, it returns err if the blob is empty or not synced.
+func (s *StorageManager) TryReadWithVersionedHash(kvIdx uint64) ([]byte, common.Hash, bool, error) {
+	s.rlock("TryReadWithVersionedHash")
+	defer s.mu.RUnlock()
+
+	if err := s.syncCheck(kvIdx); err != nil {
+		return nil, common.Hash{}, false, err
+	}
+
+	// the commit in the meta is checked against the versioned hash of the decoded blob
+	blob, _, success, err := s.tryReadWithMeta(kvIdx, int(s.shardManager.kvSize))
+	if !success || err != nil {
+		return nil, common.Hash{}, success, err
+	}
+	versionedHash, err := blobVersionedHash(blob)
+	if err != nil {
+		return nil, common.Hash{}, true, err
+	}
+	return blob, versionedHash, true, nil
 }
 
 func (s *StorageManager) TryReadMeta(kvIdx uint64) ([]byte, bool, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	return s.shardManager.TryReadMeta(kvIdx)
+	s.rlock("TryReadMeta")
+	defer s.mu.RUnlock()
+	return s.tryReadMeta(kvIdx)
 }
 
 func (s *StorageManager) LastKvIndex() uint64 {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	return s.lastKvIdx
 }
 
+// DecodeKV This function decodes the encoded blob b of the kv, and records the decoding time if the metrics are
+// enabled.
 func (s *StorageManager) DecodeKV(kvIdx uint64, b []byte, hash common.Hash, providerAddr common.Address, encodeType uint64) ([]byte, bool, error) {
-	return s.shardManager.DecodeKV(kvIdx, b, hash, providerAddr, encodeType)
+	m := s.getMetrics()
+	if m == nil {
+		return s.shardManager.DecodeKV(kvIdx, b, hash, providerAddr, encodeType)
+	}
+	start := s.Clock.Now()
+	data, found, err := s.shardManager.DecodeKV(kvIdx, b, hash, providerAddr, encodeType)
+	if found && err == nil {
+		m.RecordCodec(CodecDecode, s.Clock.Now().Sub(start))
+	}
+	return data, found, err
 }
 
 func (s *StorageManager) KvEntries() uint64 {
@@ -532,26 +1578,211 @@ func (s *StorageManager) ContractAddress() common.Address {
 	return s.shardManager.contractAddress
 }
 
+// Shards This function returns the indices of the managed shards in ascending order.
 func (s *StorageManager) Shards() []uint64 {
-	shards := make([]uint64, 0)
-	for idx := range s.shardManager.ShardMap() {
-		shards = append(shards, idx)
+	s.rlock("Shards")
+	defer s.mu.RUnlock()
+
+	return s.shardManager.ShardIds()
+}
+
+// AddShard This function starts managing a new shard while the node is running. The shard data file is opened
+// from DataDir if it exists, or created otherwise. Once added, the shard is served by reads and commits, and
+// DownloadShardMetas should be called to download its metas before syncing it.
+func (s *StorageManager) AddShard(shardIdx uint64, miner common.Address, encodeType uint64) error {
+	kvEntries := s.shardManager.kvEntries
+	return s.AddShardRange(shardIdx, shardIdx*kvEntries, (shardIdx+1)*kvEntries, miner, encodeType)
+}
+
+// AddShardRange This function is like AddShard but only owns the contiguous sub-range [startKv, endKv) of the
+// shard, e.g. to save disk space, so the data file only covers the kvs in the sub-range. The kvs of the shard out
+// of the sub-range are not downloaded or synced, and reading or committing them returns ErrNotOwned.
+// Note that the shard cannot be mined unless it owns the whole shard.
+func (s *StorageManager) AddShardRange(shardIdx, startKv, endKv uint64, miner common.Address, encodeType uint64) error {
+	if encodeType > ENCODE_END {
+		return fmt.Errorf("unknown encode type %d", encodeType)
+	}
+	sm := s.shardManager
+	if startKv >= endKv || startKv < shardIdx*sm.kvEntries || endKv > (shardIdx+1)*sm.kvEntries {
+		return fmt.Errorf("invalid kv range [%d, %d) of shard %d", startKv, endKv, shardIdx)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := sm.getDataShard(shardIdx); ok {
+		return fmt.Errorf("shard %d already exists", shardIdx)
 	}
-	return shards
+
+	filename := filepath.Join(s.DataDir, fmt.Sprintf(ShardFileName, shardIdx))
+	var (
+		df  *DataFile
+		err error
+	)
+	if _, statErr := os.Stat(filename); statErr == nil {
+		df, err = OpenDataFile(filename)
+		if err != nil {
+			return err
+		}
+		if df.miner != miner || df.encodeType != encodeType || df.KvIdxStart() != startKv || df.KvIdxEnd() != endKv {
+			df.Close()
+			return fmt.Errorf("data file %s does not match shard %d", filename, shardIdx)
+		}
+	} else {
+		df, err = Create(filename, startKv*sm.chunksPerKv, (endKv-startKv)*sm.chunksPerKv, 0, sm.kvSize, encodeType, miner, sm.chunkSize)
+		if err != nil {
+			return err
+		}
+	}
+
+	ds := NewDataShard(shardIdx, sm.kvSize, sm.kvEntries, sm.chunkSize)
+	if err = ds.AddDataFile(df); err != nil {
+		df.Close()
+		return err
+	}
+	if err = sm.addDataShard(ds); err != nil {
+		df.Close()
+		return err
+	}
+	log.Info("Shard added", "shard", shardIdx, "startKv", startKv, "endKv", endKv, "file", filename, "miner", miner, "encodeType", encodeType)
+	return nil
+}
+
+// OwnedKvRange This function returns the range [start, end) of the kvs owned by the shard, which is the whole
+// shard unless it is added by AddShardRange.
+func (s *StorageManager) OwnedKvRange(shardIdx uint64) (uint64, uint64, bool) {
+	ds, ok := s.shardManager.getDataShard(shardIdx)
+	if !ok {
+		return 0, 0, false
+	}
+	start, end := ds.KvRange()
+	return start, end, true
+}
+
+// RemoveShard This function stops managing a shard while the node is running, closes its data files and drops its
+// metas. Operations already holding the lock complete before the shard is removed, and later commits to the shard
+// return ErrShardNotManaged while reads report it as not managed. If deleteFile is true, the data files are deleted.
+// If a data file fails to close, the shard is kept managed with an error, so the removal can be retried to release
+// the files. The failures to delete the files are returned after the shard is removed.
+func (s *StorageManager) RemoveShard(shardIdx uint64, deleteFile bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ds, ok := s.shardManager.getDataShard(shardIdx)
+	if !ok {
+		return ErrShardNotManaged
+	}
+	// the files are closed before the shard is unmapped, so if any of them fails to close, the shard is still
+	// managed and the removal can be retried to release them
+	if err := s.dropStaging(shardIdx); err != nil {
+		return err
+	}
+	filenames := ds.Filenames()
+	if err := ds.Close(); err != nil {
+		return err
+	}
+
+	if _, err := s.shardManager.RemoveDataShard(shardIdx); err != nil {
+		return ErrShardNotManaged
+	}
+	s.blobMetas.deleteShard(shardIdx)
+	s.metasMu.Lock()
+	s.dropShardMetasL1(shardIdx)
+	s.metasMu.Unlock()
+	s.dropFill(shardIdx)
+
+	var errs []error
+	if deleteFile {
+		for _, filename := range filenames {
+			if err := os.Remove(filename); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	log.Info("Shard removed", "shard", shardIdx, "files", filenames, "deleted", deleteFile)
+	return errors.Join(errs...)
 }
 
+// ReadSampleUnlocked This function reads one encoded sample without taking s.mu, as it is on the hot path of mining,
+// which reads samples continuously and must not be blocked by downloading and syncing. So the sample may be read
+// while the blob containing it is being written. Use ReadSamples to read samples consistently with the commits.
+// The shard is looked up under the read lock of the shard map, so it is safe against AddShard and RemoveShard, and
+// the data files are read under the read lock of the shard, so it is safe against the replacement of a data file by
+// CompactShard and PromoteStaging.
 func (s *StorageManager) ReadSampleUnlocked(shardIdx, sampleIdx uint64) (common.Hash, error) {
-	if ds, ok := s.shardManager.shardMap[shardIdx]; ok {
+	if ds, ok := s.shardManager.getDataShard(shardIdx); ok {
 		return ds.ReadSample(sampleIdx)
 	}
-	return common.Hash{}, errors.New("shard not found")
+	return common.Hash{}, ErrShardNotManaged
+}
+
+// SampleErrors is the error returned by ReadSamples, the i-th error of which is the error of the i-th sample
+// or nil if the sample is read.
+type SampleErrors []error
+
+func (e SampleErrors) Error() string {
+	failed, first := 0, -1
+	for i, err := range e {
+		if err != nil {
+			failed++
+			if first < 0 {
+				first = i
+			}
+		}
+	}
+	if first < 0 {
+		return "no sample error"
+	}
+	return fmt.Sprintf("%d of %d samples failed to read, the first one at %d: %v", failed, len(e), first, e[first])
+}
+
+// ReadSamples This function reads the encoded samples of a shard under s.mu, so that none of them is read while
+// a blob is being committed, e.g. for generating proofs. The sample indices are global as in ReadSampleUnlocked.
+// If some samples fail to read, e.g. out of the owned range of the shard, the others are still returned along with
+// SampleErrors.
+func (s *StorageManager) ReadSamples(shardIdx uint64, sampleIndices []uint64) ([]common.Hash, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ds, ok := s.shardManager.getDataShard(shardIdx)
+	if !ok {
+		return nil, ErrShardNotManaged
+	}
+
+	samplesPerKv := s.shardManager.kvSize / 32
+	start, end := ds.KvRange()
+	first, limit := start*samplesPerKv, end*samplesPerKv
+	samples := make([]common.Hash, len(sampleIndices))
+	var errs SampleErrors
+	for i, sampleIdx := range sampleIndices {
+		var err error
+		if sampleIdx < first || sampleIdx >= limit {
+			err = fmt.Errorf("%w: sample %d, shard %d", ErrSampleOutOfRange, sampleIdx, shardIdx)
+		} else {
+			samples[i], err = ds.ReadSample(sampleIdx)
+		}
+		if err != nil {
+			if errs == nil {
+				errs = make(SampleErrors, len(sampleIndices))
+			}
+			errs[i] = err
+		}
+	}
+	if errs != nil {
+		return samples, errs
+	}
+	return samples, nil
 }
 
 func (s *StorageManager) GetShardMiner(shardIdx uint64) (common.Address, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	return s.shardManager.GetShardMiner(shardIdx)
 }
 
 func (s *StorageManager) GetShardEncodeType(shardIdx uint64) (uint64, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	return s.shardManager.GetShardEncodeType(shardIdx)
 }
 
@@ -570,6 +1801,73 @@ func (s *StorageManager) KvEntriesBits() uint64 {
 	return s.shardManager.kvEntriesBits
 }
 
-func (s *StorageManager) Close() error {
-	return s.shardManager.Close()
+// Geometry bundles the kv size and shard geometry of the storage, e.g. to be serialized in a P2P handshake.
+type Geometry struct {
+	ContractAddress common.Address `json:"contractAddress"`
+	MaxKvSize       uint64         `json:"maxKvSize"`
+	MaxKvSizeBits   uint64         `json:"maxKvSizeBits"`
+	ChunksPerKvBits uint64         `json:"chunksPerKvBits"`
+	KvEntries       uint64         `json:"kvEntries"`
+	KvEntriesBits   uint64         `json:"kvEntriesBits"`
+}
+
+// Geometry This function returns the kv size and shard geometry read under the read lock, so that the values are
+// consistent with each other.
+func (s *StorageManager) Geometry() Geometry {
+	s.rlock("Geometry")
+	defer s.mu.RUnlock()
+	return Geometry{
+		ContractAddress: s.shardManager.contractAddress,
+		MaxKvSize:       s.shardManager.kvSize,
+		MaxKvSizeBits:   s.shardManager.kvSizeBits,
+		ChunksPerKvBits: s.shardManager.chunksPerKvBits,
+		KvEntries:       s.shardManager.kvEntries,
+		KvEntriesBits:   s.shardManager.kvEntriesBits,
+	}
+}
+
+// ShardConfig is the config of a managed shard, e.g. for a status endpoint.
+type ShardConfig struct {
+	ShardIdx   uint64         `json:"shardIdx"`
+	Miner      common.Address `json:"miner"`
+	EncodeType uint64         `json:"encodeType"`
+	KvEntries  uint64         `json:"kvEntries"`
+	// StartKv and EndKv are the range [StartKv, EndKv) of the kvs owned by the shard.
+	StartKv uint64 `json:"startKv"`
+	EndKv   uint64 `json:"endKv"`
+}
+
+// ShardConfigs This function returns the configs of all the managed shards sorted by the shard index, which are
+// read under the read lock so that they are not torn by AddShard or RemoveShard in the meantime.
+func (s *StorageManager) ShardConfigs() []ShardConfig {
+	s.rlock("ShardConfigs")
+	defer s.mu.RUnlock()
+
+	shardIds := s.shardManager.ShardIds()
+	configs := make([]ShardConfig, 0, len(shardIds))
+	for _, shardIdx := range shardIds {
+		ds, ok := s.shardManager.getDataShard(shardIdx)
+		if !ok {
+			continue
+		}
+		start, end := ds.KvRange()
+		configs = append(configs, ShardConfig{
+			ShardIdx:   shardIdx,
+			Miner:      ds.Miner(),
+			EncodeType: ds.EncodeType(),
+			KvEntries:  s.shardManager.kvEntries,
+			StartKv:    start,
+			EndKv:      end,
+		})
+	}
+	return configs
+}
+
+// workerPool returns the worker pool of the download path, which is created on first use as DownloadThreadNum
+// is set after the StorageManager is created.
+func (s *StorageManager) workerPool() *workerPool {
+	s.poolOnce.Do(func() {
+		s.pool = newWorkerPool(s.DownloadThreadNum)
+	})
+	return s.pool
 }
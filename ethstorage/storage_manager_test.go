@@ -4,15 +4,30 @@
 package ethstorage
 
 import (
+	"bytes"
 	"context"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"math/big"
 	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/detailyang/go-fallocate"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto/kzg4844"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
 	"github.com/ethereum/go-ethereum/log"
 	prv "github.com/ethstorage/go-ethstorage/ethstorage/prover"
 )
@@ -33,6 +48,7 @@ var (
 
 type mockL1Source struct {
 	lastBlobIndex uint64
+	finalized     int64
 	metaFile      *os.File
 }
 
@@ -65,6 +81,13 @@ func (l1 *mockL1Source) GetStorageLastBlobIdx(blockNumber int64) (uint64, error)
 	return l1.lastBlobIndex, nil
 }
 
+func (l1 *mockL1Source) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	if number.Sign() < 0 {
+		return &types.Header{Number: new(big.Int).SetInt64(l1.finalized)}, nil
+	}
+	return &types.Header{Number: new(big.Int).Set(number)}, nil
+}
+
 func createMetaFile(filename string, len int64) (*os.File, error) {
 	file, err := os.Create(filename)
 	if err != nil {
@@ -101,12 +124,12 @@ func createEthStorage(contract common.Address, shardIdxList []uint64, chunkSize,
 		fileName := fmt.Sprintf(".\\ss%d.dat", shardIdx)
 		files = append(files, fileName)
 		startChunkId := shardIdx * chunkPerKv * kvEntries
-		_, err := Create(fileName, startChunkId, kvEntries*chunkPerKv, 0, kvSize, encodeType, miner, sm.ChunkSize())
+		df, err := Create(fileName, startChunkId, kvEntries*chunkPerKv, 0, kvSize, encodeType, miner, sm.ChunkSize())
 		if err != nil {
 			log.Crit("open failed", "error", err)
 		}
+		df.Close()
 
-		var df *DataFile
 		df, err = OpenDataFile(fileName)
 		if err != nil {
 			log.Crit("open failed", "error", err)
@@ -208,6 +231,36 @@ func TestStorageManager_DownloadFinished(t *testing.T) {
 	}
 }
 
+func TestStorageManager_DownloadFinishedWithContractCommits(t *testing.T) {
+	setup(t)
+	h := common.Hash{2, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 3}
+	c := ToContractCommit(h)
+	if c.Hash() != h {
+		t.Fatal("the contract commit should be padded back to the commit", c.Hash())
+	}
+	err := storageManager.DownloadFinishedWithContractCommits(97529, []uint64{2}, [][]byte{{10}}, []ContractCommit{c})
+	if err != nil {
+		t.Fatal("failed to Downloand Finished", err)
+	}
+
+	bs, success, err := storageManager.TryReadMeta(2)
+	if err != nil || !success {
+		t.Fatal("failed to read meta", err)
+	}
+	if common.BytesToHash(bs) != prepareCommit(h) {
+		t.Fatal("failed to write meta", err)
+	}
+
+	if err := storageManager.SetHashSize(HashSizeInContract + 1); err != nil {
+		t.Fatal("failed to set hash size", err)
+	}
+	defer storageManager.SetHashSize(HashSizeInContract)
+	err = storageManager.DownloadFinishedWithContractCommits(97530, []uint64{3}, [][]byte{{10}}, []ContractCommit{c})
+	if !errors.Is(err, ErrInvalidHashSize) {
+		t.Fatal("expected ErrInvalidHashSize with a larger hash size", err)
+	}
+}
+
 func TestStorageManager_CommitBlobs(t *testing.T) {
 	setup(t)
 
@@ -254,3 +307,5000 @@ func TestStorageManager_DownloadAllMeta(t *testing.T) {
 		t.Fatal("failed to compare meta", err)
 	}
 }
+
+func TestStorageManager_ShardGettersConcurrent(t *testing.T) {
+	setup(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if miner, ok := storageManager.GetShardMiner(0); !ok || miner != (common.Address{}) {
+					t.Errorf("unexpected shard miner %v, ok %v", miner, ok)
+					return
+				}
+				if encodeType, ok := storageManager.GetShardEncodeType(0); !ok || encodeType != defaultEncodeType {
+					t.Errorf("unexpected shard encode type %d, ok %v", encodeType, ok)
+					return
+				}
+				if _, ok := storageManager.GetShardMiner(1); ok {
+					t.Errorf("shard 1 should not be managed")
+					return
+				}
+				if shards := storageManager.Shards(); len(shards) != 1 || shards[0] != 0 {
+					t.Errorf("unexpected shards %v", shards)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestStorageManager_AddShard(t *testing.T) {
+	setup(t)
+	storageManager.DataDir = t.TempDir()
+	defer storageManager.shardManager.Close()
+
+	if err := storageManager.AddShard(0, common.Address{}, defaultEncodeType); err == nil {
+		t.Fatal("adding an existing shard should fail")
+	}
+	if err := storageManager.AddShard(1, common.Address{}, defaultEncodeType); err != nil {
+		t.Fatal("failed to add shard", err)
+	}
+	if shards := storageManager.Shards(); len(shards) != 2 {
+		t.Fatal("unexpected shards", shards)
+	}
+	if encodeType, ok := storageManager.GetShardEncodeType(1); !ok || encodeType != defaultEncodeType {
+		t.Fatal("unexpected encode type of the new shard", encodeType)
+	}
+
+	kvIndex := kvEntries + 1
+	h := common.Hash{1, 2, 3}
+	err := storageManager.DownloadFinished(97529, []uint64{kvIndex}, [][]byte{{10}}, []common.Hash{h})
+	if err != nil {
+		t.Fatal("failed to Downloand Finished", err)
+	}
+	bs, success, err := storageManager.TryReadMeta(kvIndex)
+	if err != nil || !success {
+		t.Fatal("failed to read meta from the new shard", err)
+	}
+	if common.BytesToHash(bs) != prepareCommit(h) {
+		t.Fatal("failed to write meta to the new shard")
+	}
+}
+
+func TestStorageManager_RemoveShard(t *testing.T) {
+	setup(t)
+	storageManager.DataDir = t.TempDir()
+	if err := storageManager.AddShard(1, common.Address{}, defaultEncodeType); err != nil {
+		t.Fatal("failed to add shard", err)
+	}
+	kvIndex := kvEntries + 1
+	err := storageManager.DownloadFinished(97529, []uint64{kvIndex}, [][]byte{{10}}, []common.Hash{{1, 2, 3}})
+	if err != nil {
+		t.Fatal("failed to Downloand Finished", err)
+	}
+
+	if err = storageManager.RemoveShard(1, true); err != nil {
+		t.Fatal("failed to remove shard", err)
+	}
+	if shards := storageManager.Shards(); len(shards) != 1 || shards[0] != 0 {
+		t.Fatal("unexpected shards", shards)
+	}
+	if _, err = os.Stat(filepath.Join(storageManager.DataDir, fmt.Sprintf(ShardFileName, 1))); !os.IsNotExist(err) {
+		t.Fatal("shard file should be deleted", err)
+	}
+	if _, ok := storageManager.blobMetas.get(kvIndex); ok {
+		t.Fatal("metas of the removed shard should be dropped")
+	}
+	if _, success, _ := storageManager.TryReadMeta(kvIndex); success {
+		t.Fatal("removed shard should not be served")
+	}
+	if err = storageManager.RemoveShard(1, true); !errors.Is(err, ErrShardNotManaged) {
+		t.Fatal("removing an unmanaged shard should return ErrShardNotManaged", err)
+	}
+}
+
+func TestStorageManager_RemoveShardCloseError(t *testing.T) {
+	setup(t)
+	storageManager.DataDir = t.TempDir()
+	if err := storageManager.AddShard(1, common.Address{}, defaultEncodeType); err != nil {
+		t.Fatal("failed to add shard", err)
+	}
+	ds, _ := storageManager.shardManager.getDataShard(1)
+	// close the fd behind the file, so closing the file fails
+	if err := syscall.Close(int(ds.dataFiles[0].file.Fd())); err != nil {
+		t.Fatal(err)
+	}
+	if err := storageManager.RemoveShard(1, true); err == nil {
+		t.Fatal("removing the shard should fail")
+	}
+	if shards := storageManager.Shards(); len(shards) != 2 {
+		t.Fatal("the shard should still be managed", shards)
+	}
+
+	// the retry skips the files closed already
+	if err := storageManager.RemoveShard(1, true); err != nil {
+		t.Fatal("failed to remove shard", err)
+	}
+	if shards := storageManager.Shards(); len(shards) != 1 || shards[0] != 0 {
+		t.Fatal("unexpected shards", shards)
+	}
+	if _, err := os.Stat(filepath.Join(storageManager.DataDir, fmt.Sprintf(ShardFileName, 1))); !os.IsNotExist(err) {
+		t.Fatal("shard file should be deleted", err)
+	}
+}
+
+func TestDataShard_CloseAll(t *testing.T) {
+	dir := t.TempDir()
+	ds := NewDataShard(0, 4096, 4, 4096)
+	for i := uint64(0); i < 2; i++ {
+		df, err := Create(filepath.Join(dir, fmt.Sprintf("ss%d.dat", i)), i*2, 2, 0, 4096, defaultEncodeType, common.Address{}, 4096)
+		if err != nil {
+			t.Fatal("failed to create data file", err)
+		}
+		if err = ds.AddDataFile(df); err != nil {
+			t.Fatal("failed to add data file", err)
+		}
+	}
+	if err := syscall.Close(int(ds.dataFiles[0].file.Fd())); err != nil {
+		t.Fatal(err)
+	}
+	if err := ds.Close(); err == nil {
+		t.Fatal("closing the shard should fail")
+	}
+	// the other file is closed despite the failure of the first one
+	if err := ds.dataFiles[1].file.Close(); !errors.Is(err, os.ErrClosed) {
+		t.Fatal("all the files should be closed", err)
+	}
+	if err := ds.Close(); err != nil {
+		t.Fatal("closing again should skip the closed files", err)
+	}
+}
+
+// fakeClock is a Clock only advanced by the test.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestStorageManager_HealthStatus(t *testing.T) {
+	setup(t)
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	storageManager.Clock = clock
+	if err := storageManager.Reset(97528); err != nil {
+		t.Fatal("failed to reset", err)
+	}
+	l1 := storageManager.l1Source.(*mockL1Source)
+	l1.finalized = 97528
+
+	status, err := storageManager.HealthStatus(context.Background())
+	if err != nil {
+		t.Fatal("failed to get health status", err)
+	}
+	if status.State != HealthSyncing {
+		t.Fatal("should be syncing before metas are downloaded", status.State)
+	}
+
+	if err = storageManager.DownloadAllMetas(context.Background(), 4); err != nil {
+		t.Fatal("failed to download metas", err)
+	}
+	if status, _ = storageManager.HealthStatus(context.Background()); status.State != HealthSynced {
+		t.Fatal("should be synced after metas are downloaded", status.State)
+	}
+
+	l1.finalized = 97528 + 10*32
+	if status, _ = storageManager.HealthStatus(context.Background()); status.State != HealthSyncing {
+		t.Fatal("should be syncing when finalized L1 is ahead", status.State)
+	}
+
+	clock.advance(DefaultStallTimeout - time.Minute)
+	if status, _ = storageManager.HealthStatus(context.Background()); status.State != HealthSyncing {
+		t.Fatal("should be syncing before the stall timeout", status.State)
+	}
+	clock.advance(2 * time.Minute)
+	if status, _ = storageManager.HealthStatus(context.Background()); status.State != HealthStalled {
+		t.Fatal("should be stalled when local L1 does not advance", status.State)
+	}
+}
+
+func TestStorageManager_PendingL1Range(t *testing.T) {
+	setup(t)
+	if err := storageManager.Reset(97528); err != nil {
+		t.Fatal("failed to reset", err)
+	}
+	l1 := storageManager.l1Source.(*mockL1Source)
+	l1.finalized = 97528 + 2*L1FinalizedStep + 5
+
+	from, to, err := storageManager.PendingL1Range(context.Background())
+	if err != nil || from != 97528 || to != l1.finalized {
+		t.Fatal("unexpected pending range", from, to, err)
+	}
+	steps := []int64{}
+	for from < to {
+		next := NextL1Step(from, to)
+		if err = storageManager.DownloadFinished(next, nil, nil, nil); err != nil {
+			t.Fatal("failed to download", err)
+		}
+		steps = append(steps, next)
+		if from, to, err = storageManager.PendingL1Range(context.Background()); err != nil {
+			t.Fatal("failed to get the pending range", err)
+		}
+	}
+	if !reflect.DeepEqual(steps, []int64{97560, 97592, 97597}) || from != l1.finalized {
+		t.Fatal("unexpected steps", steps, from)
+	}
+
+	// caught up if localL1 is ahead of the finalized head
+	l1.finalized = 97500
+	if from, to, err = storageManager.PendingL1Range(context.Background()); err != nil || from != to || from != 97597 {
+		t.Fatal("unexpected pending range", from, to, err)
+	}
+}
+
+func TestStorageManager_OnBlobCommitted(t *testing.T) {
+	setup(t)
+
+	var notified1, notified2 []uint64
+	storageManager.OnBlobCommitted(func(kvIdx uint64) {
+		// the callback is invoked outside the lock, so it can read the storage
+		if _, success, err := storageManager.TryReadMeta(kvIdx); !success || err != nil {
+			t.Error("failed to read meta in callback", err)
+		}
+		notified1 = append(notified1, kvIdx)
+	})
+	storageManager.OnBlobCommitted(func(kvIdx uint64) {
+		notified2 = append(notified2, kvIdx)
+	})
+
+	err := storageManager.DownloadFinished(97529, []uint64{4, 5}, [][]byte{{10}, {11}}, []common.Hash{{1}, {2}})
+	if err != nil {
+		t.Fatal("failed to Downloand Finished", err)
+	}
+	if len(notified1) != 2 || len(notified2) != 2 {
+		t.Fatal("subscribers should be notified of the written blobs", notified1, notified2)
+	}
+
+	// the blob already stored locally is not notified again
+	kvIndex := uint64(2)
+	b, h := createBlob(kvIndex)
+	if _, err = storageManager.CommitBlobs([]uint64{kvIndex}, [][]byte{b}, []common.Hash{h}); err != nil {
+		t.Fatal("failed to commit blob", err)
+	}
+	if len(notified1) != 2 {
+		t.Fatal("unexpected notification", notified1)
+	}
+}
+
+func TestStorageManager_KvIdxOutOfMetaRange(t *testing.T) {
+	setup(t)
+
+	storageManager.mu.Lock()
+	metas, err := storageManager.getKvMetas([]uint64{MaxKvIdxInMeta})
+	if err != nil || metaKvIdx(metas[0]) != MaxKvIdxInMeta {
+		t.Error("failed to get meta of the largest kvIdx", err)
+	}
+	_, err = storageManager.getKvMetas([]uint64{MaxKvIdxInMeta + 1})
+	storageManager.mu.Unlock()
+	if !errors.Is(err, ErrKvIdxOutOfRange) {
+		t.Fatal("getKvMetas should return ErrKvIdxOutOfRange", err)
+	}
+
+	err = storageManager.DownloadFinished(97529, []uint64{MaxKvIdxInMeta + 1}, [][]byte{{10}}, []common.Hash{{1}})
+	if !errors.Is(err, ErrKvIdxOutOfRange) {
+		t.Fatal("DownloadFinished should return ErrKvIdxOutOfRange", err)
+	}
+}
+
+func TestStorageManager_ReEncodeShard(t *testing.T) {
+	setup(t)
+	storageManager.DataDir = t.TempDir()
+	oldMiner, newMiner := common.Address{1}, common.Address{2}
+	if err := storageManager.AddShard(1, oldMiner, defaultEncodeType); err != nil {
+		t.Fatal("failed to add shard", err)
+	}
+	defer storageManager.RemoveShard(1, true)
+
+	kvIndex := kvEntries + 1
+	blob := []byte{10, 11, 12}
+	commit, err := blobVersionedHash(blob)
+	if err != nil {
+		t.Fatal("failed to compute versioned hash", err)
+	}
+	err = storageManager.DownloadFinished(97529, []uint64{kvIndex}, [][]byte{blob}, []common.Hash{commit})
+	if err != nil {
+		t.Fatal("failed to Downloand Finished", err)
+	}
+
+	// simulate an interrupted re-encoding which has not reached its first checkpoint
+	progressFile := filepath.Join(storageManager.DataDir, fmt.Sprintf(ShardFileName, 1)) + reEncodeFileSuffix
+	if err = writeReEncodeProgress(progressFile, &reEncodeProgress{OldMiner: oldMiner, NewMiner: newMiner, Next: kvEntries}); err != nil {
+		t.Fatal(err)
+	}
+	if err = storageManager.ReEncodeShard(1, common.Address{3}); err == nil {
+		t.Fatal("re-encoding to another miner should fail before the unfinished one completes")
+	}
+	if err = storageManager.ReEncodeShard(1, newMiner); err != nil {
+		t.Fatal("failed to re-encode shard", err)
+	}
+	if _, err = os.Stat(progressFile); !os.IsNotExist(err) {
+		t.Fatal("progress file should be removed", err)
+	}
+
+	if miner, _ := storageManager.GetShardMiner(1); miner != newMiner {
+		t.Fatal("miner of the shard should be updated", miner)
+	}
+	// read the header from the disk without OpenDataFile, as the data file is locked by the shard
+	file, err := os.Open(filepath.Join(storageManager.DataDir, fmt.Sprintf(ShardFileName, 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	df := &DataFile{file: file}
+	if err = df.readHeader(); err != nil {
+		t.Fatal(err)
+	}
+	if df.Miner() != newMiner {
+		t.Fatal("miner in the data file header should be updated", df.Miner())
+	}
+
+	encoded, _, err := storageManager.shardManager.TryReadEncoded(kvIndex, int(storageManager.MaxKvSize()))
+	if err != nil {
+		t.Fatal("failed to read encoded blob", err)
+	}
+	decoded, _, err := storageManager.DecodeKV(kvIndex, encoded, prepareCommit(commit), newMiner, defaultEncodeType)
+	if err != nil || !bytes.Equal(decoded[:len(blob)], blob) {
+		t.Fatal("blob should decode with the new miner", err)
+	}
+	// DecodeKV callers rely on the shard miner once the re-encoding completes
+	for kvIdx := kvEntries; kvIdx < 2*kvEntries; kvIdx++ {
+		if provider, err := storageManager.StoredProvider(kvIdx); err != nil || provider != newMiner {
+			t.Fatal("stored provider should be the shard miner", kvIdx, provider, err)
+		}
+	}
+}
+
+func TestStorageManager_ReEncodeShardCompacting(t *testing.T) {
+	setup(t)
+	storageManager.DataDir = t.TempDir()
+	oldMiner, newMiner := common.Address{1}, common.Address{2}
+	if err := storageManager.AddShard(1, oldMiner, defaultEncodeType); err != nil {
+		t.Fatal("failed to add shard", err)
+	}
+	defer storageManager.RemoveShard(1, true)
+
+	storageManager.mu.Lock()
+	storageManager.compacting[1] = true
+	storageManager.mu.Unlock()
+	if err := storageManager.ReEncodeShard(1, newMiner); !errors.Is(err, ErrShardCompacting) {
+		t.Fatal("expected ErrShardCompacting", err)
+	}
+	storageManager.mu.Lock()
+	delete(storageManager.compacting, 1)
+	storageManager.mu.Unlock()
+
+	// an interrupted compaction must complete first
+	tmpName := filepath.Join(storageManager.DataDir, fmt.Sprintf(ShardFileName, 1)) + compactFileSuffix
+	if err := os.WriteFile(tmpName, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := storageManager.ReEncodeShard(1, newMiner); !errors.Is(err, ErrShardCompacting) {
+		t.Fatal("expected ErrShardCompacting", err)
+	}
+	if miner, _ := storageManager.GetShardMiner(1); miner != oldMiner {
+		t.Fatal("the shard should not be re-encoded", miner)
+	}
+	os.Remove(tmpName)
+	if err := storageManager.ReEncodeShard(1, newMiner); err != nil {
+		t.Fatal("failed to re-encode shard", err)
+	}
+}
+
+func TestStorageManager_ReEncodeShardResume(t *testing.T) {
+	setup(t)
+	storageManager.DataDir = t.TempDir()
+	oldMiner, newMiner := common.Address{1}, common.Address{2}
+	if err := storageManager.AddShard(1, oldMiner, defaultEncodeType); err != nil {
+		t.Fatal("failed to add shard", err)
+	}
+	defer storageManager.RemoveShard(1, true)
+
+	kvIndices := []uint64{kvEntries, kvEntries + 1, kvEntries + 2, kvEntries + 3, kvEntries + 4}
+	blobs := make([][]byte, len(kvIndices))
+	commits := make([]common.Hash, len(kvIndices))
+	for i, kvIdx := range kvIndices {
+		blobs[i], _ = createBlob(kvIdx)
+		var err error
+		if commits[i], err = blobVersionedHash(blobs[i]); err != nil {
+			t.Fatal("failed to compute versioned hash", err)
+		}
+	}
+	if err := storageManager.DownloadFinished(97529, kvIndices, blobs, commits); err != nil {
+		t.Fatal("failed to Downloand Finished", err)
+	}
+	ds, _ := storageManager.shardManager.getDataShard(1)
+	// a torn blob can be re-encoded with neither miner
+	garbage := bytes.Repeat([]byte{0xab}, int(ds.chunkSize))
+	if err := ds.writeChunk(kvIndices[4]*ds.chunksPerKv, garbage); err != nil {
+		t.Fatal("failed to write chunk", err)
+	}
+
+	// simulate a crash after the first blobs are re-encoded but before the first progress checkpoint
+	storageManager.mu.Lock()
+	for _, kvIdx := range kvIndices[:3] {
+		if err := storageManager.reEncodeKV(ds, kvIdx, oldMiner, newMiner); err != nil {
+			storageManager.mu.Unlock()
+			t.Fatal("failed to re-encode kv", err)
+		}
+	}
+	storageManager.mu.Unlock()
+
+	// the resume re-encodes the rest, and skips the blobs already re-encoded instead of garbling them
+	if err := storageManager.ReEncodeShard(1, newMiner); err != nil {
+		t.Fatal("failed to re-encode shard", err)
+	}
+	for i, kvIdx := range kvIndices[:4] {
+		data, success, err := storageManager.TryRead(kvIdx, len(blobs[i]), commits[i])
+		if err != nil || !success || !bytes.Equal(data, blobs[i]) {
+			t.Fatal("blob should decode with the new miner", kvIdx, success, err)
+		}
+	}
+	if info, _ := storageManager.BlobInfo(kvIndices[4]); info.Synced {
+		t.Fatal("the torn blob should be flagged for resync")
+	}
+}
+
+func TestStorageManager_StoredProvider(t *testing.T) {
+	setup(t)
+	storageManager.DataDir = t.TempDir()
+	oldMiner, newMiner := common.Address{1}, common.Address{2}
+	if err := storageManager.AddShard(1, oldMiner, defaultEncodeType); err != nil {
+		t.Fatal("failed to add shard", err)
+	}
+	defer storageManager.RemoveShard(1, true)
+
+	if provider, err := storageManager.StoredProvider(kvEntries); err != nil || provider != oldMiner {
+		t.Fatal("stored provider should be the shard miner", provider, err)
+	}
+	if _, err := storageManager.StoredProvider(2 * kvEntries); !errors.Is(err, ErrShardNotManaged) {
+		t.Fatal("expected ErrShardNotManaged", err)
+	}
+
+	// simulate an interrupted re-encoding which has re-encoded the first 2 blobs
+	progressFile := filepath.Join(storageManager.DataDir, fmt.Sprintf(ShardFileName, 1)) + reEncodeFileSuffix
+	if err := writeReEncodeProgress(progressFile, &reEncodeProgress{OldMiner: oldMiner, NewMiner: newMiner, Next: kvEntries + 2}); err != nil {
+		t.Fatal(err)
+	}
+	if provider, err := storageManager.StoredProvider(kvEntries + 1); err != nil || provider != newMiner {
+		t.Fatal("stored provider of a re-encoded blob should be the new miner", provider, err)
+	}
+	if provider, err := storageManager.StoredProvider(kvEntries + 2); err != nil || provider != oldMiner {
+		t.Fatal("stored provider of a blob not re-encoded should be the old miner", provider, err)
+	}
+}
+
+func TestStorageManager_MismatchedLengths(t *testing.T) {
+	setup(t)
+
+	err := storageManager.DownloadFinished(97529, []uint64{4, 5}, [][]byte{{10}}, []common.Hash{{1}, {2}, {3}})
+	if !errors.Is(err, ErrMismatchedLengths) {
+		t.Fatal("DownloadFinished should return ErrMismatchedLengths", err)
+	}
+	if !strings.Contains(err.Error(), "kvIndices 2, blobs 1, commits 3") {
+		t.Fatal("error should contain all the lengths", err)
+	}
+
+	_, err = storageManager.CommitBlobs([]uint64{4}, [][]byte{{10}, {11}}, []common.Hash{{1}})
+	if !errors.Is(err, ErrMismatchedLengths) {
+		t.Fatal("CommitBlobs should return ErrMismatchedLengths", err)
+	}
+	if !strings.Contains(err.Error(), "kvIndices 1, blobs 2, commits 1") {
+		t.Fatal("error should contain all the lengths", err)
+	}
+}
+
+func TestBlobVersionedHash(t *testing.T) {
+	// the versioned hash of the empty blob, whose KZG commitment is the point at infinity 0xc000...00
+	expected := common.HexToHash("0x010657f37554c781402a22917dee2f75def7ab966d7b770905398eba3c444014")
+	versionedHash, err := blobVersionedHash(make([]byte, 131072))
+	if err != nil {
+		t.Fatal("failed to compute versioned hash", err)
+	}
+	if versionedHash != expected {
+		t.Fatal("unexpected versioned hash of the empty blob", versionedHash.Hex())
+	}
+}
+
+func TestStorageManager_TryReadWithVersionedHash(t *testing.T) {
+	setup(t)
+
+	kvIndex := uint64(4)
+	blob, _ := createBlob(kvIndex)
+	versionedHash, err := blobVersionedHash(blob)
+	if err != nil {
+		t.Fatal("failed to compute versioned hash", err)
+	}
+	err = storageManager.DownloadFinished(97529, []uint64{kvIndex}, [][]byte{blob}, []common.Hash{versionedHash})
+	if err != nil {
+		t.Fatal("failed to Downloand Finished", err)
+	}
+
+	data, hash, success, err := storageManager.TryReadWithVersionedHash(kvIndex)
+	if err != nil || !success {
+		t.Fatal("failed to read blob with versioned hash", err)
+	}
+	if hash != versionedHash || hash[0] != 0x01 {
+		t.Fatal("unexpected versioned hash", hash.Hex())
+	}
+	if !bytes.Equal(data, blob) {
+		t.Fatal("unexpected blob data")
+	}
+
+	if _, _, _, err = storageManager.TryReadWithVersionedHash(kvIndex + 1); err == nil {
+		t.Fatal("reading a blob not synced should fail")
+	}
+}
+
+func TestStorageManager_DownloadFinishedMaxInFlightBytes(t *testing.T) {
+	setup(t)
+	storageManager.DownloadThreadNum = 4
+	storageManager.MaxInFlightBytes = 131072
+	defer func() {
+		storageManager.MaxInFlightBytes = 0
+	}()
+
+	kvIndices := []uint64{4, 5, 6, 7, 8}
+	blobs := make([][]byte, len(kvIndices))
+	commits := make([]common.Hash, len(kvIndices))
+	for i, kvIdx := range kvIndices {
+		blobs[i], commits[i] = createBlob(kvIdx)
+	}
+	err := storageManager.DownloadFinished(97529, kvIndices, blobs, commits)
+	if err != nil {
+		t.Fatal("failed to Downloand Finished", err)
+	}
+	for i, kvIdx := range kvIndices {
+		data, success, err := storageManager.TryRead(kvIdx, 131072, commits[i])
+		if err != nil || !success || !bytes.Equal(data, blobs[i]) {
+			t.Fatal("failed to read blob written with MaxInFlightBytes", kvIdx, err)
+		}
+	}
+}
+
+func TestStorageManager_Geometry(t *testing.T) {
+	setup(t)
+
+	geometry := storageManager.Geometry()
+	expected := Geometry{
+		ContractAddress: storageManager.ContractAddress(),
+		MaxKvSize:       storageManager.MaxKvSize(),
+		MaxKvSizeBits:   storageManager.MaxKvSizeBits(),
+		ChunksPerKvBits: storageManager.ChunksPerKvBits(),
+		KvEntries:       storageManager.KvEntries(),
+		KvEntriesBits:   storageManager.KvEntriesBits(),
+	}
+	if geometry != expected {
+		t.Fatal("unexpected geometry", geometry)
+	}
+
+	bs, err := json.Marshal(geometry)
+	if err != nil {
+		t.Fatal("failed to marshal geometry", err)
+	}
+	decoded := Geometry{}
+	if err = json.Unmarshal(bs, &decoded); err != nil {
+		t.Fatal("failed to unmarshal geometry", err)
+	}
+	if decoded != geometry {
+		t.Fatal("unexpected decoded geometry", string(bs))
+	}
+}
+
+// advancingL1Source serves generated metas, and calls onGetKvMetas before the first GetKvMetas returns.
+type advancingL1Source struct {
+	mu            sync.Mutex
+	lastBlobIndex uint64
+	onGetKvMetas  func()
+}
+
+func (l1 *advancingL1Source) GetKvMetas(kvIndices []uint64, blockNumber int64) ([][32]byte, error) {
+	l1.mu.Lock()
+	hook := l1.onGetKvMetas
+	l1.onGetKvMetas = nil
+	l1.mu.Unlock()
+	if hook != nil {
+		hook()
+	}
+
+	metas := make([][32]byte, 0)
+	for _, idx := range kvIndices {
+		metas = append(metas, newTestMeta(idx, byte(idx+1)))
+	}
+	return metas, nil
+}
+
+func (l1 *advancingL1Source) GetStorageLastBlobIdx(blockNumber int64) (uint64, error) {
+	l1.mu.Lock()
+	defer l1.mu.Unlock()
+	return l1.lastBlobIndex, nil
+}
+
+func (l1 *advancingL1Source) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	return &types.Header{Number: new(big.Int).Set(number)}, nil
+}
+
+func TestStorageManager_DownloadAllMetasLastKvIdxAdvanced(t *testing.T) {
+	sm, files := createEthStorage(contractAddress, []uint64{0}, 131072, 131072, kvEntries, common.Address{}, defaultEncodeType)
+	defer func() {
+		sm.Close()
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}()
+
+	l1 := &advancingL1Source{lastBlobIndex: 4}
+	s := NewStorageManager(sm, l1)
+	if err := s.Reset(1); err != nil {
+		t.Fatal("failed to reset", err)
+	}
+	// lastKvIdx advances to 10 after the download of the first batch begins
+	l1.onGetKvMetas = func() {
+		l1.mu.Lock()
+		l1.lastBlobIndex = 10
+		l1.mu.Unlock()
+		if err := s.Reset(2); err != nil {
+			t.Error("failed to reset", err)
+		}
+	}
+
+	if err := s.DownloadAllMetas(context.Background(), 2); err != nil {
+		t.Fatal("failed to download metas", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.blobMetas.len() != 10 {
+		t.Fatal("unexpected meta count", s.blobMetas.len())
+	}
+	for idx := uint64(0); idx < 10; idx++ {
+		if meta, ok := s.blobMetas.get(idx); !ok || meta != newTestMeta(idx, byte(idx+1)) {
+			t.Fatal("meta of the newly covered index should be downloaded", idx, meta)
+		}
+	}
+}
+
+func TestStorageManager_ReadSamples(t *testing.T) {
+	setup(t)
+
+	samplesPerShard := kvEntries * storageManager.MaxKvSize() / 32
+	sampleIndices := []uint64{0, 4096, samplesPerShard - 1, samplesPerShard}
+	samples, err := storageManager.ReadSamples(0, sampleIndices)
+	var sampleErrs SampleErrors
+	if !errors.As(err, &sampleErrs) || len(sampleErrs) != len(sampleIndices) {
+		t.Fatal("expected SampleErrors", err)
+	}
+	for i, sampleIdx := range sampleIndices[:3] {
+		if sampleErrs[i] != nil {
+			t.Fatal("failed to read sample", sampleIdx, sampleErrs[i])
+		}
+		expected, err := storageManager.ReadSampleUnlocked(0, sampleIdx)
+		if err != nil || samples[i] != expected {
+			t.Fatal("unexpected sample", sampleIdx, samples[i])
+		}
+	}
+	if !errors.Is(sampleErrs[3], ErrSampleOutOfRange) {
+		t.Fatal("expected ErrSampleOutOfRange", sampleErrs[3])
+	}
+
+	if _, err = storageManager.ReadSamples(0, sampleIndices[:3]); err != nil {
+		t.Fatal("failed to read samples", err)
+	}
+	if _, err = storageManager.ReadSamples(1, sampleIndices); !errors.Is(err, ErrShardNotManaged) {
+		t.Fatal("expected ErrShardNotManaged", err)
+	}
+}
+
+func TestStorageManager_ReadSampleUnlockedDuringAddShard(t *testing.T) {
+	setup(t)
+	storageManager.DataDir = t.TempDir()
+	defer storageManager.shardManager.Close()
+
+	samplesPerShard := kvEntries * storageManager.MaxKvSize() / 32
+	done := make(chan struct{})
+	var wg, started sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		started.Add(1)
+		go func() {
+			defer wg.Done()
+			started.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if _, err := storageManager.ReadSampleUnlocked(0, 0); err != nil {
+					t.Error("failed to read sample of shard 0", err)
+					return
+				}
+				// shard 1 may or may not be managed yet
+				storageManager.ReadSampleUnlocked(1, samplesPerShard)
+			}
+		}()
+	}
+
+	started.Wait()
+	for i := 0; i < 10; i++ {
+		if err := storageManager.AddShard(1, common.Address{}, defaultEncodeType); err != nil {
+			t.Fatal("failed to add shard", err)
+		}
+		if err := storageManager.RemoveShard(1, true); err != nil {
+			t.Fatal("failed to remove shard", err)
+		}
+	}
+	close(done)
+	wg.Wait()
+}
+
+// countingL1Source counts the GetStorageLastBlobIdx requests sent to the wrapped Il1Source.
+type countingL1Source struct {
+	Il1Source
+	lastBlobIdxCalls int
+}
+
+func (l1 *countingL1Source) GetStorageLastBlobIdx(blockNumber int64) (uint64, error) {
+	l1.lastBlobIdxCalls++
+	return l1.Il1Source.GetStorageLastBlobIdx(blockNumber)
+}
+
+func TestStorageManager_LastBlobIdxCache(t *testing.T) {
+	setup(t)
+	l1 := &countingL1Source{Il1Source: storageManager.l1Source}
+	storageManager.l1Source = l1
+
+	if err := storageManager.Reset(97530); err != nil {
+		t.Fatal("failed to reset", err)
+	}
+	if err := storageManager.Reset(97530); err != nil {
+		t.Fatal("failed to reset", err)
+	}
+	if l1.lastBlobIdxCalls != 1 {
+		t.Fatal("lastKvIdx of the same block should be cached", l1.lastBlobIdxCalls)
+	}
+
+	err := storageManager.DownloadFinished(97531, []uint64{5}, [][]byte{{10}}, []common.Hash{{1}})
+	if err != nil {
+		t.Fatal("failed to Downloand Finished", err)
+	}
+	err = storageManager.DownloadFinished(97532, []uint64{4}, [][]byte{{10}}, []common.Hash{{1}})
+	if err != nil {
+		t.Fatal("failed to Downloand Finished", err)
+	}
+	if l1.lastBlobIdxCalls != 3 {
+		t.Fatal("unexpected GetStorageLastBlobIdx calls", l1.lastBlobIdxCalls)
+	}
+	storageManager.mu.Lock()
+	defer storageManager.mu.Unlock()
+	if len(storageManager.lastBlobIdxCache) != 1 {
+		t.Fatal("cache of the blocks before localL1 should be dropped", storageManager.lastBlobIdxCache)
+	}
+}
+
+func TestStorageManager_Capacity(t *testing.T) {
+	setup(t)
+	kvSize := storageManager.MaxKvSize()
+
+	if total := storageManager.TotalCapacity(); total != kvEntries*kvSize {
+		t.Fatal("unexpected total capacity", total)
+	}
+	if used, err := storageManager.UsedCapacity(); err != nil || used != 3*kvSize {
+		t.Fatal("unexpected used capacity", used, err)
+	}
+
+	// the cached count is dropped once a blob is committed to the shard
+	err := storageManager.DownloadFinished(97529, []uint64{4}, [][]byte{{10}}, []common.Hash{{1}})
+	if err != nil {
+		t.Fatal("failed to Downloand Finished", err)
+	}
+	capacities, err := storageManager.ShardCapacities()
+	if err != nil {
+		t.Fatal("failed to get shard capacities", err)
+	}
+	expected := []ShardCapacity{{ShardIdx: 0, Total: kvEntries * kvSize, Used: 4 * kvSize}}
+	if len(capacities) != 1 || capacities[0] != expected[0] {
+		t.Fatal("unexpected shard capacities", capacities)
+	}
+}
+
+func TestStorageManager_ShardProgress(t *testing.T) {
+	setup(t)
+	l1 := storageManager.l1Source.(*mockL1Source)
+	l1.lastBlobIndex = 8
+	if err := storageManager.Reset(97600); err != nil {
+		t.Fatal("failed to reset", err)
+	}
+
+	// kvs 1-3 are synced, and the kvs from lastKvIdx are complete
+	if progress, err := storageManager.ShardProgress(0); err != nil || progress != float64(3+8)/16 {
+		t.Fatal("unexpected progress", progress, err)
+	}
+	// the kvs beyond lastKvIdx are not counted twice once empty filled
+	if _, _, err := storageManager.CommitEmptyBlobs(8, 9); err != nil {
+		t.Fatal("failed to commit empty blobs", err)
+	}
+	if progress, _ := storageManager.ShardProgress(0); progress != float64(3+8)/16 {
+		t.Fatal("unexpected progress after the empty filling", progress)
+	}
+
+	// the count follows the blobs committed and lastKvIdx
+	l1.lastBlobIndex = 10
+	if err := storageManager.DownloadFinished(97601, []uint64{4}, [][]byte{{10}}, []common.Hash{{1}}); err != nil {
+		t.Fatal("failed to download", err)
+	}
+	if progress, _ := storageManager.ShardProgress(0); progress != float64(4+2+6)/16 {
+		t.Fatal("unexpected progress after the download", progress)
+	}
+
+	if _, err := storageManager.ShardProgress(1); !errors.Is(err, ErrShardNotManaged) {
+		t.Fatal("expected ErrShardNotManaged", err)
+	}
+}
+
+func TestStorageManager_ShardFill(t *testing.T) {
+	setup(t)
+
+	// the fill state is loaded once, and read under the read lock only
+	if used, err := storageManager.UsedCapacity(); err != nil || used != 3*storageManager.shardManager.kvSize {
+		t.Fatal("unexpected used capacity", used, err)
+	}
+	f := storageManager.fills[0]
+	storageManager.mu.RLock()
+	done := make(chan error)
+	go func() {
+		_, err := storageManager.ShardCapacities()
+		if err == nil {
+			_, err = storageManager.ShardProgress(0)
+		}
+		if err == nil {
+			_, err = storageManager.LocalHighestFilledIndex()
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal("failed to query the fill state", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the fill state should be queried under the read lock")
+	}
+	storageManager.mu.RUnlock()
+
+	// the state is updated by the writes instead of being scanned again, with the empty filled kvs not synced
+	storageManager.l1Source.(*mockL1Source).lastBlobIndex = 8
+	if err := storageManager.Reset(97600); err != nil {
+		t.Fatal("failed to reset", err)
+	}
+	if _, _, err := storageManager.CommitEmptyBlobs(8, 9); err != nil {
+		t.Fatal("failed to commit empty blobs", err)
+	}
+	if err := storageManager.DownloadFinished(97601, []uint64{5}, [][]byte{{10}}, []common.Hash{{1}}); err != nil {
+		t.Fatal("failed to download", err)
+	}
+	if storageManager.fills[0] != f || f.count != 6 {
+		t.Fatal("the fill state should be updated in place", f.count)
+	}
+	if highest, err := storageManager.LocalHighestFilledIndex(); err != nil || highest != 5 {
+		t.Fatal("unexpected highest filled index", highest, err)
+	}
+	if _, err := storageManager.VerifyShard(0); err != nil {
+		t.Fatal("failed to verify shard", err)
+	}
+	if storageManager.fills[0] != f {
+		t.Fatal("the fill state should be kept by VerifyShard")
+	}
+}
+
+func TestStorageManager_TryReadVerified(t *testing.T) {
+	setup(t)
+
+	blob, hash := createBlob(1)
+	meta := generateMetadata(1, 131072, hash[:])
+	storageManager.blobMetas.set(1, meta)
+	data, success, err := storageManager.TryReadVerified(1, 131072)
+	if err != nil || !success {
+		t.Fatal("failed to read verified blob", err)
+	}
+	if !bytes.Equal(data, blob) {
+		t.Fatal("unexpected blob data")
+	}
+
+	// the contract has a new commit for the blob but the local data is stale
+	_, hash = createBlob(100)
+	storageManager.blobMetas.set(2, generateMetadata(2, 131072, hash[:]))
+	if _, _, err = storageManager.TryReadVerified(2, 131072); !errors.Is(err, ErrCommitMismatch) {
+		t.Fatal("expected ErrCommitMismatch", err)
+	}
+
+	if _, _, err = storageManager.TryReadVerified(5, 131072); err == nil {
+		t.Fatal("reading a blob not synced should fail")
+	}
+}
+
+// hookedL1Source serves the metas set in it instead of the wrapped l1 source, calling hook before each GetKvMetas.
+type hookedL1Source struct {
+	Il1Source
+	metas map[uint64][32]byte
+	hook  func()
+}
+
+func (l1 *hookedL1Source) GetKvMetas(kvIndices []uint64, blockNumber int64) ([][32]byte, error) {
+	l1.hook()
+	metas := make([][32]byte, 0, len(kvIndices))
+	for _, idx := range kvIndices {
+		metas = append(metas, l1.metas[idx])
+	}
+	return metas, nil
+}
+
+func TestStorageManager_TryReadVerifiedQueryUnlocked(t *testing.T) {
+	setup(t)
+
+	// the contract meta not downloaded is queried without the lock
+	rewrite := false
+	want, wantHash := createBlob(1)
+	blob, hash := createBlob(2)
+	metas := map[uint64][32]byte{1: generateMetadata(1, 131072, wantHash[:])}
+	l1 := &hookedL1Source{Il1Source: storageManager.getL1Source(), metas: metas, hook: func() {
+		if !storageManager.mu.TryLock() {
+			t.Error("the contract meta should be queried without the lock")
+			return
+		}
+		storageManager.mu.Unlock()
+		if rewrite {
+			rewrite = false
+			if err := storageManager.DownloadFinished(97529, []uint64{1}, [][]byte{blob}, []common.Hash{hash}); err != nil {
+				t.Error("failed to download", err)
+			}
+		}
+	}}
+	if err := storageManager.SetL1Source(l1); err != nil {
+		t.Fatal("failed to set l1 source", err)
+	}
+	storageManager.blobMetas.delete(1)
+	if data, _, err := storageManager.TryReadVerified(1, 131072); err != nil || !bytes.Equal(data, want) {
+		t.Fatal("failed to read verified blob", err)
+	}
+
+	// the blob rewritten while the contract meta is queried is confirmed again before decoding
+	rewrite = true
+	storageManager.blobMetas.delete(1)
+	if data, _, err := storageManager.TryReadVerified(1, 131072); err != nil || !bytes.Equal(data, blob) {
+		t.Fatal("the rewritten blob should be read", err)
+	}
+}
+
+func TestStorageManager_AddShardRange(t *testing.T) {
+	setup(t)
+	storageManager.DataDir = t.TempDir()
+	defer storageManager.shardManager.Close()
+
+	if err := storageManager.AddShardRange(1, kvEntries-1, kvEntries+8, common.Address{}, defaultEncodeType); err == nil {
+		t.Fatal("adding a range out of the shard should fail")
+	}
+	startKv, endKv := kvEntries+4, kvEntries+8
+	if err := storageManager.AddShardRange(1, startKv, endKv, common.Address{}, defaultEncodeType); err != nil {
+		t.Fatal("failed to add shard range", err)
+	}
+	if start, end, ok := storageManager.OwnedKvRange(1); !ok || start != startKv || end != endKv {
+		t.Fatal("unexpected owned kv range", start, end)
+	}
+	if total := storageManager.TotalCapacity(); total != (kvEntries+4)*storageManager.MaxKvSize() {
+		t.Fatal("unexpected total capacity", total)
+	}
+
+	// the kv not owned is skipped without faulting the shard
+	kvIndices := []uint64{startKv - 1, startKv}
+	err := storageManager.DownloadFinished(97529, kvIndices, [][]byte{{10}, {10}}, []common.Hash{{1}, {1}})
+	if err != nil {
+		t.Fatal("failed to Downloand Finished", err)
+	}
+	if _, success, err := storageManager.TryReadMeta(startKv); !success || err != nil {
+		t.Fatal("failed to read meta of the owned kv", err)
+	}
+	if _, _, err = storageManager.TryReadMeta(startKv - 1); !errors.Is(err, ErrNotOwned) {
+		t.Fatal("expected ErrNotOwned for reading meta", err)
+	}
+	if _, _, err = storageManager.TryRead(endKv, 1, common.Hash{1}); !errors.Is(err, ErrNotOwned) {
+		t.Fatal("expected ErrNotOwned for reading", err)
+	}
+	if err = storageManager.syncCheck(endKv); !errors.Is(err, ErrNotOwned) {
+		t.Fatal("expected ErrNotOwned for sync check", err)
+	}
+	if err = storageManager.CommitBlob(endKv, make([]byte, 131072), common.Hash{}); !errors.Is(err, ErrNotOwned) {
+		t.Fatal("expected ErrNotOwned for committing", err)
+	}
+}
+
+func TestStorageManager_AuditLog(t *testing.T) {
+	setup(t)
+	defer storageManager.SetAuditWriter(nil)
+	buf := new(bytes.Buffer)
+	storageManager.SetAuditWriter(buf)
+
+	h := common.Hash{1, 2, 3}
+	err := storageManager.DownloadFinished(97529, []uint64{4}, [][]byte{{10}}, []common.Hash{h})
+	if err != nil {
+		t.Fatal("failed to Downloand Finished", err)
+	}
+	storageManager.blobMetas.set(6, newTestMeta(6, 0))
+	if inserted, _, err := storageManager.CommitEmptyBlobs(6, 6); err != nil || inserted != 1 {
+		t.Fatal("failed to commit empty blobs", inserted, err)
+	}
+
+	dec := json.NewDecoder(buf)
+	expected := []CommitAuditRecord{
+		{KvIdx: 4, Commit: h[:HashSizeInContract], Source: CommitSourceDownload},
+		{KvIdx: 6, Commit: make([]byte, HashSizeInContract), Source: CommitSourceEmpty},
+	}
+	for _, e := range expected {
+		var r CommitAuditRecord
+		if err = dec.Decode(&r); err != nil {
+			t.Fatal("failed to decode audit record", err)
+		}
+		if r.KvIdx != e.KvIdx || !bytes.Equal(r.Commit, e.Commit) || r.Source != e.Source || r.Time.IsZero() {
+			t.Fatal("unexpected audit record", r)
+		}
+	}
+	if dec.More() {
+		t.Fatal("unexpected audit records")
+	}
+}
+
+func TestPrepareCommit(t *testing.T) {
+	commit := common.Hash{}
+	for i := range commit {
+		commit[i] = 0xff
+	}
+	c := PrepareCommit(commit)
+	if !bytes.Equal(c[:HashSizeInContract], commit[:HashSizeInContract]) {
+		t.Fatal("the commit prefix should be kept", c)
+	}
+	// only the filling bit is set after the truncated commit
+	if c[HashSizeInContract] != blobFillingMask || !bytes.Equal(c[HashSizeInContract+1:], make([]byte, 32-HashSizeInContract-1)) {
+		t.Fatal("the commit should be truncated with the filling bit", c)
+	}
+	if !IsFilled(c) || IsFilled(common.Hash{}) {
+		t.Fatal("unexpected filling bit")
+	}
+	// the filling bit of the empty blob tells it from a kv not synced yet
+	if empty := PrepareCommit(common.Hash{}); !IsFilled(empty) || empty == (common.Hash{}) {
+		t.Fatal("the empty commit should be filled", empty)
+	}
+}
+
+func TestPrepareCommitRoundTrip(t *testing.T) {
+	setup(t)
+
+	kvIdx := uint64(4)
+	blob, commit := createBlob(kvIdx)
+	encodedBlob, success, err := storageManager.shardManager.TryEncodeKV(kvIdx, blob, commit)
+	if !success || err != nil {
+		t.Fatal("failed to encode blob", err)
+	}
+	contractMeta := generateMetadata(kvIdx, 131072, commit[:])
+
+	storageManager.mu.Lock()
+	defer storageManager.mu.Unlock()
+	if err = storageManager.commitEncodedBlob(kvIdx, encodedBlob, commit, contractMeta, CommitSourceSync); err != nil {
+		t.Fatal("failed to commit blob", err)
+	}
+	m, success, err := storageManager.shardManager.TryReadMeta(kvIdx)
+	if !success || err != nil {
+		t.Fatal("failed to read meta", err)
+	}
+	localMeta := common.BytesToHash(m)
+	if localMeta != PrepareCommit(commit) {
+		t.Fatal("unexpected local meta", localMeta)
+	}
+
+	// the local meta passes the mismatch check against the original commit, and is taken as already committed
+	storageManager.committed = nil
+	if err = storageManager.commitEncodedBlob(kvIdx, encodedBlob, localMeta, contractMeta, CommitSourceSync); err != nil {
+		t.Fatal("the prepared commit should match the contract meta", err)
+	}
+	if len(storageManager.committed) != 0 {
+		t.Fatal("the blob should not be committed again", storageManager.committed)
+	}
+}
+
+func TestStorageManager_BlobInfo(t *testing.T) {
+	setup(t)
+
+	_, hash := createBlob(1)
+	storageManager.blobMetas.set(1, generateMetadata(1, 131072, hash[:]))
+	info, err := storageManager.BlobInfo(1)
+	if err != nil {
+		t.Fatal("failed to get blob info", err)
+	}
+	if !info.Synced || info.Empty || info.ShardIdx != 0 || !bytes.Equal(info.LocalCommit, hash[:HashSizeInContract]) ||
+		!bytes.Equal(info.ContractCommit, hash[:HashSizeInContract]) {
+		t.Fatal("unexpected info of synced blob", info)
+	}
+
+	// not synced, and the contract meta not downloaded
+	if info, err = storageManager.BlobInfo(5); err != nil || info.Synced || info.Empty || info.ContractCommit != nil {
+		t.Fatal("unexpected info of blob not synced", info, err)
+	}
+
+	storageManager.blobMetas.set(6, newTestMeta(6, 0))
+	if _, _, err = storageManager.CommitEmptyBlobs(6, 6); err != nil {
+		t.Fatal("failed to commit empty blobs", err)
+	}
+	if info, err = storageManager.BlobInfo(6); err != nil || !info.Synced || !info.Empty {
+		t.Fatal("unexpected info of empty blob", info, err)
+	}
+
+	if _, err = storageManager.BlobInfo(kvEntries); !errors.Is(err, ErrShardNotManaged) {
+		t.Fatal("expected ErrShardNotManaged", err)
+	}
+}
+
+func TestStorageManager_VerifyShard(t *testing.T) {
+	setup(t)
+
+	torn, err := storageManager.VerifyShard(0)
+	if err != nil || len(torn) != 0 {
+		t.Fatal("unexpected torn blobs", torn, err)
+	}
+
+	// simulate a crash after the meta is updated but before the data is written
+	ds, _ := storageManager.shardManager.getDataShard(0)
+	garbage := bytes.Repeat([]byte{0xab}, int(ds.chunkSize))
+	if err = ds.writeChunk(2*ds.chunksPerKv, garbage); err != nil {
+		t.Fatal("failed to write chunk", err)
+	}
+	if torn, err = storageManager.VerifyShard(0); err != nil || len(torn) != 1 || torn[0] != 2 {
+		t.Fatal("unexpected torn blobs", torn, err)
+	}
+	if info, _ := storageManager.BlobInfo(2); info.Synced {
+		t.Fatal("the torn blob should be flagged for resync")
+	}
+	if torn, err = storageManager.VerifyShard(0); err != nil || len(torn) != 0 {
+		t.Fatal("unexpected torn blobs after flagged", torn, err)
+	}
+	if _, err = storageManager.VerifyShard(1); !errors.Is(err, ErrShardNotManaged) {
+		t.Fatal("expected ErrShardNotManaged", err)
+	}
+}
+
+func TestStorageManager_ScrubShard(t *testing.T) {
+	setup(t)
+	storageManager.ScrubRate = 4
+
+	// the synced blobs are checked at ScrubRate
+	start := time.Now()
+	res, err := storageManager.ScrubShard(context.Background(), 0)
+	if err != nil || res.Scrubbed != 3 || len(res.Corrupt) != 0 || res.Next != kvEntries {
+		t.Fatal("unexpected scrub result", res, err)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Fatal("the scrub should be rate limited", elapsed)
+	}
+
+	// simulate the bit rot of a blob
+	ds, _ := storageManager.shardManager.getDataShard(0)
+	garbage := bytes.Repeat([]byte{0xab}, int(ds.chunkSize))
+	if err = ds.writeChunk(2*ds.chunksPerKv, garbage); err != nil {
+		t.Fatal("failed to write chunk", err)
+	}
+	storageManager.ScrubRate = 1000
+	if res, err = storageManager.ScrubShard(context.Background(), 0); err != nil || !reflect.DeepEqual(res.Corrupt, []uint64{2}) {
+		t.Fatal("unexpected corrupt blobs", res, err)
+	}
+	if info, _ := storageManager.BlobInfo(2); info.Synced {
+		t.Fatal("the corrupt blob should be flagged for resync")
+	}
+	if res, err = storageManager.ScrubShard(context.Background(), 0); err != nil || res.Scrubbed != 2 || len(res.Corrupt) != 0 {
+		t.Fatal("unexpected scrub result after flagged", res, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if res, err = storageManager.ScrubShard(ctx, 0); !errors.Is(err, context.Canceled) || res.Next != 0 {
+		t.Fatal("the scrub should stop once cancelled", res, err)
+	}
+	if _, err = storageManager.ScrubShard(context.Background(), 1); !errors.Is(err, ErrShardNotManaged) {
+		t.Fatal("expected ErrShardNotManaged", err)
+	}
+}
+
+func TestStorageManager_ShouldThrottle(t *testing.T) {
+	setup(t)
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	storageManager.Clock = clock
+	storageManager.ThrottleDepth = 1
+
+	if storageManager.ShouldThrottle() {
+		t.Fatal("should not throttle without pending commits")
+	}
+
+	// the commit waiting for the lock is pending
+	storageManager.mu.Lock()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		storageManager.CommitEmptyBlobs(6, 6)
+	}()
+	for storageManager.PendingWriteDepth() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if !storageManager.ShouldThrottle() {
+		t.Fatal("should throttle with too many pending commits")
+	}
+	storageManager.mu.Unlock()
+	<-done
+	if storageManager.PendingWriteDepth() != 0 || storageManager.ShouldThrottle() {
+		t.Fatal("should not throttle after the commit is done")
+	}
+
+	// slow commits
+	for i := 0; i < 16; i++ {
+		start := storageManager.beginWrite()
+		clock.advance(DefaultThrottleLatency * 2)
+		storageManager.endWrite(start)
+	}
+	if !storageManager.ShouldThrottle() {
+		t.Fatal("should throttle when the commits take too long", storageManager.CommitLatency())
+	}
+}
+
+func TestStorageManager_CommitEncodedBlobPublic(t *testing.T) {
+	setup(t)
+
+	kvIdx := uint64(4)
+	blob, commit := createBlob(kvIdx)
+	encodedBlob, success, err := storageManager.shardManager.TryEncodeKV(kvIdx, blob, commit)
+	if !success || err != nil {
+		t.Fatal("failed to encode blob", err)
+	}
+	storageManager.blobMetas.set(kvIdx, generateMetadata(kvIdx, 131072, commit[:]))
+
+	if err = storageManager.CommitEncodedBlobPublic(kvIdx, encodedBlob[:1024], commit); err == nil {
+		t.Fatal("committing an encoded blob of invalid length should fail")
+	}
+	if err = storageManager.CommitEncodedBlobPublic(kvIdx, encodedBlob, common.Hash{1}); !errors.Is(err, ErrCommitMismatch) {
+		t.Fatal("expected ErrCommitMismatch", err)
+	}
+	if err = storageManager.CommitEncodedBlobPublic(kvIdx, encodedBlob, commit); err != nil {
+		t.Fatal("failed to commit encoded blob", err)
+	}
+	data, success, err := storageManager.TryRead(kvIdx, 131072, commit)
+	if !success || err != nil || !bytes.Equal(data, blob) {
+		t.Fatal("failed to read the committed blob", err)
+	}
+}
+
+// recordingMetrics records the methods of the lock waits and the codec operations.
+type recordingMetrics struct {
+	mu      sync.Mutex
+	methods map[string]int
+	waits   []time.Duration
+	codecs  map[string]int
+}
+
+func (m *recordingMetrics) RecordLockWait(method string, wait time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.methods[method]++
+	m.waits = append(m.waits, wait)
+}
+
+func (m *recordingMetrics) RecordCodec(op string, duration time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.codecs[op]++
+}
+
+func TestStorageManager_LockWaitMetrics(t *testing.T) {
+	if !lockMetricsEnabled {
+		t.Skip("lock metrics are compiled out")
+	}
+	setup(t)
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	storageManager.Clock = clock
+	m := &recordingMetrics{methods: make(map[string]int), codecs: make(map[string]int)}
+	storageManager.SetMetrics(m)
+
+	kvIdx := uint64(4)
+	blob, commit := createBlob(kvIdx)
+	storageManager.blobMetas.set(kvIdx, generateMetadata(kvIdx, 131072, commit[:]))
+	if err := storageManager.CommitBlob(kvIdx, blob, commit); err != nil {
+		t.Fatal("failed to commit blob", err)
+	}
+	if _, success, err := storageManager.TryRead(kvIdx, 131072, commit); !success || err != nil {
+		t.Fatal("failed to read blob", err)
+	}
+
+	if m.methods["CommitBlob"] != 1 || m.methods["TryRead"] != 1 {
+		t.Fatal("lock waits of the hot methods should be recorded", m.methods)
+	}
+	for _, wait := range m.waits {
+		if wait != 0 {
+			t.Fatal("wait should be measured with the clock", wait)
+		}
+	}
+
+	storageManager.SetMetrics(nil)
+	if _, _, err := storageManager.TryRead(kvIdx, 131072, commit); err != nil {
+		t.Fatal("failed to read blob", err)
+	}
+	if m.methods["TryRead"] != 1 {
+		t.Fatal("lock waits should not be recorded after the metrics are disabled")
+	}
+}
+
+// finalizingL1Source serves generated metas, and finalizes a new L1 block by DownloadFinished on every GetKvMetas.
+type finalizingL1Source struct {
+	advancingL1Source
+	s         *StorageManager
+	finalized atomic.Int64
+}
+
+func (l1 *finalizingL1Source) GetKvMetas(kvIndices []uint64, blockNumber int64) ([][32]byte, error) {
+	done := make(chan error, 1)
+	go func() {
+		done <- l1.s.DownloadFinished(l1.finalized.Add(32), nil, nil, nil)
+	}()
+	// DownloadFinished blocks if the metas are downloaded with the lock held
+	select {
+	case err := <-done:
+		if err != nil {
+			return nil, err
+		}
+	case <-time.After(100 * time.Millisecond):
+	}
+	return l1.advancingL1Source.GetKvMetas(kvIndices, blockNumber)
+}
+
+func TestStorageManager_DownloadAllMetasDuringFinality(t *testing.T) {
+	sm, files := createEthStorage(contractAddress, []uint64{0}, 131072, 131072, kvEntries, common.Address{}, defaultEncodeType)
+	defer func() {
+		sm.Close()
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}()
+
+	l1 := &finalizingL1Source{advancingL1Source: advancingL1Source{lastBlobIndex: 10}}
+	s := NewStorageManager(sm, l1)
+	l1.s = s
+	l1.finalized.Store(1)
+	if err := s.Reset(1); err != nil {
+		t.Fatal("failed to reset", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.DownloadAllMetas(context.Background(), 2)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal("failed to download metas", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("downloading metas should terminate while L1 keeps finalizing")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for idx := uint64(0); idx < 10; idx++ {
+		if meta, ok := s.blobMetas.get(idx); !ok || meta != newTestMeta(idx, byte(idx+1)) {
+			t.Fatal("meta should be downloaded", idx, meta)
+		}
+	}
+}
+
+func TestStorageManager_TryReadTo(t *testing.T) {
+	setup(t)
+
+	kvIdx := uint64(4)
+	blob, commit := createBlob(kvIdx)
+	storageManager.blobMetas.set(kvIdx, generateMetadata(kvIdx, 131072, commit[:]))
+	if err := storageManager.CommitBlob(kvIdx, blob, commit); err != nil {
+		t.Fatal("failed to commit blob", err)
+	}
+
+	ranges := [][2]int{{0, 131072}, {0, 100}, {4000, 10000}, {131072 - 5, 5}, {8192, 0}}
+	for _, r := range ranges {
+		buf := new(bytes.Buffer)
+		success, err := storageManager.TryReadTo(kvIdx, buf, r[0], r[1], commit)
+		if !success || err != nil {
+			t.Fatal("failed to read blob", r, err)
+		}
+		if !bytes.Equal(buf.Bytes(), blob[r[0]:r[0]+r[1]]) {
+			t.Fatal("unexpected data", r)
+		}
+	}
+
+	if _, err := storageManager.TryReadTo(kvIdx, io.Discard, 131072-5, 6, commit); err == nil {
+		t.Fatal("reading beyond the kv size should fail")
+	}
+	if success, _ := storageManager.TryReadTo(kvEntries*10, io.Discard, 0, 1, commit); success {
+		t.Fatal("reading an unmanaged kv should not succeed")
+	}
+}
+
+// changingL1Source serves the metas by block, which are changed from the block changedAt.
+type changingL1Source struct {
+	advancingL1Source
+	changedAt int64 // the block from which the metas and lastKvIdx are changed
+}
+
+func (l1 *changingL1Source) GetKvMetas(kvIndices []uint64, blockNumber int64) ([][32]byte, error) {
+	metas := make([][32]byte, 0)
+	for _, idx := range kvIndices {
+		if blockNumber >= l1.changedAt {
+			metas = append(metas, newTestMeta(idx, 2))
+		} else {
+			metas = append(metas, newTestMeta(idx, 1))
+		}
+	}
+	return metas, nil
+}
+
+func (l1 *changingL1Source) GetStorageLastBlobIdx(blockNumber int64) (uint64, error) {
+	if blockNumber >= l1.changedAt {
+		return 10, nil
+	}
+	return 6, nil
+}
+
+func TestStorageManager_DownloadAllMetasConfirmations(t *testing.T) {
+	sm, files := createEthStorage(contractAddress, []uint64{0}, 131072, 131072, kvEntries, common.Address{}, defaultEncodeType)
+	defer func() {
+		sm.Close()
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}()
+
+	s := NewStorageManager(sm, &changingL1Source{changedAt: 95})
+	s.MetaConfirmations = 10
+	if err := s.Reset(100); err != nil {
+		t.Fatal("failed to reset", err)
+	}
+	// the meta updated by DownloadFinished after the confirmed block is kept
+	s.blobMetas.set(2, newTestMeta(2, 9))
+
+	if err := s.DownloadAllMetas(context.Background(), 4); err != nil {
+		t.Fatal("failed to download metas", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for idx := uint64(0); idx < 10; idx++ {
+		expected := newTestMeta(idx, 1)
+		if idx == 2 {
+			expected = newTestMeta(idx, 9)
+		} else if idx >= 6 {
+			// the kvs appended after the confirmed block are downloaded at localL1
+			expected = newTestMeta(idx, 2)
+		}
+		if meta, ok := s.blobMetas.get(idx); !ok || meta != expected {
+			t.Fatal("unexpected meta", idx, meta)
+		}
+	}
+}
+
+func TestStorageManager_ShardConfigs(t *testing.T) {
+	setup(t)
+	storageManager.DataDir = t.TempDir()
+	defer storageManager.shardManager.Close()
+
+	miner := common.Address{1}
+	if err := storageManager.AddShardRange(2, 2*kvEntries+4, 2*kvEntries+8, miner, ENCODE_KECCAK_256); err != nil {
+		t.Fatal("failed to add shard range", err)
+	}
+	miner0, _ := storageManager.GetShardMiner(0)
+	expected := []ShardConfig{
+		{ShardIdx: 0, Miner: miner0, EncodeType: defaultEncodeType, KvEntries: kvEntries, StartKv: 0, EndKv: kvEntries},
+		{ShardIdx: 2, Miner: miner, EncodeType: ENCODE_KECCAK_256, KvEntries: kvEntries, StartKv: 2*kvEntries + 4, EndKv: 2*kvEntries + 8},
+	}
+	configs := storageManager.ShardConfigs()
+	if len(configs) != len(expected) {
+		t.Fatal("unexpected shard configs", configs)
+	}
+	for i := range expected {
+		if configs[i] != expected[i] {
+			t.Fatal("unexpected shard config", configs[i])
+		}
+	}
+
+	bs, err := json.Marshal(configs)
+	if err != nil {
+		t.Fatal("failed to marshal shard configs", err)
+	}
+	decoded := []ShardConfig{}
+	if err = json.Unmarshal(bs, &decoded); err != nil || len(decoded) != len(configs) || decoded[1] != configs[1] {
+		t.Fatal("unexpected decoded shard configs", string(bs), err)
+	}
+}
+
+func TestStorageManager_CommitMismatchedContractKvIdx(t *testing.T) {
+	setup(t)
+
+	kvIdx := uint64(4)
+	blob, commit := createBlob(kvIdx)
+	// the contract meta of kvIdx encodes another kvIdx, e.g. a stale or wrong meta
+	storageManager.blobMetas.set(kvIdx, generateMetadata(kvIdx+1, 131072, commit[:]))
+
+	if err := storageManager.CommitBlob(kvIdx, blob, commit); !errors.Is(err, ErrKvIdxMismatch) {
+		t.Fatal("expected ErrKvIdxMismatch", err)
+	}
+	inserted, err := storageManager.CommitBlobs([]uint64{kvIdx}, [][]byte{blob}, []common.Hash{commit})
+	if err != nil || len(inserted) != 0 {
+		t.Fatal("the blob with a mismatched contract kvIdx should not be committed", inserted, err)
+	}
+	encodedBlob, _, err := storageManager.shardManager.TryEncodeKV(kvIdx, blob, commit)
+	if err != nil {
+		t.Fatal("failed to encode blob", err)
+	}
+	if err = storageManager.CommitEncodedBlobPublic(kvIdx, encodedBlob, commit); !errors.Is(err, ErrKvIdxMismatch) {
+		t.Fatal("expected ErrKvIdxMismatch", err)
+	}
+	if m, success, err := storageManager.TryReadMeta(kvIdx); !success || err != nil || IsFilled(common.BytesToHash(m)) {
+		t.Fatal("the blob should not be filled", err)
+	}
+}
+
+// loggingL1Source serves generated metas, records the kvs whose metas are requested, and reports the updated kvs
+// by the PutBlob logs.
+type loggingL1Source struct {
+	advancingL1Source
+	updated   []uint64
+	requested []uint64
+}
+
+func (l1 *loggingL1Source) GetKvMetas(kvIndices []uint64, blockNumber int64) ([][32]byte, error) {
+	l1.mu.Lock()
+	l1.requested = append(l1.requested, kvIndices...)
+	l1.mu.Unlock()
+	return l1.advancingL1Source.GetKvMetas(kvIndices, blockNumber)
+}
+
+func (l1 *loggingL1Source) FilterLogsByBlockRange(start *big.Int, end *big.Int, eventSig string) ([]types.Log, error) {
+	logs := []types.Log{}
+	for _, kvIdx := range l1.updated {
+		logs = append(logs, types.Log{Topics: []common.Hash{{}, common.BigToHash(new(big.Int).SetUint64(kvIdx)), {}, {}}})
+	}
+	return logs, nil
+}
+
+func TestStorageManager_CatchUpMetas(t *testing.T) {
+	sm, files := createEthStorage(contractAddress, []uint64{0}, 131072, 131072, kvEntries, common.Address{}, defaultEncodeType)
+	defer func() {
+		sm.Close()
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}()
+
+	l1 := &loggingL1Source{advancingL1Source: advancingL1Source{lastBlobIndex: 10}, updated: []uint64{1}}
+	s := NewStorageManager(sm, l1)
+	if err := s.Reset(5); err != nil {
+		t.Fatal("failed to reset", err)
+	}
+	// the blobs filled locally before the restart
+	ds, _ := sm.getDataShard(0)
+	localCommit := prepareCommit(common.Hash{0xaa, 0xaa, 0xaa})
+	for _, kvIdx := range []uint64{0, 1, 2, 3} {
+		if err := ds.WriteMeta(kvIdx, localCommit[:]); err != nil {
+			t.Fatal("failed to write meta", err)
+		}
+	}
+
+	if err := s.CatchUpMetas(context.Background(), 1, 6, 2); err != nil {
+		t.Fatal("failed to catch up metas", err)
+	}
+	expectedRequested := []uint64{1, 4, 5, 6, 7, 8, 9}
+	if fmt.Sprint(l1.requested) != fmt.Sprint(expectedRequested) {
+		t.Fatal("unexpected downloaded metas", l1.requested)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for idx := uint64(0); idx < 10; idx++ {
+		expected := newTestMeta(idx, byte(idx+1))
+		if idx == 0 || idx == 2 || idx == 3 {
+			expected = [32]byte{}
+			putMetaKvIdx(&expected, idx)
+			copy(expected[32-HashSizeInContract:], localCommit[0:HashSizeInContract])
+		}
+		if meta, ok := s.blobMetas.get(idx); !ok || meta != expected {
+			t.Fatal("unexpected meta", idx, meta)
+		}
+	}
+	if !s.metasDownloaded {
+		t.Fatal("metas should be downloaded")
+	}
+}
+
+func TestStorageManager_CommitBlobStream(t *testing.T) {
+	setup(t)
+
+	ch := make(chan BlobItem, 4)
+	go func() {
+		defer close(ch)
+		for kvIdx := uint64(0); kvIdx < 6; kvIdx++ {
+			blob, commit := createBlob(kvIdx)
+			storageManager.mu.Lock()
+			storageManager.blobMetas.set(kvIdx, generateMetadata(kvIdx, 131072, commit[:]))
+			storageManager.mu.Unlock()
+			if kvIdx == 5 {
+				// the commit does not match the contract meta
+				commit = common.Hash{1}
+			}
+			ch <- BlobItem{KvIndex: kvIdx, Blob: blob, Commit: commit}
+		}
+	}()
+
+	stats, err := storageManager.CommitBlobStream(context.Background(), ch)
+	if err != nil {
+		t.Fatal("failed to commit blob stream", err)
+	}
+	if stats != (CommitStreamStats{Received: 6, Committed: 5, Skipped: 1}) {
+		t.Fatal("unexpected stats", stats)
+	}
+	for kvIdx := uint64(0); kvIdx < 5; kvIdx++ {
+		blob, commit := createBlob(kvIdx)
+		if data, success, err := storageManager.TryRead(kvIdx, 131072, commit); !success || err != nil || !bytes.Equal(data, blob) {
+			t.Fatal("failed to read the committed blob", kvIdx, err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = storageManager.CommitBlobStream(ctx, make(chan BlobItem)); !errors.Is(err, context.Canceled) {
+		t.Fatal("expected context.Canceled", err)
+	}
+}
+
+func TestDataFileLock(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "shard-0.dat")
+	df, err := Create(fileName, 0, kvEntries, 0, 131072, defaultEncodeType, common.Address{}, 131072)
+	if err != nil {
+		t.Fatal("failed to create data file", err)
+	}
+	if _, err = OpenDataFile(fileName); runtime.GOOS != "windows" && !errors.Is(err, ErrDataFileLocked) {
+		t.Fatal("opening a data file already open should fail", err)
+	}
+	if _, err = Create(fileName, 0, kvEntries, 0, 131072, defaultEncodeType, common.Address{}, 131072); runtime.GOOS != "windows" && !errors.Is(err, ErrDataFileLocked) {
+		t.Fatal("creating a data file already open should fail", err)
+	}
+	if info, err := os.Stat(fileName); err != nil || info.Size() < HEADER_SIZE {
+		t.Fatal("the data file should not be truncated by the failed creation", err)
+	}
+	if err = df.Close(); err != nil {
+		t.Fatal("failed to close data file", err)
+	}
+
+	df, err = OpenDataFile(fileName)
+	if err != nil {
+		t.Fatal("failed to open the closed data file", err)
+	}
+	df.Close()
+}
+
+func TestMetaCheckpointerContiguous(t *testing.T) {
+	s := &StorageManager{Clock: &fakeClock{}, MetaCheckpointDir: t.TempDir()}
+	c := s.newMetaCheckpointer(0, 0)
+	c.complete(4, 6)
+	c.complete(8, 10)
+	if c.next != 0 {
+		t.Fatal("checkpoint should not advance over an incomplete range", c.next)
+	}
+	c.complete(0, 2)
+	if c.next != 2 {
+		t.Fatal("unexpected next", c.next)
+	}
+	c.complete(2, 4)
+	if c.next != 6 || len(c.completed) != 1 {
+		t.Fatal("unexpected next", c.next, c.completed)
+	}
+}
+
+func TestStorageManager_DownloadMetasFromCheckpoint(t *testing.T) {
+	sm, files := createEthStorage(contractAddress, []uint64{0}, 131072, 131072, kvEntries, common.Address{}, defaultEncodeType)
+	defer func() {
+		sm.Close()
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}()
+	dir := t.TempDir()
+	download := func(l1Block int64, updated ...uint64) *loggingL1Source {
+		l1 := &loggingL1Source{advancingL1Source: advancingL1Source{lastBlobIndex: 10}, updated: updated}
+		s := NewStorageManager(sm, l1)
+		s.MetaCheckpointDir = dir
+		if err := s.Reset(l1Block); err != nil {
+			t.Fatal("failed to reset", err)
+		}
+		if err := s.DownloadAllMetas(context.Background(), 2); err != nil {
+			t.Fatal("failed to download metas", err)
+		}
+		for idx := uint64(0); idx < 10; idx++ {
+			if meta, ok := s.blobMetas.get(idx); !ok || meta != newTestMeta(idx, byte(idx+1)) {
+				t.Fatal("unexpected meta", idx, meta)
+			}
+		}
+		return l1
+	}
+
+	if l1 := download(5); len(l1.requested) != 10 {
+		t.Fatal("all the metas should be downloaded without a checkpoint", l1.requested)
+	}
+	if l1 := download(5); len(l1.requested) != 0 {
+		t.Fatal("no meta should be downloaded after a complete checkpoint", l1.requested)
+	}
+
+	// simulate a download interrupted at kv 6
+	ckptFile := filepath.Join(dir, fmt.Sprintf(metaCheckpointFileName, 0))
+	ckpt, err := readMetaCheckpoint(ckptFile)
+	if err != nil || ckpt.L1 != 5 || ckpt.Next != 10 {
+		t.Fatal("unexpected checkpoint", ckpt, err)
+	}
+	ckpt.Next = 6
+	if err = writeJSONSynced(ckptFile, ckpt); err != nil {
+		t.Fatal(err)
+	}
+	if l1 := download(5); fmt.Sprint(l1.requested) != fmt.Sprint([]uint64{6, 7, 8, 9}) {
+		t.Fatal("the download should resume from the checkpoint", l1.requested)
+	}
+
+	// the checkpoint of an earlier canonical block is resumed, with the metas updated since then downloaded again
+	if l1 := download(6, 2, 7); fmt.Sprint(l1.requested) != fmt.Sprint([]uint64{2, 7}) {
+		t.Fatal("the updated metas should be downloaded again", l1.requested)
+	}
+	if ckpt, err = readMetaCheckpoint(ckptFile); err != nil || ckpt.L1 != 6 || ckpt.Next != 10 {
+		t.Fatal("unexpected checkpoint", ckpt, err)
+	}
+
+	// the checkpoint of a later block, or of a reorged block, is not trusted
+	if l1 := download(5); len(l1.requested) != 10 {
+		t.Fatal("all the metas should be downloaded with a later checkpoint", l1.requested)
+	}
+	ckpt.L1Hash = common.Hash{1}
+	if err = writeJSONSynced(ckptFile, ckpt); err != nil {
+		t.Fatal(err)
+	}
+	if l1 := download(6); len(l1.requested) != 10 {
+		t.Fatal("all the metas should be downloaded with a reorged checkpoint", l1.requested)
+	}
+}
+
+func TestStorageManager_DecodeKVError(t *testing.T) {
+	setup(t)
+
+	miner := common.HexToAddress("0x0000000000000000000000000000000000001234")
+	tests := []struct {
+		blobLen    int
+		encodeType uint64
+		cause      string
+	}{
+		{blobLen: 131072, encodeType: ENCODE_END + 1, cause: "unsupported encode type"},
+		{blobLen: 131073, encodeType: defaultEncodeType, cause: "blob larger than kv size 131072"},
+	}
+	for _, tt := range tests {
+		_, found, err := storageManager.DecodeKV(4, make([]byte, tt.blobLen), common.Hash{}, miner, tt.encodeType)
+		if err == nil || !found {
+			t.Fatal("decoding should fail", tt, found)
+		}
+		for _, field := range []string{
+			"kv 4",
+			fmt.Sprintf("encodeType %d", tt.encodeType),
+			miner.Hex(),
+			fmt.Sprintf("blob length %d", tt.blobLen),
+			tt.cause,
+		} {
+			if !strings.Contains(err.Error(), field) {
+				t.Fatal("error should contain", field, err)
+			}
+		}
+	}
+
+	// a kv of the shards not managed is not found without an error, like the other reads
+	data, found, err := storageManager.DecodeKV(kvEntries, make([]byte, 131072), common.Hash{}, miner, defaultEncodeType)
+	if data != nil || found || err != nil {
+		t.Fatal("the kv of an unmanaged shard should not be found", found, err)
+	}
+	if _, found, err = storageManager.DecodeKV(4, make([]byte, 131072), common.Hash{}, miner, defaultEncodeType); !found || err != nil {
+		t.Fatal("failed to decode", found, err)
+	}
+}
+
+func TestStorageManager_SetL1Source(t *testing.T) {
+	setup(t)
+
+	if err := storageManager.SetL1Source(nil); !errors.Is(err, ErrNilL1Source) {
+		t.Fatal("expected ErrNilL1Source", err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10; i++ {
+			storageManager.Reset(int64(97530 + i))
+		}
+	}()
+	l1 := &countingL1Source{Il1Source: storageManager.getL1Source()}
+	if err := storageManager.SetL1Source(l1); err != nil {
+		t.Fatal("failed to set l1Source", err)
+	}
+	wg.Wait()
+
+	if err := storageManager.Reset(98000); err != nil {
+		t.Fatal("failed to reset", err)
+	}
+	if l1.lastBlobIdxCalls == 0 {
+		t.Fatal("the new l1Source should be used")
+	}
+}
+
+func TestStorageManager_TryReadEncodedReadLen(t *testing.T) {
+	setup(t)
+
+	kvSize := int(storageManager.MaxKvSize())
+	if data, success, err := storageManager.TryReadEncoded(1, kvSize); !success || err != nil || len(data) != kvSize {
+		t.Fatal("failed to read the whole encoded blob", err)
+	}
+	if _, _, err := storageManager.TryReadEncoded(1, kvSize+1); !errors.Is(err, ErrReadLenTooLarge) {
+		t.Fatal("expected ErrReadLenTooLarge", err)
+	}
+	if _, _, err := storageManager.TryReadEncoded(1, -1); !errors.Is(err, ErrReadLenTooLarge) {
+		t.Fatal("expected ErrReadLenTooLarge", err)
+	}
+	if data, success, err := storageManager.TryReadEncoded(1, 0); !success || err != nil || len(data) != 0 {
+		t.Fatal("reading 0 bytes should return empty data", len(data), err)
+	}
+}
+
+func TestStorageManager_QuarantinedCommits(t *testing.T) {
+	setup(t)
+
+	kvIndices := []uint64{4, 5, 6}
+	blobs := make([][]byte, len(kvIndices))
+	commits := make([]common.Hash, len(kvIndices))
+	for i, kvIdx := range kvIndices {
+		blobs[i], commits[i] = createBlob(kvIdx)
+		// the contract meta has another commit
+		storageManager.blobMetas.set(kvIdx, generateMetadata(kvIdx, 131072, common.Hash{1}.Bytes()))
+	}
+
+	if _, err := storageManager.CommitBlobs(kvIndices, blobs, commits); err != nil {
+		t.Fatal("failed to commit blobs", err)
+	}
+	if quarantined := storageManager.QuarantinedCommits(); len(quarantined) != 0 {
+		t.Fatal("mismatched commits should not be recorded by default", quarantined)
+	}
+
+	storageManager.QuarantineLimit = 2
+	if _, err := storageManager.CommitBlobs(kvIndices, blobs, commits); err != nil {
+		t.Fatal("failed to commit blobs", err)
+	}
+	if quarantined := storageManager.QuarantinedCommits(); fmt.Sprint(quarantined) != fmt.Sprint([]uint64{5, 6}) {
+		t.Fatal("unexpected quarantined commits", quarantined)
+	}
+	if err := storageManager.CommitBlob(4, blobs[0], commits[0]); !errors.Is(err, ErrCommitMismatch) {
+		t.Fatal("expected ErrCommitMismatch", err)
+	}
+	if quarantined := storageManager.QuarantinedCommits(); fmt.Sprint(quarantined) != fmt.Sprint([]uint64{4}) {
+		t.Fatal("quarantined commits should be drained by the last call", quarantined)
+	}
+}
+
+func TestStorageManager_FillEmptyBlobs(t *testing.T) {
+	setup(t)
+
+	for kvIdx := uint64(6); kvIdx <= 9; kvIdx++ {
+		storageManager.blobMetas.set(kvIdx, newTestMeta(kvIdx, 0))
+	}
+	// the blob is not empty, so it is skipped but still counts as processed
+	_, commit := createBlob(8)
+	storageManager.blobMetas.set(8, generateMetadata(8, 131072, commit[:]))
+
+	var reports [][2]uint64
+	inserted, err := storageManager.FillEmptyBlobs(context.Background(), 6, 9, 2, func(filled, total uint64) {
+		reports = append(reports, [2]uint64{filled, total})
+	})
+	if err != nil || inserted != 3 {
+		t.Fatal("failed to fill empty blobs", inserted, err)
+	}
+	if fmt.Sprint(reports) != fmt.Sprint([][2]uint64{{4, 4}}) {
+		t.Fatal("unexpected progress reports", reports)
+	}
+}
+
+func TestFillProgressAggregation(t *testing.T) {
+	const total = 10 * emptyFillProgressInterval
+	var (
+		reported  []uint64
+		processed atomic.Uint64
+		wg        sync.WaitGroup
+	)
+	p := newFillProgress(total, func(filled, tot uint64) {
+		reported = append(reported, filled)
+	})
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// the workers process more than total in all, which must be capped
+			for j := 0; j < 2*total/8/100; j++ {
+				p.add(processed.Add(100))
+			}
+		}()
+	}
+	wg.Wait()
+	p.done()
+
+	if len(reported) == 0 || reported[len(reported)-1] != total {
+		t.Fatal("the last report should be total", reported)
+	}
+	for i, filled := range reported {
+		if filled > total || (i > 0 && filled <= reported[i-1]) {
+			t.Fatal("reports should increase and never exceed total", reported)
+		}
+	}
+}
+
+type reorgingL1Source struct {
+	advancingL1Source
+	reorged atomic.Bool
+}
+
+func (l1 *reorgingL1Source) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	header := &types.Header{Number: new(big.Int).Set(number)}
+	if l1.reorged.Load() {
+		header.Extra = []byte("reorged")
+	}
+	return header, nil
+}
+
+func TestStorageManager_VerifyL1Canonical(t *testing.T) {
+	sm, files := createEthStorage(contractAddress, []uint64{0}, 131072, 131072, kvEntries, common.Address{}, defaultEncodeType)
+	defer func() {
+		sm.Close()
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}()
+	l1 := &reorgingL1Source{}
+	s := NewStorageManager(sm, l1)
+	if _, err := s.VerifyL1Canonical(context.Background()); !errors.Is(err, ErrL1HashUnknown) {
+		t.Fatal("expected ErrL1HashUnknown before localL1 is set", err)
+	}
+	if err := s.Reset(100); err != nil {
+		t.Fatal("failed to reset", err)
+	}
+	if ok, err := s.VerifyL1Canonical(context.Background()); !ok || err != nil {
+		t.Fatal("localL1 should be canonical", ok, err)
+	}
+	l1.reorged.Store(true)
+	if ok, err := s.VerifyL1Canonical(context.Background()); ok || err != nil {
+		t.Fatal("localL1 should not be canonical after the reorg", ok, err)
+	}
+	if err := s.DownloadFinished(132, nil, nil, nil); err != nil {
+		t.Fatal("failed to download", err)
+	}
+	if ok, err := s.VerifyL1Canonical(context.Background()); !ok || err != nil {
+		t.Fatal("the hash should be recorded by DownloadFinished", ok, err)
+	}
+}
+
+type blockingL1Source struct {
+	advancingL1Source
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (l1 *blockingL1Source) GetStorageLastBlobIdx(blockNumber int64) (uint64, error) {
+	l1.entered <- struct{}{}
+	<-l1.release
+	return l1.advancingL1Source.GetStorageLastBlobIdx(blockNumber)
+}
+
+func TestStorageManager_CloseWaitsForDownloadFinished(t *testing.T) {
+	sm, files := createEthStorage(contractAddress, []uint64{0}, 131072, 131072, kvEntries, common.Address{}, defaultEncodeType)
+	defer func() {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}()
+	l1 := &blockingL1Source{
+		advancingL1Source: advancingL1Source{lastBlobIndex: 1},
+		entered:           make(chan struct{}),
+		release:           make(chan struct{}),
+	}
+	s := NewStorageManager(sm, l1)
+
+	blob, commit := createBlob(0)
+	downloaded := make(chan error, 1)
+	go func() {
+		downloaded <- s.DownloadFinished(100, []uint64{0}, [][]byte{blob}, []common.Hash{commit})
+	}()
+	// the blob is written, and DownloadFinished is blocked by the l1 source
+	<-l1.entered
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- s.Close()
+	}()
+	for {
+		s.opsMu.RLock()
+		closing := s.closed
+		s.opsMu.RUnlock()
+		if closing {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := s.CommitBlob(0, blob, commit); !errors.Is(err, ErrStorageClosed) {
+		t.Fatal("expected ErrStorageClosed after Close", err)
+	}
+	select {
+	case err := <-closed:
+		t.Fatal("Close should wait for DownloadFinished", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(l1.release)
+	if err := <-downloaded; err != nil {
+		t.Fatal("failed to download", err)
+	}
+	if err := <-closed; err != nil {
+		t.Fatal("failed to close", err)
+	}
+}
+
+func TestStorageManager_CloseTimeout(t *testing.T) {
+	sm, files := createEthStorage(contractAddress, []uint64{0}, 131072, 131072, kvEntries, common.Address{}, defaultEncodeType)
+	defer func() {
+		sm.Close()
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}()
+	l1 := &blockingL1Source{
+		advancingL1Source: advancingL1Source{lastBlobIndex: 1},
+		entered:           make(chan struct{}),
+		release:           make(chan struct{}),
+	}
+	s := NewStorageManager(sm, l1)
+	s.CloseTimeout = 50 * time.Millisecond
+
+	downloaded := make(chan error, 1)
+	go func() {
+		downloaded <- s.DownloadFinished(100, nil, nil, nil)
+	}()
+	<-l1.entered
+	if err := s.Close(); !errors.Is(err, ErrCloseTimeout) {
+		t.Fatal("expected ErrCloseTimeout", err)
+	}
+	close(l1.release)
+	if err := <-downloaded; err != nil {
+		t.Fatal("failed to download", err)
+	}
+}
+
+func TestStorageManager_SyncAllowlist(t *testing.T) {
+	sm, files := createEthStorage(contractAddress, []uint64{0}, 131072, 131072, kvEntries, common.Address{}, defaultEncodeType)
+	defer func() {
+		sm.Close()
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}()
+
+	l1 := &loggingL1Source{advancingL1Source: advancingL1Source{lastBlobIndex: 10}}
+	s := NewStorageManager(sm, l1)
+	s.DownloadThreadNum = 2
+	if err := s.Reset(5); err != nil {
+		t.Fatal("failed to reset", err)
+	}
+	s.SetSyncAllowlist([]uint64{5, 2})
+	if allowlist := s.SyncAllowlist(); fmt.Sprint(allowlist) != fmt.Sprint([]uint64{2, 5}) {
+		t.Fatal("unexpected allowlist", allowlist)
+	}
+	if err := s.DownloadAllMetas(context.Background(), 4); err != nil {
+		t.Fatal("failed to download metas", err)
+	}
+	if fmt.Sprint(l1.requested) != fmt.Sprint([]uint64{2, 5}) {
+		t.Fatal("only the metas of the allowed kvs should be downloaded", l1.requested)
+	}
+
+	blob2, commit2 := createBlob(2)
+	blob3, commit3 := createBlob(3)
+	if err := s.DownloadFinished(10, []uint64{2, 3}, [][]byte{blob2, blob3}, []common.Hash{commit2, commit3}); err != nil {
+		t.Fatal("failed to download", err)
+	}
+	if data, success, err := s.TryRead(2, 131072, commit2); !success || err != nil || !bytes.Equal(data, blob2) {
+		t.Fatal("failed to read the allowed kv", err)
+	}
+	if _, _, err := s.TryReadEncoded(2, 131072); err != nil {
+		t.Fatal("failed to read the allowed kv", err)
+	}
+	if _, _, err := s.TryRead(3, 131072, commit3); !errors.Is(err, ErrNotOwned) {
+		t.Fatal("expected ErrNotOwned for reading the kv not allowed", err)
+	}
+	if _, _, err := s.TryReadEncoded(3, 131072); !errors.Is(err, ErrNotOwned) {
+		t.Fatal("expected ErrNotOwned for reading the kv not allowed", err)
+	}
+	if meta, _, err := s.TryReadMeta(3); err != nil || IsFilled(common.BytesToHash(meta)) {
+		t.Fatal("the kv not allowed should not be written by DownloadFinished", err)
+	}
+	if err := s.CommitBlob(3, blob3, commit3); !errors.Is(err, ErrNotOwned) {
+		t.Fatal("expected ErrNotOwned for committing the kv not allowed", err)
+	}
+
+	s.SetSyncAllowlist(nil)
+	if _, _, err := s.TryRead(3, 131072, commit3); errors.Is(err, ErrNotOwned) {
+		t.Fatal("all the kvs should be allowed after the allowlist is cleared", err)
+	}
+}
+
+func TestStorageManager_ShardsSorted(t *testing.T) {
+	addr := common.Address{0x46}
+	sm := NewShardManager(addr, 131072, kvEntries, 131072)
+	defer delete(ContractToShardManager, addr)
+	for _, shardIdx := range []uint64{7, 2, 9, 0, 5, 11, 3} {
+		if err := sm.AddDataShard(shardIdx); err != nil {
+			t.Fatal("failed to add data shard", err)
+		}
+	}
+	expected := fmt.Sprint([]uint64{0, 2, 3, 5, 7, 9, 11})
+	s := NewStorageManager(sm, nil)
+	// the map iteration order is random, so check it a few times
+	for i := 0; i < 10; i++ {
+		if shards := s.Shards(); fmt.Sprint(shards) != expected {
+			t.Fatal("shards should be sorted", shards)
+		}
+		if shards := Shards()[addr]; fmt.Sprint(shards) != expected {
+			t.Fatal("shards should be sorted", shards)
+		}
+	}
+}
+
+func TestStorageManager_DiskTimeout(t *testing.T) {
+	setup(t)
+	storageManager.DiskTimeout = 10 * time.Second
+	defer func() {
+		storageManager.DiskTimeout = 0
+	}()
+
+	kvIdx := uint64(4)
+	blob, commit := createBlob(kvIdx)
+	storageManager.blobMetas.set(kvIdx, generateMetadata(kvIdx, 131072, commit[:]))
+	if err := storageManager.CommitBlob(kvIdx, blob, commit); err != nil {
+		t.Fatal("failed to commit blob with DiskTimeout", err)
+	}
+	if data, success, err := storageManager.TryRead(kvIdx, 131072, commit); !success || err != nil || !bytes.Equal(data, blob) {
+		t.Fatal("failed to read blob with DiskTimeout", err)
+	}
+
+	// a hung IO
+	storageManager.DiskTimeout = 50 * time.Millisecond
+	release := make(chan struct{})
+	defer close(release)
+	err := storageManager.diskIO("write", kvIdx, func() {
+		<-release
+	})
+	if !errors.Is(err, ErrStorageTimeout) {
+		t.Fatal("expected ErrStorageTimeout", err)
+	}
+}
+
+func TestStorageManager_DiskTimeoutPendingWrite(t *testing.T) {
+	sm, files := createEthStorage(contractAddress, []uint64{0}, 131072, 131072, kvEntries, common.Address{}, defaultEncodeType)
+	defer func() {
+		sm.Close()
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}()
+	s := NewStorageManager(sm, &advancingL1Source{lastBlobIndex: 10})
+	if err := s.Reset(5); err != nil {
+		t.Fatal("failed to reset", err)
+	}
+	s.DiskTimeout = 50 * time.Millisecond
+	s.CloseTimeout = 50 * time.Millisecond
+
+	// a hung write of kv 2
+	if err := s.acquire(); err != nil {
+		t.Fatal("failed to acquire", err)
+	}
+	release := make(chan struct{})
+	err := s.diskWrite("write", 2, func() {
+		<-release
+	})
+	s.release()
+	if !errors.Is(err, ErrStorageTimeout) {
+		t.Fatal("expected ErrStorageTimeout", err)
+	}
+
+	// the commits of kv 2 are refused until the hung write finishes, the other kvs are written
+	blob, commit := createBlob(2)
+	s.blobMetas.set(2, generateMetadata(2, 131072, commit[:]))
+	if err := s.CommitBlob(2, blob, commit); !errors.Is(err, ErrStorageTimeout) {
+		t.Fatal("expected ErrStorageTimeout", err)
+	}
+	blob3, commit3 := createBlob(3)
+	s.blobMetas.set(3, generateMetadata(3, 131072, commit3[:]))
+	if err := s.CommitBlob(3, blob3, commit3); err != nil {
+		t.Fatal("failed to commit blob", err)
+	}
+	if shards := s.hungShards(); !shards[0] {
+		t.Fatal("expected shard 0 pending", shards)
+	}
+
+	// Close waits for the hung write
+	if err := s.Close(); !errors.Is(err, ErrCloseTimeout) {
+		t.Fatal("expected ErrCloseTimeout", err)
+	}
+	close(release)
+	s.ops.Wait()
+	if shards := s.hungShards(); len(shards) != 0 {
+		t.Fatal("unexpected pending shards", shards)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal("failed to close", err)
+	}
+}
+
+func TestStorageManager_LocalHighestFilledIndex(t *testing.T) {
+	sm, files := createEthStorage(contractAddress, []uint64{0}, 131072, 131072, kvEntries, common.Address{}, defaultEncodeType)
+	defer func() {
+		sm.Close()
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}()
+	s := NewStorageManager(sm, &advancingL1Source{lastBlobIndex: 10})
+	if err := s.Reset(5); err != nil {
+		t.Fatal("failed to reset", err)
+	}
+	if _, err := s.LocalHighestFilledIndex(); !errors.Is(err, ErrNoSyncedKv) {
+		t.Fatal("expected ErrNoSyncedKv", err)
+	}
+
+	for _, kvIdx := range []uint64{2, 5} {
+		blob, commit := createBlob(kvIdx)
+		s.blobMetas.set(kvIdx, generateMetadata(kvIdx, 131072, commit[:]))
+		if err := s.CommitBlob(kvIdx, blob, commit); err != nil {
+			t.Fatal("failed to commit blob", err)
+		}
+	}
+	// the empty filled blob is not synced
+	s.blobMetas.set(12, newTestMeta(12, 0))
+	if _, _, err := s.CommitEmptyBlobs(12, 12); err != nil {
+		t.Fatal("failed to commit empty blobs", err)
+	}
+	if highest, err := s.LocalHighestFilledIndex(); err != nil || highest != 5 {
+		t.Fatal("unexpected highest filled index", highest, err)
+	}
+
+	blob, commit := createBlob(8)
+	s.blobMetas.set(8, generateMetadata(8, 131072, commit[:]))
+	if err := s.CommitBlob(8, blob, commit); err != nil {
+		t.Fatal("failed to commit blob", err)
+	}
+	if highest, err := s.LocalHighestFilledIndex(); err != nil || highest != 8 {
+		t.Fatal("the cache should be invalidated by the commit", highest, err)
+	}
+}
+
+func TestStorageManager_CommitBlobsStrict(t *testing.T) {
+	sm, files := createEthStorage(contractAddress, []uint64{0}, 131072, 131072, kvEntries, common.Address{}, defaultEncodeType)
+	defer func() {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}()
+	s := NewStorageManager(sm, &advancingL1Source{lastBlobIndex: 10})
+	if err := s.Reset(5); err != nil {
+		t.Fatal("failed to reset", err)
+	}
+
+	kvIndices := []uint64{2, 3, 4}
+	blobs := make([][]byte, len(kvIndices))
+	commits := make([]common.Hash, len(kvIndices))
+	for i, kvIdx := range kvIndices {
+		blobs[i], commits[i] = createBlob(kvIdx)
+		s.blobMetas.set(kvIdx, generateMetadata(kvIdx, 131072, commits[i][:]))
+	}
+	// the mismatched commit is benign
+	s.blobMetas.set(3, generateMetadata(3, 131072, common.Hash{1}.Bytes()))
+	inserted, err := s.CommitBlobsStrict(kvIndices[:2], blobs[:2], commits[:2])
+	if err != nil || fmt.Sprint(inserted) != fmt.Sprint([]uint64{2}) {
+		t.Fatal("unexpected strict commit result", inserted, err)
+	}
+
+	// the storage fails
+	ds, _ := sm.getDataShard(0)
+	ds.Close()
+	if inserted, err = s.CommitBlobs(kvIndices[2:], blobs[2:], commits[2:]); err != nil || len(inserted) != 0 {
+		t.Fatal("the lenient commit should skip the failed blob", inserted, err)
+	}
+	if inserted, err = s.CommitBlobsStrict(kvIndices[2:], blobs[2:], commits[2:]); err == nil || len(inserted) != 0 {
+		t.Fatal("the strict commit should fail", inserted, err)
+	}
+}
+
+func TestStorageManager_FetchContractMetas(t *testing.T) {
+	sm, files := createEthStorage(contractAddress, []uint64{0}, 131072, 131072, kvEntries, common.Address{}, defaultEncodeType)
+	defer func() {
+		sm.Close()
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}()
+	l1 := &loggingL1Source{advancingL1Source: advancingL1Source{lastBlobIndex: 10}}
+	s := NewStorageManager(sm, l1)
+
+	kvIndices := []uint64{1, 3, 7}
+	metas, err := s.FetchContractMetas(kvIndices, 5)
+	if err != nil {
+		t.Fatal("failed to fetch contract metas", err)
+	}
+	for i, kvIdx := range kvIndices {
+		if metas[i] != newTestMeta(kvIdx, byte(kvIdx+1)) {
+			t.Fatal("unexpected meta", kvIdx, metas[i])
+		}
+		if _, ok := s.blobMetas.get(kvIdx); ok {
+			t.Fatal("the fetched metas should not be cached", kvIdx)
+		}
+	}
+	if fmt.Sprint(l1.requested) != fmt.Sprint(kvIndices) {
+		t.Fatal("unexpected requested metas", l1.requested)
+	}
+}
+
+func TestStorageManager_CodecMetrics(t *testing.T) {
+	setup(t)
+	m := &recordingMetrics{methods: make(map[string]int), codecs: make(map[string]int)}
+	storageManager.SetMetrics(m)
+	defer storageManager.SetMetrics(nil)
+
+	kvIdx := uint64(4)
+	blob, commit := createBlob(kvIdx)
+	storageManager.blobMetas.set(kvIdx, generateMetadata(kvIdx, 131072, commit[:]))
+	if err := storageManager.CommitBlob(kvIdx, blob, commit); err != nil {
+		t.Fatal("failed to commit blob", err)
+	}
+	encoded, _, err := storageManager.TryReadEncoded(kvIdx, int(storageManager.MaxKvSize()))
+	if err != nil {
+		t.Fatal("failed to read encoded blob", err)
+	}
+	miner, _ := storageManager.GetShardMiner(0)
+	decoded, _, err := storageManager.DecodeKV(kvIdx, encoded, prepareCommit(commit), miner, defaultEncodeType)
+	if err != nil || !bytes.Equal(decoded[:len(blob)], blob) {
+		t.Fatal("failed to decode blob", err)
+	}
+	if m.codecs[CodecEncode] != 1 || m.codecs[CodecDecode] != 1 {
+		t.Fatal("codec operations should be recorded", m.codecs)
+	}
+}
+
+func TestStorageManager_HashSize(t *testing.T) {
+	for _, size := range []int{HashSizeInContract, maxHashSizeInContract} {
+		t.Run(fmt.Sprintf("size%d", size), func(t *testing.T) {
+			setup(t)
+			if err := storageManager.SetHashSize(size); err != nil {
+				t.Fatal("failed to set hash size", err)
+			}
+			contractMeta := func(kvIdx uint64, commit common.Hash) common.Hash {
+				meta := [32]byte{}
+				if err := putMetaKvIdx(&meta, kvIdx); err != nil {
+					t.Fatal(err)
+				}
+				copy(meta[32-size:], commit[:size])
+				return meta
+			}
+
+			kvIdx := uint64(4)
+			blob, commit := createBlob(kvIdx)
+			storageManager.blobMetas.set(kvIdx, contractMeta(kvIdx, commit))
+			if err := storageManager.CommitBlob(kvIdx, blob, commit); err != nil {
+				t.Fatal("failed to commit blob", err)
+			}
+			m, _, err := storageManager.shardManager.TryReadMeta(kvIdx)
+			if err != nil || common.BytesToHash(m) != prepareCommitN(commit, size) {
+				t.Fatal("unexpected local meta", common.BytesToHash(m), err)
+			}
+			data, _, err := storageManager.TryReadVerified(kvIdx, len(blob))
+			if err != nil || !bytes.Equal(data, blob) {
+				t.Fatal("failed to read verified blob", err)
+			}
+			if _, _, err = storageManager.TryReadEncoded(kvIdx, len(blob)); err != nil {
+				t.Fatal("failed to read encoded blob", err)
+			}
+			info, err := storageManager.BlobInfo(kvIdx)
+			if err != nil || !info.Synced || !bytes.Equal(info.LocalCommit, commit[:size]) ||
+				!bytes.Equal(info.ContractCommit, commit[:size]) {
+				t.Fatal("unexpected blob info", info, err)
+			}
+
+			// the contract commit differs from the blob only in the last byte kept with the size
+			kvIdx = 5
+			blob, commit = createBlob(kvIdx)
+			meta := contractMeta(kvIdx, commit)
+			meta[31] ^= 0xff
+			storageManager.blobMetas.set(kvIdx, meta)
+			if err = storageManager.CommitBlob(kvIdx, blob, commit); !errors.Is(err, ErrCommitMismatch) {
+				t.Fatal("expected ErrCommitMismatch", err)
+			}
+		})
+	}
+
+	setup(t)
+	for _, size := range []int{HashSizeInContract - 1, maxHashSizeInContract + 1} {
+		if err := storageManager.SetHashSize(size); !errors.Is(err, ErrInvalidHashSize) {
+			t.Fatal("expected ErrInvalidHashSize", size, err)
+		}
+	}
+	if storageManager.HashSize() != HashSizeInContract {
+		t.Fatal("unexpected hash size", storageManager.HashSize())
+	}
+}
+
+func TestStorageManager_ExportBlobWrapper(t *testing.T) {
+	setup(t)
+
+	blob, _ := createBlob(1)
+	w, err := storageManager.ExportBlobWrapper(1)
+	if err != nil {
+		t.Fatal("failed to export blob wrapper", err)
+	}
+	if !bytes.Equal(w.Blob[:], blob) {
+		t.Fatal("unexpected blob data")
+	}
+	commitment, err := kzg4844.BlobToCommitment(w.Blob)
+	if err != nil || commitment != w.Commitment {
+		t.Fatal("unexpected commitment", err)
+	}
+	if err = kzg4844.VerifyBlobProof(w.Blob, w.Commitment, w.Proof); err != nil {
+		t.Fatal("failed to verify blob proof", err)
+	}
+	versionedHash, err := blobVersionedHash(blob)
+	if err != nil || versionedHash != w.VersionedHash {
+		t.Fatal("unexpected versioned hash", w.VersionedHash, err)
+	}
+
+	if _, err = storageManager.ExportBlobWrapper(5); err == nil {
+		t.Fatal("exporting a blob not synced should fail")
+	}
+}
+
+func TestSubsystemLogLevel(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		records []*log.Record
+	)
+	root := log.Root().GetHandler()
+	log.Root().SetHandler(log.FuncHandler(func(r *log.Record) error {
+		mu.Lock()
+		defer mu.Unlock()
+		records = append(records, r)
+		return nil
+	}))
+	defer log.Root().SetHandler(root)
+
+	if err := SetLogLevel(LogSubsystemMeta, log.LvlWarn); err != nil {
+		t.Fatal("failed to set log level", err)
+	}
+	defer SetLogLevel(LogSubsystemMeta, log.LvlTrace)
+	metaLog.Info("quieted")
+	metaLog.Error("kept")
+	commitLog.Info("kept")
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(records) != 2 || records[0].Msg != "kept" || records[1].Msg != "kept" {
+		t.Fatal("unexpected records", len(records))
+	}
+	if len(records[1].Ctx) < 2 || records[1].Ctx[0] != "subsystem" || records[1].Ctx[1] != LogSubsystemCommit {
+		t.Fatal("unexpected context", records[1].Ctx)
+	}
+
+	if err := SetLogLevel("p2p", log.LvlWarn); !errors.Is(err, ErrUnknownLogSubsystem) {
+		t.Fatal("expected ErrUnknownLogSubsystem", err)
+	}
+	levels, err := ParseLogLevels(" meta=warn, commit=DEBUG,")
+	if err != nil || len(levels) != 2 || levels[LogSubsystemMeta] != log.LvlWarn || levels[LogSubsystemCommit] != log.LvlDebug {
+		t.Fatal("unexpected levels", levels, err)
+	}
+	for _, s := range []string{"meta", "meta=loud", "p2p=warn"} {
+		if _, err = ParseLogLevels(s); err == nil {
+			t.Fatal("parsing invalid levels should fail", s)
+		}
+	}
+}
+
+func TestStorageManager_EstimateSyncETA(t *testing.T) {
+	setup(t)
+	clock := &fakeClock{now: time.Unix(1000000, 0)}
+	storageManager.Clock = clock
+
+	// the blobs committed by setup are out of the window of the fake clock
+	if _, err := storageManager.EstimateSyncETA(); !errors.Is(err, ErrInsufficientThroughput) {
+		t.Fatal("expected ErrInsufficientThroughput", err)
+	}
+
+	kvIdx := uint64(4)
+	blob, commit := createBlob(kvIdx)
+	storageManager.blobMetas.set(kvIdx, generateMetadata(kvIdx, 131072, commit[:]))
+	if err := storageManager.CommitBlob(kvIdx, blob, commit); err != nil {
+		t.Fatal("failed to commit blob", err)
+	}
+	clock.advance(10 * time.Second)
+	if _, err := storageManager.EstimateSyncETA(); !errors.Is(err, ErrInsufficientThroughput) {
+		t.Fatal("expected ErrInsufficientThroughput with a short span", err)
+	}
+
+	// 1 blob per minute, with the blobs 5 to 15 remaining
+	clock.advance(50 * time.Second)
+	eta, err := storageManager.EstimateSyncETA()
+	if err != nil || eta != 11*time.Minute {
+		t.Fatal("unexpected eta", eta, err)
+	}
+
+	clock.advance(10 * time.Minute)
+	if _, err = storageManager.EstimateSyncETA(); !errors.Is(err, ErrInsufficientThroughput) {
+		t.Fatal("expected ErrInsufficientThroughput after the window", err)
+	}
+
+	storageManager.mu.Lock()
+	storageManager.lastKvIdx = kvIdx + 1
+	storageManager.mu.Unlock()
+	if eta, err = storageManager.EstimateSyncETA(); err != nil || eta != 0 {
+		t.Fatal("expected 0 when synced", eta, err)
+	}
+}
+
+func TestStorageManager_CommitBlobByVersionedHash(t *testing.T) {
+	setup(t)
+
+	kvIdx := uint64(4)
+	blob, _ := createBlob(kvIdx)
+	versionedHash, err := blobVersionedHash(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storageManager.blobMetas.set(kvIdx, generateMetadata(kvIdx, 131072, versionedHash[:]))
+
+	other, _ := createBlob(kvIdx + 1)
+	if err = storageManager.CommitBlobByVersionedHash(kvIdx, other, versionedHash); !errors.Is(err, ErrVersionedHashMismatch) {
+		t.Fatal("expected ErrVersionedHashMismatch", err)
+	}
+	if err = storageManager.CommitBlobByVersionedHash(kvIdx, blob, versionedHash); err != nil {
+		t.Fatal("failed to commit blob by versioned hash", err)
+	}
+	data, hash, _, err := storageManager.TryReadWithVersionedHash(kvIdx)
+	if err != nil || !bytes.Equal(data, blob) || hash != versionedHash {
+		t.Fatal("unexpected blob read", hash, err)
+	}
+}
+
+func TestStorageManager_RepairDivergentBlobs(t *testing.T) {
+	setup(t)
+
+	// the contract commits of kv 2 and 3 changed without the local data updated, and kv 4 is not synced
+	blob, commit := createBlob(100)
+	storageManager.blobMetas.set(2, generateMetadata(2, 131072, commit[:]))
+	storageManager.blobMetas.set(3, newTestMeta(3, 0))
+	_, commit4 := createBlob(4)
+	storageManager.blobMetas.set(4, generateMetadata(4, 131072, commit4[:]))
+
+	var fetched []uint64
+	fetch := func(ctx context.Context, kvIdx uint64, c common.Hash) ([]byte, error) {
+		fetched = append(fetched, kvIdx)
+		if !bytes.Equal(c[:HashSizeInContract], commit[:HashSizeInContract]) {
+			return nil, errors.New("unexpected commit")
+		}
+		return blob, nil
+	}
+	res, err := storageManager.RepairDivergentBlobs(context.Background(), fetch)
+	if err != nil || res.Divergent != 2 || res.Repaired != 2 || len(res.Failed) != 0 {
+		t.Fatal("unexpected repair result", res, err)
+	}
+	if len(fetched) != 1 || fetched[0] != 2 {
+		t.Fatal("unexpected fetched blobs", fetched)
+	}
+	data, _, err := storageManager.TryReadVerified(2, len(blob))
+	if err != nil || !bytes.Equal(data, blob) {
+		t.Fatal("blob not repaired", err)
+	}
+	if info, err := storageManager.BlobInfo(3); err != nil || !info.Empty {
+		t.Fatal("blob not repaired to empty", info, err)
+	}
+
+	// nothing diverges once repaired
+	if res, err = storageManager.RepairDivergentBlobs(context.Background(), fetch); err != nil || res.Divergent != 0 {
+		t.Fatal("unexpected repair result", res, err)
+	}
+
+	// the blobs failed to fetch are reported
+	_, commit = createBlob(101)
+	storageManager.blobMetas.set(1, generateMetadata(1, 131072, commit[:]))
+	failing := func(ctx context.Context, kvIdx uint64, c common.Hash) ([]byte, error) {
+		return nil, errors.New("not found")
+	}
+	res, err = storageManager.RepairDivergentBlobs(context.Background(), failing)
+	if err != nil || res.Divergent != 1 || res.Repaired != 0 || len(res.Failed) != 1 || res.Failed[0] != 1 {
+		t.Fatal("unexpected repair result", res, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = storageManager.RepairDivergentBlobs(ctx, fetch); !errors.Is(err, context.Canceled) {
+		t.Fatal("expected context.Canceled", err)
+	}
+}
+
+func TestStorageManager_PrewarmShard(t *testing.T) {
+	setup(t)
+
+	n, err := storageManager.PrewarmShard(context.Background(), 0)
+	if err != nil {
+		t.Fatal("failed to prewarm shard", err)
+	}
+	ds, _ := storageManager.shardManager.getDataShard(0)
+	info, err := ds.dataFiles[0].file.Stat()
+	if err != nil || n != uint64(info.Size()) {
+		t.Fatal("unexpected bytes read", n, err)
+	}
+
+	if _, err = storageManager.PrewarmShard(context.Background(), 1); !errors.Is(err, ErrShardNotManaged) {
+		t.Fatal("expected ErrShardNotManaged", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = storageManager.PrewarmShard(ctx, 0); !errors.Is(err, context.Canceled) {
+		t.Fatal("expected context.Canceled", err)
+	}
+}
+
+func TestStorageManager_CommitBlobsOrder(t *testing.T) {
+	setup(t)
+
+	kvIndices := []uint64{6, 4, 5, 4, 7}
+	blobs := make([][]byte, len(kvIndices))
+	commits := make([]common.Hash, len(kvIndices))
+	for i, kvIdx := range kvIndices {
+		blobs[i], commits[i] = createBlob(kvIdx)
+		storageManager.blobMetas.set(kvIdx, generateMetadata(kvIdx, 131072, commits[i][:]))
+	}
+	// the commit of kv 5 is changed in the contract
+	_, other := createBlob(100)
+	storageManager.blobMetas.set(5, generateMetadata(5, 131072, other[:]))
+
+	inserted, err := storageManager.CommitBlobs(kvIndices, blobs, commits)
+	if err != nil {
+		t.Fatal("failed to commit blobs", err)
+	}
+	expected := []uint64{6, 4, 4, 7}
+	if len(inserted) != len(expected) {
+		t.Fatal("unexpected inserted", inserted)
+	}
+	for i := range expected {
+		if inserted[i] != expected[i] {
+			t.Fatal("inserted is not in the input order", inserted)
+		}
+	}
+}
+
+type xorSampleHasher struct {
+	indices []uint64
+}
+
+func (h *xorSampleHasher) HashSample(sampleIdx uint64, raw []byte) common.Hash {
+	h.indices = append(h.indices, sampleIdx)
+	sample := common.BytesToHash(raw)
+	for i := range sample {
+		sample[i] ^= 0xff
+	}
+	return sample
+}
+
+func TestShardManager_SampleHasher(t *testing.T) {
+	setup(t)
+
+	sampleIdx := uint64(1) << (storageManager.shardManager.kvSizeBits - 5)
+	raw, err := storageManager.ReadSampleUnlocked(0, sampleIdx)
+	if err != nil {
+		t.Fatal("failed to read sample", err)
+	}
+
+	h := &xorSampleHasher{}
+	storageManager.shardManager.SetSampleHasher(h)
+	sample, err := storageManager.ReadSampleUnlocked(0, sampleIdx)
+	if err != nil {
+		t.Fatal("failed to read sample", err)
+	}
+	for i := range sample {
+		if sample[i] != raw[i]^0xff {
+			t.Fatal("sample is not computed by the hasher", sample, raw)
+		}
+	}
+	if len(h.indices) != 1 || h.indices[0] != sampleIdx {
+		t.Fatal("unexpected sample indices", h.indices)
+	}
+
+	// the shards added later use the hasher too
+	if err = storageManager.shardManager.AddDataShard(1); err != nil {
+		t.Fatal(err)
+	}
+	if ds, _ := storageManager.shardManager.getDataShard(1); ds.sampleHasher != h {
+		t.Fatal("the hasher is not set to the added shard")
+	}
+
+	storageManager.shardManager.SetSampleHasher(nil)
+	if sample, err = storageManager.ReadSampleUnlocked(0, sampleIdx); err != nil || sample != raw {
+		t.Fatal("unexpected raw sample", sample, err)
+	}
+}
+
+func TestStorageManager_CompactShard(t *testing.T) {
+	setup(t)
+	ds, _ := storageManager.shardManager.getDataShard(0)
+	name := ds.dataFiles[0].file.Name()
+	tmpName := name + compactFileSuffix
+	progressName := tmpName + compactProgressSuffix
+	// the data file is renamed from the compacted file after it has been removed by setup
+	placeDataFile(t, name)
+	defer os.Remove(name)
+	defer os.Remove(tmpName)
+	defer os.Remove(progressName)
+
+	// an interrupted compaction leaves the data file intact
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := storageManager.CompactShard(ctx, 0); !errors.Is(err, context.Canceled) {
+		t.Fatal("expected context.Canceled", err)
+	}
+	if _, err := os.Stat(tmpName); err != nil {
+		t.Fatal("the compacted file should be kept to resume", err)
+	}
+
+	// resume from a progress covering all the kvs, none of which has been copied actually
+	if err := os.WriteFile(progressName, []byte{0, 0, 0, 0, 0, 0, 0, byte(kvEntries)}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := storageManager.CompactShard(context.Background(), 0); err != nil {
+		t.Fatal("failed to compact shard", err)
+	}
+	if _, err := os.Stat(tmpName); !os.IsNotExist(err) {
+		t.Fatal("the compacted file should be renamed", err)
+	}
+	if _, err := os.Stat(progressName); !os.IsNotExist(err) {
+		t.Fatal("the progress should be removed", err)
+	}
+
+	for _, kvIdx := range []uint64{1, 2, 3} {
+		blob, _ := createBlob(kvIdx)
+		data, _, err := storageManager.TryReadVerified(kvIdx, len(blob))
+		if err != nil || !bytes.Equal(data, blob) {
+			t.Fatal("blob not kept by compaction", kvIdx, err)
+		}
+	}
+
+	// the compacted file is served and written as usual
+	kvIdx := uint64(4)
+	blob, commit := createBlob(kvIdx)
+	storageManager.blobMetas.set(kvIdx, generateMetadata(kvIdx, 131072, commit[:]))
+	if err := storageManager.CommitBlob(kvIdx, blob, commit); err != nil {
+		t.Fatal("failed to commit blob", err)
+	}
+	if data, _, err := storageManager.TryReadVerified(kvIdx, len(blob)); err != nil || !bytes.Equal(data, blob) {
+		t.Fatal("failed to read blob committed after compaction", err)
+	}
+
+	if err := storageManager.CompactShard(context.Background(), 1); !errors.Is(err, ErrShardNotManaged) {
+		t.Fatal("expected ErrShardNotManaged", err)
+	}
+}
+
+// placeDataFile places an empty file at the path of a data file removed by setup, so replaceDataFile can link it to
+// the backup while the data file is replaced.
+func placeDataFile(t *testing.T, name string) {
+	if err := os.WriteFile(name, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStorageManager_CompactShardReopenFailure(t *testing.T) {
+	setup(t)
+	storageManager.DataDir = t.TempDir()
+	if err := storageManager.AddShard(1, common.Address{}, defaultEncodeType); err != nil {
+		t.Fatal("failed to add shard", err)
+	}
+	ds, _ := storageManager.shardManager.getDataShard(1)
+	df := ds.dataFiles[0]
+	name := df.file.Name()
+
+	// the compacted file fails to open as it has no header, so the data file is restored
+	tmpName := name + compactFileSuffix
+	if err := os.WriteFile(tmpName, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	storageManager.mu.Lock()
+	err := replaceDataFile(ds, df, tmpName)
+	storageManager.mu.Unlock()
+	if err == nil {
+		t.Fatal("replacing with a bad file should fail")
+	}
+	if ds.dataFiles[0] != df {
+		t.Fatal("the data file should be kept")
+	}
+	info, err := os.Stat(name)
+	if err != nil {
+		t.Fatal("the data file should be restored", err)
+	}
+	if opened, _ := df.file.Stat(); !os.SameFile(info, opened) {
+		t.Fatal("the data file should be the one written by the shard")
+	}
+	if _, err = os.Stat(name + compactBackupSuffix); !os.IsNotExist(err) {
+		t.Fatal("the backup should be renamed back", err)
+	}
+
+	// the commits still go to the data file, which is read by a restarted node
+	kvIdx := kvEntries + 1
+	if err = storageManager.DownloadFinished(97529, []uint64{kvIdx}, [][]byte{{10}}, []common.Hash{{1, 2, 3}}); err != nil {
+		t.Fatal("failed to download", err)
+	}
+	if err = storageManager.RemoveShard(1, false); err != nil {
+		t.Fatal("failed to remove shard", err)
+	}
+	reopened, err := OpenDataFile(name)
+	if err != nil {
+		t.Fatal("failed to open data file", err)
+	}
+	defer reopened.Close()
+	if meta, err := reopened.ReadMeta(kvIdx); err != nil || !isFilledN([32]byte(meta), storageManager.hashSize()) {
+		t.Fatal("the blob should be written to the data file", err)
+	}
+}
+
+func TestStorageManager_CompactShardExclusive(t *testing.T) {
+	setup(t)
+	ds, _ := storageManager.shardManager.getDataShard(0)
+	name := ds.dataFiles[0].file.Name()
+
+	storageManager.mu.Lock()
+	storageManager.compacting[0] = true
+	storageManager.mu.Unlock()
+	if err := storageManager.CompactShard(context.Background(), 0); !errors.Is(err, ErrShardCompacting) {
+		t.Fatal("expected ErrShardCompacting", err)
+	}
+	storageManager.mu.Lock()
+	delete(storageManager.compacting, 0)
+	storageManager.mu.Unlock()
+
+	// the compaction would keep the stale data of the kvs re-encoded with their metas unchanged
+	progressFile := name + reEncodeFileSuffix
+	if err := writeReEncodeProgress(progressFile, &reEncodeProgress{Next: 2}); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(progressFile)
+	if err := storageManager.CompactShard(context.Background(), 0); err == nil || !strings.Contains(err.Error(), "re-encoding") {
+		t.Fatal("the compaction should be rejected during a re-encoding", err)
+	}
+	if _, err := os.Stat(name + compactFileSuffix); !os.IsNotExist(err) {
+		t.Fatal("the compaction should not start", err)
+	}
+}
+
+// readSamplesUntil reads the samples of kvs 1-3 of shard 0 by ReadSampleUnlocked until stop is closed, and returns
+// the first error. It returns once the reads have started.
+func readSamplesUntil(stop <-chan struct{}) <-chan error {
+	done := make(chan error, 1)
+	started := make(chan struct{})
+	samplesPerKv := storageManager.shardManager.kvSize / 32
+	go func() {
+		for i := uint64(0); ; i++ {
+			if i == 1 {
+				close(started)
+			}
+			select {
+			case <-stop:
+				done <- nil
+				return
+			default:
+			}
+			sampleIdx := (1+i%3)*samplesPerKv + i%samplesPerKv
+			if _, err := storageManager.ReadSampleUnlocked(0, sampleIdx); err != nil {
+				done <- err
+				return
+			}
+		}
+	}()
+	<-started
+	return done
+}
+
+func TestStorageManager_CompactShardConcurrentSamples(t *testing.T) {
+	setup(t)
+	ds, _ := storageManager.shardManager.getDataShard(0)
+	name := ds.dataFiles[0].file.Name()
+	// the data file is renamed from the compacted file after it has been removed by setup
+	placeDataFile(t, name)
+	defer os.Remove(name)
+
+	// the mining reads the samples without the lock while the data file is replaced
+	stop := make(chan struct{})
+	done := readSamplesUntil(stop)
+	for i := 0; i < 20; i++ {
+		if err := storageManager.CompactShard(context.Background(), 0); err != nil {
+			t.Fatal("failed to compact shard", err)
+		}
+	}
+	close(stop)
+	if err := <-done; err != nil {
+		t.Fatal("failed to read sample during the compaction", err)
+	}
+}
+
+func TestStorageManager_MetasReady(t *testing.T) {
+	setup(t)
+	storageManager.MetasRequired = true
+
+	if storageManager.MetasReady() {
+		t.Fatal("metas should not be ready before downloaded")
+	}
+	if _, _, err := storageManager.TryReadEncoded(5, 1); !errors.Is(err, ErrMetasNotLoaded) {
+		t.Fatal("expected ErrMetasNotLoaded", err)
+	}
+	if _, _, err := storageManager.TryReadVerified(5, 1); !errors.Is(err, ErrMetasNotLoaded) {
+		t.Fatal("expected ErrMetasNotLoaded", err)
+	}
+	// the synced blobs are served regardless
+	if _, _, err := storageManager.TryReadEncoded(1, 1); err != nil {
+		t.Fatal("failed to read synced blob", err)
+	}
+
+	if err := storageManager.DownloadAllMetas(context.Background(), 4); err != nil {
+		t.Fatal("failed to download metas", err)
+	}
+	if !storageManager.MetasReady() {
+		t.Fatal("metas should be ready once downloaded")
+	}
+	if _, _, err := storageManager.TryReadEncoded(5, 1); err == nil || errors.Is(err, ErrMetasNotLoaded) {
+		t.Fatal("expected the error of a blob not synced", err)
+	}
+}
+
+func TestStorageManager_CommitBlobsUnmanagedShard(t *testing.T) {
+	sm, files := createEthStorage(contractAddress, []uint64{0}, 131072, 131072, kvEntries, common.Address{}, defaultEncodeType)
+	defer func() {
+		sm.Close()
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}()
+	s := NewStorageManager(sm, &advancingL1Source{lastBlobIndex: 2 * kvEntries})
+	if err := s.Reset(5); err != nil {
+		t.Fatal("failed to reset", err)
+	}
+
+	// the kv of shard 1 fails to encode without an error, and is skipped with ErrShardNotManaged
+	blob, hash := createBlob(kvEntries)
+	inserted, err := s.CommitBlobs([]uint64{kvEntries}, [][]byte{blob}, []common.Hash{hash})
+	if err != nil || len(inserted) != 0 {
+		t.Fatal("blob of an unmanaged shard should be skipped", inserted, err)
+	}
+}
+
+func TestWarnLimiter(t *testing.T) {
+	var records []*log.Record
+	logger := log.New()
+	logger.SetHandler(log.FuncHandler(func(r *log.Record) error {
+		records = append(records, r)
+		return nil
+	}))
+	l := newWarnLimiter(logger, time.Minute)
+
+	now := time.Unix(1000000, 0)
+	for i := 0; i < 3; i++ {
+		l.warn(now.Add(time.Duration(i)*time.Second), "Blob encode failed", 3, "index", i)
+	}
+	l.warn(now, "Blob encode failed", 4, "index", 0)
+	if len(records) != 2 {
+		t.Fatal("repeated warnings should be aggregated", len(records))
+	}
+
+	l.warn(now.Add(61*time.Second), "Blob encode failed", 3, "index", 3)
+	if len(records) != 3 {
+		t.Fatal("warning should be logged after the interval", len(records))
+	}
+	ctx := records[2].Ctx
+	if len(ctx) != 8 || ctx[0] != "shard" || ctx[1] != uint64(3) || ctx[4] != "repeated" || ctx[5] != uint64(3) ||
+		ctx[7] != 61*time.Second {
+		t.Fatal("unexpected context", ctx)
+	}
+}
+
+func TestWarnLimiter_FlushBurst(t *testing.T) {
+	var records []*log.Record
+	logger := log.New()
+	logger.SetHandler(log.FuncHandler(func(r *log.Record) error {
+		records = append(records, r)
+		return nil
+	}))
+	l := newWarnLimiter(logger, time.Minute)
+
+	// a burst of 5 warnings of shard 3 stops, and only a warning of another shard comes after the interval
+	now := time.Unix(1000000, 0)
+	for i := 0; i < 5; i++ {
+		l.warn(now.Add(time.Duration(i)*time.Second), "Blob encode failed", 3, "index", i)
+	}
+	l.warn(now.Add(30*time.Second), "Blob skipped", 4, "index", 0)
+	if len(records) != 2 {
+		t.Fatal("repeated warnings should be aggregated", len(records))
+	}
+
+	l.warn(now.Add(61*time.Second), "Blob skipped", 4, "index", 1)
+	if len(records) != 3 {
+		t.Fatal("count of the burst should be flushed", len(records))
+	}
+	r := records[2]
+	if r.Msg != "Blob encode failed" || len(r.Ctx) != 6 || r.Ctx[1] != uint64(3) || r.Ctx[2] != "repeated" ||
+		r.Ctx[3] != uint64(4) || r.Ctx[5] != time.Minute {
+		t.Fatal("unexpected flushed count", r.Msg, r.Ctx)
+	}
+
+	// the count is flushed once, and the next warning of the burst is logged as a new one
+	l.warn(now.Add(62*time.Second), "Blob encode failed", 3, "index", 5)
+	if len(records) != 4 || len(records[3].Ctx) != 4 {
+		t.Fatal("warning should be logged without a count", len(records))
+	}
+}
+
+func TestStorageManager_ResetAndInvalidateMetas(t *testing.T) {
+	sm, files := createEthStorage(contractAddress, []uint64{0}, 131072, 131072, kvEntries, common.Address{}, defaultEncodeType)
+	defer func() {
+		sm.Close()
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}()
+
+	l1 := &loggingL1Source{advancingL1Source: advancingL1Source{lastBlobIndex: 10}, updated: []uint64{1, 3}}
+	s := NewStorageManager(sm, l1)
+	if err := s.Reset(5); err != nil {
+		t.Fatal("failed to reset", err)
+	}
+	if err := s.DownloadAllMetas(context.Background(), 4); err != nil {
+		t.Fatal("failed to download metas", err)
+	}
+
+	// Reset keeps the metas, even those updated since
+	if err := s.Reset(6); err != nil {
+		t.Fatal("failed to reset", err)
+	}
+	if !s.MetasReady() || s.blobMetas.len() != 10 {
+		t.Fatal("Reset should keep the metas", s.blobMetas.len())
+	}
+
+	// the kvs 1 and 3 are updated and the kv 9 is removed at the new block
+	l1.mu.Lock()
+	l1.lastBlobIndex = 9
+	l1.mu.Unlock()
+	dropped, err := s.ResetAndInvalidateMetas(7)
+	if err != nil || dropped != 3 {
+		t.Fatal("unexpected dropped metas", dropped, err)
+	}
+	if s.MetasReady() || s.LastKvIndex() != 9 {
+		t.Fatal("unexpected state after reset", s.MetasReady(), s.LastKvIndex())
+	}
+	s.mu.Lock()
+	for idx := uint64(0); idx < 10; idx++ {
+		_, ok := s.blobMetas.get(idx)
+		if ok == (idx == 1 || idx == 3 || idx == 9) {
+			s.mu.Unlock()
+			t.Fatal("unexpected meta kept", idx, ok)
+		}
+	}
+	s.mu.Unlock()
+	// the commits of the dropped metas fail until downloaded again
+	blob, commit := createBlob(1)
+	if err = s.CommitBlob(1, blob, commit); err == nil {
+		t.Fatal("commit of a stale meta should fail")
+	}
+
+	// all the metas are dropped if the updated kvs cannot be found
+	s2 := NewStorageManager(sm, &l1.advancingL1Source)
+	if err = s2.Reset(5); err != nil {
+		t.Fatal("failed to reset", err)
+	}
+	if err = s2.DownloadAllMetas(context.Background(), 4); err != nil {
+		t.Fatal("failed to download metas", err)
+	}
+	if dropped, err = s2.ResetAndInvalidateMetas(6); err != nil || dropped != 9 || s2.blobMetas.len() != 0 {
+		t.Fatal("unexpected dropped metas", dropped, err)
+	}
+}
+
+// BenchmarkStorageManager_ReadDuringMetaDownload measures the latency of the reads while the metas are downloaded
+// continuously, which write blobMetas without s.mu.
+func BenchmarkStorageManager_ReadDuringMetaDownload(b *testing.B) {
+	sm, files := createEthStorage(contractAddress, []uint64{0}, 131072, 131072, kvEntries, common.Address{}, defaultEncodeType)
+	defer func() {
+		sm.Close()
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}()
+	s := NewStorageManager(sm, &advancingL1Source{lastBlobIndex: kvEntries})
+	if err := s.Reset(5); err != nil {
+		b.Fatal("failed to reset", err)
+	}
+	blob, commit := createBlob(2)
+	s.blobMetas.set(2, generateMetadata(2, 131072, commit[:]))
+	if err := s.CommitBlob(2, blob, commit); err != nil {
+		b.Fatal("failed to commit blob", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for ctx.Err() == nil {
+			s.DownloadAllMetas(ctx, 1)
+		}
+	}()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.TryReadVerified(2, 131072)
+	}
+	b.StopTimer()
+	cancel()
+	<-done
+}
+
+func BenchmarkStorageManager_StreamShardMetas(b *testing.B) {
+	// the metas of a full shard of 256K kvs as with 128KB blobs, with small kvs so the data file is small
+	const entries = 256 * 1024
+	sm, files := createEthStorage(contractAddress, []uint64{0}, 128, 128, entries, common.Address{}, defaultEncodeType)
+	defer func() {
+		sm.Close()
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}()
+	s := NewStorageManager(sm, &advancingL1Source{lastBlobIndex: entries})
+	for i := uint64(0); i < entries; i++ {
+		s.blobMetas.set(i, newTestMeta(i, byte(i)))
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		count := 0
+		if err := s.StreamShardMetas(0, func(uint64, [32]byte) error {
+			count++
+			return nil
+		}); err != nil {
+			b.Fatal("failed to stream metas", err)
+		}
+		if count != entries {
+			b.Fatal("unexpected number of metas", count)
+		}
+	}
+}
+
+func BenchmarkStorageManager_ConcurrentReads(b *testing.B) {
+	sm, files := createEthStorage(contractAddress, []uint64{0}, 131072, 131072, kvEntries, common.Address{}, defaultEncodeType)
+	defer func() {
+		sm.Close()
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}()
+	s := NewStorageManager(sm, &advancingL1Source{lastBlobIndex: kvEntries})
+	if err := s.Reset(5); err != nil {
+		b.Fatal("failed to reset", err)
+	}
+	const kvs = 4
+	commits := make([]common.Hash, kvs)
+	for kvIdx := uint64(0); kvIdx < kvs; kvIdx++ {
+		var blob []byte
+		blob, commits[kvIdx] = createBlob(kvIdx)
+		s.blobMetas.set(kvIdx, generateMetadata(kvIdx, 131072, commits[kvIdx][:]))
+		if err := s.CommitBlob(kvIdx, blob, commits[kvIdx]); err != nil {
+			b.Fatal("failed to commit blob", err)
+		}
+	}
+
+	var next atomic.Uint64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			kvIdx := next.Add(1) % kvs
+			if _, _, err := s.TryRead(kvIdx, 131072, commits[kvIdx]); err != nil {
+				b.Error("failed to read blob", err)
+				return
+			}
+		}
+	})
+}
+
+func TestShardManager_MaskCache(t *testing.T) {
+	sm, files := createEthStorage(contractAddress, []uint64{0}, 131072, 131072, kvEntries, common.Address{}, defaultEncodeType)
+	defer func() {
+		sm.Close()
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}()
+	s := NewStorageManager(sm, &advancingL1Source{lastBlobIndex: kvEntries})
+	if err := s.Reset(5); err != nil {
+		t.Fatal("failed to reset", err)
+	}
+	blobs := make([][]byte, 2)
+	commits := make([]common.Hash, 2)
+	for kvIdx := uint64(0); kvIdx < 2; kvIdx++ {
+		blobs[kvIdx], commits[kvIdx] = createBlob(kvIdx)
+		s.blobMetas.set(kvIdx, generateMetadata(kvIdx, 131072, commits[kvIdx][:]))
+		if err := s.CommitBlob(kvIdx, blobs[kvIdx], commits[kvIdx]); err != nil {
+			t.Fatal("failed to commit blob", err)
+		}
+	}
+
+	sm.SetMaskCache(1)
+	ds, _ := sm.getDataShard(0)
+	if ds.masks == nil || ds.masks != sm.masks {
+		t.Fatal("the mask cache should be set to the shards")
+	}
+	// the reads with the masks cached or evicted are the same as those without the cache
+	for _, kvIdx := range []uint64{0, 0, 1, 0} {
+		data, _, err := s.TryRead(kvIdx, 131072, commits[kvIdx])
+		if err != nil {
+			t.Fatal("failed to read blob", err)
+		}
+		if !bytes.Equal(data, blobs[kvIdx]) {
+			t.Fatal("unexpected blob read with the mask cache", kvIdx)
+		}
+		var buf bytes.Buffer
+		if _, err = s.TryReadTo(kvIdx, &buf, 100, 200, commits[kvIdx]); err != nil {
+			t.Fatal("failed to read blob", err)
+		}
+		if !bytes.Equal(buf.Bytes(), blobs[kvIdx][100:300]) {
+			t.Fatal("unexpected range read with the mask cache", kvIdx)
+		}
+	}
+	if sm.masks.masks.Len() != 1 {
+		t.Fatal("the cache should be bounded by its size", sm.masks.masks.Len())
+	}
+
+	sm.SetMaskCache(0)
+	if ds.masks != nil {
+		t.Fatal("the mask cache should be disabled")
+	}
+}
+
+// BenchmarkShardManager_MaskCache measures the repeated reads of the same blobs with and without the mask cache.
+func BenchmarkShardManager_MaskCache(b *testing.B) {
+	sm, files := createEthStorage(contractAddress, []uint64{0}, 131072, 131072, kvEntries, common.Address{}, defaultEncodeType)
+	defer func() {
+		sm.Close()
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}()
+	s := NewStorageManager(sm, &advancingL1Source{lastBlobIndex: kvEntries})
+	if err := s.Reset(5); err != nil {
+		b.Fatal("failed to reset", err)
+	}
+	const kvs = 4
+	commits := make([]common.Hash, kvs)
+	for kvIdx := uint64(0); kvIdx < kvs; kvIdx++ {
+		var blob []byte
+		blob, commits[kvIdx] = createBlob(kvIdx)
+		s.blobMetas.set(kvIdx, generateMetadata(kvIdx, 131072, commits[kvIdx][:]))
+		if err := s.CommitBlob(kvIdx, blob, commits[kvIdx]); err != nil {
+			b.Fatal("failed to commit blob", err)
+		}
+	}
+
+	for _, size := range []int{0, kvs} {
+		b.Run(fmt.Sprintf("cache=%d", size), func(b *testing.B) {
+			sm.SetMaskCache(size)
+			for i := 0; i < b.N; i++ {
+				kvIdx := uint64(i % kvs)
+				if _, _, err := s.TryRead(kvIdx, 131072, commits[kvIdx]); err != nil {
+					b.Fatal("failed to read blob", err)
+				}
+			}
+		})
+	}
+}
+
+func TestStorageManager_ConcurrentReadsAndCommits(t *testing.T) {
+	sm, files := createEthStorage(contractAddress, []uint64{0}, 131072, 131072, kvEntries, common.Address{}, defaultEncodeType)
+	defer func() {
+		sm.Close()
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}()
+	s := NewStorageManager(sm, &advancingL1Source{lastBlobIndex: kvEntries})
+	if err := s.Reset(5); err != nil {
+		t.Fatal("failed to reset", err)
+	}
+	const kvs = 4
+	blobs := make([][]byte, kvs)
+	commits := make([]common.Hash, kvs)
+	for kvIdx := uint64(0); kvIdx < kvs; kvIdx++ {
+		blobs[kvIdx], commits[kvIdx] = createBlob(kvIdx)
+		s.blobMetas.set(kvIdx, generateMetadata(kvIdx, 131072, commits[kvIdx][:]))
+	}
+	if err := s.CommitBlob(0, blobs[0], commits[0]); err != nil {
+		t.Fatal("failed to commit blob", err)
+	}
+
+	// the readers run in parallel with each other and with the commits of the other kvs
+	var wg sync.WaitGroup
+	errs := make(chan error, 3)
+	for r := 0; r < 3; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 3; i++ {
+				if data, _, err := s.TryRead(0, 131072, commits[0]); err != nil || !bytes.Equal(data, blobs[0]) {
+					errs <- fmt.Errorf("failed to read blob: %v", err)
+					return
+				}
+				if _, err := s.TryReadBlob(0); err != nil {
+					errs <- err
+					return
+				}
+				s.LastKvIndex()
+				s.HashSize()
+			}
+		}()
+	}
+	for kvIdx := uint64(1); kvIdx < kvs; kvIdx++ {
+		if err := s.CommitBlob(kvIdx, blobs[kvIdx], commits[kvIdx]); err != nil {
+			t.Fatal("failed to commit blob", err)
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+func TestStorageManager_ReadPathsUnderReadLock(t *testing.T) {
+	sm, files := createEthStorage(contractAddress, []uint64{0}, 131072, 131072, kvEntries, common.Address{}, defaultEncodeType)
+	defer func() {
+		sm.Close()
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}()
+	s := NewStorageManager(sm, &advancingL1Source{lastBlobIndex: kvEntries})
+	if err := s.Reset(5); err != nil {
+		t.Fatal("failed to reset", err)
+	}
+	blob, commit := createBlob(0)
+	s.blobMetas.set(0, generateMetadata(0, 131072, commit[:]))
+	if err := s.CommitBlob(0, blob, commit); err != nil {
+		t.Fatal("failed to commit blob", err)
+	}
+
+	// the pure reads complete while another reader holds the read lock
+	s.mu.RLock()
+	done := make(chan error)
+	go func() {
+		s.Shards()
+		s.Geometry()
+		s.ShardConfigs()
+		if _, ok := s.HasCommit(commit); !ok {
+			done <- errors.New("commit not found")
+			return
+		}
+		if _, err := s.StoredProvider(0); err != nil {
+			done <- err
+			return
+		}
+		_, err := s.ExportBlobWrapper(0)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal("failed to read", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the reads should run under the read lock")
+	}
+	s.mu.RUnlock()
+}
+
+func TestStorageManager_VerifySampleProof(t *testing.T) {
+	setup(t)
+
+	samplesPerKv := storageManager.MaxKvSize() / 32
+	blob, _ := createBlob(2)
+	proof, err := prover.GenerateKZGProof(blob, 7)
+	if err != nil {
+		t.Fatal("failed to generate proof", err)
+	}
+	if ok, err := storageManager.VerifySampleProof(0, 2*samplesPerKv+7, proof); err != nil || !ok {
+		t.Fatal("the proof should be valid", ok, err)
+	}
+	// the proof of another sample of the blob
+	if ok, err := storageManager.VerifySampleProof(0, 2*samplesPerKv+8, proof); err != nil || ok {
+		t.Fatal("the proof of another sample should be invalid", ok, err)
+	}
+	// the proof of the sample of another blob
+	if ok, err := storageManager.VerifySampleProof(0, 3*samplesPerKv+7, proof); err != nil || ok {
+		t.Fatal("the proof of another blob should be invalid", ok, err)
+	}
+	tampered := common.CopyBytes(proof)
+	tampered[len(tampered)-1] ^= 1
+	if ok, _ := storageManager.VerifySampleProof(0, 2*samplesPerKv+7, tampered); ok {
+		t.Fatal("the tampered proof should be invalid")
+	}
+
+	if _, err = storageManager.VerifySampleProof(0, 2*samplesPerKv+7, proof[1:]); err == nil {
+		t.Fatal("the malformed proof should fail")
+	}
+	if _, err = storageManager.VerifySampleProof(0, 5*samplesPerKv, proof); !errors.Is(err, ErrSampleNotSynced) {
+		t.Fatal("expected ErrSampleNotSynced", err)
+	}
+	if _, err = storageManager.VerifySampleProof(1, 2*samplesPerKv+7, proof); !errors.Is(err, ErrShardNotManaged) {
+		t.Fatal("expected ErrShardNotManaged", err)
+	}
+}
+
+func TestStorageManager_GetProofInputs(t *testing.T) {
+	setup(t)
+
+	samplesPerKv := storageManager.MaxKvSize() / 32
+	blob, commit := createBlob(2)
+	inputs, err := storageManager.GetProofInputs(0, 2*samplesPerKv+7)
+	if err != nil {
+		t.Fatal("failed to get proof inputs", err)
+	}
+	expectedCommit := common.Hash{}
+	copy(expectedCommit[:HashSizeInContract], commit[:HashSizeInContract])
+	miner, _ := storageManager.GetShardMiner(0)
+	if inputs.KvIdx != 2 || inputs.SampleIdxInKv != 7 || inputs.Commit != expectedCommit || !bytes.Equal(inputs.Data, blob) {
+		t.Fatal("unexpected proof inputs", inputs.KvIdx, inputs.SampleIdxInKv, inputs.Commit)
+	}
+	if inputs.EncodingKey != CalcEncodeKey(commit, 2, miner) {
+		t.Fatal("unexpected encoding key", inputs.EncodingKey)
+	}
+	// the encoded sample is the sample of the blob encoded with the key
+	encodeType, _ := storageManager.GetShardEncodeType(0)
+	encoded := EncodeChunk(storageManager.MaxKvSize(), inputs.Data, encodeType, inputs.EncodingKey)
+	if common.BytesToHash(encoded[7*32:8*32]) != inputs.EncodedSample {
+		t.Fatal("the encoded sample should be of the blob encoded with the key")
+	}
+	sample, err := storageManager.ReadSampleUnlocked(0, 2*samplesPerKv+7)
+	if err != nil || sample != inputs.EncodedSample {
+		t.Fatal("the encoded sample should be the one read by ReadSampleUnlocked", err)
+	}
+
+	if _, err = storageManager.GetProofInputs(0, 5*samplesPerKv); !errors.Is(err, ErrSampleNotSynced) {
+		t.Fatal("expected ErrSampleNotSynced", err)
+	}
+	if _, err = storageManager.GetProofInputs(0, kvEntries*samplesPerKv); !errors.Is(err, ErrSampleOutOfRange) {
+		t.Fatal("expected ErrSampleOutOfRange", err)
+	}
+	if _, err = storageManager.GetProofInputs(1, 2*samplesPerKv+7); !errors.Is(err, ErrShardNotManaged) {
+		t.Fatal("expected ErrShardNotManaged", err)
+	}
+}
+
+// limitedL1Source rejects the requests of more than limit metas, like a provider with a response size limit.
+type limitedL1Source struct {
+	advancingL1Source
+	limit    int
+	rejected int
+	maxBatch int
+}
+
+func (l1 *limitedL1Source) GetKvMetas(kvIndices []uint64, blockNumber int64) ([][32]byte, error) {
+	l1.mu.Lock()
+	if len(kvIndices) > l1.limit {
+		l1.rejected++
+		l1.mu.Unlock()
+		return nil, errors.New("response size exceeded")
+	}
+	if len(kvIndices) > l1.maxBatch {
+		l1.maxBatch = len(kvIndices)
+	}
+	l1.mu.Unlock()
+	return l1.advancingL1Source.GetKvMetas(kvIndices, blockNumber)
+}
+
+func TestStorageManager_DownloadAllMetasAdaptiveBatch(t *testing.T) {
+	entries := uint64(1024)
+	sm, files := createEthStorage(contractAddress, []uint64{0}, 131072, 131072, entries, common.Address{}, defaultEncodeType)
+	defer func() {
+		sm.Close()
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}()
+
+	l1 := &limitedL1Source{advancingL1Source: advancingL1Source{lastBlobIndex: entries}, limit: 10}
+	s := NewStorageManager(sm, l1)
+	s.MetaBatchMin = 2
+	s.MetaBatchMax = 64
+	if err := s.Reset(1); err != nil {
+		t.Fatal("failed to reset", err)
+	}
+	if err := s.DownloadAllMetas(context.Background(), 8000); err != nil {
+		t.Fatal("failed to download metas", err)
+	}
+	if s.blobMetas.len() != int(entries) {
+		t.Fatal("unexpected meta count", s.blobMetas.len())
+	}
+	for idx := uint64(0); idx < entries; idx++ {
+		if meta, ok := s.blobMetas.get(idx); !ok || meta != newTestMeta(idx, byte(idx+1)) {
+			t.Fatal("meta should be downloaded", idx, meta)
+		}
+	}
+	// the batch grows from the min to the limit, and a rejected size is not tried again by the same task
+	if l1.maxBatch != 8 {
+		t.Fatal("unexpected max batch", l1.maxBatch)
+	}
+	if l1.rejected == 0 || l1.rejected > MetaDownloadThread {
+		t.Fatal("unexpected rejected batches", l1.rejected)
+	}
+
+	// the batch size is fixed without the max
+	l1 = &limitedL1Source{advancingL1Source: advancingL1Source{lastBlobIndex: entries}, limit: 10}
+	s = NewStorageManager(sm, l1)
+	if err := s.Reset(1); err != nil {
+		t.Fatal("failed to reset", err)
+	}
+	if err := s.DownloadAllMetas(context.Background(), 4); err != nil {
+		t.Fatal("failed to download metas", err)
+	}
+	if l1.maxBatch != 4 || l1.rejected != 0 {
+		t.Fatal("unexpected batches", l1.maxBatch, l1.rejected)
+	}
+}
+
+func TestStorageManager_OnL1Advance(t *testing.T) {
+	setup(t)
+
+	var advances1, advances2 [][2]int64
+	storageManager.OnL1Advance(func(oldL1, newL1 int64) {
+		// the callback is invoked outside the lock, so it can read the storage
+		storageManager.mu.Lock()
+		localL1 := storageManager.localL1
+		storageManager.mu.Unlock()
+		if localL1 != newL1 {
+			t.Error("unexpected local L1 in callback", localL1)
+		}
+		advances1 = append(advances1, [2]int64{oldL1, newL1})
+	})
+	storageManager.OnL1Advance(func(oldL1, newL1 int64) {
+		advances2 = append(advances2, [2]int64{oldL1, newL1})
+	})
+
+	if err := storageManager.DownloadFinished(97529, []uint64{4}, [][]byte{{10}}, []common.Hash{{1}}); err != nil {
+		t.Fatal("failed to Downloand Finished", err)
+	}
+	if err := storageManager.DownloadFinished(97600, nil, nil, nil); err != nil {
+		t.Fatal("failed to Downloand Finished", err)
+	}
+	// the failed DownloadFinished does not advance localL1
+	if err := storageManager.DownloadFinished(97600, nil, nil, nil); err == nil {
+		t.Fatal("DownloadFinished of an old L1 should fail")
+	}
+	expected := [][2]int64{{97528, 97529}, {97529, 97600}}
+	if fmt.Sprint(advances1) != fmt.Sprint(expected) || fmt.Sprint(advances2) != fmt.Sprint(expected) {
+		t.Fatal("unexpected advances", advances1, advances2)
+	}
+}
+
+func TestStorageManager_CommitBlobsInputReused(t *testing.T) {
+	for _, encodeType := range []uint64{defaultEncodeType, NO_ENCODE} {
+		sm, files := createEthStorage(contractAddress, []uint64{0}, 131072, 131072, kvEntries, common.Address{}, encodeType)
+		s := NewStorageManager(sm, &advancingL1Source{lastBlobIndex: 10})
+		if err := s.Reset(5); err != nil {
+			t.Fatal("failed to reset", err)
+		}
+
+		kvIdx := uint64(4)
+		blob, commit := createBlob(kvIdx)
+		s.blobMetas.set(kvIdx, generateMetadata(kvIdx, 131072, commit[:]))
+		expected := common.CopyBytes(blob)
+		inserted, err := s.CommitBlobs([]uint64{kvIdx}, [][]byte{blob}, []common.Hash{commit})
+		if err != nil || len(inserted) != 1 {
+			t.Fatal("failed to commit blob", inserted, err)
+		}
+		// the caller reuses the buffer once CommitBlobs returns
+		for i := range blob {
+			blob[i] = 0xff
+		}
+		stored, success, err := s.TryRead(kvIdx, len(expected), prepareCommit(commit))
+		if !success || err != nil || !bytes.Equal(stored, expected) {
+			t.Fatal("the stored blob should not be affected by the reuse of the input", encodeType, err)
+		}
+
+		sm.Close()
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}
+}
+
+func TestStorageManager_CommitBlobsParallel(t *testing.T) {
+	sm, files := createEthStorage(contractAddress, []uint64{0}, 131072, 131072, kvEntries, common.Address{}, defaultEncodeType)
+	defer func() {
+		sm.Close()
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}()
+	s := NewStorageManager(sm, &advancingL1Source{lastBlobIndex: 10})
+	s.CommitThreadNum = 4
+	if err := s.Reset(5); err != nil {
+		t.Fatal("failed to reset", err)
+	}
+
+	var (
+		kvIndices = []uint64{7, 1, 5, 3, 0, 6, 2}
+		blobs     = make([][]byte, len(kvIndices))
+		commits   = make([]common.Hash, len(kvIndices))
+	)
+	for i, kvIdx := range kvIndices {
+		blobs[i], commits[i] = createBlob(kvIdx)
+		s.blobMetas.set(kvIdx, generateMetadata(kvIdx, 131072, commits[i][:]))
+	}
+	// the blob of kv 5 does not match its meta, and is skipped
+	commits[2] = common.Hash{0x01}
+
+	inserted, err := s.CommitBlobs(kvIndices, blobs, commits)
+	if err != nil {
+		t.Fatal("failed to commit blobs", err)
+	}
+	expected := []uint64{7, 1, 3, 0, 6, 2}
+	if fmt.Sprint(inserted) != fmt.Sprint(expected) {
+		t.Fatal("the blobs should be inserted in the order of the input", inserted, expected)
+	}
+	for i, kvIdx := range kvIndices {
+		if kvIdx == 5 {
+			continue
+		}
+		stored, success, err := s.TryRead(kvIdx, len(blobs[i]), prepareCommit(commits[i]))
+		if !success || err != nil || !bytes.Equal(stored, blobs[i]) {
+			t.Fatal("failed to read the committed blob", kvIdx, err)
+		}
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal("failed to close", err)
+	}
+	if _, err := s.CommitBlobs(kvIndices, blobs, commits); err == nil {
+		t.Fatal("CommitBlobs should fail after Close")
+	}
+}
+
+func TestStorageManager_HasCommit(t *testing.T) {
+	sm, files := createEthStorage(contractAddress, []uint64{0}, 131072, 131072, kvEntries, common.Address{}, defaultEncodeType)
+	defer func() {
+		sm.Close()
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}()
+	s := NewStorageManager(sm, &advancingL1Source{lastBlobIndex: 10})
+	if err := s.Reset(5); err != nil {
+		t.Fatal("failed to reset", err)
+	}
+
+	blobs := make([][]byte, 4)
+	commits := make([]common.Hash, 4)
+	for kvIdx := uint64(0); kvIdx < 4; kvIdx++ {
+		blobs[kvIdx], commits[kvIdx] = createBlob(kvIdx)
+		s.blobMetas.set(kvIdx, generateMetadata(kvIdx, 131072, commits[kvIdx][:]))
+	}
+	if _, err := s.CommitBlobs([]uint64{1, 2}, blobs[1:3], commits[1:3]); err != nil {
+		t.Fatal("failed to commit blobs", err)
+	}
+
+	check := func(commit common.Hash, expectedIdx uint64, expectedFound bool) {
+		t.Helper()
+		kvIdx, found := s.HasCommit(commit)
+		if found != expectedFound || (found && kvIdx != expectedIdx) {
+			t.Fatal("unexpected HasCommit result", kvIdx, found, expectedIdx, expectedFound)
+		}
+	}
+	// the scan of the metas
+	check(commits[1], 1, true)
+	check(commits[2], 2, true)
+	check(commits[3], 0, false)
+	check(common.Hash{0x01}, 0, false)
+
+	// the index built from the metas
+	s.EnableCommitIndex()
+	check(commits[1], 1, true)
+	check(commits[2], 2, true)
+	check(commits[3], 0, false)
+	// kv 3 is dropped from the index as it is not stored, and added back once committed
+	if _, err := s.CommitBlobs([]uint64{3}, blobs[3:], commits[3:]); err != nil {
+		t.Fatal("failed to commit blob", err)
+	}
+	check(commits[3], 3, true)
+}
+
+func TestStorageManager_GetBlobsByVersionedHashes(t *testing.T) {
+	sm, files := createEthStorage(contractAddress, []uint64{0}, 131072, 131072, kvEntries, common.Address{}, defaultEncodeType)
+	defer func() {
+		sm.Close()
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}()
+	s := NewStorageManager(sm, &advancingL1Source{lastBlobIndex: 10})
+	if err := s.Reset(5); err != nil {
+		t.Fatal("failed to reset", err)
+	}
+
+	blobs := make([][]byte, 4)
+	commits := make([]common.Hash, 4)
+	for kvIdx := uint64(0); kvIdx < 4; kvIdx++ {
+		blobs[kvIdx], commits[kvIdx] = createBlob(kvIdx)
+		s.blobMetas.set(kvIdx, generateMetadata(kvIdx, 131072, commits[kvIdx][:]))
+	}
+	if _, err := s.CommitBlobs([]uint64{1, 2}, blobs[1:3], commits[1:3]); err != nil {
+		t.Fatal("failed to commit blobs", err)
+	}
+	if inserted, _, err := s.CommitEmptyBlobs(12, 12); err != nil || inserted != 1 {
+		t.Fatal("failed to commit empty blobs", inserted, err)
+	}
+
+	check := func() {
+		t.Helper()
+		// kv 3 is not stored, and the zero hash does not match the empty filled kv 12
+		got, err := s.GetBlobsByVersionedHashes([][32]byte{commits[2], commits[3], {}, commits[1]})
+		if err != nil || len(got) != 4 {
+			t.Fatal("failed to get blobs", got, err)
+		}
+		if got[0] == nil || got[0].Index != 2 || !bytes.Equal(got[0].Data, blobs[2]) {
+			t.Fatal("unexpected blob of kv 2", got[0])
+		}
+		if got[1] != nil || got[2] != nil {
+			t.Fatal("the blobs not stored should be nil", got[1], got[2])
+		}
+		if got[3] == nil || got[3].Index != 1 || !bytes.Equal(got[3].Data, blobs[1]) {
+			t.Fatal("unexpected blob of kv 1", got[3])
+		}
+	}
+	// by the scan of the metas and by the reverse index
+	check()
+	s.EnableCommitIndex()
+	check()
+}
+
+func TestStorageManager_TryReadBlob(t *testing.T) {
+	sm, files := createEthStorage(contractAddress, []uint64{0}, 131072, 131072, kvEntries, common.Address{}, defaultEncodeType)
+	defer func() {
+		sm.Close()
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}()
+	s := NewStorageManager(sm, &advancingL1Source{lastBlobIndex: 10})
+	if err := s.Reset(5); err != nil {
+		t.Fatal("failed to reset", err)
+	}
+
+	kvIdx := uint64(3)
+	blob, commit := createBlob(kvIdx)
+	s.blobMetas.set(kvIdx, generateMetadata(kvIdx, 131072, commit[:]))
+
+	b, err := s.TryReadBlob(kvIdx)
+	if err != nil || b.Synced || b.Data != nil || b.Index != kvIdx || b.EncodeType != defaultEncodeType {
+		t.Fatal("the blob not synced should be returned without data", b, err)
+	}
+
+	if err := s.CommitBlob(kvIdx, blob, commit); err != nil {
+		t.Fatal("failed to commit blob", err)
+	}
+	b, err = s.TryReadBlob(kvIdx)
+	if err != nil {
+		t.Fatal("failed to read blob", err)
+	}
+	expectedCommit := common.Hash{}
+	copy(expectedCommit[:HashSizeInContract], commit[:HashSizeInContract])
+	if !b.Synced || b.Commit != expectedCommit || !bytes.Equal(b.Data, blob) {
+		t.Fatal("unexpected blob", b.Synced, b.Commit, expectedCommit)
+	}
+
+	if _, err := s.TryReadBlob(kvEntries); !errors.Is(err, ErrShardNotManaged) {
+		t.Fatal("the blob of a shard not managed should fail", err)
+	}
+}
+
+func TestStorageManager_CommitBlobsInvalidLen(t *testing.T) {
+	sm, files := createEthStorage(contractAddress, []uint64{0}, 131072, 131072, kvEntries, common.Address{}, defaultEncodeType)
+	defer func() {
+		sm.Close()
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}()
+	s := NewStorageManager(sm, &advancingL1Source{lastBlobIndex: 10})
+	if err := s.Reset(5); err != nil {
+		t.Fatal("failed to reset", err)
+	}
+
+	var (
+		kvIndices = []uint64{0, 1, 2, 3, 4}
+		blobs     = make([][]byte, len(kvIndices))
+		commits   = make([]common.Hash, len(kvIndices))
+	)
+	for i, kvIdx := range kvIndices {
+		blobs[i], commits[i] = createBlob(kvIdx)
+		s.blobMetas.set(kvIdx, generateMetadata(kvIdx, 131072, commits[i][:]))
+	}
+	// kv 1 is empty with a commit, kv 2 is short and kv 3 is oversized
+	blobs[1] = []byte{}
+	blobs[2] = blobs[2][:1024]
+	blobs[3] = append(blobs[3], 0x01)
+	// kv 4 is the empty sentinel matching an empty meta
+	blobs[4], commits[4] = []byte{}, common.Hash{}
+	s.blobMetas.set(4, generateMetadata(4, 0, commits[4][:]))
+
+	for i, kvIdx := range kvIndices[1:4] {
+		if err := s.CommitBlob(kvIdx, blobs[i+1], commits[i+1]); !errors.Is(err, ErrInvalidBlobLen) {
+			t.Fatal("CommitBlob should reject the blob of an invalid length", kvIdx, err)
+		}
+	}
+	for _, strict := range []bool{false, true} {
+		inserted, err := s.commitBlobs(context.Background(), kvIndices, blobs, commits, strict)
+		if err != nil {
+			t.Fatal("failed to commit blobs", strict, err)
+		}
+		if fmt.Sprint(inserted) != fmt.Sprint([]uint64{0, 4}) {
+			t.Fatal("only the blobs of valid lengths should be inserted", strict, inserted)
+		}
+	}
+	for _, kvIdx := range kvIndices[1:4] {
+		m, _, err := s.TryReadMeta(kvIdx)
+		if err != nil || IsFilled(common.BytesToHash(m)) {
+			t.Fatal("the blob of an invalid length should not be stored", kvIdx, err)
+		}
+	}
+	b, err := s.TryReadBlob(4)
+	if err != nil || !b.Synced || !bytes.Equal(b.Data, make([]byte, 131072)) {
+		t.Fatal("the empty blob should be stored", err)
+	}
+}
+
+func TestStorageManager_SetMetaIndexDB(t *testing.T) {
+	sm, files := createEthStorage(contractAddress, []uint64{0}, 131072, 131072, kvEntries, common.Address{}, defaultEncodeType)
+	defer func() {
+		sm.Close()
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}()
+	s := NewStorageManager(sm, &advancingL1Source{lastBlobIndex: 10})
+	if err := s.Reset(5); err != nil {
+		t.Fatal("failed to reset", err)
+	}
+
+	blob, commit := createBlob(1)
+	s.blobMetas.set(1, generateMetadata(1, 131072, commit[:]))
+	db := memorydb.New()
+	if err := s.SetMetaIndexDB(db); err != nil {
+		t.Fatal("failed to set meta index db", err)
+	}
+	// the meta and the block it is valid at
+	if db.Len() != 2 {
+		t.Fatal("the metas should be moved to the database", db.Len())
+	}
+	if err := s.CommitBlob(1, blob, commit); err != nil {
+		t.Fatal("failed to commit blob with the meta in the database", err)
+	}
+
+	if err := s.DownloadAllMetas(context.Background(), 4); err != nil {
+		t.Fatal("failed to download metas", err)
+	}
+	if db.Len() != 11 || s.blobMetas.len() != 10 {
+		t.Fatal("the downloaded metas should be kept in the database", db.Len(), s.blobMetas.len())
+	}
+}
+
+func TestStorageManager_SetMetaIndexDBRestore(t *testing.T) {
+	sm, files := createEthStorage(contractAddress, []uint64{0}, 131072, 131072, kvEntries, common.Address{}, defaultEncodeType)
+	defer func() {
+		sm.Close()
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}()
+	l1 := &loggingL1Source{advancingL1Source: advancingL1Source{lastBlobIndex: 10}, updated: []uint64{1, 3}}
+	db := memorydb.New()
+	s := NewStorageManager(sm, l1)
+	if err := s.SetMetaIndexDB(db); err != nil {
+		t.Fatal("failed to set meta index db", err)
+	}
+	if err := s.Reset(5); err != nil {
+		t.Fatal("failed to reset", err)
+	}
+	if err := s.DownloadAllMetas(context.Background(), 4); err != nil {
+		t.Fatal("failed to download metas", err)
+	}
+
+	// after a restart, the metas are reused until the first Reset, which drops the kvs 1 and 3 updated since and the
+	// kv 9 removed at the new block
+	l1.mu.Lock()
+	l1.lastBlobIndex = 9
+	l1.mu.Unlock()
+	s = NewStorageManager(sm, l1)
+	if err := s.SetMetaIndexDB(db); err != nil {
+		t.Fatal("failed to set meta index db", err)
+	}
+	if s.blobMetas.len() != 10 || s.restoredMetasL1 != 5 {
+		t.Fatal("the metas should be restored", s.blobMetas.len(), s.restoredMetasL1)
+	}
+	if err := s.Reset(7); err != nil {
+		t.Fatal("failed to reset", err)
+	}
+	for _, kvIdx := range []uint64{1, 3, 9} {
+		if _, ok := s.blobMetas.get(kvIdx); ok {
+			t.Fatal("stale meta should be dropped", kvIdx)
+		}
+	}
+	if s.blobMetas.len() != 7 || s.restoredMetasL1 != 0 {
+		t.Fatal("the rest metas should be kept", s.blobMetas.len(), s.restoredMetasL1)
+	}
+	if blockL1, _, _ := s.blobMetas.(*dbMetaStore).readL1(); blockL1 != 7 {
+		t.Fatal("the metas should be recorded valid at the new block", blockL1)
+	}
+
+	// the metas of a block no longer canonical are all dropped
+	s.blobMetas.(*dbMetaStore).writeL1(7, common.Hash{1})
+	s = NewStorageManager(sm, l1)
+	if err := s.SetMetaIndexDB(db); err != nil {
+		t.Fatal("failed to set meta index db", err)
+	}
+	if s.blobMetas.len() != 0 || s.restoredMetasL1 != 0 {
+		t.Fatal("the metas of a reorged block should be dropped", s.blobMetas.len())
+	}
+}
+
+func TestStorageManager_MetaBandwidth(t *testing.T) {
+	sm, files := createEthStorage(contractAddress, []uint64{0}, 131072, 131072, kvEntries, common.Address{}, defaultEncodeType)
+	defer func() {
+		sm.Close()
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}()
+	s := NewStorageManager(sm, &advancingL1Source{lastBlobIndex: kvEntries})
+	if err := s.Reset(5); err != nil {
+		t.Fatal("failed to reset", err)
+	}
+	if s.metaBandwidthLimiter() != nil {
+		t.Fatal("the meta download should be unlimited by default")
+	}
+
+	// the first second of the budget is the burst, after which the rest takes a second
+	s = NewStorageManager(sm, &advancingL1Source{lastBlobIndex: kvEntries})
+	s.MetaBandwidth = kvEntries / 2 * metaResponseSize
+	if err := s.Reset(5); err != nil {
+		t.Fatal("failed to reset", err)
+	}
+	start := time.Now()
+	if err := s.DownloadShardMetas(context.Background(), 0, 4); err != nil {
+		t.Fatal("failed to download metas", err)
+	}
+	if elapsed := time.Since(start); elapsed < 800*time.Millisecond {
+		t.Fatal("the meta download should be throttled", elapsed)
+	}
+	if s.blobMetas.len() != int(kvEntries) {
+		t.Fatal("unexpected number of the metas downloaded", s.blobMetas.len())
+	}
+
+	// the throttled download stops once cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := s.waitMetaBandwidth(ctx, int(kvEntries)); !errors.Is(err, context.Canceled) {
+		t.Fatal("expected the wait to be cancelled", err)
+	}
+}
+
+func TestStorageManager_StreamShardMetas(t *testing.T) {
+	sm, files := createEthStorage(contractAddress, []uint64{0}, 131072, 131072, kvEntries, common.Address{}, defaultEncodeType)
+	defer func() {
+		sm.Close()
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}()
+	s := NewStorageManager(sm, &advancingL1Source{lastBlobIndex: kvEntries / 2})
+	if err := s.Reset(5); err != nil {
+		t.Fatal("failed to reset", err)
+	}
+	if err := s.DownloadShardMetas(context.Background(), 0, 4); err != nil {
+		t.Fatal("failed to download metas", err)
+	}
+
+	// the downloaded metas are streamed in order, without those beyond lastKvIdx
+	var kvs []uint64
+	err := s.StreamShardMetas(0, func(kvIdx uint64, meta [32]byte) error {
+		if meta != newTestMeta(kvIdx, byte(kvIdx+1)) {
+			t.Fatal("unexpected meta", kvIdx, meta)
+		}
+		kvs = append(kvs, kvIdx)
+		return nil
+	})
+	if err != nil || !reflect.DeepEqual(kvs, []uint64{0, 1, 2, 3, 4, 5, 6, 7}) {
+		t.Fatal("unexpected metas streamed", kvs, err)
+	}
+
+	// the local metas are streamed for every kv of the shard, empty as nothing is synced
+	kvs = nil
+	err = s.StreamShardFileMetas(0, func(kvIdx uint64, meta [32]byte) error {
+		if meta != [32]byte{} {
+			t.Fatal("unexpected local meta", kvIdx, meta)
+		}
+		kvs = append(kvs, kvIdx)
+		return nil
+	})
+	if err != nil || len(kvs) != int(kvEntries) || kvs[kvEntries-1] != kvEntries-1 {
+		t.Fatal("unexpected local metas streamed", kvs, err)
+	}
+
+	// the walk stops at the first error of fn
+	stop := errors.New("stop")
+	n := 0
+	err = s.StreamShardMetas(0, func(kvIdx uint64, meta [32]byte) error {
+		n++
+		if kvIdx == 2 {
+			return stop
+		}
+		return nil
+	})
+	if !errors.Is(err, stop) || n != 3 {
+		t.Fatal("the walk should stop at the error", n, err)
+	}
+
+	if err := s.StreamShardMetas(1, func(uint64, [32]byte) error { return nil }); !errors.Is(err, ErrShardNotManaged) {
+		t.Fatal("expected ErrShardNotManaged", err)
+	}
+}
+
+// spanRecorder records the spans started as "parent/name", with the parent carried by the context.
+type spanRecorder struct {
+	mu    sync.Mutex
+	spans map[string]bool
+}
+
+type spanNameKey struct{}
+
+func (r *spanRecorder) StartSpan(ctx context.Context, name string) (context.Context, func(err error)) {
+	parent, _ := ctx.Value(spanNameKey{}).(string)
+	r.mu.Lock()
+	r.spans[parent+"/"+name] = true
+	r.mu.Unlock()
+	return context.WithValue(ctx, spanNameKey{}, name), func(error) {}
+}
+
+func TestStorageManager_Tracer(t *testing.T) {
+	sm, files := createEthStorage(contractAddress, []uint64{0}, 131072, 131072, kvEntries, common.Address{}, defaultEncodeType)
+	defer func() {
+		sm.Close()
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}()
+	s := NewStorageManager(sm, &advancingL1Source{lastBlobIndex: kvEntries})
+	s.DownloadThreadNum = 1
+	if err := s.Reset(5); err != nil {
+		t.Fatal("failed to reset", err)
+	}
+
+	// no span is created without a tracer
+	allocs := testing.AllocsPerRun(100, func() {
+		_, end := s.startSpan(context.Background(), "CommitBlobs")
+		end(nil)
+	})
+	if allocs != 0 {
+		t.Fatal("the disabled tracing should not allocate", allocs)
+	}
+
+	r := &spanRecorder{spans: map[string]bool{}}
+	s.SetTracer(r)
+	if err := s.DownloadAllMetas(context.Background(), 4); err != nil {
+		t.Fatal("failed to download metas", err)
+	}
+	blob, hash := createBlob(0)
+	if err := s.DownloadFinishedContext(context.Background(), 6, []uint64{0}, [][]byte{blob}, []common.Hash{hash}); err != nil {
+		t.Fatal("failed to download", err)
+	}
+	ctx := context.WithValue(context.Background(), spanNameKey{}, "sync")
+	commit := common.Hash{}
+	for i := 0; i < HashSizeInContract; i++ {
+		commit[i] = 2
+	}
+	if _, err := s.CommitBlobsContext(ctx, []uint64{1}, [][]byte{make([]byte, 131072)}, []common.Hash{commit}); err != nil {
+		t.Fatal("failed to commit", err)
+	}
+	for _, span := range []string{
+		"/DownloadAllMetas", "DownloadAllMetas/metaWorker", "metaWorker/metaBatch",
+		"/DownloadFinished", "DownloadFinished/lock", "DownloadFinished/write", "DownloadFinished/metas",
+		"sync/CommitBlobs", "CommitBlobs/encode", "CommitBlobs/lock", "CommitBlobs/metas", "CommitBlobs/write",
+	} {
+		if !r.spans[span] {
+			t.Fatal("span not traced", span, r.spans)
+		}
+	}
+
+	s.SetTracer(nil)
+	r.spans = map[string]bool{}
+	if _, err := s.CommitBlobs([]uint64{1}, [][]byte{make([]byte, 131072)}, []common.Hash{commit}); err != nil {
+		t.Fatal("failed to commit", err)
+	}
+	if len(r.spans) != 0 {
+		t.Fatal("the spans should not be traced once the tracer is unset", r.spans)
+	}
+}
+
+func TestStorageManager_DownloadBatchMax(t *testing.T) {
+	sm, files := createEthStorage(contractAddress, []uint64{0}, 131072, 131072, kvEntries, common.Address{}, defaultEncodeType)
+	defer func() {
+		sm.Close()
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}()
+	s := NewStorageManager(sm, &advancingL1Source{lastBlobIndex: kvEntries})
+	s.DownloadThreadNum = 1
+	s.DownloadBatchMax = 2
+	if err := s.Reset(5); err != nil {
+		t.Fatal("failed to reset", err)
+	}
+	// the blobs are notified once the lock is released after each sub-batch
+	var notified []int64
+	s.OnBlobCommitted(func(kvIdx uint64) {
+		s.mu.RLock()
+		notified = append(notified, s.localL1)
+		s.mu.RUnlock()
+	})
+	download := func(newL1 int64, kvIndices []uint64) error {
+		blobs := make([][]byte, len(kvIndices))
+		commits := make([]common.Hash, len(kvIndices))
+		for i, kvIdx := range kvIndices {
+			blobs[i], commits[i] = createBlob(kvIdx)
+		}
+		return s.DownloadFinished(newL1, kvIndices, blobs, commits)
+	}
+
+	// localL1 advances only after the last sub-batch
+	if err := download(6, []uint64{0, 1, 2, 3, 4}); err != nil {
+		t.Fatal("failed to download", err)
+	}
+	if !reflect.DeepEqual(notified, []int64{5, 5, 5, 5, 6}) {
+		t.Fatal("unexpected localL1 seen between the sub-batches", notified)
+	}
+	_, hash := createBlob(4)
+	if meta, ok := s.blobMetas.get(4); !ok || !bytes.Equal(meta[32-HashSizeInContract:], hash[:HashSizeInContract]) {
+		t.Fatal("the metas should be updated after the last sub-batch", meta, ok)
+	}
+
+	// the blobs of the sub-batches before a failed one are kept, while localL1 is not advanced
+	notified = nil
+	s.OnBlobCommitted(func(kvIdx uint64) {
+		if kvIdx == 6 {
+			s.diskFullAt.Store(s.Clock.Now().UnixNano())
+		}
+	})
+	if err := download(7, []uint64{5, 6, 7, 8}); !errors.Is(err, ErrDiskFull) {
+		t.Fatal("expected ErrDiskFull", err)
+	}
+	if len(notified) != 2 || s.localL1 != 6 {
+		t.Fatal("unexpected state after the failed sub-batch", notified, s.localL1)
+	}
+
+	// the whole batch is written under one hold of the lock by default
+	s.diskFullAt.Store(0)
+	s.DownloadBatchMax = 0
+	notified = nil
+	if err := download(7, []uint64{5, 6, 7, 8}); err != nil {
+		t.Fatal("failed to download", err)
+	}
+	if !reflect.DeepEqual(notified, []int64{7, 7, 7, 7}) {
+		t.Fatal("unexpected localL1 seen by the notifications", notified)
+	}
+}
+
+func TestStorageManager_DownloadBatchMaxCommit(t *testing.T) {
+	sm, files := createEthStorage(contractAddress, []uint64{0}, 131072, 131072, kvEntries, common.Address{}, defaultEncodeType)
+	defer func() {
+		sm.Close()
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}()
+	s := NewStorageManager(sm, &advancingL1Source{lastBlobIndex: kvEntries})
+	s.DownloadThreadNum = 1
+	s.DownloadBatchMax = 2
+	if err := s.Reset(5); err != nil {
+		t.Fatal("failed to reset", err)
+	}
+	if err := s.DownloadShardMetas(context.Background(), 0, 4); err != nil {
+		t.Fatal("failed to download metas", err)
+	}
+
+	kvIndices := []uint64{0, 1, 2, 3}
+	blobs := make([][]byte, len(kvIndices))
+	commits := make([]common.Hash, len(kvIndices))
+	for i, kvIdx := range kvIndices {
+		blobs[i], commits[i] = createBlob(kvIdx)
+	}
+	// a commit of the sync layer with the commit before the download comes between the sub-batches
+	var inserted []uint64
+	var commitErr error
+	s.OnBlobCommitted(func(kvIdx uint64) {
+		if kvIdx != 1 || inserted != nil {
+			return
+		}
+		staleCommit := common.Hash{}
+		for i := 0; i < HashSizeInContract; i++ {
+			staleCommit[i] = 1
+		}
+		inserted, commitErr = s.CommitBlobs([]uint64{0}, [][]byte{make([]byte, 131072)}, []common.Hash{staleCommit})
+	})
+	if err := s.DownloadFinished(6, kvIndices, blobs, commits); err != nil {
+		t.Fatal("failed to download", err)
+	}
+	if commitErr != nil || inserted == nil || len(inserted) != 0 {
+		t.Fatal("the stale commit should not be inserted", inserted, commitErr)
+	}
+	for i, kvIdx := range kvIndices {
+		data, success, err := s.TryRead(kvIdx, len(blobs[i]), commits[i])
+		if err != nil || !success || !bytes.Equal(data, blobs[i]) {
+			t.Fatal("the downloaded blob should be kept", kvIdx, success, err)
+		}
+	}
+}
+
+func TestStorageManager_ShardMetasL1(t *testing.T) {
+	sm, files := createEthStorage(contractAddress, []uint64{0, 1}, 131072, 131072, kvEntries, common.Address{}, defaultEncodeType)
+	defer func() {
+		sm.Close()
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}()
+	s := NewStorageManager(sm, &advancingL1Source{lastBlobIndex: 2 * kvEntries})
+	if err := s.Reset(5); err != nil {
+		t.Fatal("failed to reset", err)
+	}
+
+	if _, ok := s.ShardMetasL1(0); ok {
+		t.Fatal("the metas of the shard should not be downloaded yet")
+	}
+	if err := s.DownloadShardMetas(context.Background(), 0, 4); err != nil {
+		t.Fatal("failed to download metas", err)
+	}
+	if l1, ok := s.ShardMetasL1(0); !ok || l1 != 5 {
+		t.Fatal("unexpected block of the metas of shard 0", l1, ok)
+	}
+	if _, ok := s.ShardMetasL1(1); ok {
+		t.Fatal("the metas of shard 1 should not be downloaded yet")
+	}
+
+	// the blocks are tracked by shard
+	if err := s.DownloadFinished(8, nil, nil, nil); err != nil {
+		t.Fatal("failed to advance localL1", err)
+	}
+	if err := s.DownloadShardMetas(context.Background(), 1, 4); err != nil {
+		t.Fatal("failed to download metas", err)
+	}
+	l1a, _ := s.ShardMetasL1(0)
+	l1b, _ := s.ShardMetasL1(1)
+	if l1a != 5 || l1b != 8 {
+		t.Fatal("unexpected blocks of the metas", l1a, l1b)
+	}
+
+	if err := s.RemoveShard(1, false); err != nil {
+		t.Fatal("failed to remove shard", err)
+	}
+	if _, ok := s.ShardMetasL1(1); ok {
+		t.Fatal("the block of the removed shard should be dropped")
+	}
+	// all the metas are dropped as the updated kvs cannot be found
+	if _, err := s.ResetAndInvalidateMetas(10); err != nil {
+		t.Fatal("failed to reset", err)
+	}
+	if _, ok := s.ShardMetasL1(0); ok {
+		t.Fatal("the block of the dropped metas should be dropped")
+	}
+}
+
+func TestStorageManager_VerifyAgainstChain(t *testing.T) {
+	sm, files := createEthStorage(contractAddress, []uint64{0, 1}, 131072, 131072, kvEntries, common.Address{}, defaultEncodeType)
+	defer func() {
+		sm.Close()
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}()
+	lastKvIdx := kvEntries + 4
+	s := NewStorageManager(sm, &advancingL1Source{lastBlobIndex: lastKvIdx})
+
+	// the commits of the contract metas served by advancingL1Source
+	commitOf := func(b byte) common.Hash {
+		c := common.Hash{}
+		for i := 0; i < HashSizeInContract; i++ {
+			c[i] = b
+		}
+		return c
+	}
+	writeMeta := func(kvIdx uint64, commit common.Hash) {
+		ds, _ := sm.getDataShard(kvIdx / kvEntries)
+		if err := ds.WriteMeta(kvIdx, prepareCommit(commit).Bytes()); err != nil {
+			t.Fatal("failed to write meta", err)
+		}
+	}
+	matched := []uint64{0, 2, kvEntries + 1}
+	for _, kvIdx := range matched {
+		writeMeta(kvIdx, commitOf(byte(kvIdx+1)))
+	}
+	writeMeta(1, commitOf(0xff))
+	writeMeta(kvEntries, commitOf(0xff))
+
+	report, err := s.VerifyAgainstChain(context.Background(), 10)
+	if err != nil {
+		t.Fatal("failed to verify", err)
+	}
+	if report.Block != 10 || report.LastKvIdx != lastKvIdx || report.Checked != lastKvIdx {
+		t.Fatal("unexpected report", report.Block, report.LastKvIdx, report.Checked)
+	}
+	if report.Matched != uint64(len(matched)) {
+		t.Fatal("unexpected matched count", report.Matched)
+	}
+	if fmt.Sprint(report.Mismatched) != fmt.Sprint([]uint64{1, kvEntries}) {
+		t.Fatal("unexpected mismatched kvs", report.Mismatched)
+	}
+	if len(report.Missing) != int(lastKvIdx)-len(matched)-2 || report.Missing[0] != 3 {
+		t.Fatal("unexpected missing kvs", report.Missing)
+	}
+	bs, err := json.Marshal(report)
+	if err != nil {
+		t.Fatal("failed to marshal report", err)
+	}
+	decoded := &VerifyReport{}
+	if err := json.Unmarshal(bs, decoded); err != nil || fmt.Sprint(decoded) != fmt.Sprint(report) {
+		t.Fatal("the report should be serializable", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := s.VerifyAgainstChain(ctx, 10); !errors.Is(err, context.Canceled) {
+		t.Fatal("expected the verification to be cancelled", err)
+	}
+}
+
+func TestEmptyFilledAndUnsynced(t *testing.T) {
+	commit := common.Hash{0x01, 0x02}
+	withBit := func(meta common.Hash, i int, bit byte) common.Hash {
+		meta[i] |= bit
+		return meta
+	}
+	for _, size := range []int{HashSizeInContract, maxHashSizeInContract} {
+		cases := []struct {
+			name                          string
+			meta                          common.Hash
+			filled, emptyFilled, unsynced bool
+		}{
+			{"not synced", common.Hash{}, false, false, true},
+			{"empty filled", prepareCommitN(common.Hash{}, size), true, true, false},
+			{"filled", prepareCommitN(commit, size), true, false, false},
+			{"commit without the filling bit", commit, false, false, true},
+			{"empty filled with another bit", withBit(prepareCommitN(common.Hash{}, size), size, 0x01), true, false, false},
+			{"empty filled with a trailing byte", withBit(prepareCommitN(common.Hash{}, size), 31, 0x01), true, false, false},
+			{"filling bit of another hash size", withBit(common.Hash{}, size-1, blobFillingMask), false, false, true},
+		}
+		for _, c := range cases {
+			if isFilledN(c.meta, size) != c.filled || isEmptyFilledN(c.meta, size) != c.emptyFilled ||
+				!isFilledN(c.meta, size) != c.unsynced {
+				t.Fatal("unexpected state of the meta", size, c.name)
+			}
+		}
+	}
+	if !IsEmptyFilled(PrepareCommit(common.Hash{})) || IsUnsynced(PrepareCommit(common.Hash{})) || !IsUnsynced(common.Hash{}) {
+		t.Fatal("unexpected state of the exported helpers")
+	}
+}
+
+func TestStorageManager_SyncCheckWithoutFillingBit(t *testing.T) {
+	setup(t)
+
+	ds, _ := storageManager.shardManager.getDataShard(0)
+	if err := ds.WriteMeta(6, common.Hash{0x01, 0x02}.Bytes()); err != nil {
+		t.Fatal("failed to write meta", err)
+	}
+	if err := storageManager.syncCheck(6); err == nil {
+		t.Fatal("the blob without the filling bit should not be served")
+	}
+	if err := ds.WriteMeta(6, prepareCommit(common.Hash{}).Bytes()); err != nil {
+		t.Fatal("failed to write meta", err)
+	}
+	if err := storageManager.syncCheck(6); err == nil {
+		t.Fatal("the empty blob should not be served")
+	}
+}
+
+func TestStorageManager_BlobsChangedSince(t *testing.T) {
+	sm, files := createEthStorage(contractAddress, []uint64{0}, 131072, 131072, kvEntries, common.Address{}, defaultEncodeType)
+	defer func() {
+		sm.Close()
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}()
+	s := NewStorageManager(sm, &advancingL1Source{lastBlobIndex: kvEntries})
+	if err := s.Reset(5); err != nil {
+		t.Fatal("failed to reset", err)
+	}
+
+	if err := s.DownloadFinished(7, []uint64{4, 1}, [][]byte{{10}, {11}}, []common.Hash{{1}, {2}}); err != nil {
+		t.Fatal("failed to download", err)
+	}
+	if err := s.DownloadFinished(9, []uint64{2, 4}, [][]byte{{12}, {13}}, []common.Hash{{3}, {4}}); err != nil {
+		t.Fatal("failed to download", err)
+	}
+	for _, c := range []struct {
+		from    int64
+		changed []uint64
+	}{
+		{5, []uint64{1, 2, 4}},
+		{7, []uint64{2, 4}},
+		{9, []uint64{}},
+	} {
+		changed, err := s.BlobsChangedSince(c.from)
+		if err != nil {
+			t.Fatal("failed to get the changed blobs", err)
+		}
+		if !reflect.DeepEqual(changed, c.changed) {
+			t.Fatal("unexpected changed blobs since", c.from, changed)
+		}
+	}
+	if _, err := s.BlobsChangedSince(4); !errors.Is(err, ErrChangesNotTracked) {
+		t.Fatal("the changes before the reset should not be tracked", err)
+	}
+
+	// the tracking restarts from the block of the reset
+	if _, err := s.ResetAndInvalidateMetas(10); err != nil {
+		t.Fatal("failed to reset", err)
+	}
+	if _, err := s.BlobsChangedSince(9); !errors.Is(err, ErrChangesNotTracked) {
+		t.Fatal("the changes before the reset should not be tracked", err)
+	}
+	if changed, err := s.BlobsChangedSince(10); err != nil || len(changed) != 0 {
+		t.Fatal("unexpected changed blobs", changed, err)
+	}
+}
+
+func TestStorageManager_DiskFull(t *testing.T) {
+	sm, files := createEthStorage(contractAddress, []uint64{0}, 131072, 131072, kvEntries, common.Address{}, defaultEncodeType)
+	defer func() {
+		sm.Close()
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}()
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	s := NewStorageManager(sm, &advancingL1Source{lastBlobIndex: kvEntries})
+	s.Clock = clock
+	s.DownloadThreadNum = 1
+	s.DiskFullRetry = time.Minute
+	if err := s.Reset(5); err != nil {
+		t.Fatal("failed to reset", err)
+	}
+
+	// the write failed as the disk is full
+	werr := &os.PathError{Op: "write", Path: files[0], Err: syscall.ENOSPC}
+	if err := s.checkDiskWrite(4, werr); !errors.Is(err, ErrDiskFull) || !errors.Is(err, syscall.ENOSPC) {
+		t.Fatal("the write should fail with ErrDiskFull", err)
+	}
+	if full, at := s.DiskFull(); !full || !at.Equal(clock.Now()) {
+		t.Fatal("the disk should be reported full", full, at)
+	}
+	if err := s.checkDiskWrite(4, errors.New("other")); errors.Is(err, ErrDiskFull) {
+		t.Fatal("the other errors should be kept", err)
+	}
+
+	// the commits fail fast until DiskFullRetry passes
+	if err := s.DownloadFinished(7, []uint64{4}, [][]byte{{10}}, []common.Hash{{1}}); !errors.Is(err, ErrDiskFull) {
+		t.Fatal("the download should fail fast", err)
+	}
+	if _, err := s.CommitBlobs([]uint64{4}, [][]byte{{}}, []common.Hash{{}}); !errors.Is(err, ErrDiskFull) {
+		t.Fatal("the commit should fail fast", err)
+	}
+	if _, _, err := s.CommitEmptyBlobs(4, 5); !errors.Is(err, ErrDiskFull) {
+		t.Fatal("the commit should fail fast", err)
+	}
+	if s.localL1 != 5 {
+		t.Fatal("localL1 should not advance", s.localL1)
+	}
+
+	// a write succeeding after the retry records the space freed
+	clock.advance(time.Minute)
+	if err := s.DownloadFinished(7, []uint64{4}, [][]byte{{10}}, []common.Hash{{1}}); err != nil {
+		t.Fatal("failed to download", err)
+	}
+	if full, _ := s.DiskFull(); full {
+		t.Fatal("the disk should not be reported full")
+	}
+	if err := s.checkDiskFull(); err != nil {
+		t.Fatal("the commits should not fail fast", err)
+	}
+}
+
+func TestStorageManager_L1Checkpoint(t *testing.T) {
+	sm, files := createEthStorage(contractAddress, []uint64{0}, 131072, 131072, kvEntries, common.Address{}, defaultEncodeType)
+	defer func() {
+		sm.Close()
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}()
+	ckptFile := filepath.Join(t.TempDir(), "l1checkpoint.json")
+	s := NewStorageManager(sm, &advancingL1Source{lastBlobIndex: 8})
+	s.DownloadThreadNum = 2
+	s.L1CheckpointFile = ckptFile
+	if err := s.Reset(5); err != nil {
+		t.Fatal("failed to reset", err)
+	}
+	if _, ok, err := s.ReadL1Checkpoint(); ok || err != nil {
+		t.Fatal("no checkpoint should be written yet", ok, err)
+	}
+
+	if err := s.DownloadFinished(7, []uint64{4, 2}, [][]byte{{10}, {11}}, []common.Hash{{1}, {2}}); err != nil {
+		t.Fatal("failed to download", err)
+	}
+	if err := s.DownloadFinished(9, []uint64{3}, [][]byte{{12}}, []common.Hash{{3}}); err != nil {
+		t.Fatal("failed to download", err)
+	}
+	ckpt, ok, err := s.ReadL1Checkpoint()
+	if err != nil || !ok {
+		t.Fatal("failed to read the checkpoint", ok, err)
+	}
+	expected := L1Checkpoint{L1: 9, L1Hash: s.localL1Hash, LastKvIdx: 8, FilledNext: 5}
+	if *ckpt != expected || ckpt.L1Hash == (common.Hash{}) {
+		t.Fatal("unexpected checkpoint", ckpt)
+	}
+
+	// no progress is claimed by a batch failed to write
+	s.diskFullAt.Store(s.Clock.Now().UnixNano())
+	if err := s.DownloadFinished(11, []uint64{5}, [][]byte{{13}}, []common.Hash{{4}}); !errors.Is(err, ErrDiskFull) {
+		t.Fatal("the download should fail", err)
+	}
+	if ckpt, _, _ := s.ReadL1Checkpoint(); ckpt.L1 != 9 {
+		t.Fatal("the checkpoint should not advance", ckpt.L1)
+	}
+
+	// a restart resumes from the checkpoint unless the block is reorged
+	s2 := NewStorageManager(sm, &advancingL1Source{lastBlobIndex: 8})
+	s2.L1CheckpointFile = ckptFile
+	if ckpt, ok, err := s2.ReadL1Checkpoint(); !ok || err != nil || *ckpt != expected || s2.filledNext != 5 {
+		t.Fatal("unexpected checkpoint after restart", ckpt, ok, err)
+	}
+	expected.L1Hash = common.Hash{1}
+	if err := writeJSONSynced(ckptFile, &expected); err != nil {
+		t.Fatal("failed to write the checkpoint", err)
+	}
+	if _, ok, err := s2.ReadL1Checkpoint(); ok || err != nil {
+		t.Fatal("the reorged checkpoint should not be trusted", ok, err)
+	}
+}
+
+func TestStorageManager_PauseResume(t *testing.T) {
+	sm, files := createEthStorage(contractAddress, []uint64{0}, 131072, 131072, kvEntries, common.Address{}, defaultEncodeType)
+	defer func() {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}()
+	l1 := &advancingL1Source{lastBlobIndex: 4}
+	s := NewStorageManager(sm, l1)
+	s.DownloadThreadNum = 1
+	if err := s.Reset(5); err != nil {
+		t.Fatal("failed to reset", err)
+	}
+
+	// the meta download in flight completes before the pause takes effect
+	started, release := make(chan struct{}), make(chan struct{})
+	l1.onGetKvMetas = func() {
+		close(started)
+		<-release
+	}
+	downloaded := make(chan error, 1)
+	go func() {
+		downloaded <- s.DownloadAllMetas(context.Background(), 4)
+	}()
+	<-started
+	paused := make(chan struct{})
+	go func() {
+		s.Pause()
+		close(paused)
+	}()
+	select {
+	case <-paused:
+		t.Fatal("Pause should wait for the download in flight")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	<-paused
+	if err := <-downloaded; err != nil {
+		t.Fatal("failed to download metas", err)
+	}
+	if !s.Paused() {
+		t.Fatal("the sync should be paused")
+	}
+
+	// the commits and downloads fail while the reads go on
+	blob, commit := createBlob(0)
+	if err := s.CommitBlob(0, blob, commit); !errors.Is(err, ErrPaused) {
+		t.Fatal("expected ErrPaused", err)
+	}
+	if err := s.DownloadFinished(7, []uint64{0}, [][]byte{blob}, []common.Hash{commit}); !errors.Is(err, ErrPaused) {
+		t.Fatal("expected ErrPaused", err)
+	}
+	if err := s.DownloadAllMetas(context.Background(), 4); !errors.Is(err, ErrPaused) {
+		t.Fatal("expected ErrPaused", err)
+	}
+	if err := s.CatchUpMetas(context.Background(), 0, 0, 4); !errors.Is(err, ErrPaused) {
+		t.Fatal("expected ErrPaused", err)
+	}
+	if _, err := s.ResetAndInvalidateMetas(7); !errors.Is(err, ErrPaused) {
+		t.Fatal("expected ErrPaused", err)
+	}
+	if _, err := s.VerifyShard(0); !errors.Is(err, ErrPaused) {
+		t.Fatal("expected ErrPaused", err)
+	}
+	if err := s.CompactShard(context.Background(), 0); !errors.Is(err, ErrPaused) {
+		t.Fatal("expected ErrPaused", err)
+	}
+	if err := s.ReEncodeShard(0, common.Address{}); !errors.Is(err, ErrPaused) {
+		t.Fatal("expected ErrPaused", err)
+	}
+	if err := s.BeginStaging(context.Background(), 0); !errors.Is(err, ErrPaused) {
+		t.Fatal("expected ErrPaused", err)
+	}
+	if err := s.PromoteStaging(0); !errors.Is(err, ErrPaused) {
+		t.Fatal("expected ErrPaused", err)
+	}
+	if _, _, err := s.TryReadMeta(0); err != nil {
+		t.Fatal("failed to read while paused", err)
+	}
+
+	s.Resume()
+	if s.Paused() {
+		t.Fatal("the sync should be resumed")
+	}
+	if err := s.DownloadFinished(7, []uint64{0}, [][]byte{blob}, []common.Hash{commit}); err != nil {
+		t.Fatal("failed to download after resume", err)
+	}
+
+	// the commits wait for Resume if PauseBlocks, and are woken up by Close
+	s.PauseBlocks = true
+	s.Pause()
+	committed := make(chan error, 1)
+	go func() {
+		_, _, err := s.CommitEmptyBlobs(4, 5)
+		committed <- err
+	}()
+	select {
+	case err := <-committed:
+		t.Fatal("the commit should wait for Resume", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	s.Resume()
+	if err := <-committed; err != nil {
+		t.Fatal("failed to commit after resume", err)
+	}
+	s.Pause()
+	go func() {
+		committed <- s.DownloadFinished(9, nil, nil, nil)
+	}()
+	if err := s.Close(); err != nil {
+		t.Fatal("failed to close", err)
+	}
+	if err := <-committed; !errors.Is(err, ErrStorageClosed) {
+		t.Fatal("expected ErrStorageClosed", err)
+	}
+}
+
+func TestStorageManager_FillEmptyRange(t *testing.T) {
+	sm, files := createEthStorage(contractAddress, []uint64{0}, 131072, 131072, kvEntries, common.Address{}, defaultEncodeType)
+	defer func() {
+		sm.Close()
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}()
+	s := NewStorageManager(sm, &advancingL1Source{lastBlobIndex: 4})
+	if err := s.Reset(5); err != nil {
+		t.Fatal("failed to reset", err)
+	}
+	s.blobMetas.set(2, newTestMeta(2, 0))
+	s.blobMetas.set(3, newTestMeta(3, 5))
+
+	// the blob which is not empty is skipped
+	r, err := s.FillEmptyRange(2, 6)
+	if err != nil {
+		t.Fatal("failed to fill empty blobs", err)
+	}
+	expected := FillResult{Inserted: 4, Skipped: 1, NextIndex: 7, StoppedReason: FillReachedLimit}
+	if r != expected {
+		t.Fatal("unexpected fill result", r)
+	}
+	// the old signature is kept
+	if inserted, next, err := s.CommitEmptyBlobs(7, 8); err != nil || inserted != 2 || next != 9 {
+		t.Fatal("unexpected empty blobs committed", inserted, next, err)
+	}
+
+	// the fill stops at the blob failed to write
+	ds, _ := sm.getDataShard(0)
+	ds.dataFiles[0].file.Close()
+	r, err = s.FillEmptyRange(9, 10)
+	if err != nil {
+		t.Fatal("the error of the blob should be kept in the result", err)
+	}
+	if r.Inserted != 0 || r.NextIndex != 9 || r.StoppedReason != FillWriteFailed || r.Err == nil {
+		t.Fatal("unexpected fill result", r)
+	}
+}
+
+func TestStorageManager_CommitEmptyBlobsEncodeFailed(t *testing.T) {
+	sm, files := createEthStorage(contractAddress, []uint64{0}, 131072, 131072, kvEntries, common.Address{}, defaultEncodeType)
+	defer func() {
+		sm.Close()
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}()
+	s := NewStorageManager(sm, &advancingL1Source{lastBlobIndex: 4})
+	if err := s.Reset(5); err != nil {
+		t.Fatal("failed to reset", err)
+	}
+
+	// the third index is in shard 1, which is not managed, so it fails to encode
+	start := kvEntries - 2
+	inserted, next, err := s.CommitEmptyBlobs(start, start+3)
+	if !errors.Is(err, ErrShardNotManaged) {
+		t.Fatal("the encode error should be returned", err)
+	}
+	if inserted != 2 || next != kvEntries {
+		t.Fatal("the blobs before the one failed to encode should be committed", inserted, next)
+	}
+	for kvIdx := start; kvIdx < kvEntries; kvIdx++ {
+		if meta, _, _ := s.TryReadMeta(kvIdx); !isFilledN(common.BytesToHash(meta), s.HashSize()) {
+			t.Fatal("the empty blob should be committed", kvIdx)
+		}
+	}
+
+	r, err := s.FillEmptyRange(kvEntries, kvEntries)
+	if err != nil || r.StoppedReason != FillEncodeFailed || !errors.Is(r.Err, ErrShardNotManaged) || r.NextIndex != kvEntries {
+		t.Fatal("unexpected fill result", r, err)
+	}
+}
+
+// headL1Source serves head as the latest block, and counts the requests of it.
+type headL1Source struct {
+	advancingL1Source
+	head     int64
+	requests int
+}
+
+func (l1 *headL1Source) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	if number != nil {
+		return l1.advancingL1Source.HeaderByNumber(ctx, number)
+	}
+	l1.mu.Lock()
+	defer l1.mu.Unlock()
+	l1.requests++
+	return &types.Header{Number: big.NewInt(l1.head)}, nil
+}
+
+func TestStorageManager_MetaAge(t *testing.T) {
+	sm, files := createEthStorage(contractAddress, []uint64{0}, 131072, 131072, kvEntries, common.Address{}, defaultEncodeType)
+	defer func() {
+		sm.Close()
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}()
+	l1 := &headL1Source{advancingL1Source: advancingL1Source{lastBlobIndex: 10}, head: 120}
+	s := NewStorageManager(sm, l1)
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	s.Clock = clock
+	if err := s.Reset(100); err != nil {
+		t.Fatal("failed to reset", err)
+	}
+
+	if age, err := s.MetaAge(context.Background()); err != nil || age != 20 {
+		t.Fatal("unexpected meta age", age, err)
+	}
+	// the head is cached within the TTL
+	l1.mu.Lock()
+	l1.head = 130
+	l1.mu.Unlock()
+	if err := s.DownloadFinished(110, nil, nil, nil); err != nil {
+		t.Fatal("failed to download finished", err)
+	}
+	if age, err := s.MetaAge(context.Background()); err != nil || age != 10 || l1.requests != 1 {
+		t.Fatal("unexpected meta age with the cached head", age, err, l1.requests)
+	}
+	clock.advance(metaAgeHeadTTL)
+	if age, err := s.MetaAge(context.Background()); err != nil || age != 20 || l1.requests != 2 {
+		t.Fatal("unexpected meta age after the TTL", age, err, l1.requests)
+	}
+}
+
+func TestStorageManager_PromoteStagingConcurrentSamples(t *testing.T) {
+	setup(t)
+	ds, _ := storageManager.shardManager.getDataShard(0)
+	name := ds.dataFiles[0].file.Name()
+	// the data file is renamed from the staging copy after it has been removed by setup
+	placeDataFile(t, name)
+	defer os.Remove(name)
+	defer os.Remove(name + stagingFileSuffix)
+
+	// the mining reads the samples without the lock while the data file is replaced by the staging copy
+	stop := make(chan struct{})
+	done := readSamplesUntil(stop)
+	for i := 0; i < 20; i++ {
+		if err := storageManager.BeginStaging(context.Background(), 0); err != nil {
+			t.Fatal("failed to begin staging", err)
+		}
+		if err := storageManager.PromoteStaging(0); err != nil {
+			t.Fatal("failed to promote staging", err)
+		}
+	}
+	close(stop)
+	if err := <-done; err != nil {
+		t.Fatal("failed to read sample during the promotion", err)
+	}
+}
+
+func TestStorageManager_Staging(t *testing.T) {
+	sm, files := createEthStorage(contractAddress, []uint64{0}, 131072, 131072, kvEntries, common.Address{}, defaultEncodeType)
+	defer func() {
+		sm.Close()
+		for _, file := range files {
+			os.Remove(file)
+			os.Remove(file + stagingFileSuffix)
+		}
+	}()
+	s := NewStorageManager(sm, &advancingL1Source{lastBlobIndex: 10})
+	if err := s.Reset(5); err != nil {
+		t.Fatal("failed to reset", err)
+	}
+	blobs := make(map[uint64][]byte)
+	commit := func(kvIdx uint64) {
+		blob, commit := createBlob(kvIdx)
+		blobs[kvIdx] = blob
+		s.blobMetas.set(kvIdx, generateMetadata(kvIdx, 131072, commit[:]))
+		if err := s.CommitBlob(kvIdx, blob, commit); err != nil {
+			t.Fatal("failed to commit blob", kvIdx, err)
+		}
+	}
+	isFilled := func(kvIdx uint64) bool {
+		meta, _, err := s.TryReadMeta(kvIdx)
+		if err != nil {
+			t.Fatal("failed to read meta", err)
+		}
+		return IsFilled(common.BytesToHash(meta))
+	}
+	commit(4)
+
+	if err := s.BeginStaging(context.Background(), 0); err != nil {
+		t.Fatal("failed to begin staging", err)
+	}
+	if err := s.BeginStaging(context.Background(), 0); !errors.Is(err, ErrShardStaging) {
+		t.Fatal("expected ErrShardStaging", err)
+	}
+	commit(5)
+	// the blob written to the staging copy is not served until promoted
+	if isFilled(5) || !isFilled(4) {
+		t.Fatal("the live data should be served during staging")
+	}
+
+	if err := s.PromoteStaging(0); err != nil {
+		t.Fatal("failed to promote staging", err)
+	}
+	for _, kvIdx := range []uint64{4, 5} {
+		_, commit := createBlob(kvIdx)
+		data, success, err := s.TryRead(kvIdx, 131072, prepareCommit(commit))
+		if !success || err != nil || !bytes.Equal(data, blobs[kvIdx]) {
+			t.Fatal("the blob should be served after promoted", kvIdx, err)
+		}
+	}
+	if _, err := os.Stat(files[0] + stagingFileSuffix); !os.IsNotExist(err) {
+		t.Fatal("the staging file should be renamed", err)
+	}
+	if err := s.PromoteStaging(0); !errors.Is(err, ErrShardNotStaging) {
+		t.Fatal("expected ErrShardNotStaging", err)
+	}
+
+	// the blobs written to the aborted staging copy are dropped
+	if err := s.BeginStaging(context.Background(), 0); err != nil {
+		t.Fatal("failed to begin staging", err)
+	}
+	commit(6)
+	if err := s.AbortStaging(0); err != nil {
+		t.Fatal("failed to abort staging", err)
+	}
+	if isFilled(6) || !isFilled(5) {
+		t.Fatal("the aborted blob should not be served")
+	}
+	if _, err := os.Stat(files[0] + stagingFileSuffix); !os.IsNotExist(err) {
+		t.Fatal("the staging file should be removed", err)
+	}
+	commit(6)
+	if !isFilled(6) {
+		t.Fatal("the blob should be written to the data file after aborted")
+	}
+}
+
+func TestStorageManager_DownloadFinishedWritePanic(t *testing.T) {
+	sm, files := createEthStorage(contractAddress, []uint64{0}, 131072, 131072, kvEntries, common.Address{}, defaultEncodeType)
+	defer func() {
+		sm.Close()
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}()
+	// the write of a shard with an unsupported encode type panics
+	ds, _ := sm.getDataShard(0)
+	ds.dataFiles[0].encodeType = ENCODE_END + 1
+	s := NewStorageManager(sm, &advancingL1Source{lastBlobIndex: 10})
+	s.DownloadThreadNum = 2
+	if err := s.Reset(5); err != nil {
+		t.Fatal("failed to reset", err)
+	}
+
+	err := s.DownloadFinished(6, []uint64{1, 2}, [][]byte{{1}, {2}}, []common.Hash{{1}, {2}})
+	if !errors.Is(err, ErrWritePanic) {
+		t.Fatal("expected ErrWritePanic", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !errors.Is(s.shardFaults[0], ErrWritePanic) {
+		t.Fatal("the shard should be faulted", s.shardFaults)
+	}
+}
@@ -0,0 +1,39 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import "context"
+
+// StorageTracer starts the spans of the storage operations, which is implemented by an adapter of a tracer like
+// that of OpenTelemetry.
+type StorageTracer interface {
+	// StartSpan starts the span named name as a child of the span carried by ctx if any, and returns the context
+	// carrying the new span and the function to end it with the error of the operation, nil if it succeeded.
+	StartSpan(ctx context.Context, name string) (context.Context, func(err error))
+}
+
+// SetTracer This function sets the tracer of the spans of DownloadFinishedContext, DownloadAllMetas with a span for
+// each of its workers and batches, and CommitBlobsContext, with the child spans of the time waiting for the lock,
+// encoding the blobs, getting the contract metas, and writing the blobs to the disk, so a slow batch can be broken
+// down in a trace. The spans carried by the context passed to these methods are the parents of their spans.
+// The tracing is disabled if t is nil, which it is by default, in which case no span is created.
+func (s *StorageManager) SetTracer(t StorageTracer) {
+	if t == nil {
+		s.tracer.Store(nil)
+		return
+	}
+	s.tracer.Store(&t)
+}
+
+func endNoSpan(error) {}
+
+// startSpan starts the span named name with the tracer set by SetTracer, or returns ctx with a no-op end function
+// if the tracing is disabled. It can be called without s.mu.
+func (s *StorageManager) startSpan(ctx context.Context, name string) (context.Context, func(err error)) {
+	t := s.tracer.Load()
+	if t == nil {
+		return ctx, endNoSpan
+	}
+	return (*t).StartSpan(ctx, name)
+}
@@ -0,0 +1,65 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"fmt"
+	"sort"
+)
+
+// kvSet is a set of kv indices, where the nil set contains all the kvs.
+type kvSet map[uint64]struct{}
+
+func (set kvSet) contains(kvIdx uint64) bool {
+	if set == nil {
+		return true
+	}
+	_, ok := set[kvIdx]
+	return ok
+}
+
+// SetSyncAllowlist This function makes the node sparse by restricting the kvs it syncs to kvIndices, e.g. for a
+// prover that only needs some blobs; a nil kvIndices syncs all the owned kvs again. The kvs must still be owned by
+// the managed shards, which keep their data files. Only the metas of the allowed kvs are downloaded, and the kvs not
+// allowed are treated as not owned: DownloadFinished and the commits skip them, and reading them returns ErrNotOwned.
+// The metas of the kvs newly allowed are not downloaded by this function, so DownloadAllMetas should be called after
+// the allowlist changes, or their commits fail as the metas are not found.
+func (s *StorageManager) SetSyncAllowlist(kvIndices []uint64) {
+	var set kvSet
+	if kvIndices != nil {
+		set = make(kvSet, len(kvIndices))
+		for _, kvIdx := range kvIndices {
+			set[kvIdx] = struct{}{}
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.syncAllowlist = set
+}
+
+// checkAllowed returns ErrNotOwned if the kv is not in the sync allowlist. The caller must hold s.mu.
+func (s *StorageManager) checkAllowed(kvIdx uint64) error {
+	if !s.syncAllowlist.contains(kvIdx) {
+		return fmt.Errorf("%w: kvIdx %d is not in the sync allowlist", ErrNotOwned, kvIdx)
+	}
+	return nil
+}
+
+// SyncAllowlist This function returns the sorted kv indices set by SetSyncAllowlist, or nil if all the owned kvs
+// are synced.
+func (s *StorageManager) SyncAllowlist() []uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.syncAllowlist == nil {
+		return nil
+	}
+	kvIndices := make([]uint64, 0, len(s.syncAllowlist))
+	for kvIdx := range s.syncAllowlist {
+		kvIndices = append(kvIndices, kvIdx)
+	}
+	sort.Slice(kvIndices, func(i, j int) bool { return kvIndices[i] < kvIndices[j] })
+	return kvIndices
+}
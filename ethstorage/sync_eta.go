@@ -0,0 +1,97 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"errors"
+	"time"
+)
+
+const (
+	// commitRateBucket is the time span of a bucket of the commit rate
+	commitRateBucket = 5 * time.Second
+	// commitRateBuckets is the number of buckets of the commit rate, i.e. the rate is averaged over the last 5 minutes
+	commitRateBuckets = 60
+	// minCommitRateSpan is the min time span of the commits for the commit rate to be taken as measured
+	minCommitRateSpan = 30 * time.Second
+)
+
+var ErrInsufficientThroughput = errors.New("insufficient commit throughput data")
+
+// commitRate is the rolling count of the committed blobs in buckets of commitRateBucket, from which the average
+// number of blobs committed per second in the last commitRateBuckets buckets is calculated. The zero value is ready.
+type commitRate struct {
+	slots  [commitRateBuckets]int64 // the bucket index since the epoch of each bucket, to tell whether it is stale
+	counts [commitRateBuckets]uint64
+}
+
+func (r *commitRate) add(now time.Time, n int) {
+	slot := now.UnixNano() / int64(commitRateBucket)
+	i := slot % commitRateBuckets
+	if r.slots[i] != slot {
+		r.slots[i], r.counts[i] = slot, 0
+	}
+	r.counts[i] += uint64(n)
+}
+
+// perSecond returns the average blobs committed per second since the oldest bucket with commits in the window, or
+// 0 if the commits span less than minCommitRateSpan.
+func (r *commitRate) perSecond(now time.Time) float64 {
+	cur := now.UnixNano() / int64(commitRateBucket)
+	var (
+		total  uint64
+		oldest = cur + 1
+	)
+	for i, slot := range r.slots {
+		if slot > cur-commitRateBuckets && slot <= cur && r.counts[i] > 0 {
+			total += r.counts[i]
+			if slot < oldest {
+				oldest = slot
+			}
+		}
+	}
+	span := now.Sub(time.Unix(0, oldest*int64(commitRateBucket)))
+	if total == 0 || span < minCommitRateSpan {
+		return 0
+	}
+	return float64(total) / span.Seconds()
+}
+
+// EstimateSyncETA This function estimates the time to sync the blobs between the local highest filled index and
+// LastKvIndex, capped by the end of the managed shards, from the average commit rate of the last 5 minutes. It returns
+// 0 if the blobs are synced, and ErrInsufficientThroughput if the rate cannot be measured yet, e.g. right after start.
+func (s *StorageManager) EstimateSyncETA() (time.Duration, error) {
+	next := uint64(0)
+	highest, err := s.LocalHighestFilledIndex()
+	if err == nil {
+		next = highest + 1
+	} else if !errors.Is(err, ErrNoSyncedKv) {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	target := s.lastKvIdx
+	end := uint64(0)
+	for _, shardIdx := range s.shardManager.ShardIds() {
+		if ds, ok := s.shardManager.getDataShard(shardIdx); ok {
+			if _, e := ds.KvRange(); e > end {
+				end = e
+			}
+		}
+	}
+	if end < target {
+		target = end
+	}
+	if next >= target {
+		return 0, nil
+	}
+
+	rate := s.commitRate.perSecond(s.Clock.Now())
+	if rate == 0 {
+		return 0, ErrInsufficientThroughput
+	}
+	return time.Duration(float64(target-next) / rate * float64(time.Second)), nil
+}
@@ -0,0 +1,113 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/log"
+)
+
+var ErrPaused = errors.New("storage sync is paused")
+
+// syncGate gates the operations writing the shard files and the metas by Pause and Resume. The gated operations must not call
+// each other, as a nested one would wait for the pause which waits for the outer one.
+type syncGate struct {
+	mu       sync.Mutex
+	cond     *sync.Cond // signalled when paused, closed or inflight changes
+	paused   bool
+	closed   bool
+	inflight int
+}
+
+func (g *syncGate) init() {
+	if g.cond == nil {
+		g.cond = sync.NewCond(&g.mu)
+	}
+}
+
+// enterSync starts a gated operation, which returns ErrPaused while paused, or waits for Resume if PauseBlocks.
+// The operation must call exitSync once it completes.
+func (s *StorageManager) enterSync() error {
+	g := &s.gate
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.init()
+	for g.paused && !g.closed {
+		if !s.PauseBlocks {
+			return ErrPaused
+		}
+		g.cond.Wait()
+	}
+	if g.closed {
+		return ErrStorageClosed
+	}
+	g.inflight++
+	return nil
+}
+
+func (s *StorageManager) exitSync() {
+	g := &s.gate
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.inflight--
+	if g.inflight == 0 {
+		g.cond.Broadcast()
+	}
+}
+
+// Pause This function pauses the sync for e.g. a disk maintenance without shutting down the node, after which
+// DownloadFinished, the commit functions, the downloads of the metas by DownloadAllMetas, DownloadShardMetas and
+// CatchUpMetas, ResetAndInvalidateMetas, and the maintenance of the shards by VerifyShard, ScrubShard, CompactShard,
+// ReEncodeShard, BeginStaging and PromoteStaging return ErrPaused, or wait for Resume if PauseBlocks, while the reads
+// go on. ScrubShard only stops at a corrupt blob, whose flagging is the write. It returns once the operations in
+// flight complete, including a long compaction or re-encoding, so the shard files are not written after it returns,
+// except by the meta downloads of the shards in DownloadAllMetas after the current one, which return ErrPaused, and
+// by AddShard, RemoveShard and AbortStaging, which create and remove the shard files. It must not be called from the
+// callbacks of the operations, e.g. OnBlobCommitted.
+func (s *StorageManager) Pause() {
+	g := &s.gate
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.init()
+	if !g.paused {
+		log.Info("Storage sync paused", "inflight", g.inflight)
+	}
+	g.paused = true
+	for g.inflight > 0 {
+		g.cond.Wait()
+	}
+}
+
+// Resume This function resumes the sync paused by Pause, and wakes up the operations waiting for it.
+func (s *StorageManager) Resume() {
+	g := &s.gate
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.init()
+	if g.paused {
+		log.Info("Storage sync resumed")
+	}
+	g.paused = false
+	g.cond.Broadcast()
+}
+
+// Paused This function reports whether the sync is paused by Pause.
+func (s *StorageManager) Paused() bool {
+	g := &s.gate
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.paused
+}
+
+// closeSync wakes up the operations waiting for Resume with ErrStorageClosed, as Close does not wait for them.
+func (s *StorageManager) closeSync() {
+	g := &s.gate
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.init()
+	g.closed = true
+	g.cond.Broadcast()
+}
@@ -0,0 +1,179 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// verifyChainBatchSize is the number of the kvs whose contract metas are fetched in one request by VerifyAgainstChain
+const verifyChainBatchSize = 1000
+
+// VerifyReport is the result of VerifyAgainstChain, which is serializable to JSON for sharing.
+type VerifyReport struct {
+	Block      int64    `json:"block"`
+	LastKvIdx  uint64   `json:"lastKvIdx"`  // lastKvIdx of the contract at the block
+	Checked    uint64   `json:"checked"`    // number of the kvs compared
+	Matched    uint64   `json:"matched"`    // number of the kvs stored with the commit in the contract
+	Mismatched []uint64 `json:"mismatched"` // kvs stored with another commit than the one in the contract
+	Missing    []uint64 `json:"missing"`    // kvs not stored yet
+}
+
+// merge adds the results of a batch to the report. The caller must protect the report.
+func (r *VerifyReport) merge(b *VerifyReport) {
+	r.Checked += b.Checked
+	r.Matched += b.Matched
+	r.Mismatched = append(r.Mismatched, b.Mismatched...)
+	r.Missing = append(r.Missing, b.Missing...)
+}
+
+// VerifyAgainstChain This function compares the commit in the local meta of every owned kv below lastKvIdx with the
+// one in the contract meta at blockNumber, and reports the matched, mismatched and missing kvs, e.g. for an audit.
+// Unlike VerifyShard, the data is not read, so it does not find the torn blobs. The contract metas are fetched in
+// parallel like the meta download, and the local metas are read under the lock batch by batch, so the commits go on
+// meanwhile; a kv committed during the verification may be reported against an older view of it. The kvs not in the
+// sync allowlist are skipped. If ctx is cancelled, or the storage is closed, the partial report is returned with the
+// error.
+func (s *StorageManager) VerifyAgainstChain(ctx context.Context, blockNumber int64) (*VerifyReport, error) {
+	if err := s.acquire(); err != nil {
+		return nil, err
+	}
+	defer s.release()
+	ctx, cancel := s.withCloseCtx(ctx)
+	defer cancel()
+
+	lastKvIdx, err := s.getL1Source().GetStorageLastBlobIdx(blockNumber)
+	if err != nil {
+		return nil, err
+	}
+	report := &VerifyReport{Block: blockNumber, LastKvIdx: lastKvIdx, Mismatched: []uint64{}, Missing: []uint64{}}
+
+	var batches [][2]uint64
+	for _, shardIdx := range s.Shards() {
+		first, limit, ok := s.OwnedKvRange(shardIdx)
+		if !ok {
+			continue
+		}
+		if limit > lastKvIdx {
+			limit = lastKvIdx
+		}
+		for from := first; from < limit; from += verifyChainBatchSize {
+			to := from + verifyChainBatchSize
+			if to > limit {
+				to = limit
+			}
+			batches = append(batches, [2]uint64{from, to})
+		}
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex // protect report and firstErr
+		firstErr error
+		next     = make(chan [2]uint64)
+	)
+	for i := 0; i < MetaDownloadThread; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for b := range next {
+				res, err := s.verifyBatchAgainstChain(b[0], b[1], blockNumber)
+				mu.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = err
+				}
+				if err == nil {
+					report.merge(res)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+feed:
+	for _, b := range batches {
+		mu.Lock()
+		failed := firstErr != nil
+		mu.Unlock()
+		if failed {
+			break
+		}
+		select {
+		case next <- b:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(next)
+	wg.Wait()
+
+	sort.Slice(report.Mismatched, func(i, j int) bool { return report.Mismatched[i] < report.Mismatched[j] })
+	sort.Slice(report.Missing, func(i, j int) bool { return report.Missing[i] < report.Missing[j] })
+	if firstErr != nil {
+		return report, firstErr
+	}
+	if s.closeCtx.Err() != nil {
+		return report, ErrStorageClosed
+	}
+	if err = ctx.Err(); err != nil {
+		return report, err
+	}
+	metaLog.Info("Local store verified against the chain", "block", blockNumber, "checked", report.Checked,
+		"matched", report.Matched, "mismatched", len(report.Mismatched), "missing", len(report.Missing))
+	return report, nil
+}
+
+// verifyBatchAgainstChain compares the local metas of the kvs in [from, to) with the contract metas at blockNumber.
+func (s *StorageManager) verifyBatchAgainstChain(from, to uint64, blockNumber int64) (*VerifyReport, error) {
+	s.mu.Lock()
+	allowlist := s.syncAllowlist
+	s.mu.Unlock()
+	var kvIndices []uint64
+	for kvIdx := from; kvIdx < to; kvIdx++ {
+		if allowlist.contains(kvIdx) {
+			kvIndices = append(kvIndices, kvIdx)
+		}
+	}
+	res := &VerifyReport{}
+	if len(kvIndices) == 0 {
+		return res, nil
+	}
+	contractMetas, err := s.getKvMetasWithRetry(kvIndices, blockNumber)
+	if err != nil {
+		return nil, err
+	}
+	if len(contractMetas) != len(kvIndices) {
+		return nil, fmt.Errorf("%w: kvIndices %d, metas %d", ErrMismatchedLengths, len(kvIndices), len(contractMetas))
+	}
+
+	s.lock("VerifyAgainstChain")
+	defer s.mu.Unlock()
+	hashSize := s.hashSize()
+	for i, kvIdx := range kvIndices {
+		m, success, err := s.tryReadMeta(kvIdx)
+		if err != nil {
+			return nil, err
+		}
+		if !success {
+			// the shard is removed during the verification
+			continue
+		}
+		res.Checked++
+		localMeta := common.BytesToHash(m)
+		switch {
+		case !isFilledN(localMeta, hashSize):
+			res.Missing = append(res.Missing, kvIdx)
+		case bytes.Equal(localMeta[:hashSize], contractMetas[i][32-hashSize:]):
+			res.Matched++
+		default:
+			res.Mismatched = append(res.Mismatched, kvIdx)
+		}
+	}
+	return res, nil
+}
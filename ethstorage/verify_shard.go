@@ -0,0 +1,104 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"runtime"
+	"sort"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// VerifyShard This function checks the blobs of the shard whose local meta claims filled, by decoding each of them
+// and checking it against the commit in the meta, to find the torn blobs, e.g. partially written when the process
+// crashed. The filling bit of a torn blob is cleared, so it is no longer served and will be written again by the
+// next commit of it, i.e. it is flagged for resync. The torn kv indices are returned in order.
+// It is expensive as it reads the whole shard, so the blobs are verified in parallel, and the lock is held until
+// it finishes; it is expected to be run at startup before syncing.
+func (s *StorageManager) VerifyShard(shardIdx uint64) ([]uint64, error) {
+	if err := s.enterSync(); err != nil {
+		return nil, err
+	}
+	defer s.exitSync()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ds, ok := s.shardManager.getDataShard(shardIdx)
+	if !ok {
+		return nil, ErrShardNotManaged
+	}
+	start, end := ds.KvRange()
+	log.Info("Begin to verify shard", "shard", shardIdx, "start", start, "end", end)
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex // protect torn and firstErr
+		torn     []uint64
+		firstErr error
+		kvs      = make(chan uint64)
+		hashSize = s.hashSize()
+	)
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for kvIdx := range kvs {
+				isTorn, err := verifyKV(ds, kvIdx, hashSize)
+				mu.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = err
+				}
+				if isTorn {
+					torn = append(torn, kvIdx)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for kvIdx := start; kvIdx < end; kvIdx++ {
+		kvs <- kvIdx
+	}
+	close(kvs)
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	sort.Slice(torn, func(i, j int) bool { return torn[i] < torn[j] })
+	for _, kvIdx := range torn {
+		if err := ds.WriteMeta(kvIdx, common.Hash{}.Bytes()); err != nil {
+			return nil, err
+		}
+		s.updateFill(kvIdx, common.Hash{})
+	}
+	if len(torn) > 0 {
+		log.Warn("Torn blobs found and flagged for resync", "shard", shardIdx, "count", len(torn), "kvIndices", torn)
+	}
+	log.Info("Shard verified", "shard", shardIdx, "torn", len(torn))
+	return torn, nil
+}
+
+// verifyKV returns whether the blob is torn, i.e. its local meta claims filled but the data does not match the
+// commit in it, with the filling bit after hashSize bytes. The error is returned only if the data cannot be read.
+func verifyKV(ds *DataShard, kvIdx uint64, hashSize int) (bool, error) {
+	m, err := ds.ReadMeta(kvIdx)
+	if err != nil {
+		return false, err
+	}
+	meta := common.BytesToHash(m)
+	if !isFilledN(meta, hashSize) {
+		return false, nil
+	}
+
+	encodeType := ds.EncodeType()
+	data, err := ds.readWith(kvIdx, int(ds.kvSize), func(cdata []byte, chunkIdx uint64) []byte {
+		return decodeChunk(ds.chunkSize, cdata, encodeType, calcEncodeKey(meta, chunkIdx, ds.Miner()))
+	})
+	if err != nil {
+		return false, err
+	}
+	return checkCommit(meta, data) != nil, nil
+}
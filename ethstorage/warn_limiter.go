@@ -0,0 +1,98 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// warnAggregateInterval is the interval within which the repeated warnings of the same message and shard are
+// aggregated into one
+const warnAggregateInterval = time.Minute
+
+type warnKey struct {
+	msg   string
+	shard uint64
+}
+
+type warnEntry struct {
+	since      time.Time // time the warning was last logged
+	suppressed uint64    // number of the warnings not logged since then
+}
+
+// warnLimiter logs a warning of a message and shard at most once per interval, e.g. for the encode failures of a
+// misconfigured shard, which would flood the logs for every blob otherwise. The warnings within the interval are
+// counted, and the count is logged with the next warning after the interval, or with the next warning of any message
+// and shard if there is none, so the count of a burst that stops is not lost.
+type warnLimiter struct {
+	logger   log.Logger
+	interval time.Duration
+
+	mu      sync.Mutex
+	entries map[warnKey]*warnEntry
+}
+
+func newWarnLimiter(logger log.Logger, interval time.Duration) *warnLimiter {
+	return &warnLimiter{logger: logger, interval: interval, entries: make(map[warnKey]*warnEntry)}
+}
+
+// warn logs the warning with the shard and ctx unless one of the same message and shard has been logged within
+// the interval before now, in which case it is counted. The counts of the other messages and shards whose interval
+// has passed are flushed. A nil warnLimiter logs every warning to commitLog.
+func (l *warnLimiter) warn(now time.Time, msg string, shard uint64, ctx ...interface{}) {
+	ctx = append([]interface{}{"shard", shard}, ctx...)
+	if l == nil {
+		commitLog.Warn(msg, ctx...)
+		return
+	}
+
+	key := warnKey{msg: msg, shard: shard}
+	l.mu.Lock()
+	flushed := l.expire(now, key)
+	e, ok := l.entries[key]
+	if ok && now.Sub(e.since) < l.interval {
+		e.suppressed++
+		l.mu.Unlock()
+		l.logFlushed(flushed)
+		return
+	}
+	l.entries[key] = &warnEntry{since: now}
+	l.mu.Unlock()
+	l.logFlushed(flushed)
+
+	if ok && e.suppressed > 0 {
+		// the count includes this one
+		ctx = append(ctx, "repeated", e.suppressed+1, "in", now.Sub(e.since).Round(time.Second))
+	}
+	l.logger.Warn(msg, ctx...)
+}
+
+// expire removes the entries other than skip whose interval has passed before now, and returns those with warnings
+// suppressed to be logged. The caller must hold l.mu.
+func (l *warnLimiter) expire(now time.Time, skip warnKey) map[warnKey]uint64 {
+	var flushed map[warnKey]uint64
+	for key, e := range l.entries {
+		if key == skip || now.Sub(e.since) < l.interval {
+			continue
+		}
+		if e.suppressed > 0 {
+			if flushed == nil {
+				flushed = make(map[warnKey]uint64)
+			}
+			flushed[key] = e.suppressed
+		}
+		delete(l.entries, key)
+	}
+	return flushed
+}
+
+// logFlushed logs the counts of the warnings suppressed within the interval of their last logged one.
+func (l *warnLimiter) logFlushed(flushed map[warnKey]uint64) {
+	for key, n := range flushed {
+		l.logger.Warn(key.msg, "shard", key.shard, "repeated", n, "in", l.interval)
+	}
+}
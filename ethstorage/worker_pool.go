@@ -0,0 +1,64 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"errors"
+	"sync"
+)
+
+var errPoolClosed = errors.New("worker pool is closed")
+
+// workerPool runs the submitted tasks with a fixed number of long-lived goroutines, so that frequent batches
+// don't need to spawn goroutines every time.
+type workerPool struct {
+	tasks  chan func()
+	wg     sync.WaitGroup
+	mu     sync.RWMutex // protect closed and the sending to tasks
+	closed bool
+}
+
+func newWorkerPool(size int) *workerPool {
+	if size < 1 {
+		size = 1
+	}
+	p := &workerPool{tasks: make(chan func(), size)}
+	p.wg.Add(size)
+	for i := 0; i < size; i++ {
+		go func() {
+			defer p.wg.Done()
+			for task := range p.tasks {
+				task()
+			}
+		}()
+	}
+	return p
+}
+
+// submit queues the task to run in the pool, and blocks if all the workers are busy.
+// Return errPoolClosed if the pool is closed.
+func (p *workerPool) submit(task func()) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.closed {
+		return errPoolClosed
+	}
+	p.tasks <- task
+	return nil
+}
+
+// close stops accepting new tasks, and waits for the queued tasks to be drained.
+func (p *workerPool) close() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
+	close(p.tasks)
+	p.mu.Unlock()
+
+	p.wg.Wait()
+}
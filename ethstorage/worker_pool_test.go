@@ -0,0 +1,35 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWorkerPool(t *testing.T) {
+	pool := newWorkerPool(4)
+
+	var done int64
+	for i := 0; i < 100; i++ {
+		err := pool.submit(func() {
+			time.Sleep(time.Millisecond)
+			atomic.AddInt64(&done, 1)
+		})
+		if err != nil {
+			t.Fatal("failed to submit task", err)
+		}
+	}
+
+	// close drains all the queued tasks
+	pool.close()
+	if atomic.LoadInt64(&done) != 100 {
+		t.Fatal("tasks should be drained on close", done)
+	}
+	if err := pool.submit(func() {}); err != errPoolClosed {
+		t.Fatal("submit after close should fail", err)
+	}
+	pool.close()
+}
@@ -0,0 +1,24 @@
+// Copyright 2022-2023, EthStorage.
+// For license information, see https://github.com/ethstorage/es-node/blob/main/LICENSE
+
+package ethstorage
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// ErrWritePanic is returned when the write of a blob panics, e.g. by a bug on a malformed blob.
+var ErrWritePanic = errors.New("write of the blob panicked")
+
+// recoverWritePanic recovers the panic of the write of the kv into ErrWritePanic set to err, so that one bad blob
+// cannot take down the node from a worker goroutine. It must be deferred directly by the function writing the kv.
+func recoverWritePanic(kvIdx uint64, err *error) {
+	if r := recover(); r != nil {
+		log.Error("Recovered from the panic of writing the blob", "kvIndex", kvIdx, "panic", r, "stack", string(debug.Stack()))
+		*err = fmt.Errorf("%w: kvIdx %d: %v", ErrWritePanic, kvIdx, r)
+	}
+}
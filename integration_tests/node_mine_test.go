@@ -335,6 +335,7 @@ func createDataFiles(cfg *storage.StorageConfig) ([]string, error) {
 		}
 
 		lg.Info("Data file created", "shard", shardIdx, "file", fileName, "datafile", fmt.Sprintf("%+v", df))
+		df.Close()
 		files = append(files, fileName)
 	}
 	return files, nil